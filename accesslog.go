@@ -0,0 +1,194 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotateWriter writes to file, and rotates the file by size or age
+type rotateWriter struct {
+	Path       string
+	MaxSize    int64         // rotate when file size exceeds, 0 = unlimited
+	MaxAge     time.Duration // rotate when file opened longer than, 0 = unlimited
+	MaxBackups int           // rotated files to keep, 0 = keep all
+	Compress   bool          // gzip rotated files
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+
+	bgMu sync.Mutex // serializes compress and cleanup
+}
+
+// Open opens log file for append
+func (w *rotateWriter) Open() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.open()
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = fi.Size()
+	w.openedAt = time.Now()
+	return nil
+}
+
+// Write implements io.Writer
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.size > 0 && w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			log.Printf("accesslog: can not rotate %s; %v", w.Path, err)
+		}
+	}
+
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) shouldRotate(n int64) bool {
+	if w.MaxSize > 0 && w.size+n > w.MaxSize {
+		return true
+	}
+	if w.MaxAge > 0 && time.Since(w.openedAt) >= w.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (w *rotateWriter) rotate() error {
+	w.f.Close()
+	w.f = nil
+
+	backup := w.Path + "." + time.Now().Format("20060102T150405.000")
+	err := os.Rename(w.Path, backup)
+	if err != nil {
+		// keep writing to the same file
+		backup = ""
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	go func() {
+		w.bgMu.Lock()
+		defer w.bgMu.Unlock()
+
+		if backup != "" && w.Compress {
+			if err := compressFile(backup); err != nil {
+				log.Printf("accesslog: can not compress %s; %v", backup, err)
+			}
+		}
+		w.cleanup()
+	}()
+	return err
+}
+
+// cleanup removes oldest rotated files over max backups
+func (w *rotateWriter) cleanup() {
+	if w.MaxBackups <= 0 {
+		return
+	}
+	files, err := filepath.Glob(w.Path + ".*")
+	if err != nil {
+		return
+	}
+	// timestamp suffix sorts by rotate time
+	sort.Strings(files)
+	for len(files) > w.MaxBackups {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+}
+
+// Close closes log file
+func (w *rotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// dialSyslog connects to local syslog, or remote syslog by udp://host:port or tcp://host:port
+func dialSyslog(addr string) (io.Writer, error) {
+	const priority = syslog.LOG_INFO | syslog.LOG_DAEMON
+	const tag = "geth-proxy"
+
+	if addr == "local" {
+		return syslog.New(priority, tag)
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %s", u.Scheme)
+	}
+	if !strings.Contains(u.Host, ":") {
+		u.Host += ":514"
+	}
+	return syslog.Dial(u.Scheme, u.Host, priority, tag)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ipACL allows or denies client by ip,
+// deny list is checked first, empty allow list allows all
+type ipACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// Allowed returns true if ip can access
+func (a *ipACL) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(a.Allow) == 0 && len(a.Deny) == 0
+	}
+	if containsIP(a.Deny, ip) {
+		return false
+	}
+	return len(a.Allow) == 0 || containsIP(a.Allow, ip)
+}
+
+// Middleware returns middleware that rejects denied clients
+func (a *ipACL) Middleware(name string) parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !a.Allowed(clientIP(r)) {
+				aclDeny(w, r, name)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+}
+
+// locationACL applies ip acl by longest matched path prefix
+type locationACL struct {
+	prefixes []string // sorted longest first
+	acls     map[string]*ipACL
+}
+
+// parseLocationACL parses allow and deny list, prefix=cidr|cidr,...
+func parseLocationACL(allow, deny string) (*locationACL, error) {
+	m := locationACL{
+		acls: make(map[string]*ipACL),
+	}
+	get := func(prefix string) *ipACL {
+		a := m.acls[prefix]
+		if a == nil {
+			a = &ipACL{}
+			m.acls[prefix] = a
+			m.prefixes = append(m.prefixes, prefix)
+		}
+		return a
+	}
+	for prefix, v := range parseMap(allow) {
+		ns, err := parseCIDRs(strings.Split(v, "|"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow list for %s; %w", prefix, err)
+		}
+		a := get(prefix)
+		a.Allow = append(a.Allow, ns...)
+	}
+	for prefix, v := range parseMap(deny) {
+		ns, err := parseCIDRs(strings.Split(v, "|"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny list for %s; %w", prefix, err)
+		}
+		a := get(prefix)
+		a.Deny = append(a.Deny, ns...)
+	}
+	sort.Slice(m.prefixes, func(i, j int) bool {
+		return len(m.prefixes[i]) > len(m.prefixes[j])
+	})
+	return &m, nil
+}
+
+func (m *locationACL) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range m.prefixes {
+			if !strings.HasPrefix(r.URL.Path, prefix) {
+				continue
+			}
+			if !m.acls[prefix].Allowed(clientIP(r)) {
+				aclDeny(w, r, prefix)
+				return
+			}
+			break
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func aclDeny(w http.ResponseWriter, r *http.Request, location string) {
+	promACLDenied(location)
+	if r.Method == http.MethodPost {
+		writeRPCError(w, r, http.StatusForbidden, rpcCodeServerError, "forbidden")
+		return
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+// clientIP returns ip of the client that sent the request resolved by trusted proxies,
+// fallback to remote address, forwarded headers are never read since client can set them
+func clientIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientIPKey{}).(net.IP); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns ip of the connection's remote address
+func remoteIP(r *http.Request) net.IP {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return net.ParseIP(host)
+}
+
+func isLoopback(ip net.IP) bool {
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseCIDRs parses list of cidr or ip
+func parseCIDRs(xs []string) ([]*net.IPNet, error) {
+	var rs []*net.IPNet
+	for _, x := range xs {
+		x = strings.TrimSpace(x)
+		if x == "" {
+			continue
+		}
+		if !strings.Contains(x, "/") {
+			ip := net.ParseIP(x)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %s", x)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			rs = append(rs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(x)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, n)
+	}
+	return rs, nil
+}
+
+func containsIP(ns []*net.IPNet, ip net.IP) bool {
+	for _, n := range ns {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var aclDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "acl_denied",
+}, []string{"location"})
+
+func promACLDenied(location string) {
+	c, err := aclDenied.GetMetricWith(prometheus.Labels{"location": location})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
+
+// loopbackOnly allows only requests from loopback connection,
+// forwarded client ip headers are ignored
+func loopbackOnly() parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isLoopback(remoteIP(r)) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/authn"
+	"github.com/moonrhythm/parapet/pkg/location"
+
+	"github.com/moonrhythm/geth-proxy/pkg/cache"
+)
+
+// admin serves runtime control api
+type admin struct {
+	Username string
+	Password string
+	Caches   []cache.Flusher
+	Limiters []*concurrencyLimiter
+	Usage    *usageTracker
+}
+
+// Middleware returns admin api middleware
+func (m *admin) Middleware() parapet.Middleware {
+	var ms parapet.Middlewares
+	ms.Use(authn.Basic(m.Username, m.Password))
+	ms.Use(m.route("/upstreams", http.MethodGet, m.upstreams))
+	ms.Use(m.route("/upstreams/drain", http.MethodPost, m.drainUpstream))
+	ms.Use(m.route("/upstreams/enable", http.MethodPost, m.enableUpstream))
+	ms.Use(m.route("/upstreams/weight", http.MethodPost, m.setUpstreamWeight))
+	ms.Use(m.route("/cache/flush", http.MethodPost, m.flushCache))
+	ms.Use(m.route("/limiters", http.MethodGet, m.limiters))
+	ms.Use(m.route("/maintenance", "", serveMaintenance))
+	if m.Usage != nil {
+		ms.Use(m.route("/usage", http.MethodGet, m.Usage.ServeHTTP))
+	}
+	ms.Use(parapet.Handler(http.NotFound))
+	return ms
+}
+
+func (m *admin) route(path, method string, h http.HandlerFunc) parapet.Middleware {
+	l := location.Exact(path)
+	l.Use(parapet.Handler(func(w http.ResponseWriter, r *http.Request) {
+		if method != "" && r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}))
+	return l
+}
+
+type adminUpstream struct {
+	Addr     string `json:"addr"`
+	Healthy  bool   `json:"healthy"`
+	Disabled bool   `json:"disabled"`
+	Weight   int    `json:"weight"`
+	Head     uint64 `json:"head"`
+	Lag      uint64 `json:"lag"`
+	InFlight int64  `json:"inFlight"`
+	Latency  int64  `json:"latencyMs"` // ewma
+}
+
+func (m *admin) upstreams(w http.ResponseWriter, r *http.Request) {
+	var maxHead uint64
+	upstreams := pool.List()
+	rs := make([]adminUpstream, len(upstreams))
+	for i, u := range upstreams {
+		rs[i] = adminUpstream{
+			Addr:     u.Addr,
+			Healthy:  u.Healthy(),
+			Disabled: u.Disabled(),
+			Weight:   u.Weight(),
+			InFlight: u.InFlight(),
+			Latency:  u.Latency().Milliseconds(),
+		}
+		if h := u.Head(); h != nil {
+			rs[i].Head = h.Number.Uint64()
+		}
+		if rs[i].Head > maxHead {
+			maxHead = rs[i].Head
+		}
+	}
+	for i := range rs {
+		rs[i].Lag = maxHead - rs[i].Head
+	}
+	writeJSON(w, rs)
+}
+
+func (m *admin) drainUpstream(w http.ResponseWriter, r *http.Request) {
+	m.setUpstreamDisabled(w, r, true)
+}
+
+func (m *admin) enableUpstream(w http.ResponseWriter, r *http.Request) {
+	m.setUpstreamDisabled(w, r, false)
+}
+
+func (m *admin) setUpstreamDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	addr := r.FormValue("addr")
+	u := pool.Get(addr)
+	if u == nil {
+		http.Error(w, "upstream not found", http.StatusNotFound)
+		return
+	}
+	u.SetDisabled(disabled)
+	log.Printf("admin: upstream %s disabled=%t", addr, disabled)
+	writeJSON(w, adminUpstream{
+		Addr:     u.Addr,
+		Healthy:  u.Healthy(),
+		Disabled: u.Disabled(),
+		Weight:   u.Weight(),
+	})
+}
+
+func (m *admin) setUpstreamWeight(w http.ResponseWriter, r *http.Request) {
+	addr := r.FormValue("addr")
+	u := pool.Get(addr)
+	if u == nil {
+		http.Error(w, "upstream not found", http.StatusNotFound)
+		return
+	}
+	weight, err := strconv.Atoi(r.FormValue("weight"))
+	if err != nil || weight < 0 {
+		http.Error(w, "invalid weight", http.StatusBadRequest)
+		return
+	}
+	u.SetWeight(weight)
+	log.Printf("admin: upstream %s weight=%d", addr, weight)
+	writeJSON(w, adminUpstream{
+		Addr:     u.Addr,
+		Healthy:  u.Healthy(),
+		Disabled: u.Disabled(),
+		Weight:   u.Weight(),
+	})
+}
+
+func (m *admin) flushCache(w http.ResponseWriter, r *http.Request) {
+	for _, c := range m.Caches {
+		c.Flush()
+	}
+	log.Printf("admin: cache flushed")
+	writeJSON(w, struct {
+		Flushed int `json:"flushed"`
+	}{len(m.Caches)})
+}
+
+func (m *admin) limiters(w http.ResponseWriter, r *http.Request) {
+	rs := make([]concurrencyLimiterState, len(m.Limiters))
+	for i, l := range m.Limiters {
+		rs[i] = l.State()
+	}
+	writeJSON(w, rs)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// healthAlert is the webhook payload, text is for slack compatible webhooks
+type healthAlert struct {
+	Text     string    `json:"text"`
+	Event    string    `json:"event"`
+	Chain    string    `json:"chain,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// alertState is the debounced health state of a target
+type alertState struct {
+	Notified bool // last notified healthy state
+	Current  bool // observed healthy state
+	Since    time.Time
+}
+
+// healthAlerter notifies webhook when node or upstream health changes,
+// a change must persist for debounce duration to be notified
+type healthAlerter struct {
+	Webhook  string
+	Debounce time.Duration
+	Pools    []*upstreamPool
+
+	states map[string]*alertState
+}
+
+// Start starts watching health
+func (m *healthAlerter) Start() {
+	m.states = make(map[string]*alertState)
+	go func() {
+		for {
+			m.check()
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+func (m *healthAlerter) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	ready, err := headTracker.Ready(ctx)
+	cancel()
+	m.observe("node", err == nil && ready, func(healthy bool) healthAlert {
+		if healthy {
+			return healthAlert{Event: "node_healthy", Text: "geth-proxy: node is healthy"}
+		}
+		return healthAlert{Event: "node_unhealthy", Text: "geth-proxy: node is unhealthy, last block too old or unavailable"}
+	})
+
+	seen := map[string]bool{"node": true}
+	for _, p := range m.Pools {
+		for _, u := range p.List() {
+			chain, addr := p.Chain, u.Addr
+			key := "upstream/" + chain + "/" + addr
+			seen[key] = true
+			m.observe(key, u.Healthy(), func(healthy bool) healthAlert {
+				if healthy {
+					return healthAlert{
+						Event:    "upstream_readmitted",
+						Text:     fmt.Sprintf("geth-proxy: upstream %s (%s) is healthy, readmitted to pool", addr, chain),
+						Chain:    chain,
+						Upstream: addr,
+					}
+				}
+				return healthAlert{
+					Event:    "upstream_ejected",
+					Text:     fmt.Sprintf("geth-proxy: upstream %s (%s) is unhealthy, ejected from pool", addr, chain),
+					Chain:    chain,
+					Upstream: addr,
+				}
+			})
+		}
+	}
+
+	// removed upstreams
+	for key := range m.states {
+		if !seen[key] {
+			delete(m.states, key)
+		}
+	}
+}
+
+func (m *healthAlerter) observe(key string, healthy bool, alert func(healthy bool) healthAlert) {
+	now := time.Now()
+	st := m.states[key]
+	if st == nil {
+		// assume healthy, so target that never becomes healthy is notified
+		st = &alertState{Notified: true, Current: healthy, Since: now}
+		m.states[key] = st
+	}
+	if st.Current != healthy {
+		st.Current = healthy
+		st.Since = now
+	}
+	if st.Current == st.Notified || now.Sub(st.Since) < m.Debounce {
+		return
+	}
+	st.Notified = st.Current
+
+	a := alert(st.Current)
+	a.Time = now
+	log.Printf("alert: %s", a.Text)
+	go postWebhook(m.Webhook, a)
+}
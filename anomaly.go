@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// anomalyDetector tracks sliding-window statistics per client,
+// and flags clients that behave differently from their baseline
+type anomalyDetector struct {
+	Window      time.Duration // baseline window
+	Recent      time.Duration // recent window, compare with baseline
+	RateFactor  float64       // flag when recent request rate > baseline rate * RateFactor
+	ErrorRate   float64       // flag when recent error rate > ErrorRate
+	MethodShift float64       // flag when distance between recent and baseline method mix > MethodShift (0-2)
+	MinRequests int           // min recent requests to evaluate
+	Webhook     string        // webhook url to notify
+
+	mu      sync.Mutex
+	clients map[string]*clientStats
+}
+
+const anomalyBuckets = 60
+
+type clientStats struct {
+	buckets [anomalyBuckets]statsBucket
+	alerted map[string]time.Time
+}
+
+type statsBucket struct {
+	index    int64
+	requests int
+	errors   int
+	methods  map[string]int
+}
+
+type anomaly struct {
+	Client string  `json:"client"`
+	Type   string  `json:"type"`
+	Value  float64 `json:"value"`
+	Limit  float64 `json:"limit"`
+}
+
+func (m *anomalyDetector) bucketSize() time.Duration {
+	return m.Window / anomalyBuckets
+}
+
+// Start starts evaluating loop
+func (m *anomalyDetector) Start() {
+	go func() {
+		for {
+			time.Sleep(m.bucketSize())
+			m.evaluate()
+		}
+	}()
+}
+
+// ServeHandler implements middleware interface
+func (m *anomalyDetector) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := getRPCCall(r.Context())
+		if c == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		nw := errorTrackResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(&nw, r)
+
+		m.record(clientKey(r), c.Methods(), nw.isError())
+	})
+}
+
+func (m *anomalyDetector) record(client string, methods []string, isError bool) {
+	index := time.Now().UnixNano() / int64(m.bucketSize())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.clients == nil {
+		m.clients = make(map[string]*clientStats)
+	}
+	s := m.clients[client]
+	if s == nil {
+		s = &clientStats{alerted: make(map[string]time.Time)}
+		m.clients[client] = s
+	}
+
+	b := &s.buckets[index%anomalyBuckets]
+	if b.index != index {
+		*b = statsBucket{
+			index:   index,
+			methods: make(map[string]int),
+		}
+	}
+	b.requests++
+	if isError {
+		b.errors++
+	}
+	for _, method := range methods {
+		b.methods[method]++
+	}
+}
+
+func (m *anomalyDetector) evaluate() {
+	now := time.Now()
+	index := now.UnixNano() / int64(m.bucketSize())
+	recentBuckets := int64(m.Recent / m.bucketSize())
+	if recentBuckets <= 0 {
+		recentBuckets = 1
+	}
+
+	var anomalies []anomaly
+
+	m.mu.Lock()
+	for client, s := range m.clients {
+		var (
+			recent, baseline                 statsBucket
+			recentMethods, baselineMethods   = make(map[string]int), make(map[string]int)
+			recentDuration, baselineDuration time.Duration
+			active                           bool
+		)
+		for i := range s.buckets {
+			b := &s.buckets[i]
+			age := index - b.index
+			if age < 0 || age >= anomalyBuckets {
+				continue
+			}
+			active = true
+			if age < recentBuckets {
+				recent.requests += b.requests
+				recent.errors += b.errors
+				sumMethods(recentMethods, b.methods)
+				continue
+			}
+			baseline.requests += b.requests
+			sumMethods(baselineMethods, b.methods)
+		}
+		if !active {
+			delete(m.clients, client)
+			continue
+		}
+		if recent.requests < m.MinRequests {
+			continue
+		}
+		recentDuration = time.Duration(recentBuckets) * m.bucketSize()
+		baselineDuration = m.Window - recentDuration
+
+		if m.RateFactor > 0 && baseline.requests > 0 && baselineDuration > 0 {
+			recentRate := float64(recent.requests) / recentDuration.Seconds()
+			baselineRate := float64(baseline.requests) / baselineDuration.Seconds()
+			if factor := recentRate / baselineRate; factor > m.RateFactor {
+				anomalies = m.appendAnomaly(anomalies, s, now, anomaly{client, "rate", factor, m.RateFactor})
+			}
+		}
+
+		if m.ErrorRate > 0 {
+			if rate := float64(recent.errors) / float64(recent.requests); rate > m.ErrorRate {
+				anomalies = m.appendAnomaly(anomalies, s, now, anomaly{client, "error_rate", rate, m.ErrorRate})
+			}
+		}
+
+		if m.MethodShift > 0 && baseline.requests > 0 {
+			if d := methodMixDistance(recentMethods, baselineMethods); d > m.MethodShift {
+				anomalies = m.appendAnomaly(anomalies, s, now, anomaly{client, "method_shift", d, m.MethodShift})
+			}
+		}
+	}
+	anomalyClients.Set(float64(len(m.clients)))
+	m.mu.Unlock()
+
+	for _, a := range anomalies {
+		log.Printf("anomaly: client=%s type=%s value=%.2f limit=%.2f", a.Client, a.Type, a.Value, a.Limit)
+		promAnomaly(a.Type)
+		if m.Webhook != "" {
+			go postWebhook(m.Webhook, a)
+		}
+	}
+}
+
+// appendAnomaly appends anomaly if the client did not flag with the same type within window
+func (m *anomalyDetector) appendAnomaly(xs []anomaly, s *clientStats, now time.Time, a anomaly) []anomaly {
+	if now.Sub(s.alerted[a.Type]) < m.Window {
+		return xs
+	}
+	s.alerted[a.Type] = now
+	return append(xs, a)
+}
+
+func sumMethods(dst, src map[string]int) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+// methodMixDistance returns L1 distance between method distributions (0-2)
+func methodMixDistance(a, b map[string]int) float64 {
+	var totalA, totalB int
+	for _, v := range a {
+		totalA += v
+	}
+	for _, v := range b {
+		totalB += v
+	}
+	if totalA == 0 || totalB == 0 {
+		return 0
+	}
+
+	var d float64
+	for k, v := range a {
+		d += math.Abs(float64(v)/float64(totalA) - float64(b[k])/float64(totalB))
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			d += float64(v) / float64(totalB)
+		}
+	}
+	return d
+}
+
+// errorTrackResponseWriter tracks whether response is http or json-rpc error
+type errorTrackResponseWriter struct {
+	http.ResponseWriter
+	status int
+	head   []byte
+}
+
+const errorTrackHeadSize = 256
+
+func (w *errorTrackResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *errorTrackResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if n := errorTrackHeadSize - len(w.head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		w.head = append(w.head, p[:n]...)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements Flusher interface
+func (w *errorTrackResponseWriter) Flush() {
+	if w, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.Flush()
+	}
+}
+
+func (w *errorTrackResponseWriter) isError() bool {
+	if w.status >= 400 {
+		return true
+	}
+	return bytes.Contains(w.head, []byte(`"error":{`))
+}
+
+var anomalyCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "client_anomalies",
+}, []string{"type"})
+
+var anomalyClients = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: promNamespace,
+	Name:      "client_tracked",
+})
+
+func promAnomaly(typ string) {
+	c, err := anomalyCount.GetMetricWith(prometheus.Labels{
+		"type": typ,
+	})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
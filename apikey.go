@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiKeyPolicy is api key with its tenant and powers
+type apiKeyPolicy struct {
+	Tenant   string
+	Tier     string
+	Methods  map[string]bool // allowed methods, namespace_* or *, empty = all
+	Rate     int             // max calls per second, 0 = unlimited
+	CURate   int             // max compute units per second, 0 = unlimited
+	MaxBatch int             // max calls per batch, 0 = unlimited
+	Block    string          // default block tag for requests that omit block parameter, empty = proxy's default
+
+	bucket   *tokenBucket
+	cuBucket *tokenBucket
+}
+
+// parseAPIKey parses tenant:key;tier=name;methods=method|namespace_*;rate=n;cu=n;batch=n;block=tag
+func parseAPIKey(s string) (key string, p *apiKeyPolicy, err error) {
+	parts := strings.Split(s, ";")
+	i := strings.Index(parts[0], ":")
+	if i <= 0 || i == len(parts[0])-1 {
+		return "", nil, fmt.Errorf("invalid api key, required tenant:key")
+	}
+	p = &apiKeyPolicy{Tenant: strings.TrimSpace(parts[0][:i])}
+	key = strings.TrimSpace(parts[0][i+1:])
+
+	for _, x := range parts[1:] {
+		k, v := splitKeyValue(x)
+		switch k {
+		case "tier":
+			p.Tier = v
+		case "methods":
+			p.Methods = parseSet(strings.ReplaceAll(v, "|", ","))
+		case "rate":
+			p.Rate, err = strconv.Atoi(v)
+		case "cu":
+			p.CURate, err = strconv.Atoi(v)
+		case "batch":
+			p.MaxBatch, err = strconv.Atoi(v)
+		case "block":
+			if !isBlockTag(v) {
+				err = fmt.Errorf("unknown block tag %s", v)
+			}
+			p.Block = v
+		case "":
+		default:
+			return "", nil, fmt.Errorf("unknown policy %s for tenant %s", k, p.Tenant)
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid %s for tenant %s; %w", k, p.Tenant, err)
+		}
+	}
+	if p.Rate > 0 {
+		p.bucket = newTokenBucket(p.Rate)
+	}
+	if p.CURate > 0 {
+		p.cuBucket = newTokenBucket(p.CURate)
+	}
+	return key, p, nil
+}
+
+// AllowMethod returns true if key can call method
+func (p *apiKeyPolicy) AllowMethod(method string) bool {
+	if len(p.Methods) == 0 || p.Methods["*"] || p.Methods[method] {
+		return true
+	}
+	return p.Methods[rpcNamespace(method)+"_*"]
+}
+
+// apiKeyAuth authenticates request by api key from X-Api-Key header or apikey query,
+// the key's tenant and policy are stored in request context
+type apiKeyAuth struct {
+	keys map[string]*apiKeyPolicy
+}
+
+func newAPIKeyAuth(xs []string) (*apiKeyAuth, error) {
+	m := &apiKeyAuth{keys: make(map[string]*apiKeyPolicy)}
+	tenants := make(map[string]bool)
+	for _, x := range xs {
+		key, p, err := parseAPIKey(x)
+		if err != nil {
+			return nil, err
+		}
+		if m.keys[key] != nil {
+			return nil, fmt.Errorf("duplicated api key for tenant %s", p.Tenant)
+		}
+		if tenants[p.Tenant] {
+			return nil, fmt.Errorf("duplicated tenant %s", p.Tenant)
+		}
+		tenants[p.Tenant] = true
+		m.keys[key] = p
+	}
+	return m, nil
+}
+
+// Len returns number of keys
+func (m *apiKeyAuth) Len() int {
+	return len(m.keys)
+}
+
+// ServeHandler implements middleware interface
+func (m *apiKeyAuth) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Api-Key")
+		if key == "" {
+			key = r.URL.Query().Get("apikey")
+		}
+		if key == "" {
+			promAPIKeyRequest("missing")
+			apiKeyUnauthorized(w, r)
+			return
+		}
+		p := m.keys[key]
+		if p == nil {
+			promAPIKeyRequest("invalid")
+			apiKeyUnauthorized(w, r)
+			return
+		}
+		promAPIKeyRequest("valid")
+		r.Header.Del("X-Api-Key")
+		if r.URL.Query().Has("apikey") {
+			q := r.URL.Query()
+			q.Del("apikey")
+			r.URL.RawQuery = q.Encode()
+		}
+
+		t := authTenant{
+			Tenant: p.Tenant,
+			Tier:   p.Tier,
+			Policy: p,
+		}
+		ctx := r.Context()
+		logger.Set(ctx, "tenant", t.Tenant)
+		if t.Tier != "" {
+			logger.Set(ctx, "tier", t.Tier)
+		}
+		promTenantRequest(t)
+		ctx = context.WithValue(ctx, authTenantKey{}, &t)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func apiKeyUnauthorized(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		writeRPCError(w, r, http.StatusUnauthorized, rpcCodeServerError, "unauthorized")
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// apiKeyPolicyGuard enforces authenticated key's batch size, rate, compute unit rate, and method allowlist,
+// must be used after parseRPC
+type apiKeyPolicyGuard struct {
+	Units computeUnits
+}
+
+// ServeHandler implements middleware interface
+func (m apiKeyPolicyGuard) ServeHandler(h http.Handler) http.Handler {
+	next := interceptRPC(m.intercept).ServeHandler(h)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := getAuthTenant(r.Context())
+		c := getRPCCall(r.Context())
+		if t == nil || t.Policy == nil || c == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		l, x := m.take(t.Policy, c)
+		if l != nil {
+			if l.Info != nil {
+				writeRateLimitError(w, r, l.Message, *l.Info)
+				return
+			}
+			// waiting never helps, reject without Retry-After
+			writeRPCErrorData(w, r, http.StatusOK, rpcCodeLimitExceeded, l.Message, l.Data)
+			return
+		}
+		if x != nil {
+			x.SetHeader(w.Header())
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyLimit is the reason call exceeds key's limit
+type apiKeyLimit struct {
+	Reason  string         // batch, rate, or cu
+	Message string         // json-rpc error message
+	Data    interface{}    // json-rpc error data
+	Info    *rateLimitInfo // rate limit info when call can be retried, nil = call never allowed
+}
+
+// take checks call against key's batch size, rate, and compute unit rate,
+// tokens are taken from both buckets only when call is allowed by both.
+// Returns rejected limit, or rate limit info of the last bucket to report in headers
+func (m apiKeyPolicyGuard) take(p *apiKeyPolicy, c *rpcCall) (*apiKeyLimit, *rateLimitInfo) {
+	reject := func(l *apiKeyLimit) (*apiKeyLimit, *rateLimitInfo) {
+		promAPIKeyRejected(p.Tenant, l.Reason)
+		return l, nil
+	}
+
+	n := len(c.Requests)
+	if p.MaxBatch > 0 && c.Batch && n > p.MaxBatch {
+		return reject(&apiKeyLimit{
+			Reason:  "batch",
+			Message: fmt.Sprintf("batch size %d exceeds limit %d", n, p.MaxBatch),
+			Data: map[string]interface{}{
+				"maxBatchSize": p.MaxBatch,
+			},
+		})
+	}
+	if p.bucket != nil && p.bucket.Exceeds(n) {
+		return reject(&apiKeyLimit{
+			Reason:  "rate",
+			Message: fmt.Sprintf("batch size %d exceeds rate limit %d calls per second", n, p.Rate),
+			Data: map[string]interface{}{
+				"limit": p.Rate,
+			},
+		})
+	}
+	var cu int
+	if p.cuBucket != nil {
+		cu = m.Units.Call(c)
+		if p.cuBucket.Exceeds(cu) {
+			return reject(&apiKeyLimit{
+				Reason:  "cu",
+				Message: fmt.Sprintf("call costs %d compute units, exceeds rate limit %d compute units per second", cu, p.CURate),
+				Data: map[string]interface{}{
+					"limit": p.CURate,
+				},
+			})
+		}
+	}
+
+	var info *rateLimitInfo
+	if p.bucket != nil {
+		ok, remaining, wait := p.bucket.Take(n)
+		x := rateLimitInfo{Limit: p.Rate, Remaining: remaining}
+		if !ok {
+			x.RetryAfter = retryAfterSeconds(wait)
+			return reject(&apiKeyLimit{
+				Reason:  "rate",
+				Message: fmt.Sprintf("rate limit %d calls per second exceeded", p.Rate),
+				Data:    x,
+				Info:    &x,
+			})
+		}
+		info = &x
+	}
+	if p.cuBucket != nil {
+		ok, remaining, wait := p.cuBucket.Take(cu)
+		x := rateLimitInfo{Limit: p.CURate, Remaining: remaining}
+		if !ok {
+			// call is not forwarded, refund calls taken from rate bucket
+			if p.bucket != nil {
+				p.bucket.Put(n)
+			}
+			x.RetryAfter = retryAfterSeconds(wait)
+			return reject(&apiKeyLimit{
+				Reason:  "cu",
+				Message: fmt.Sprintf("rate limit %d compute units per second exceeded", p.CURate),
+				Data:    x,
+				Info:    &x,
+			})
+		}
+		info = &x
+	}
+	return nil, info
+}
+
+func (m apiKeyPolicyGuard) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	p := getAuthTenant(r.Context()).Policy
+	if p.AllowMethod(req.Method) {
+		return nil
+	}
+	promAPIKeyRejected(p.Tenant, "method")
+	return newRPCError(req, rpcCodeMethodNotFound, fmt.Sprintf("the method %s is not allowed for this key", req.Method))
+}
+
+// tokenBucket allows rate per second, with a second of burst
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Exceeds returns true if n tokens can never be taken, burst is capped at rate
+func (b *tokenBucket) Exceeds(n int) bool {
+	return float64(n) > b.rate
+}
+
+// Take takes n tokens, returns false and duration until n tokens available when not enough
+func (b *tokenBucket) Take(n int) (ok bool, remaining int, wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	if b.tokens < float64(n) {
+		wait = time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+		return false, int(b.tokens), wait
+	}
+	b.tokens -= float64(n)
+	return true, int(b.tokens), 0
+}
+
+// Put returns n tokens taken by Take
+func (b *tokenBucket) Put(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += float64(n)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+var (
+	apiKeyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "apikey_requests",
+	}, []string{"result"})
+
+	apiKeyRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "apikey_policy_rejected",
+	}, []string{"tenant", "reason"})
+)
+
+func promAPIKeyRequest(result string) {
+	c, err := apiKeyRequests.GetMetricWith(prometheus.Labels{"result": result})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
+
+func promAPIKeyRejected(tenant, reason string) {
+	c, err := apiKeyRejected.GetMetricWith(prometheus.Labels{
+		"tenant": tenant,
+		"reason": reason,
+	})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/moonrhythm/parapet/pkg/authn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuth authenticates clients with username and password,
+// authorization header is removed before forwarding to upstream
+type basicAuth struct {
+	users map[string]string // username => password or htpasswd hash
+}
+
+// newBasicAuth creates basic auth from credential (username:password) and htpasswd file
+func newBasicAuth(credential, htpasswdFile string) (*basicAuth, error) {
+	m := basicAuth{
+		users: make(map[string]string),
+	}
+	if credential != "" {
+		username, password := parseCredential(credential)
+		if username == "" || password == "" {
+			return nil, fmt.Errorf("invalid credential, required username:password")
+		}
+		m.users[username] = password
+	}
+	if htpasswdFile != "" {
+		err := m.loadHtpasswd(htpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &m, nil
+}
+
+// loadHtpasswd loads bcrypt, sha1 ({SHA}), or plain text entries from htpasswd file
+func (m *basicAuth) loadHtpasswd(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash := parseCredential(line)
+		if username == "" || hash == "" {
+			return fmt.Errorf("invalid htpasswd entry for %q", username)
+		}
+		if strings.HasPrefix(hash, "$apr1$") {
+			return fmt.Errorf("unsupported htpasswd md5 hash for %s, use bcrypt (htpasswd -B)", username)
+		}
+		m.users[username] = hash
+	}
+	return scanner.Err()
+}
+
+// Len returns number of users
+func (m *basicAuth) Len() int {
+	return len(m.users)
+}
+
+// Authenticate returns true if username and password are valid
+func (m *basicAuth) Authenticate(username, password string) bool {
+	hash, ok := m.users[username]
+	if !ok {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+}
+
+// Middleware returns basic auth middleware
+func (m *basicAuth) Middleware() *authn.BasicAuthenticator {
+	return &authn.BasicAuthenticator{
+		Realm:        "geth-proxy",
+		Authenticate: m.Authenticate,
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// payloadLimit rejects request body larger than max bytes before parsing json-rpc,
+// must be used before parseRPC
+type payloadLimit struct {
+	Max int64
+}
+
+// ServeHandler implements middleware interface
+func (m payloadLimit) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Body == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > m.Max {
+			m.reject(w, r)
+			return
+		}
+
+		// content length can be unknown, read at most max+1 bytes to detect oversized body
+		body, err := io.ReadAll(io.LimitReader(r.Body, m.Max+1))
+		r.Body.Close()
+		if err != nil {
+			writeRPCError(w, r, http.StatusBadRequest, rpcCodeParseError, "can not read request body")
+			return
+		}
+		if int64(len(body)) > m.Max {
+			m.reject(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (m payloadLimit) reject(w http.ResponseWriter, r *http.Request) {
+	promBatchLimit("payload")
+	writeRPCErrorData(w, r, http.StatusRequestEntityTooLarge, rpcCodeLimitExceeded,
+		fmt.Sprintf("request payload exceeds limit %d bytes", m.Max),
+		map[string]interface{}{
+			"maxPayload": m.Max,
+		},
+	)
+}
+
+// batchLimit rejects json-rpc batch with more than max calls,
+// every call in the batch gets the error
+type batchLimit struct {
+	Max int
+}
+
+// ServeHandler implements middleware interface
+func (m batchLimit) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := getRPCCall(r.Context())
+		if c == nil || !c.Batch || len(c.Requests) <= m.Max {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		promBatchLimit("calls")
+		writeRPCErrorData(w, r, http.StatusOK, rpcCodeLimitExceeded,
+			fmt.Sprintf("batch size %d exceeds limit %d", len(c.Requests), m.Max),
+			map[string]interface{}{
+				"maxBatchSize": m.Max,
+			},
+		)
+	})
+}
+
+var batchLimitRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "batch_limit_rejected",
+}, []string{"limit"})
+
+func promBatchLimit(limit string) {
+	c, err := batchLimitRejected.GetMetricWith(prometheus.Labels{"limit": limit})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/moonrhythm/parapet/pkg/upstream"
+)
+
+// blockAPI serves block with transactions, receipts, and traces in single request
+//
+//	GET /v1/blocks/{number}/full?traces=1
+type blockAPI struct {
+	BatchSize   int // receipts per upstream batch call
+	Concurrency int // max concurrent upstream calls
+}
+
+type blockAPIResponse struct {
+	Block    json.RawMessage   `json:"block"`
+	Receipts []json.RawMessage `json:"receipts"`
+	Traces   json.RawMessage   `json:"traces,omitempty"`
+}
+
+type blockAPIError struct {
+	Error string `json:"error"`
+}
+
+func (m *blockAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// /v1/blocks/{number}/full
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/blocks/"), "/")
+	if len(parts) != 2 || parts[1] != "full" {
+		http.NotFound(w, r)
+		return
+	}
+	number, ok := parseBlockAPINumber(parts[0])
+	if !ok {
+		m.writeError(w, http.StatusBadRequest, "invalid block number")
+		return
+	}
+
+	ctx := r.Context()
+
+	var block struct {
+		Hash         string `json:"hash"`
+		Transactions []struct {
+			Hash string `json:"hash"`
+		} `json:"transactions"`
+	}
+	var resp blockAPIResponse
+	err := pool.Next().RPC.CallContext(ctx, &resp.Block, "eth_getBlockByNumber", number, true)
+	if err != nil {
+		m.writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if len(resp.Block) == 0 || string(resp.Block) == "null" {
+		m.writeError(w, http.StatusNotFound, "block not found")
+		return
+	}
+	err = json.Unmarshal(resp.Block, &block)
+	if err != nil {
+		m.writeError(w, http.StatusBadGateway, "invalid block")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		sem      = make(chan struct{}, m.Concurrency)
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	// receipts, by tx hash from the fetched block to make response consistent when reorg
+	resp.Receipts = make([]json.RawMessage, len(block.Transactions))
+	for start := 0; start < len(block.Transactions); start += m.BatchSize {
+		end := start + m.BatchSize
+		if end > len(block.Transactions) {
+			end = len(block.Transactions)
+		}
+
+		batch := make([]rpc.BatchElem, 0, end-start)
+		for i := start; i < end; i++ {
+			batch = append(batch, rpc.BatchElem{
+				Method: "eth_getTransactionReceipt",
+				Args:   []interface{}{block.Transactions[i].Hash},
+				Result: &resp.Receipts[i],
+			})
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := pool.Next().RPC.BatchCallContext(ctx, batch)
+			if err != nil {
+				fail(err)
+				return
+			}
+			for _, x := range batch {
+				if x.Error != nil {
+					fail(x.Error)
+					return
+				}
+			}
+		}()
+	}
+
+	if r.FormValue("traces") == "1" {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			u := pool.NextFor(&rpcCall{Requests: []*rpcRequest{{Method: "debug_traceBlockByHash"}}})
+			if u == nil {
+				fail(upstream.ErrUnavailable)
+				return
+			}
+			err := u.RPC.CallContext(ctx, &resp.Traces, "debug_traceBlockByHash", block.Hash, map[string]string{"tracer": "callTracer"})
+			if err != nil {
+				fail(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		m.writeError(w, http.StatusBadGateway, firstErr.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (m *blockAPI) writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(blockAPIError{msg})
+}
+
+// parseBlockAPINumber parses decimal, hex, or tag block number into json-rpc block number
+func parseBlockAPINumber(s string) (string, bool) {
+	switch s {
+	case "latest", "earliest", "pending", "safe", "finalized":
+		return s, true
+	}
+	if strings.HasPrefix(s, "0x") {
+		n, err := hexutil.DecodeUint64(s)
+		if err != nil {
+			return "", false
+		}
+		return hexutil.EncodeUint64(n), true
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	return hexutil.EncodeUint64(n), true
+}
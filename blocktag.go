@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// blockParamIndex is the position of optional block parameter for each method
+var blockParamIndex = map[string]int{
+	"eth_getBalance":          1,
+	"eth_getCode":             1,
+	"eth_getTransactionCount": 1,
+	"eth_getStorageAt":        2,
+	"eth_call":                1,
+	"eth_estimateGas":         1,
+	"eth_createAccessList":    1,
+	"eth_getProof":            2,
+}
+
+type defaultBlockKey struct{}
+
+// withDefaultBlock overrides default block tag for the request
+func withDefaultBlock(r *http.Request, tag string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), defaultBlockKey{}, tag))
+}
+
+// defaultBlockPaths sets default block tag by request path,
+// then rewrites the path to json-rpc endpoint.
+//
+// ex. POST /finalized => POST / with finalized as default block tag
+type defaultBlockPaths map[string]string
+
+// ServeHandler implements middleware interface
+func (m defaultBlockPaths) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tag, ok := m[r.URL.Path]; ok {
+			r = withDefaultBlock(r, tag)
+			r.URL.Path = "/"
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// defaultBlock fills omitted block parameter with block tag of the path, then api key, then configured tag
+type defaultBlock struct {
+	Tag string // default tag, empty = not modify
+}
+
+// ServeHandler implements middleware interface
+func (m defaultBlock) ServeHandler(h http.Handler) http.Handler {
+	return interceptRPC(m.intercept).ServeHandler(h)
+}
+
+func (m defaultBlock) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	ctx := r.Context()
+	tag, _ := ctx.Value(defaultBlockKey{}).(string)
+	if t := getAuthTenant(ctx); tag == "" && t != nil && t.Policy != nil {
+		tag = t.Policy.Block
+	}
+	if tag == "" {
+		tag = m.Tag
+	}
+	if tag == "" || tag == "latest" {
+		return nil
+	}
+
+	if req.Method == "eth_getLogs" {
+		var params []map[string]json.RawMessage
+		if json.Unmarshal(req.Params, &params) != nil || len(params) == 0 || params[0] == nil {
+			return nil
+		}
+		filter := params[0]
+		if _, ok := filter["blockHash"]; ok {
+			return nil
+		}
+		if _, ok := filter["toBlock"]; ok {
+			return nil
+		}
+		filter["toBlock"], _ = json.Marshal(tag)
+		if _, ok := filter["fromBlock"]; !ok {
+			filter["fromBlock"] = filter["toBlock"]
+		}
+		req.Params, _ = json.Marshal(params)
+		getRPCCall(ctx).Dirty = true
+		return nil
+	}
+
+	i, ok := blockParamIndex[req.Method]
+	if !ok {
+		return nil
+	}
+	var params []json.RawMessage
+	if json.Unmarshal(req.Params, &params) != nil || len(params) != i {
+		return nil
+	}
+	b, _ := json.Marshal(tag)
+	params = append(params, b)
+	req.Params, _ = json.Marshal(params)
+	getRPCCall(ctx).Dirty = true
+	return nil
+}
+
+func isBlockTag(tag string) bool {
+	switch tag {
+	case "latest", "safe", "finalized", "earliest", "pending":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// broadcastTx forwards eth_sendRawTransaction to all healthy upstreams,
+// the first success wins, others are best-effort
+func broadcastTx(timeout time.Duration) parapet.Middleware {
+	return interceptRPC(func(r *http.Request, req *rpcRequest) *rpcResponse {
+		if req.Method != "eth_sendRawTransaction" {
+			return nil
+		}
+
+		upstreams := pool.Healthy()
+		if len(upstreams) <= 1 {
+			return nil
+		}
+
+		type result struct {
+			result json.RawMessage
+			err    error
+		}
+
+		// broadcast must continue after the first success returned to client
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+		var wg sync.WaitGroup
+		ch := make(chan result, len(upstreams))
+		for _, u := range upstreams {
+			u := u
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				res, err := callRPC(ctx, u.RPC, req)
+				if err != nil && !isAlreadyKnown(err) {
+					log.Printf("broadcast: %s failed; %v", u.Addr, err)
+					promBroadcastFailure(u.Addr)
+				}
+				ch <- result{res, err}
+			}()
+		}
+		go func() {
+			wg.Wait()
+			cancel()
+		}()
+
+		var firstErr error
+		for range upstreams {
+			select {
+			case <-r.Context().Done():
+				return newRPCError(req, rpcCodeInternalError, "request canceled")
+			case res := <-ch:
+				if res.err == nil {
+					return newRPCResult(req, res.result)
+				}
+				if firstErr == nil {
+					firstErr = res.err
+				}
+			}
+		}
+		return newRPCErrorFrom(req, firstErr)
+	})
+}
+
+func isAlreadyKnown(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "already known") || strings.Contains(msg, "known transaction")
+}
+
+var broadcastFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "broadcast_failures",
+}, []string{"upstream"})
+
+func promBroadcastFailure(upstream string) {
+	c, err := broadcastFailures.GetMetricWith(prometheus.Labels{
+		"upstream": upstream,
+	})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "cache",
+}, []string{"method", "result"})
+
+func promCache(method, result string) {
+	c, err := cacheCount.GetMetricWith(prometheus.Labels{
+		"method": method,
+		"result": result,
+	})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// captureRecord is a captured json-rpc call, client's information and request ids are not recorded
+type captureRecord struct {
+	Time     time.Time        `json:"time"`
+	Duration float64          `json:"duration"` // seconds
+	Batch    bool             `json:"batch,omitempty"`
+	Requests []captureRequest `json:"requests"`
+}
+
+type captureRequest struct {
+	Method   string          `json:"method"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	Redacted bool            `json:"redacted,omitempty"` // params were removed, can not be replayed
+}
+
+// capture records sampled json-rpc calls as json lines, for replay subcommand
+type capture struct {
+	Writer io.Writer
+	Sample float64         // 0-1
+	Redact map[string]bool // methods that params must not be recorded
+
+	mu sync.Mutex
+}
+
+// ServeHandler implements middleware interface
+func (m *capture) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := getRPCCall(r.Context())
+		if c == nil || (m.Sample < 1 && rand.Float64() >= m.Sample) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// record before params are rewritten by next middlewares
+		start := time.Now()
+		rec := captureRecord{
+			Time:     start,
+			Batch:    c.Batch,
+			Requests: make([]captureRequest, len(c.Requests)),
+		}
+		for i, req := range c.Requests {
+			if req == nil {
+				continue
+			}
+			rec.Requests[i].Method = req.Method
+			if m.Redact[req.Method] {
+				rec.Requests[i].Redacted = true
+				continue
+			}
+			rec.Requests[i].Params = req.Params
+		}
+
+		h.ServeHTTP(w, r)
+		rec.Duration = float64(time.Since(start)) / float64(time.Second)
+		m.write(&rec)
+	})
+}
+
+func (m *capture) write(rec *captureRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.Writer.Write(b)
+	if err != nil {
+		log.Printf("capture: can not write; %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// certMonitor monitors loaded tls certificates expiry
+type certMonitor struct {
+	Warning time.Duration // log warning when certificate will expire within
+
+	mu    sync.RWMutex
+	certs []*x509.Certificate
+}
+
+var certs certMonitor
+
+// Add adds certificate to monitor
+func (m *certMonitor) Add(cert tls.Certificate) {
+	if len(cert.Certificate) == 0 {
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		log.Printf("cert: can not parse certificate; %v", err)
+		return
+	}
+
+	m.mu.Lock()
+	m.certs = append(m.certs, leaf)
+	m.mu.Unlock()
+
+	certExpiry.With(prometheus.Labels{"subject": leaf.Subject.CommonName}).Set(float64(leaf.NotAfter.Unix()))
+}
+
+// Reset removes all certificates, ex. before reloaded certificates are added
+func (m *certMonitor) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.certs {
+		certExpiry.Delete(prometheus.Labels{"subject": c.Subject.CommonName})
+	}
+	m.certs = nil
+}
+
+// Len returns number of monitored certificates
+func (m *certMonitor) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.certs)
+}
+
+// Start starts expiry checking loop
+func (m *certMonitor) Start() {
+	go func() {
+		for {
+			m.check()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func (m *certMonitor) check() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, c := range m.certs {
+		left := time.Until(c.NotAfter)
+		if left <= 0 {
+			log.Printf("cert: %s expired at %s", c.Subject.CommonName, c.NotAfter.Format(time.RFC3339))
+		} else if left < m.Warning {
+			log.Printf("cert: %s will expire in %s at %s", c.Subject.CommonName, left.Truncate(time.Minute), c.NotAfter.Format(time.RFC3339))
+		}
+	}
+}
+
+// Expired returns true if any certificate expired
+func (m *certMonitor) Expired() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	for _, c := range m.certs {
+		if now.After(c.NotAfter) {
+			return true
+		}
+	}
+	return false
+}
+
+var certExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: promNamespace,
+	Name:      "tls_cert_expiry_timestamp_seconds",
+}, []string{"subject"})
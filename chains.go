@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/block"
+	"github.com/moonrhythm/parapet/pkg/location"
+	"github.com/moonrhythm/parapet/pkg/stripprefix"
+	"github.com/moonrhythm/parapet/pkg/upstream"
+)
+
+// chainRoute is an additional chain served by path prefix (/name) or host,
+// with its own upstream pool
+type chainRoute struct {
+	Name  string
+	Hosts map[string]bool
+	Pool  *upstreamPool
+
+	HTTPPort    string
+	WSPort      string
+	WSTimeout   time.Duration
+	WS          wsProxy // websocket limits, pool and port are set from chain
+	GraphQLPort string
+	GraphQL     graphqlGuard
+	Transport   transportConfig
+	RPC         parapet.Middlewares // rpc policies and limits before forwarding, shared with default route
+	Guard       *namespaceGuard     // websocket blocked namespaces, nil = allow all
+	APIKeys     *apiKeyPolicyGuard  // websocket api key policy, nil = api key auth disabled
+}
+
+// reservedChainNames are path prefixes used by proxy
+var reservedChainNames = map[string]bool{
+	"ws":          true,
+	"metrics":     true,
+	"healthz":     true,
+	"livez":       true,
+	"readyz":      true,
+	"lifecycle":   true,
+	"maintenance": true,
+	"v1":          true,
+	"graphql":     true,
+	"internal":    true,
+	"default":     true,
+	"gas":         true,
+	"txpool":      true,
+	"sse":         true,
+	"heads":       true,
+	"version":     true,
+}
+
+// parseChainRoutes parses name=addr|addr,... into chain routes,
+// hosts is host=name,... to route by host, host can be wildcard subdomain (ex. *.sepolia.example.com)
+func parseChainRoutes(chains, hosts, httpPort string) ([]*chainRoute, error) {
+	var rs []*chainRoute
+	byName := make(map[string]*chainRoute)
+	for _, x := range parseList(chains) {
+		name, addrs := splitKeyValue(x)
+		if name == "" || strings.Contains(name, "/") || reservedChainNames[name] {
+			return nil, fmt.Errorf("invalid chain name %q", name)
+		}
+		if byName[name] != nil {
+			return nil, fmt.Errorf("duplicated chain %s", name)
+		}
+
+		c := &chainRoute{
+			Name:     name,
+			Hosts:    make(map[string]bool),
+			Pool:     newUpstreamPool(name),
+			HTTPPort: httpPort,
+		}
+		for _, addr := range strings.Split(addrs, "|") {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			u, err := newGethUpstream(name, addr, httpPort)
+			if err != nil {
+				return nil, err
+			}
+			c.Pool.Add(u)
+		}
+		if len(c.Pool.List()) == 0 {
+			return nil, fmt.Errorf("chain %s requires geth address", name)
+		}
+		rs = append(rs, c)
+		byName[name] = c
+	}
+
+	for host, name := range parseMap(hosts) {
+		c := byName[name]
+		if c == nil {
+			return nil, fmt.Errorf("chain %s not found for host %s", name, host)
+		}
+		c.Hosts[strings.ToLower(host)] = true
+	}
+	return rs, nil
+}
+
+// Middleware returns middleware that forwards matched requests to chain's pool
+func (c *chainRoute) Middleware() parapet.Middleware {
+	prefix := "/" + c.Name
+
+	b := block.New(func(r *http.Request) bool {
+		return matchHost(c.Hosts, r.Host) || r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/")
+	})
+	b.Use(parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !matchHost(c.Hosts, r.Host) {
+				r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+				if r.URL.Path == "" {
+					r.URL.Path = "/"
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}))
+
+	// websocket
+	if c.WSPort != "" {
+		l := location.Exact("/ws")
+		l.Use(maintenanceGuard())
+		l.Use(trackWSSession())
+		l.Use(stripprefix.New("/ws"))
+		ws := c.WS
+		ws.Pool = c.Pool
+		ws.Port = c.WSPort
+		ws.HandshakeTimeout = c.WSTimeout
+		ws.Guard = c.Guard
+		ws.APIKeys = c.APIKeys
+		l.Use(&ws)
+		l.Use(upstream.New(c.Pool.Transport(c.WSPort, c.Transport.WithResponseHeaderTimeout(c.WSTimeout).New())))
+		b.Use(l)
+	}
+
+	// graphql
+	if c.GraphQLPort != "" {
+		l := location.Exact("/graphql")
+		l.Use(maintenanceGuard())
+		l.Use(c.GraphQL)
+		l.Use(upstream.New(c.Pool.Transport(c.GraphQLPort, upstreamTimer{c.Transport.New()})))
+		b.Use(l)
+	}
+
+	// http
+	b.Use(c.RPC)
+	b.Use(upstream.New(c.Pool.Transport(c.HTTPPort, upstreamTimer{c.Transport.New()})))
+	return b
+}
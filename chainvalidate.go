@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/moonrhythm/parapet/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// chainValidator verifies upstream data is consistent with the configured network
+type chainValidator struct {
+	ChainID *big.Int    // expected chain id, nil = not check
+	Genesis common.Hash // expected genesis hash, zero = not check
+	Sample  float64     // sample rate of responses to validate (0-1)
+	Webhook string      // webhook url to notify
+
+	mu          sync.Mutex
+	knownHashes map[uint64]common.Hash // block hashes seen by head tracker
+}
+
+const (
+	chainValidateKnownHashes   = 256
+	chainValidateConfirmations = 12
+)
+
+type chainValidationFailure struct {
+	Check    string `json:"check"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Upstream string `json:"upstream"` // upstream address, empty when unknown
+}
+
+// Start starts upstream chain id and genesis checking loop
+func (m *chainValidator) Start() {
+	m.knownHashes = make(map[uint64]common.Hash)
+
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			m.checkUpstreams(ctx)
+			cancel()
+
+			time.Sleep(time.Minute)
+		}
+	}()
+
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			m.recordHead(ctx)
+			cancel()
+
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+// checkUpstreams checks chain id and genesis of all healthy upstreams
+func (m *chainValidator) checkUpstreams(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, u := range pool.Healthy() {
+		u := u
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.checkUpstream(ctx, u)
+		}()
+	}
+	wg.Wait()
+}
+
+func (m *chainValidator) checkUpstream(ctx context.Context, u *gethUpstream) {
+	if m.ChainID != nil {
+		id, err := u.Eth.ChainID(ctx)
+		if err == nil && id.Cmp(m.ChainID) != 0 {
+			m.fail(chainValidationFailure{"chain_id", m.ChainID.String(), id.String(), u.Addr})
+		}
+	}
+
+	if m.Genesis != (common.Hash{}) {
+		header, err := u.Eth.HeaderByNumber(ctx, big.NewInt(0))
+		if err == nil && header.Hash() != m.Genesis {
+			m.fail(chainValidationFailure{"genesis", m.Genesis.Hex(), header.Hash().Hex(), u.Addr})
+		}
+	}
+}
+
+func (m *chainValidator) recordHead(ctx context.Context) {
+	block, _ := getLastBlock(ctx)
+	if block != nil {
+		m.mu.Lock()
+		m.knownHashes[block.NumberU64()] = block.Hash()
+		if n := block.NumberU64(); n > 0 {
+			// parent hash is canonical, fix recorded hash when reorg
+			if _, ok := m.knownHashes[n-1]; ok {
+				m.knownHashes[n-1] = block.ParentHash()
+			}
+		}
+		for n := range m.knownHashes {
+			if n+chainValidateKnownHashes < block.NumberU64() {
+				delete(m.knownHashes, n)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *chainValidator) fail(f chainValidationFailure) {
+	log.Printf("chain validation: %s mismatch on upstream %s, expected %s got %s", f.Check, f.Upstream, f.Expected, f.Actual)
+	promChainValidationFailure(f.Check, f.Upstream)
+	if m.Webhook != "" {
+		go postWebhook(m.Webhook, f)
+	}
+}
+
+// ServeHandler implements middleware interface
+func (m *chainValidator) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := getRPCCall(r.Context())
+		if c == nil || c.Batch || !isChainValidateMethod(c.Requests[0].Method) || rand.Float64() >= m.Sample {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// validate uncompressed response only
+		r.Header.Del("Accept-Encoding")
+
+		nw := captureResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(&nw, r)
+
+		go m.validateResponse(nw.buf.Bytes(), responseUpstream(r))
+	})
+}
+
+// responseUpstream returns address of upstream that served the request from request log, or empty
+func responseUpstream(r *http.Request) string {
+	host, _ := logger.Get(r.Context(), "upstream").(string)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func isChainValidateMethod(method string) bool {
+	return strings.HasPrefix(method, "eth_getBlockBy") || strings.HasPrefix(method, "eth_getTransactionBy")
+}
+
+type chainValidateObject struct {
+	Hash         *common.Hash      `json:"hash"`
+	Number       *hexutil.Uint64   `json:"number"`
+	ChainID      *hexutil.Big      `json:"chainId"`
+	Transactions []json.RawMessage `json:"transactions"`
+}
+
+func (m *chainValidator) validateResponse(body []byte, upstream string) {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if json.Unmarshal(body, &resp) != nil || len(resp.Result) == 0 || resp.Result[0] != '{' {
+		return
+	}
+
+	var obj chainValidateObject
+	if json.Unmarshal(resp.Result, &obj) != nil {
+		return
+	}
+
+	// transaction
+	m.validateTx(&obj, upstream)
+
+	// block
+	if obj.Number != nil && obj.Hash != nil && obj.Transactions != nil {
+		m.validateBlock(uint64(*obj.Number), *obj.Hash, upstream)
+
+		for _, raw := range obj.Transactions {
+			if len(raw) == 0 || raw[0] != '{' {
+				continue
+			}
+			var tx chainValidateObject
+			if json.Unmarshal(raw, &tx) == nil {
+				m.validateTx(&tx, upstream)
+			}
+		}
+	}
+}
+
+func (m *chainValidator) validateTx(tx *chainValidateObject, upstream string) {
+	if m.ChainID == nil || tx.ChainID == nil {
+		return
+	}
+	if id := tx.ChainID.ToInt(); id.Cmp(m.ChainID) != 0 {
+		m.fail(chainValidationFailure{"tx_chain_id", m.ChainID.String(), id.String(), upstream})
+	}
+}
+
+func (m *chainValidator) validateBlock(number uint64, hash common.Hash, upstream string) {
+	m.mu.Lock()
+	known, ok := m.knownHashes[number]
+	var head uint64
+	for n := range m.knownHashes {
+		if n > head {
+			head = n
+		}
+	}
+	m.mu.Unlock()
+
+	// skip recent blocks, it can be reorged
+	if !ok || number+chainValidateConfirmations > head {
+		return
+	}
+	if known != hash {
+		m.fail(chainValidationFailure{"block_hash", known.Hex(), hash.Hex(), upstream})
+	}
+}
+
+// captureResponseWriter captures response body while writing to client
+type captureResponseWriter struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *captureResponseWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements Flusher interface
+func (w *captureResponseWriter) Flush() {
+	if w, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.Flush()
+	}
+}
+
+var chainValidationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "chain_validation_failures",
+}, []string{"check", "upstream"})
+
+func promChainValidationFailure(check, upstream string) {
+	c, err := chainValidationFailures.GetMetricWith(prometheus.Labels{
+		"check":    check,
+		"upstream": upstream,
+	})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
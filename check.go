@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+
+	"github.com/moonrhythm/geth-proxy/pkg/upstreampool"
+)
+
+// runCheck runs check subcommand, one-shot readiness probe against proxy's /readyz or geth,
+// exits 0 when ready, 1 otherwise
+//
+//	geth-proxy check -url=http://127.0.0.1/readyz
+//	geth-proxy check -geth=http://127.0.0.1:8545 -json
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	var (
+		proxyURL        = fs.String("url", "http://127.0.0.1/readyz", "proxy readiness url")
+		gethURL         = fs.String("geth", "", "check geth json-rpc url directly instead of proxy")
+		healthyDuration = fs.Duration("healthy-duration", time.Minute, "duration from geth's last block that mark as healthy")
+		blockUnit       = fs.Duration("block-unit", time.Second, "geth block timestamp unit")
+		timeout         = fs.Duration("timeout", 5*time.Second, "check timeout")
+		jsonOutput      = fs.Bool("json", false, "print result as json")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: geth-proxy check [flags]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	var res checkResult
+	if *gethURL != "" {
+		res = checkGeth(ctx, *gethURL, *healthyDuration, *blockUnit)
+	} else {
+		res = checkProxy(ctx, *proxyURL)
+	}
+	res.OK = len(res.Checks) > 0
+	for _, c := range res.Checks {
+		if !c.OK {
+			res.OK = false
+		}
+	}
+
+	if *jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(res)
+	} else {
+		for _, c := range res.Checks {
+			if c.OK {
+				fmt.Printf("[+]%s ok\n", c.Name)
+				continue
+			}
+			fmt.Printf("[-]%s failed: %s\n", c.Name, c.Error)
+		}
+	}
+	if !res.OK {
+		os.Exit(1)
+	}
+}
+
+type checkResult struct {
+	OK     bool          `json:"ok"`
+	Target string        `json:"target"`
+	Head   uint64        `json:"head,omitempty"`
+	Checks []checkStatus `json:"checks"`
+}
+
+type checkStatus struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func (r *checkResult) add(name string, err error) {
+	c := checkStatus{Name: name, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// checkProxy gets proxy's verbose readiness, and parses each check
+func checkProxy(ctx context.Context, rawURL string) checkResult {
+	res := checkResult{Target: rawURL}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		res.add("request", err)
+		return res
+	}
+	q := u.Query()
+	q.Set("verbose", "")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		res.add("request", err)
+		return res
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		res.add("request", err)
+		return res
+	}
+	defer resp.Body.Close()
+
+	// [+]name ok, [+]name excluded: ok, or [-]name failed: reason
+	sc := bufio.NewScanner(io.LimitReader(resp.Body, 1<<20))
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "[+]"):
+			name := strings.Fields(line[3:])
+			if len(name) > 0 {
+				res.add(name[0], nil)
+			}
+		case strings.HasPrefix(line, "[-]"):
+			name, reason := line[3:], "failed"
+			if i := strings.Index(name, " failed: "); i >= 0 {
+				name, reason = name[:i], name[i+len(" failed: "):]
+			}
+			res.add(name, errors.New(reason))
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		res.add("status", fmt.Errorf("http status %d", resp.StatusCode))
+	}
+	return res
+}
+
+// checkGeth checks geth's last block age and sync status
+func checkGeth(ctx context.Context, rawURL string, healthyDuration, blockUnit time.Duration) checkResult {
+	res := checkResult{Target: rawURL}
+
+	c, err := ethclient.DialContext(ctx, rawURL)
+	if err != nil {
+		res.add("dial", err)
+		return res
+	}
+	defer c.Close()
+
+	header, err := c.HeaderByNumber(ctx, nil)
+	if err != nil {
+		res.add("geth-head", fmt.Errorf("can not get block; %v", err))
+		return res
+	}
+	res.Head = header.Number.Uint64()
+	if age := time.Since(upstreampool.BlockTime(header.Time, blockUnit)); age >= healthyDuration {
+		res.add("geth-head", fmt.Errorf("last block too old (%s)", age.Truncate(time.Second)))
+	} else {
+		res.add("geth-head", nil)
+	}
+
+	progress, err := c.SyncProgress(ctx)
+	if err != nil {
+		res.add("geth-syncing", err)
+	} else if progress != nil {
+		res.add("geth-syncing", fmt.Errorf("syncing %d/%d", progress.CurrentBlock, progress.HighestBlock))
+	} else {
+		res.add("geth-syncing", nil)
+	}
+	return res
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"net/http"
+)
+
+// clientKey returns the identity of the client that sent the request,
+// authenticated tenant, or client ip
+func clientKey(r *http.Request) string {
+	if t := getAuthTenant(r.Context()); t != nil && t.Tenant != "" {
+		return "tenant:" + t.Tenant
+	}
+	if ip := clientIP(r); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clientConcurrencyLimit caps in-flight requests per client (tenant or ip),
+// extra requests are rejected instead of queued, so one client can not hold all upstream connections
+type clientConcurrencyLimit struct {
+	Max int
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// ServeHandler implements middleware interface
+func (m *clientConcurrencyLimit) ServeHandler(h http.Handler) http.Handler {
+	m.inFlight = make(map[string]int)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := clientKey(r)
+
+		if !m.acquire(key) {
+			by := "ip"
+			if strings.HasPrefix(key, "tenant:") {
+				by = "tenant"
+			}
+			promClientConcurrencyRejected(by)
+			writeRateLimitError(w, r, fmt.Sprintf("concurrent requests limit %d exceeded", m.Max), rateLimitInfo{
+				Limit:      m.Max,
+				RetryAfter: 1,
+			})
+			return
+		}
+		defer m.release(key)
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (m *clientConcurrencyLimit) acquire(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.inFlight[key] >= m.Max {
+		return false
+	}
+	m.inFlight[key]++
+	return true
+}
+
+func (m *clientConcurrencyLimit) release(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlight[key]--
+	if m.inFlight[key] <= 0 {
+		delete(m.inFlight, key)
+	}
+}
+
+var clientConcurrencyRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "client_concurrency_rejected",
+}, []string{"by"})
+
+func promClientConcurrencyRejected(by string) {
+	c, err := clientConcurrencyRejected.GetMetricWith(prometheus.Labels{"by": by})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// compressTransport requests compressed response from upstream,
+// then decodes the response if the client does not accept the encoding.
+//
+// Encodings that proxy can not decode will request from upstream
+// only when client also accepts it.
+type compressTransport struct {
+	http.RoundTripper
+	Encodings []string // encodings in preferred order
+}
+
+// RoundTrip implements http.RoundTripper
+func (t compressTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if len(t.Encodings) == 0 || r.Header.Get("Upgrade") != "" {
+		return t.RoundTripper.RoundTrip(r)
+	}
+
+	accept := r.Header.Get("Accept-Encoding")
+	var encodings []string
+	for _, x := range t.Encodings {
+		if canDecode(x) || acceptEncoding(accept, x) {
+			encodings = append(encodings, x)
+		}
+	}
+	if len(encodings) == 0 {
+		return t.RoundTripper.RoundTrip(r)
+	}
+	r.Header.Set("Accept-Encoding", strings.Join(encodings, ", "))
+
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" {
+		return resp, nil
+	}
+	if acceptEncoding(accept, encoding) {
+		if canDecode(encoding) {
+			resp.Body = newMeasureReader(encoding, resp.Body)
+		}
+		return resp, nil
+	}
+
+	body, err := newDecodeReader(encoding, resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if body == nil {
+		// unknown encoding, let client deal with it
+		return resp, nil
+	}
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+func acceptEncoding(accept, encoding string) bool {
+	for _, x := range strings.Split(accept, ",") {
+		x = strings.TrimSpace(x)
+		if i := strings.Index(x, ";"); i >= 0 {
+			x = strings.TrimSpace(x[:i])
+		}
+		if strings.EqualFold(x, encoding) || x == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+type decodeReader struct {
+	encoding string
+	wire     *countReader
+	r        io.ReadCloser
+	decoded  int64
+}
+
+func newDecodeReader(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	if !canDecode(encoding) {
+		return nil, nil
+	}
+
+	d := decodeReader{
+		encoding: encoding,
+		wire:     &countReader{ReadCloser: body},
+	}
+	r, err := newDecoder(encoding, d.wire)
+	if err != nil {
+		return nil, err
+	}
+	d.r = r
+	return &d, nil
+}
+
+// newDecoder creates decoder for encoding, encoding must be decodable
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, nil
+}
+
+func canDecode(encoding string) bool {
+	return encoding == "gzip" || encoding == "zstd"
+}
+
+func (d *decodeReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.decoded += int64(n)
+	return n, err
+}
+
+func (d *decodeReader) Close() error {
+	d.r.Close()
+	if saved := d.decoded - d.wire.n; saved > 0 {
+		promUpstreamCompressionSaved(d.encoding, saved)
+	}
+	return d.wire.Close()
+}
+
+// measureReader passes compressed body through to client,
+// and decodes a copy in background to measure saved bytes
+type measureReader struct {
+	io.ReadCloser
+	encoding string
+	wire     int64
+	pw       *io.PipeWriter
+	decoded  chan int64
+}
+
+func newMeasureReader(encoding string, body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	m := &measureReader{
+		ReadCloser: body,
+		encoding:   encoding,
+		pw:         pw,
+		decoded:    make(chan int64, 1),
+	}
+	go func() {
+		var n int64
+		if r, err := newDecoder(encoding, pr); err == nil {
+			n, _ = io.Copy(io.Discard, r)
+			r.Close()
+		}
+		// drain on decode error, so Read never blocks
+		io.Copy(io.Discard, pr)
+		m.decoded <- n
+	}()
+	return m
+}
+
+func (m *measureReader) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	if n > 0 {
+		m.wire += int64(n)
+		m.pw.Write(p[:n])
+	}
+	return n, err
+}
+
+func (m *measureReader) Close() error {
+	m.pw.Close()
+	if saved := <-m.decoded - m.wire; saved > 0 {
+		promUpstreamCompressionSaved(m.encoding, saved)
+	}
+	return m.ReadCloser.Close()
+}
+
+type countReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+var upstreamCompressionSaved = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "upstream_compression_saved_bytes",
+}, []string{"encoding"})
+
+func promUpstreamCompressionSaved(encoding string, n int64) {
+	c, err := upstreamCompressionSaved.GetMetricWith(prometheus.Labels{
+		"encoding": encoding,
+	})
+	if err != nil {
+		return
+	}
+	c.Add(float64(n))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix is environment variable prefix, ex. GETH_PROXY_GETH_ADDR for -geth.addr
+const envPrefix = "GETH_PROXY_"
+
+// repeatableFlag is flag that can be set multiple times,
+// its environment variable is space separated values
+type repeatableFlag interface {
+	Repeatable()
+}
+
+// Repeatable implements repeatableFlag
+func (f *listenFlag) Repeatable() {}
+
+// flagEnvName returns environment variable name for flag
+func flagEnvName(name string) string {
+	name = strings.ToUpper(name)
+	name = strings.NewReplacer(".", "_", "-", "_").Replace(name)
+	return envPrefix + name
+}
+
+// loadConfig sets flags that are not set on command line from environment variables, then config file,
+// precedence is flag > env > config file
+func loadConfig(fs *flag.FlagSet, configFlag string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if !set[configFlag] {
+		if v, ok := os.LookupEnv(flagEnvName(configFlag)); ok {
+			fs.Set(configFlag, v)
+		}
+	}
+	configFile := fs.Lookup(configFlag).Value.String()
+	var config map[string][]string
+	if configFile != "" {
+		var err error
+		config, err = readConfigFile(fs, configFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || f.Name == configFlag {
+			return
+		}
+
+		var values []string
+		if v, ok := os.LookupEnv(flagEnvName(f.Name)); ok {
+			values = []string{v}
+			if _, ok := f.Value.(repeatableFlag); ok {
+				values = strings.Fields(v)
+			}
+		} else if vs, ok := config[f.Name]; ok {
+			values = vs
+		} else {
+			return
+		}
+		for _, v := range values {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid value %q for %s; %w", v, f.Name, e)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// readConfigFile reads config file, one name=value per line,
+// name is flag name without dash, repeatable flag can be set in multiple lines,
+// empty lines and lines start with # are ignored
+func readConfigFile(fs *flag.FlagSet, fn string) (map[string][]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rs := make(map[string][]string)
+	sc := bufio.NewScanner(f)
+	for i := 1; sc.Scan(); i++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, "=") {
+			return nil, fmt.Errorf("%s:%d: required name=value", fn, i)
+		}
+		name, value := splitKeyValue(line)
+		name = strings.TrimLeft(name, "-")
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown flag %s", fn, i, name)
+		}
+		rs[name] = append(rs[name], value)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// consistencyChecker periodically sends the same deterministic read calls to all upstreams,
+// and the reference rpc if any, upstreams that result hash is different from majority are reported,
+// ex. corrupted or mis-synced node
+type consistencyChecker struct {
+	Pool      *upstreamPool
+	Reference *rpc.Client   // optional, ex. external provider
+	Depth     uint64        // blocks behind the lowest head, to avoid reorg
+	Interval  time.Duration // check interval
+	Timeout   time.Duration // per call timeout
+}
+
+// consistencyReference is the upstream label of reference rpc
+const consistencyReference = "reference"
+
+type consistencyTarget struct {
+	Name string
+	RPC  *rpc.Client
+}
+
+// Start starts checking loop
+func (m *consistencyChecker) Start() {
+	go func() {
+		for {
+			time.Sleep(m.Interval)
+			m.check()
+		}
+	}()
+}
+
+func (m *consistencyChecker) check() {
+	upstreams := m.Pool.Healthy()
+
+	var minHead uint64
+	var targets []consistencyTarget
+	for _, u := range upstreams {
+		h := u.Head()
+		if h == nil {
+			continue
+		}
+		if n := h.Number.Uint64(); minHead == 0 || n < minHead {
+			minHead = n
+		}
+		targets = append(targets, consistencyTarget{Name: u.Addr, RPC: u.RPC})
+	}
+	if m.Reference != nil {
+		targets = append(targets, consistencyTarget{Name: consistencyReference, RPC: m.Reference})
+	}
+	if len(targets) < 2 || minHead <= m.Depth {
+		return
+	}
+	block := hexutil.EncodeUint64(minHead - m.Depth)
+
+	results := m.compare(targets, "eth_getBlockByNumber", block, false)
+
+	// state check on fee recipient of the same block
+	var header struct {
+		Miner string `json:"miner"`
+	}
+	for _, t := range targets {
+		if b := results[t.Name]; b != nil && json.Unmarshal(b, &header) == nil && header.Miner != "" {
+			break
+		}
+	}
+	if header.Miner != "" {
+		m.compare(targets, "eth_getBalance", header.Miner, block)
+	}
+}
+
+// compare calls method on all targets and reports targets that result is different from majority,
+// returns result by target name
+func (m *consistencyChecker) compare(targets []consistencyTarget, method string, args ...interface{}) map[string]json.RawMessage {
+	type result struct {
+		Name   string
+		Result json.RawMessage
+		Err    error
+	}
+	ch := make(chan result, len(targets))
+	for _, t := range targets {
+		go func(t consistencyTarget) {
+			ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+			defer cancel()
+
+			var r json.RawMessage
+			err := t.RPC.CallContext(ctx, &r, method, args...)
+			ch <- result{Name: t.Name, Result: r, Err: err}
+		}(t)
+	}
+
+	results := make(map[string]json.RawMessage, len(targets))
+	hashes := make(map[string]string, len(targets))
+	count := make(map[string]int)
+	for range targets {
+		r := <-ch
+		if r.Err != nil {
+			log.Printf("consistency: %s failed; upstream=%s, %v", method, r.Name, r.Err)
+			promConsistencyCheck(m.Pool.Chain, r.Name, "error")
+			continue
+		}
+		sum := sha256.Sum256(r.Result)
+		h := hex.EncodeToString(sum[:8])
+		results[r.Name] = r.Result
+		hashes[r.Name] = h
+		count[h]++
+	}
+
+	// majority wins, reference wins ties,
+	// all targets mismatch when there is no winner, ex. two upstreams without reference
+	var expected string
+	var max int
+	for h, n := range count {
+		switch {
+		case n > max:
+			expected, max = h, n
+		case n == max && h == hashes[consistencyReference]:
+			expected = h
+		case n == max && expected != hashes[consistencyReference]:
+			expected = ""
+		}
+	}
+	for _, t := range targets {
+		h, ok := hashes[t.Name]
+		if !ok {
+			continue
+		}
+		if h != expected {
+			log.Printf("consistency: %s mismatch; upstream=%s, params=%v, hash=%s, expected=%s", method, t.Name, args, h, expected)
+			promConsistencyCheck(m.Pool.Chain, t.Name, "mismatch")
+			continue
+		}
+		promConsistencyCheck(m.Pool.Chain, t.Name, "match")
+	}
+	return results
+}
+
+var consistencyChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "consistency_checks",
+}, []string{"chain", "upstream", "result"})
+
+func promConsistencyCheck(chain, upstream, result string) {
+	c, err := consistencyChecks.GetMetricWith(prometheus.Labels{"chain": chain, "upstream": upstream, "result": result})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// upstreamDiscovery discovers upstreams into pool
+type upstreamDiscovery interface {
+	// Source returns discovery source name
+	Source() string
+
+	// Host returns host name that resolves to any upstream
+	Host() string
+
+	// Sync syncs upstreams into pool
+	Sync(ctx context.Context) error
+
+	// Start starts watching for upstream changes
+	Start()
+}
+
+// parseDiscovery parses geth address entry,
+// "dns+name" resolves A/AAAA records, "dnssrv+name" resolves SRV record targets,
+// "k8s+namespace/service" watches kubernetes service's endpoints
+func parseDiscovery(addr, httpPort string, interval time.Duration) (upstreamDiscovery, bool) {
+	switch {
+	case strings.HasPrefix(addr, "dns+"):
+		return &dnsDiscovery{
+			Name:     strings.TrimPrefix(addr, "dns+"),
+			HTTPPort: httpPort,
+			Interval: interval,
+		}, true
+	case strings.HasPrefix(addr, "dnssrv+"):
+		return &dnsDiscovery{
+			Name:     strings.TrimPrefix(addr, "dnssrv+"),
+			SRV:      true,
+			HTTPPort: httpPort,
+			Interval: interval,
+		}, true
+	case strings.HasPrefix(addr, "k8s+"):
+		return newK8sDiscovery(strings.TrimPrefix(addr, "k8s+"), httpPort), true
+	}
+	return nil, false
+}
+
+// syncUpstreams adds new and removes gone upstreams of the source
+func syncUpstreams(source, httpPort string, addrs []string) {
+	if len(addrs) == 0 {
+		// keep last known upstreams, proxy can not serve without upstream
+		log.Printf("discovery: %s has no address", source)
+		return
+	}
+	sort.Strings(addrs)
+
+	found := make(map[string]bool)
+	for _, addr := range addrs {
+		found[addr] = true
+	}
+
+	current := make(map[string]bool)
+	for _, u := range pool.List() {
+		if u.Source != source {
+			continue
+		}
+		current[u.Addr] = true
+		if !found[u.Addr] {
+			log.Printf("discovery: remove upstream %s", u.Addr)
+			pool.Remove(u)
+		}
+	}
+	for _, addr := range addrs {
+		if current[addr] {
+			continue
+		}
+		u, err := newGethUpstream(pool.Chain, addr, httpPort)
+		if err != nil {
+			log.Printf("discovery: can not dial %s; %v", addr, err)
+			continue
+		}
+		u.Source = source
+		log.Printf("discovery: add upstream %s", addr)
+		pool.Add(u)
+	}
+}
+
+// dnsDiscovery periodically resolves dns name into pool's upstreams
+type dnsDiscovery struct {
+	Name     string // dns name, A/AAAA records or SRV record
+	SRV      bool
+	HTTPPort string
+	Interval time.Duration
+}
+
+// Source returns discovery source name
+func (d *dnsDiscovery) Source() string {
+	if d.SRV {
+		return "dnssrv+" + d.Name
+	}
+	return "dns+" + d.Name
+}
+
+// Host returns host name that resolves to any upstream,
+// SRV record "_service._proto.name" resolves by "name"
+func (d *dnsDiscovery) Host() string {
+	if !d.SRV {
+		return d.Name
+	}
+	parts := strings.SplitN(d.Name, ".", 3)
+	if len(parts) == 3 && strings.HasPrefix(parts[0], "_") && strings.HasPrefix(parts[1], "_") {
+		return parts[2]
+	}
+	return d.Name
+}
+
+func (d *dnsDiscovery) resolve(ctx context.Context) ([]string, error) {
+	if !d.SRV {
+		return net.DefaultResolver.LookupHost(ctx, d.Name)
+	}
+
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, err
+	}
+	var rs []string
+	for _, srv := range srvs {
+		// upstream ports are configured by flags, use only target
+		addrs, err := net.DefaultResolver.LookupHost(ctx, strings.TrimSuffix(srv.Target, "."))
+		if err != nil {
+			log.Printf("discovery: can not resolve %s; %v", srv.Target, err)
+			continue
+		}
+		rs = append(rs, addrs...)
+	}
+	return rs, nil
+}
+
+// Sync resolves dns name then adds new and removes gone upstreams
+func (d *dnsDiscovery) Sync(ctx context.Context) error {
+	addrs, err := d.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	syncUpstreams(d.Source(), d.HTTPPort, addrs)
+	return nil
+}
+
+// Start starts re-resolving loop
+func (d *dnsDiscovery) Start() {
+	go func() {
+		for {
+			time.Sleep(d.Interval)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := d.Sync(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("discovery: can not resolve %s; %v", d.Name, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/prom"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// exemplarsEnabled attaches trace id exemplars to latency observations,
+// histograms keep classic buckets, client_golang v1.8.0 has no native histograms
+var exemplarsEnabled bool
+
+// traceID returns trace id from w3c traceparent or google cloud trace header, empty if not traced
+func traceID(h http.Header) string {
+	if x := h.Get("Traceparent"); x != "" {
+		// version-traceid-spanid-flags
+		xs := strings.Split(x, "-")
+		if len(xs) == 4 && validTraceID(xs[1]) {
+			return xs[1]
+		}
+	}
+	if x := h.Get("X-Cloud-Trace-Context"); x != "" {
+		// traceid/spanid;o=1
+		if i := strings.IndexByte(x, '/'); i >= 0 {
+			x = x[:i]
+		}
+		if validTraceID(x) {
+			return strings.ToLower(x)
+		}
+	}
+	return ""
+}
+
+func validTraceID(x string) bool {
+	if len(x) != 32 || x == strings.Repeat("0", 32) {
+		return false
+	}
+	_, err := hex.DecodeString(x)
+	return err == nil
+}
+
+// observeDuration observes duration in seconds, with request's trace id as exemplar when enabled
+func observeDuration(o prometheus.Observer, d time.Duration, h http.Header) {
+	v := float64(d) / float64(time.Second)
+	if exemplarsEnabled {
+		if id := traceID(h); id != "" {
+			if e, ok := o.(prometheus.ExemplarObserver); ok {
+				e.ObserveWithExemplar(v, prometheus.Labels{"trace_id": id})
+				return
+			}
+		}
+	}
+	o.Observe(v)
+}
+
+// metricsHandler returns proxy's metrics handler,
+// exemplars are exposed only in openmetrics format
+func metricsHandler() http.Handler {
+	if !exemplarsEnabled {
+		return prom.Handler()
+	}
+	reg := prom.Registry()
+	return promhttp.InstrumentMetricHandler(
+		reg,
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+			DisableCompression: true,
+			EnableOpenMetrics:  true,
+		}),
+	)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/upstream"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fallbackTransport forwards requests to external rpc provider
+// when no upstream in pool is healthy
+type fallbackTransport struct {
+	http.RoundTripper // local upstream transport
+	Pool              *upstreamPool
+	URL               *url.URL
+	Header            http.Header // ex. provider's auth header
+
+	transport http.RoundTripper
+	active    uint32
+}
+
+func newFallbackTransport(next http.RoundTripper, p *upstreamPool, rawURL string, header http.Header, timeout time.Duration) (*fallbackTransport, error) {
+	u, err := parseRPCURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	t := &fallbackTransport{
+		RoundTripper: next,
+		Pool:         p,
+		URL:          u,
+		Header:       header,
+	}
+	if u.Scheme == "https" {
+		t.transport = &upstream.HTTPSTransport{ResponseHeaderTimeout: timeout}
+	} else {
+		t.transport = &upstream.HTTPTransport{ResponseHeaderTimeout: timeout}
+	}
+	return t, nil
+}
+
+// parseRPCURL parses external rpc url
+func parseRPCURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("rpc url must be http or https url")
+	}
+	return u, nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *fallbackTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.localHealthy() {
+		if atomic.CompareAndSwapUint32(&t.active, 1, 0) {
+			log.Printf("fallback: geth is healthy, stopped forwarding to %s", t.URL.Host)
+		}
+		return t.RoundTripper.RoundTrip(r)
+	}
+	if atomic.CompareAndSwapUint32(&t.active, 0, 1) {
+		log.Printf("fallback: no healthy geth, forwarding to %s", t.URL.Host)
+	}
+
+	r.URL.Host = t.URL.Host
+	r.URL.Path = t.URL.Path
+	r.URL.RawPath = t.URL.RawPath
+	r.URL.RawQuery = t.URL.RawQuery
+	r.Host = t.URL.Host
+
+	// client credentials are not for provider
+	r.Header.Del("Authorization")
+	r.Header.Del("Cookie")
+	for k, vs := range t.Header {
+		r.Header[k] = vs
+	}
+
+	resp, err := t.transport.RoundTrip(r)
+	result := "success"
+	if err != nil || resp.StatusCode >= 500 {
+		result = "error"
+	}
+	promFallbackRequest(result)
+	return resp, err
+}
+
+func (t *fallbackTransport) localHealthy() bool {
+	for _, u := range t.Pool.Enabled() {
+		if u.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+var fallbackRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "fallback_requests",
+}, []string{"result"})
+
+func promFallbackRequest(result string) {
+	c, err := fallbackRequests.GetMetricWith(prometheus.Labels{"result": result})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
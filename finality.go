@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// finalityTags are tracked block tags besides latest
+var finalityTags = []string{"safe", "finalized"}
+
+var finalityState struct {
+	mu         sync.RWMutex
+	Heads      map[string]*types.Header // tag => header
+	AdvancedAt time.Time                // last time finalized head advanced
+}
+
+// finalizedWindow is max duration that finalized head must advance within, 0 = not check
+var finalizedWindow time.Duration
+
+func getTagHead(tag string) *types.Header {
+	finalityState.mu.RLock()
+	defer finalityState.mu.RUnlock()
+	return finalityState.Heads[tag]
+}
+
+func updateFinality(ctx context.Context) {
+	latest, _ := getLastBlock(ctx)
+
+	heads := make(map[string]*types.Header)
+	for _, tag := range finalityTags {
+		var head *types.Header
+		err := rpcClient.CallContext(ctx, &head, "eth_getBlockByNumber", tag, false)
+		if err != nil || head == nil {
+			continue
+		}
+		heads[tag] = head
+	}
+
+	finalityState.mu.Lock()
+	if h := heads["finalized"]; h != nil {
+		prev := finalityState.Heads["finalized"]
+		if prev == nil || h.Number.Cmp(prev.Number) > 0 {
+			finalityState.AdvancedAt = time.Now()
+		}
+	}
+	for tag, h := range heads {
+		if finalityState.Heads == nil {
+			finalityState.Heads = make(map[string]*types.Header)
+		}
+		finalityState.Heads[tag] = h
+	}
+	finalityState.mu.Unlock()
+
+	if latest != nil {
+		promSetHead("latest", latest.NumberU64(), 0)
+	}
+	for tag, h := range heads {
+		var lag uint64
+		if latest != nil && latest.NumberU64() > h.Number.Uint64() {
+			lag = latest.NumberU64() - h.Number.Uint64()
+		}
+		promSetHead(tag, h.Number.Uint64(), lag)
+	}
+}
+
+func startFinalityTracker() {
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+			updateFinality(ctx)
+			cancel()
+
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+func checkGethFinalized(ctx context.Context) error {
+	finalityState.mu.RLock()
+	head, advancedAt := finalityState.Heads["finalized"], finalityState.AdvancedAt
+	finalityState.mu.RUnlock()
+
+	if head == nil {
+		return errors.New("can not get finalized block")
+	}
+	if d := time.Since(advancedAt); d > finalizedWindow {
+		return fmt.Errorf("finalized block %d not advanced for %s", head.Number.Uint64(), d.Truncate(time.Second))
+	}
+	return nil
+}
+
+var (
+	tagHead = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "head",
+	}, []string{"tag"})
+
+	tagHeadLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "head_lag",
+	}, []string{"tag"})
+)
+
+func promSetHead(tag string, number, lag uint64) {
+	if g, err := tagHead.GetMetricWith(prometheus.Labels{"tag": tag}); err == nil {
+		g.Set(float64(number))
+	}
+	if g, err := tagHeadLag.GetMetricWith(prometheus.Labels{"tag": tag}); err == nil {
+		g.Set(float64(lag))
+	}
+}
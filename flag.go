@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDurationMap parses comma separated key=duration list
+func parseDurationMap(s string) (map[string]time.Duration, error) {
+	rs := make(map[string]time.Duration)
+	for _, x := range parseList(s) {
+		k, v := splitKeyValue(x)
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for %s; %w", k, err)
+		}
+		rs[k] = d
+	}
+	return rs, nil
+}
+
+// parseSet parses comma separated list into set
+func parseSet(s string) map[string]bool {
+	rs := make(map[string]bool)
+	for _, x := range parseList(s) {
+		rs[x] = true
+	}
+	return rs
+}
+
+// parseList parses comma separated list
+func parseList(s string) []string {
+	var rs []string
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if x != "" {
+			rs = append(rs, x)
+		}
+	}
+	return rs
+}
+
+func splitKeyValue(s string) (key, value string) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return s, ""
+	}
+	return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+}
+
+// parseCredential parses username:password
+func parseCredential(s string) (username, password string) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+// parseHeader parses comma separated Key=Value list into http header
+func parseHeader(s string) http.Header {
+	h := make(http.Header)
+	for _, x := range parseList(s) {
+		k, v := splitKeyValue(x)
+		h.Add(k, v)
+	}
+	return h
+}
+
+// parseMap parses comma separated key=value list
+func parseMap(s string) map[string]string {
+	rs := make(map[string]string)
+	for _, x := range parseList(s) {
+		k, v := splitKeyValue(x)
+		rs[k] = v
+	}
+	return rs
+}
+
+// parseFloatList parses comma separated number list
+func parseFloatList(s string) ([]float64, error) {
+	var rs []float64
+	for _, x := range parseList(s) {
+		f, err := strconv.ParseFloat(x, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", x)
+		}
+		rs = append(rs, f)
+	}
+	return rs, nil
+}
+
+// parseWeights parses comma separated addr=weight list
+func parseWeights(s string) (map[string]int, error) {
+	rs := make(map[string]int)
+	for k, v := range parseMap(s) {
+		w, err := strconv.Atoi(v)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %s=%s", k, v)
+		}
+		rs[k] = w
+	}
+	return rs, nil
+}
+
+// stringsFlag is repeatable string flag
+type stringsFlag []string
+
+func newStringsFlag(name, usage string) *stringsFlag {
+	f := &stringsFlag{}
+	flag.Var(f, name, usage)
+	return f
+}
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+// Set implements flag.Value
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// Repeatable implements repeatableFlag
+func (f *stringsFlag) Repeatable() {}
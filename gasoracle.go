@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gasEstimate is the gas oracle response, amounts are in wei
+type gasEstimate struct {
+	Block        uint64            `json:"block"`
+	BaseFee      string            `json:"baseFee"`
+	NextBaseFee  string            `json:"nextBaseFee"`
+	PriorityFee  map[string]string `json:"priorityFee"` // percentile => fee
+	MaxFee       map[string]string `json:"maxFee"`      // percentile => 2 * next base fee + priority fee
+	GasUsedRatio float64           `json:"gasUsedRatio"`
+	UpdatedAt    time.Time         `json:"updatedAt"`
+}
+
+// gasOracle polls eth_feeHistory, and serves gas estimate
+//
+//	GET /gas
+type gasOracle struct {
+	Interval    time.Duration
+	Blocks      int       // blocks of fee history
+	Percentiles []float64 // reward percentiles
+
+	mu       sync.RWMutex
+	estimate *gasEstimate
+}
+
+// Start starts polling
+func (m *gasOracle) Start() {
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			m.poll(ctx)
+			cancel()
+
+			time.Sleep(m.Interval)
+		}
+	}()
+}
+
+func (m *gasOracle) poll(ctx context.Context) {
+	var history struct {
+		OldestBlock   hexutil.Uint64   `json:"oldestBlock"`
+		BaseFeePerGas []*hexutil.Big   `json:"baseFeePerGas"`
+		GasUsedRatio  []float64        `json:"gasUsedRatio"`
+		Reward        [][]*hexutil.Big `json:"reward"`
+	}
+	err := rpcClient.CallContext(ctx, &history, "eth_feeHistory", hexutil.Uint(m.Blocks), "latest", m.Percentiles)
+	if err != nil || len(history.BaseFeePerGas) < 2 || len(history.GasUsedRatio) == 0 {
+		return
+	}
+
+	// base fee has one more entry for the next block
+	n := len(history.BaseFeePerGas)
+	baseFee := history.BaseFeePerGas[n-2].ToInt()
+	nextBaseFee := history.BaseFeePerGas[n-1].ToInt()
+
+	est := &gasEstimate{
+		Block:       uint64(history.OldestBlock) + uint64(len(history.GasUsedRatio)) - 1,
+		BaseFee:     baseFee.String(),
+		NextBaseFee: nextBaseFee.String(),
+		PriorityFee: make(map[string]string),
+		MaxFee:      make(map[string]string),
+		UpdatedAt:   time.Now(),
+	}
+	for _, x := range history.GasUsedRatio {
+		est.GasUsedRatio += x
+	}
+	est.GasUsedRatio /= float64(len(history.GasUsedRatio))
+
+	for i, p := range m.Percentiles {
+		// median of the percentile reward across blocks, not skewed by a single block
+		var rewards []*big.Int
+		for _, rs := range history.Reward {
+			if i < len(rs) && rs[i] != nil {
+				rewards = append(rewards, rs[i].ToInt())
+			}
+		}
+		if len(rewards) == 0 {
+			continue
+		}
+		sort.Slice(rewards, func(a, b int) bool { return rewards[a].Cmp(rewards[b]) < 0 })
+		tip := rewards[len(rewards)/2]
+		maxFee := new(big.Int).Add(new(big.Int).Mul(nextBaseFee, big.NewInt(2)), tip)
+
+		key := "p" + strconv.FormatFloat(p, 'f', -1, 64)
+		est.PriorityFee[key] = tip.String()
+		est.MaxFee[key] = maxFee.String()
+		if g, err := gasPriorityFee.GetMetricWith(prometheus.Labels{"percentile": key}); err == nil {
+			g.Set(weiToGwei(tip))
+		}
+	}
+	gasBaseFee.Set(weiToGwei(nextBaseFee))
+
+	m.mu.Lock()
+	m.estimate = est
+	m.mu.Unlock()
+}
+
+func (m *gasOracle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m.mu.RLock()
+	est := m.estimate
+	m.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if est == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(blockAPIError{"gas estimate not available"})
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(m.Interval/time.Second)))
+	json.NewEncoder(w).Encode(est)
+}
+
+func weiToGwei(x *big.Int) float64 {
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(x), big.NewFloat(1e9)).Float64()
+	return f
+}
+
+var (
+	gasBaseFee = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "gas_next_base_fee_gwei",
+	})
+
+	gasPriorityFee = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "gas_priority_fee_gwei",
+	}, []string{"percentile"})
+)
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// gethMetricsAggregator scrapes metrics from all geth upstreams,
+// then merges them with upstream label.
+// Single upstream is served by Single handler to keep original exposition.
+type gethMetricsAggregator struct {
+	Port    string
+	Path    string
+	Timeout time.Duration
+	Single  http.Handler
+
+	client http.Client
+}
+
+func (m *gethMetricsAggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upstreams := pool.List()
+	if len(upstreams) == 1 {
+		m.Single.ServeHTTP(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), m.Timeout)
+	defer cancel()
+
+	results := make([]map[string]*dto.MetricFamily, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		i, u := i, u
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			mfs, err := m.scrape(ctx, u.Addr)
+			if err != nil {
+				log.Printf("geth metrics: scrape %s error; %v", u.Addr, err)
+				return
+			}
+			results[i] = mfs
+		}()
+	}
+	wg.Wait()
+
+	merged := make(map[string]*dto.MetricFamily)
+	for i, mfs := range results {
+		for name, mf := range mfs {
+			for _, x := range mf.Metric {
+				x.Label = append(x.Label, &dto.LabelPair{
+					Name:  proto.String("upstream"),
+					Value: proto.String(upstreams[i].Addr),
+				})
+			}
+
+			if p, ok := merged[name]; ok {
+				if p.GetType() == mf.GetType() {
+					p.Metric = append(p.Metric, mf.Metric...)
+				}
+				continue
+			}
+			merged[name] = mf
+		}
+	}
+	if len(merged) == 0 {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, name := range names {
+		enc.Encode(merged[name])
+	}
+}
+
+func (m *gethMetricsAggregator) scrape(ctx context.Context, addr string) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gethURL(addr, m.Port)+m.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var p expfmt.TextParser
+	return p.TextToMetricFamilies(resp.Body)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// getLogsGuard rejects or clamps expensive eth_getLogs queries
+type getLogsGuard struct {
+	MaxRange      uint64    // max block range, 0 = unlimited
+	Clamp         bool      // clamp toBlock instead of reject
+	RequireFilter bool      // require address or topics filter
+	Head          blockHead // resolves block tags, nil = default chain's head
+}
+
+// ServeHandler implements middleware interface
+func (m getLogsGuard) ServeHandler(h http.Handler) http.Handler {
+	return interceptRPC(m.intercept).ServeHandler(h)
+}
+
+func (m getLogsGuard) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	if req.Method != "eth_getLogs" {
+		return nil
+	}
+
+	var params []map[string]json.RawMessage
+	if json.Unmarshal(req.Params, &params) != nil || len(params) == 0 || params[0] == nil {
+		// let upstream returns error
+		return nil
+	}
+	filter := params[0]
+
+	if m.RequireFilter && !hasLogFilter(filter) {
+		promGetLogsGuard("filter")
+		return newRPCError(req, rpcCodeInvalidParams, "eth_getLogs requires address or topics filter")
+	}
+
+	if m.MaxRange == 0 {
+		return nil
+	}
+	if _, ok := filter["blockHash"]; ok {
+		// single block
+		return nil
+	}
+
+	ctx := r.Context()
+	from, to, resp := m.Head.logsRange(ctx, req, filter)
+	if resp != nil {
+		promGetLogsGuard("unresolved")
+		return resp
+	}
+	if to < from {
+		return nil
+	}
+
+	n := to - from + 1
+	if n <= m.MaxRange {
+		return nil
+	}
+
+	if m.Clamp {
+		filter["toBlock"], _ = json.Marshal(hexutil.Uint64(from + m.MaxRange - 1))
+		req.Params, _ = json.Marshal(params)
+		getRPCCall(ctx).Dirty = true
+		promGetLogsGuard("clamp")
+		return nil
+	}
+
+	promGetLogsGuard("range")
+	resp = newRPCError(req, rpcCodeLimitExceeded, fmt.Sprintf("eth_getLogs block range %d exceeds limit %d", n, m.MaxRange))
+	resp.Error.Data = map[string]interface{}{
+		"maxRange": m.MaxRange,
+	}
+	return resp
+}
+
+func hasLogFilter(filter map[string]json.RawMessage) bool {
+	var address interface{}
+	json.Unmarshal(filter["address"], &address)
+	switch x := address.(type) {
+	case string:
+		if x != "" {
+			return true
+		}
+	case []interface{}:
+		if len(x) > 0 {
+			return true
+		}
+	}
+
+	var topics []interface{}
+	json.Unmarshal(filter["topics"], &topics)
+	for _, t := range topics {
+		if t != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// blockHead returns chain's head block number
+type blockHead func(ctx context.Context) (uint64, error)
+
+// lastBlockNumber returns default chain's head block number
+func lastBlockNumber(ctx context.Context) (uint64, error) {
+	// last known head is returned with refresh error, it is still good enough to bound the range
+	block, err := getLastBlock(ctx)
+	if block == nil {
+		if err == nil {
+			err = errNoHead
+		}
+		return 0, err
+	}
+	return block.NumberU64(), nil
+}
+
+// poolHead returns head of the pool's healthy upstreams
+func poolHead(p *upstreamPool) blockHead {
+	return func(ctx context.Context) (uint64, error) {
+		h := p.Head()
+		if h == nil {
+			return 0, errNoHead
+		}
+		return h.Number.Uint64(), nil
+	}
+}
+
+var (
+	errNoHead             = errors.New("head block unavailable")
+	errInvalidBlockNumber = errors.New("invalid block number")
+)
+
+// resolve resolves block number or tag to block number,
+// empty value resolves to latest block
+func (head blockHead) resolve(ctx context.Context, raw json.RawMessage) (uint64, error) {
+	var s string
+	if len(raw) > 0 && string(raw) != "null" {
+		err := json.Unmarshal(raw, &s)
+		if err != nil {
+			return 0, errInvalidBlockNumber
+		}
+	}
+
+	switch s {
+	case "earliest":
+		return 0, nil
+	case "", "latest", "pending", "safe", "finalized":
+		if head == nil {
+			return lastBlockNumber(ctx)
+		}
+		return head(ctx)
+	}
+	n, err := hexutil.DecodeUint64(s)
+	if err != nil {
+		return 0, errInvalidBlockNumber
+	}
+	return n, nil
+}
+
+// logsRange resolves filter's block range, or returns error response when the range can not be resolved,
+// unresolved range is rejected instead of forwarded, so it can not bypass range limits
+func (head blockHead) logsRange(ctx context.Context, req *rpcRequest, filter map[string]json.RawMessage) (from, to uint64, resp *rpcResponse) {
+	from, err := head.resolve(ctx, filter["fromBlock"])
+	if err == nil {
+		to, err = head.resolve(ctx, filter["toBlock"])
+	}
+	switch {
+	case err == errInvalidBlockNumber:
+		return 0, 0, newRPCError(req, rpcCodeInvalidParams, "eth_getLogs invalid block range")
+	case err != nil:
+		return 0, 0, newRPCError(req, rpcCodeServerError, "eth_getLogs block range can not be resolved, head block unavailable")
+	}
+	return from, to, nil
+}
+
+var getLogsGuardCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "getlogs_guard",
+}, []string{"action"})
+
+func promGetLogsGuard(action string) {
+	c, err := getLogsGuardCount.GetMetricWith(prometheus.Labels{
+		"action": action,
+	})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
+
+// getLogsSplitter splits large eth_getLogs range into sub-ranges,
+// forwards them to the next handler (limiter, routing, and upstream transport) then merges the results
+type getLogsSplitter struct {
+	Size        uint64    // sub-range size
+	Concurrency int       // max concurrent sub-range queries
+	MaxQueries  int       // max sub-range queries per request, larger range is rejected (0 = unlimited)
+	Head        blockHead // resolves block tags, nil = default chain's head
+}
+
+// ServeHandler implements middleware interface
+func (m getLogsSplitter) ServeHandler(h http.Handler) http.Handler {
+	if m.Concurrency <= 0 {
+		m.Concurrency = 1
+	}
+	return interceptRPC(func(r *http.Request, req *rpcRequest) *rpcResponse {
+		return m.intercept(h, r, req)
+	}).ServeHandler(h)
+}
+
+func (m getLogsSplitter) intercept(h http.Handler, r *http.Request, req *rpcRequest) *rpcResponse {
+	if req.Method != "eth_getLogs" {
+		return nil
+	}
+
+	var params []map[string]json.RawMessage
+	if json.Unmarshal(req.Params, &params) != nil || len(params) == 0 || params[0] == nil {
+		return nil
+	}
+	filter := params[0]
+	if _, ok := filter["blockHash"]; ok {
+		return nil
+	}
+
+	ctx := r.Context()
+	from, to, resp := m.Head.logsRange(ctx, req, filter)
+	if resp != nil {
+		promGetLogsGuard("unresolved")
+		return resp
+	}
+	if to < from || to-from+1 <= m.Size {
+		return nil
+	}
+	if m.MaxQueries > 0 && (to-from)/m.Size+1 > uint64(m.MaxQueries) {
+		promGetLogsGuard("split")
+		maxRange := m.Size * uint64(m.MaxQueries)
+		resp = newRPCError(req, rpcCodeLimitExceeded, fmt.Sprintf("eth_getLogs block range %d exceeds limit %d", to-from+1, maxRange))
+		resp.Error.Data = map[string]interface{}{
+			"maxRange": maxRange,
+		}
+		return resp
+	}
+
+	type chunk struct {
+		filter map[string]json.RawMessage
+		result []json.RawMessage
+	}
+
+	var chunks []*chunk
+	for start := from; start <= to; start += m.Size {
+		end := start + m.Size - 1
+		if end > to || end < start { // end < start when overflow
+			end = to
+		}
+
+		f := make(map[string]json.RawMessage, len(filter))
+		for k, v := range filter {
+			f[k] = v
+		}
+		f["fromBlock"], _ = json.Marshal(hexutil.Uint64(start))
+		f["toBlock"], _ = json.Marshal(hexutil.Uint64(end))
+		chunks = append(chunks, &chunk{filter: f})
+
+		if end == to {
+			break
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	// first failed sub-range, later failures may be caused by cancel
+	var (
+		mu     sync.Mutex
+		failed *rpcResponse
+	)
+	fail := func(resp *rpcResponse) {
+		mu.Lock()
+		if failed == nil {
+			failed = resp
+			cancel()
+		}
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, m.Concurrency)
+	for _, c := range chunks {
+		c := c
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if ctx.Err() != nil {
+				return
+			}
+			params, _ := json.Marshal([]interface{}{c.filter})
+			resp := forwardRPC(h, r, &rpcRequest{
+				JSONRPC: "2.0",
+				ID:      json.RawMessage("1"),
+				Method:  "eth_getLogs",
+				Params:  params,
+			})
+			if resp.Error != nil {
+				e := newRPCError(req, resp.Error.Code, resp.Error.Message)
+				e.Error.Data = resp.Error.Data
+				fail(e)
+				return
+			}
+			if err := json.Unmarshal(resp.Result, &c.result); err != nil {
+				fail(newRPCError(req, rpcCodeInternalError, "invalid eth_getLogs result from upstream"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed != nil {
+		return failed
+	}
+	var logs []json.RawMessage
+	for _, c := range chunks {
+		logs = append(logs, c.result...)
+	}
+	if logs == nil {
+		logs = []json.RawMessage{}
+	}
+	promGetLogsSplit(len(chunks))
+
+	result, _ := json.Marshal(logs)
+	return newRPCResult(req, result)
+}
+
+var getLogsSplitCount = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "getlogs_split_queries",
+})
+
+func promGetLogsSplit(n int) {
+	getLogsSplitCount.Add(float64(n))
+}
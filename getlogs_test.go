@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetLogsGuardRange(t *testing.T) {
+	head := func(ctx context.Context) (uint64, error) {
+		return 1000, nil
+	}
+	noHead := func(ctx context.Context) (uint64, error) {
+		return 0, errNoHead
+	}
+
+	cases := []struct {
+		name   string
+		head   blockHead
+		params string
+		code   int // expected error code, 0 = forwarded
+	}{
+		{"within range", head, `[{"fromBlock":"0x1","toBlock":"0xa"}]`, 0},
+		{"exceeds range", head, `[{"fromBlock":"0x1","toBlock":"0x100"}]`, rpcCodeLimitExceeded},
+		{"latest within range", head, `[{"fromBlock":"0x3e0"}]`, 0},
+		{"latest exceeds range", head, `[{"fromBlock":"0x1","toBlock":"latest"}]`, rpcCodeLimitExceeded},
+		{"block hash", noHead, `[{"blockHash":"0x01"}]`, 0},
+		{"no head", noHead, `[{"fromBlock":"0x1","toBlock":"latest"}]`, rpcCodeServerError},
+		{"no head without range", noHead, `[{}]`, rpcCodeServerError},
+		{"invalid block number", head, `[{"fromBlock":"0xzz","toBlock":"0x1"}]`, rpcCodeInvalidParams},
+		{"invalid block type", head, `[{"fromBlock":1,"toBlock":"0x1"}]`, rpcCodeInvalidParams},
+		{"reversed range", head, `[{"fromBlock":"0xa","toBlock":"0x1"}]`, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := getLogsGuard{MaxRange: 100, Head: tc.head}
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			resp := m.intercept(r, &rpcRequest{
+				JSONRPC: "2.0",
+				ID:      json.RawMessage(`1`),
+				Method:  "eth_getLogs",
+				Params:  json.RawMessage(tc.params),
+			})
+
+			switch {
+			case tc.code == 0 && resp != nil:
+				t.Errorf("response = %+v, want forwarded", resp.Error)
+			case tc.code != 0 && (resp == nil || resp.Error == nil):
+				t.Errorf("forwarded, want error code %d", tc.code)
+			case tc.code != 0 && resp.Error.Code != tc.code:
+				t.Errorf("error = %+v, want code %d", resp.Error, tc.code)
+			}
+		})
+	}
+}
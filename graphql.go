@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/moonrhythm/parapet/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type graphqlRequest struct {
+	Query string `json:"query"`
+}
+
+// graphqlGuard limits graphql query depth and complexity before forwarding to geth,
+// complexity is the number of selected fields in the query
+type graphqlGuard struct {
+	MaxDepth      int // 0 = unlimited
+	MaxComplexity int // 0 = unlimited
+}
+
+// ServeHandler implements middleware interface
+func (m graphqlGuard) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req graphqlRequest
+		switch r.Method {
+		case http.MethodGet:
+			req.Query = r.URL.Query().Get("query")
+		case http.MethodPost:
+			if r.Body == nil {
+				break
+			}
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, "can not read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+
+			// let geth returns decode error
+			json.Unmarshal(body, &req)
+		}
+
+		q := analyzeGraphQL(req.Query)
+		logger.Set(r.Context(), "graphqlOperation", q.Operation)
+
+		if m.MaxDepth > 0 && q.Depth > m.MaxDepth {
+			promGraphQLRequest(q.Operation, "depth")
+			writeGraphQLError(w, http.StatusBadRequest, fmt.Sprintf("query depth %d exceeds limit %d", q.Depth, m.MaxDepth))
+			return
+		}
+		if m.MaxComplexity > 0 && q.Complexity > m.MaxComplexity {
+			promGraphQLRequest(q.Operation, "complexity")
+			writeGraphQLError(w, http.StatusBadRequest, fmt.Sprintf("query complexity %d exceeds limit %d", q.Complexity, m.MaxComplexity))
+			return
+		}
+		promGraphQLRequest(q.Operation, "forwarded")
+		h.ServeHTTP(w, r)
+	})
+}
+
+type graphqlQueryInfo struct {
+	Operation  string // query, mutation, or subscription
+	Depth      int    // max selection set nesting
+	Complexity int    // selected fields
+}
+
+// analyzeGraphQL scans graphql query without full parsing,
+// fragments are counted where they are defined, not where they are spread
+func analyzeGraphQL(query string) graphqlQueryInfo {
+	info := graphqlQueryInfo{Operation: "query"}
+
+	var (
+		depth       int
+		parenDepth  int
+		prev        string // previous token
+		pendingName bool   // name token in selection set, counted as field unless it is an alias
+	)
+	countField := func() {
+		if pendingName {
+			info.Complexity++
+			pendingName = false
+		}
+	}
+
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case c == '#':
+			// comment
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '"':
+			// string, including block string
+			if strings.HasPrefix(query[i:], `"""`) {
+				end := strings.Index(query[i+3:], `"""`)
+				if end < 0 {
+					i = len(query)
+				} else {
+					i += end + 6
+				}
+			} else {
+				i++
+				for i < len(query) && query[i] != '"' && query[i] != '\n' {
+					if query[i] == '\\' {
+						i++
+					}
+					i++
+				}
+				i++
+			}
+			prev = "\""
+			continue
+		case isGraphQLNameStart(c):
+			j := i
+			for j < len(query) && isGraphQLNameChar(query[j]) {
+				j++
+			}
+			name := query[i:j]
+			i = j
+
+			if depth == 0 && parenDepth == 0 && prev == "" {
+				switch name {
+				case "mutation", "subscription":
+					info.Operation = name
+				}
+			}
+			if depth > 0 && parenDepth == 0 && prev != "..." && prev != "on" && prev != "@" {
+				countField()
+				pendingName = true
+			}
+			prev = name
+			continue
+		case c == ':':
+			if parenDepth == 0 {
+				// alias, field name follows
+				pendingName = false
+			}
+		case c == '{':
+			countField()
+			depth++
+			if depth > info.Depth {
+				info.Depth = depth
+			}
+		case c == '}':
+			countField()
+			if depth > 0 {
+				depth--
+			}
+		case c == '(':
+			parenDepth++
+		case c == ')':
+			if parenDepth > 0 {
+				parenDepth--
+			}
+		case c == '.' && strings.HasPrefix(query[i:], "..."):
+			countField()
+			prev = "..."
+			i += 3
+			continue
+		case c == '@':
+			countField()
+			prev = "@"
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+			continue
+		}
+		prev = string(c)
+		i++
+	}
+	countField()
+	return info
+}
+
+func isGraphQLNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return isGraphQLNameStart(c) || (c >= '0' && c <= '9')
+}
+
+type graphqlError struct {
+	Message string `json:"message"`
+}
+
+func writeGraphQLError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Errors []graphqlError `json:"errors"`
+	}{[]graphqlError{{message}}})
+}
+
+var graphqlRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "graphql_requests",
+}, []string{"operation", "result"})
+
+func promGraphQLRequest(operation, result string) {
+	c, err := graphqlRequests.GetMetricWith(prometheus.Labels{"operation": operation, "result": result})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/moonrhythm/parapet"
+)
+
+var chainInfo struct {
+	mu        sync.Mutex
+	ChainID   *big.Int
+	NetworkID *big.Int
+}
+
+// getChainID returns chain id from upstream, the result is cached since it never changes
+func getChainID(ctx context.Context) (*big.Int, error) {
+	chainInfo.mu.Lock()
+	defer chainInfo.mu.Unlock()
+
+	if chainInfo.ChainID != nil {
+		return chainInfo.ChainID, nil
+	}
+
+	id, err := ethClient.ChainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	chainInfo.ChainID = id
+	return id, nil
+}
+
+// getNetworkID returns network id from upstream, the result is cached since it never changes
+func getNetworkID(ctx context.Context) (*big.Int, error) {
+	chainInfo.mu.Lock()
+	defer chainInfo.mu.Unlock()
+
+	if chainInfo.NetworkID != nil {
+		return chainInfo.NetworkID, nil
+	}
+
+	id, err := ethClient.NetworkID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	chainInfo.NetworkID = id
+	return id, nil
+}
+
+// headCache serves eth_blockNumber, eth_chainId, and net_version from proxy's head tracker
+func headCache() parapet.Middleware {
+	return interceptRPC(func(r *http.Request, req *rpcRequest) *rpcResponse {
+		ctx := r.Context()
+
+		var result interface{}
+		switch req.Method {
+		case "eth_blockNumber":
+			block, err := getLastBlock(ctx)
+			if err != nil || block == nil {
+				return nil
+			}
+			result = hexutil.Uint64(block.NumberU64())
+		case "eth_chainId":
+			id, err := getChainID(ctx)
+			if err != nil {
+				return nil
+			}
+			result = (*hexutil.Big)(id)
+		case "net_version":
+			id, err := getNetworkID(ctx)
+			if err != nil {
+				return nil
+			}
+			result = id.String()
+		default:
+			return nil
+		}
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			return nil
+		}
+		return newRPCResult(req, b)
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// headFeedSize is number of recent heads kept for block filters
+const headFeedSize = 256
+
+// headFeed keeps recent heads from proxy's head tracker, and wakes up waiters on new head,
+// reorged heads are appended, so block filters see new hashes like geth
+type headFeed struct {
+	mu      sync.Mutex
+	heads   []*types.Header // recent heads, oldest first
+	seq     uint64          // sequence of last head
+	changed chan struct{}   // closed on new head
+}
+
+var heads = &headFeed{changed: make(chan struct{})}
+
+// Publish appends head if it is not the last head
+func (f *headFeed) Publish(h *types.Header) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if n := len(f.heads); n > 0 && f.heads[n-1].Hash() == h.Hash() {
+		return
+	}
+	f.heads = append(f.heads, h)
+	if len(f.heads) > headFeedSize {
+		f.heads = f.heads[len(f.heads)-headFeedSize:]
+	}
+	f.seq++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Since returns heads after sequence, and current sequence,
+// heads that were dropped from feed are skipped
+func (f *headFeed) Since(seq uint64) ([]*types.Header, uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := f.seq - seq
+	if seq > f.seq {
+		n = 0
+	}
+	if n > uint64(len(f.heads)) {
+		n = uint64(len(f.heads))
+	}
+	xs := make([]*types.Header, n)
+	copy(xs, f.heads[uint64(len(f.heads))-n:])
+	return xs, f.seq
+}
+
+// Latest returns last head, and channel that is closed on next head
+func (f *headFeed) Latest() (*types.Header, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.heads) == 0 {
+		return nil, f.changed
+	}
+	return f.heads[len(f.heads)-1], f.changed
+}
+
+// blockFilters emulates eth_newBlockFilter and eth_getFilterChanges with head feed,
+// so polling clients do not create filters in geth, and polls can go to any upstream
+type blockFilters struct {
+	Timeout time.Duration // remove filter not polled within
+
+	mu      sync.Mutex
+	filters map[string]*blockFilter
+}
+
+type blockFilter struct {
+	seq      uint64
+	lastPoll time.Time
+}
+
+func newBlockFilters(timeout time.Duration) *blockFilters {
+	m := &blockFilters{
+		Timeout: timeout,
+		filters: make(map[string]*blockFilter),
+	}
+	go m.cleanup()
+	return m
+}
+
+// ServeHandler implements middleware interface
+func (m *blockFilters) ServeHandler(h http.Handler) http.Handler {
+	return interceptRPC(m.intercept).ServeHandler(h)
+}
+
+func (m *blockFilters) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	switch req.Method {
+	case "eth_newBlockFilter":
+		_, seq := heads.Since(0)
+
+		var b [16]byte
+		rand.Read(b[:])
+		id := hexutil.Encode(b[:])
+
+		m.mu.Lock()
+		m.filters[id] = &blockFilter{seq: seq, lastPoll: time.Now()}
+		m.mu.Unlock()
+
+		result, _ := json.Marshal(id)
+		return newRPCResult(req, result)
+	case "eth_getFilterChanges":
+		id := filterID(req.Params)
+
+		m.mu.Lock()
+		f := m.filters[id]
+		if f == nil {
+			m.mu.Unlock()
+			// not proxy's filter
+			return nil
+		}
+		xs, seq := heads.Since(f.seq)
+		f.seq = seq
+		f.lastPoll = time.Now()
+		m.mu.Unlock()
+
+		hashes := make([]common.Hash, len(xs))
+		for i, h := range xs {
+			hashes[i] = h.Hash()
+		}
+		result, _ := json.Marshal(hashes)
+		return newRPCResult(req, result)
+	case "eth_uninstallFilter":
+		id := filterID(req.Params)
+
+		m.mu.Lock()
+		_, ok := m.filters[id]
+		delete(m.filters, id)
+		m.mu.Unlock()
+		if !ok {
+			return nil
+		}
+		return newRPCResult(req, json.RawMessage("true"))
+	}
+	return nil
+}
+
+// filterID returns filter id from params
+func filterID(params json.RawMessage) string {
+	var xs []string
+	if json.Unmarshal(params, &xs) != nil || len(xs) == 0 {
+		return ""
+	}
+	return xs[0]
+}
+
+func (m *blockFilters) cleanup() {
+	for {
+		time.Sleep(m.Timeout / 2)
+
+		m.mu.Lock()
+		for id, f := range m.filters {
+			if time.Since(f.lastPoll) > m.Timeout {
+				delete(m.filters, id)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// headPoll serves long-poll of new head,
+// responds head after given block number, or 204 when no new head within timeout
+//
+//	GET /heads/poll?after=0x10&timeout=30s
+type headPoll struct {
+	MaxTimeout time.Duration
+}
+
+func (m headPoll) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var after uint64
+	if x := r.FormValue("after"); x != "" {
+		var err error
+		after, err = hexutil.DecodeUint64(x)
+		if err != nil {
+			after, err = strconv.ParseUint(x, 10, 64)
+		}
+		if err != nil {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	timeout := m.MaxTimeout
+	if x := r.FormValue("timeout"); x != "" {
+		d, err := time.ParseDuration(x)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		if d < timeout {
+			timeout = d
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	for {
+		h, changed := heads.Latest()
+		if h != nil && h.Number.Uint64() > after {
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, h)
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+}
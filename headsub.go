@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// startHeadSubscription tracks head with newHeads subscription on primary geth,
+// head is updated the instant block arrives, and polling is used only while subscription is down
+func startHeadSubscription(p *wsProxy, addr string) {
+	f := &wsFeed{
+		Proxy:    p,
+		Addr:     addr,
+		Name:     "head",
+		Params:   json.RawMessage(`["newHeads"]`),
+		OnResult: onSubscribedHead,
+		OnState:  headTracker.SetSubscribed,
+	}
+	// never released
+	f.Acquire()
+}
+
+func onSubscribedHead(raw json.RawMessage) {
+	var h types.Header
+	if json.Unmarshal(raw, &h) != nil {
+		return
+	}
+
+	headTracker.SetHead(&h)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	promUpdateHeadDuration(ctx)
+	cancel()
+}
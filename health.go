@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func checkMaintenance(ctx context.Context) error {
+	if inMaintenance() {
+		return errors.New("in maintenance mode")
+	}
+	return nil
+}
+
+func checkGethHead(ctx context.Context) error {
+	ready, err := headTracker.Ready(ctx)
+	if err != nil {
+		return errors.New("can not get block")
+	}
+	if !ready {
+		return errors.New("last block too old")
+	}
+	return nil
+}
+
+func checkUpstreams(ctx context.Context) error {
+	for _, u := range pool.List() {
+		if u.Healthy() && !u.Disabled() {
+			return nil
+		}
+	}
+	return errors.New("no healthy upstream")
+}
+
+func checkCertExpiry(ctx context.Context) error {
+	if certs.Expired() {
+		return errors.New("certificate expired")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/moonrhythm/parapet/pkg/block"
+)
+
+func isHeavyMethod(method string) bool {
+	return strings.HasPrefix(method, "debug_") || strings.HasPrefix(method, "trace_")
+}
+
+// heavyPath creates block that matches json-rpc call contains heavy method,
+// use to separate heavy calls from latency-sensitive calls
+func heavyPath() *block.Block {
+	return block.New(func(r *http.Request) bool {
+		c := getRPCCall(r.Context())
+		if c == nil {
+			return false
+		}
+		for _, req := range c.Requests {
+			if req != nil && isHeavyMethod(req.Method) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func isTraceMethod(method string) bool {
+	return strings.HasPrefix(method, "debug_trace")
+}
+
+// heavyLimiter limits heavy calls, calls contain debug_trace* method go to Trace limiter when set,
+// so tracing can not take all heavy slots and starve other heavy calls
+type heavyLimiter struct {
+	Heavy *concurrencyLimiter
+	Trace *concurrencyLimiter // nil = share heavy limiter
+}
+
+// ServeHandler implements middleware interface
+func (m heavyLimiter) ServeHandler(h http.Handler) http.Handler {
+	heavy := m.Heavy.ServeHandler(h)
+	if m.Trace == nil {
+		return heavy
+	}
+	trace := m.Trace.ServeHandler(h)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := getRPCCall(r.Context())
+		if c != nil {
+			for _, req := range c.Requests {
+				if req != nil && isTraceMethod(req.Method) {
+					trace.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		heavy.ServeHTTP(w, r)
+	})
+}
+
+// traceNodes rejects calls for trace upstreams when none is healthy,
+// instead of sending them to full nodes that do not support trace methods
+type traceNodes struct {
+	Pool *upstreamPool
+}
+
+// ServeHandler implements middleware interface
+func (m traceNodes) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Pool.IsTrace(getRPCCall(r.Context())) && len(m.Pool.TraceHealthy()) == 0 {
+			writeRPCError(w, r, http.StatusServiceUnavailable, rpcCodeServerError, "no healthy trace node")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
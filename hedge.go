@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/upstream"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// hedgeTransport sends duplicate request to another healthy upstream
+// when the first upstream does not respond within delay, first successful response wins,
+// only calls that all methods are idempotent reads are hedged
+type hedgeTransport struct {
+	Pool      *upstreamPool
+	Port      string
+	Transport http.RoundTripper
+	Delay     time.Duration
+	Methods   map[string]bool
+}
+
+type hedgeResult struct {
+	Upstream *gethUpstream
+	Resp     *http.Response
+	Err      error
+	Cancel   context.CancelFunc
+	Hedge    bool
+}
+
+func (r *hedgeResult) ok() bool {
+	return r.Err == nil && r.Resp.StatusCode < 500
+}
+
+// discard releases loser's response
+func (r *hedgeResult) discard() {
+	if r.Resp != nil {
+		r.Resp.Body.Close()
+	}
+	r.Cancel()
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *hedgeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !t.hedgeable(r) {
+		return t.Pool.Transport(t.Port, t.Transport).RoundTrip(r)
+	}
+
+	c := getRPCCall(r.Context())
+	first := t.Pool.NextForRequest(r)
+	if first == nil {
+		return nil, upstream.ErrUnavailable
+	}
+
+	// body was buffered by parseRPC
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(chan *hedgeResult, 2)
+	send := func(u *gethUpstream, hedge bool) {
+		ctx, cancel := context.WithCancel(r.Context())
+		req := r.Clone(ctx)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.URL.Host = net.JoinHostPort(u.Addr, t.Port)
+
+		resp, err := upstreamMetricsTransport{
+			RoundTripper: u.Track(t.Transport),
+			Chain:        t.Pool.Chain,
+			Upstream:     u.Addr,
+		}.RoundTrip(req)
+		results <- &hedgeResult{Upstream: u, Resp: resp, Err: err, Cancel: cancel, Hedge: hedge}
+	}
+	go send(first, false)
+
+	timer := time.NewTimer(t.Delay)
+	defer timer.Stop()
+
+	pending := 1
+	var failed *hedgeResult
+	for {
+		select {
+		case <-timer.C:
+			second := t.nextExcept(c, first)
+			if second == nil {
+				continue
+			}
+			promHedge(t.Pool.Chain, "fired")
+			pending++
+			go send(second, true)
+		case res := <-results:
+			pending--
+			if !res.ok() && pending > 0 {
+				// wait for the other request
+				failed = res
+				continue
+			}
+
+			if failed != nil {
+				failed.discard()
+			}
+			if pending > 0 {
+				// release loser when it returns
+				go func() {
+					(<-results).discard()
+				}()
+			}
+			if res.Hedge && res.ok() {
+				promHedge(t.Pool.Chain, "won")
+			}
+
+			r.URL.Host = net.JoinHostPort(res.Upstream.Addr, t.Port)
+			if res.Err != nil {
+				res.Cancel()
+				return nil, res.Err
+			}
+			res.Resp.Body = &cancelOnClose{ReadCloser: res.Resp.Body, cancel: res.Cancel}
+			return res.Resp, nil
+		}
+	}
+}
+
+func (t *hedgeTransport) hedgeable(r *http.Request) bool {
+	c := getRPCCall(r.Context())
+	if c == nil || r.Body == nil {
+		return false
+	}
+	for _, req := range c.Requests {
+		if req == nil || !t.Methods[req.Method] {
+			return false
+		}
+	}
+	return len(t.Pool.Healthy()) > 1
+}
+
+// nextExcept returns next upstream for call that is not u
+func (t *hedgeTransport) nextExcept(c *rpcCall, u *gethUpstream) *gethUpstream {
+	for range t.Pool.Healthy() {
+		x := t.Pool.NextFor(c)
+		if x != nil && x != u {
+			return x
+		}
+	}
+	return nil
+}
+
+// cancelOnClose cancels request context after response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+var hedgeRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "hedge_requests",
+}, []string{"chain", "result"})
+
+func promHedge(chain, result string) {
+	c, err := hedgeRequests.GetMetricWith(prometheus.Labels{"chain": chain, "result": result})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rpcNamespace returns method namespace, ex. admin for admin_peers
+func rpcNamespace(method string) string {
+	i := strings.Index(method, "_")
+	if i < 0 {
+		return method
+	}
+	return method[:i]
+}
+
+// namespaceGuard blocks methods in namespaces on public route,
+// the namespaces are served by authenticated /internal/rpc instead
+type namespaceGuard struct {
+	Namespaces map[string]bool
+}
+
+// ServeHandler implements middleware interface
+func (m namespaceGuard) ServeHandler(h http.Handler) http.Handler {
+	return interceptRPC(m.intercept).ServeHandler(h)
+}
+
+func (m namespaceGuard) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	if !m.Denied(req.Method) {
+		return nil
+	}
+	promNamespaceDenied(rpcNamespace(req.Method))
+	return newRPCError(req, rpcCodeMethodNotFound, fmt.Sprintf("the method %s does not exist/is not available", req.Method))
+}
+
+// Denied returns true if method is in blocked namespaces
+func (m namespaceGuard) Denied(method string) bool {
+	return m.Namespaces[rpcNamespace(method)]
+}
+
+var namespaceDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "namespace_denied",
+}, []string{"namespace"})
+
+func promNamespaceDenied(namespace string) {
+	c, err := namespaceDenied.GetMetricWith(prometheus.Labels{"namespace": namespace})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
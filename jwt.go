@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// jwtAuth validates bearer token, signed by static key or keys from jwks url
+type jwtAuth struct {
+	Key          interface{} // static key, *rsa.PublicKey, *ecdsa.PublicKey, or []byte for hmac
+	JWKSURL      string
+	JWKSRefresh  time.Duration
+	Issuer       string
+	Audience     string
+	TenantClaim  string
+	TierClaim    string
+	Leeway       time.Duration // allowed clock skew for exp and nbf
+	AllowNoExp   bool          // accept token without exp, never expires
+	jwksMu       sync.RWMutex
+	jwks         map[string]interface{} // kid => public key
+	jwksLastLoad time.Time
+}
+
+var (
+	errJWTMalformed   = errors.New("malformed token")
+	errJWTAlgorithm   = errors.New("unsupported algorithm")
+	errJWTSignature   = errors.New("invalid signature")
+	errJWTKeyNotFound = errors.New("signing key not found")
+	errJWTExpired     = errors.New("token expired")
+	errJWTNoExpiry    = errors.New("token has no expiry")
+	errJWTNotYetValid = errors.New("token not yet valid")
+	errJWTIssuer      = errors.New("invalid issuer")
+	errJWTAudience    = errors.New("invalid audience")
+)
+
+// loadJWTKey loads PEM encoded public key, or uses file content as hmac secret
+func loadJWTKey(filename string) (interface{}, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return []byte(strings.TrimSpace(string(b))), nil
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+// Start loads jwks and refreshes periodically
+func (m *jwtAuth) Start() error {
+	if m.JWKSURL == "" {
+		return nil
+	}
+	err := m.loadJWKS()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			time.Sleep(m.JWKSRefresh)
+			err := m.loadJWKS()
+			if err != nil {
+				log.Printf("jwt: can not refresh jwks; %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) PublicKey() (interface{}, error) {
+	dec := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := dec(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := dec(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func (m *jwtAuth) loadJWKS() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.JWKSURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.PublicKey()
+		if err != nil {
+			log.Printf("jwt: skip jwk %s; %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	m.jwksMu.Lock()
+	m.jwks = keys
+	m.jwksLastLoad = time.Now()
+	m.jwksMu.Unlock()
+	return nil
+}
+
+// jwksKey returns key from jwks, reloads jwks when kid not found (key rotation)
+func (m *jwtAuth) jwksKey(kid string) (interface{}, error) {
+	m.jwksMu.RLock()
+	key := m.jwks[kid]
+	lastLoad := m.jwksLastLoad
+	m.jwksMu.RUnlock()
+	if key != nil {
+		return key, nil
+	}
+
+	// limit reload rate from unknown kid
+	if time.Since(lastLoad) < time.Minute {
+		return nil, errJWTKeyNotFound
+	}
+	err := m.loadJWKS()
+	if err != nil {
+		log.Printf("jwt: can not reload jwks; %v", err)
+		return nil, errJWTKeyNotFound
+	}
+
+	m.jwksMu.RLock()
+	key = m.jwks[kid]
+	m.jwksMu.RUnlock()
+	if key == nil {
+		return nil, errJWTKeyNotFound
+	}
+	return key, nil
+}
+
+// Verify verifies token and returns its claims
+func (m *jwtAuth) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+
+	key := m.Key
+	if key == nil {
+		key, err = m.jwksKey(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	err = m.validateClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (m *jwtAuth) validateClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	switch exp := claims["exp"].(type) {
+	case float64:
+		if now.After(time.Unix(int64(exp), 0).Add(m.Leeway)) {
+			return errJWTExpired
+		}
+	case nil:
+		// token without exp is valid forever, leaked token can not be expired
+		if !m.AllowNoExp {
+			return errJWTNoExpiry
+		}
+	default:
+		return errJWTMalformed
+	}
+	switch nbf := claims["nbf"].(type) {
+	case float64:
+		if now.Before(time.Unix(int64(nbf), 0).Add(-m.Leeway)) {
+			return errJWTNotYetValid
+		}
+	case nil:
+	default:
+		return errJWTMalformed
+	}
+	if m.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != m.Issuer {
+			return errJWTIssuer
+		}
+	}
+	if m.Audience != "" && !jwtHasAudience(claims["aud"], m.Audience) {
+		return errJWTAudience
+	}
+	return nil
+}
+
+func jwtHasAudience(aud interface{}, expected string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == expected
+	case []interface{}:
+		for _, x := range aud {
+			if s, _ := x.(string); s == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifyJWTSignature(alg string, key interface{}, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return errJWTAlgorithm
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errJWTAlgorithm
+	}
+
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return errJWTAlgorithm
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errJWTSignature
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errJWTAlgorithm
+		}
+		var err error
+		if alg[:2] == "RS" {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest, sig, nil)
+		}
+		if err != nil {
+			return errJWTSignature
+		}
+		return nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errJWTAlgorithm
+		}
+		// curve is bound to alg, ex. ES256 must be signed by P-256
+		if jwtCurveHash[pub.Curve.Params().Name] != hash {
+			return errJWTAlgorithm
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errJWTSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errJWTSignature
+		}
+		return nil
+	}
+	return errJWTAlgorithm
+}
+
+var jwtCurveHash = map[string]crypto.Hash{
+	"P-256": crypto.SHA256,
+	"P-384": crypto.SHA384,
+	"P-521": crypto.SHA512,
+}
+
+func (m *jwtAuth) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+			promJWTRequest("missing")
+			jwtUnauthorized(w, r, "")
+			return
+		}
+		claims, err := m.Verify(strings.TrimSpace(auth[7:]))
+		if err != nil {
+			promJWTRequest("invalid")
+			jwtUnauthorized(w, r, err.Error())
+			return
+		}
+		promJWTRequest("valid")
+		r.Header.Del("Authorization")
+
+		t := authTenant{
+			Tenant: jwtClaimString(claims, m.TenantClaim),
+			Tier:   jwtClaimString(claims, m.TierClaim),
+		}
+		ctx := r.Context()
+		if t.Tenant != "" {
+			logger.Set(ctx, "tenant", t.Tenant)
+		}
+		if t.Tier != "" {
+			logger.Set(ctx, "tier", t.Tier)
+		}
+		promTenantRequest(t)
+		ctx = context.WithValue(ctx, authTenantKey{}, &t)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func jwtClaimString(claims map[string]interface{}, name string) string {
+	if name == "" {
+		return ""
+	}
+	switch v := claims[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func jwtUnauthorized(w http.ResponseWriter, r *http.Request, reason string) {
+	if reason == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	} else {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=\"invalid_token\", error_description=%q", reason))
+	}
+	if r.Method == http.MethodPost {
+		writeRPCError(w, r, http.StatusUnauthorized, rpcCodeServerError, "unauthorized")
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// authTenant is the tenant of authenticated request
+type authTenant struct {
+	Tenant string
+	Tier   string
+	Policy *apiKeyPolicy // authenticated by api key
+}
+
+type authTenantKey struct{}
+
+// getAuthTenant returns authenticated tenant from context, nil if not authenticated by token or api key
+func getAuthTenant(ctx context.Context) *authTenant {
+	t, _ := ctx.Value(authTenantKey{}).(*authTenant)
+	return t
+}
+
+var (
+	jwtRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "jwt_requests",
+	}, []string{"result"})
+
+	tenantRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "tenant_requests",
+	}, []string{"tenant", "tier"})
+)
+
+func promJWTRequest(result string) {
+	c, err := jwtRequests.GetMetricWith(prometheus.Labels{"result": result})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
+
+func promTenantRequest(t authTenant) {
+	c, err := tenantRequests.GetMetricWith(prometheus.Labels{"tenant": t.Tenant, "tier": t.Tier})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// signJWT signs claims with alg, key is []byte for hmac, *rsa.PrivateKey, or *ecdsa.PrivateKey,
+// nil key creates unsigned token
+func signJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": alg, "typ": "JWT"}) + "." + enc(claims)
+	if key == nil {
+		return signed + "."
+	}
+
+	hash := jwtHashes[alg[len(alg)-3:]]
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var (
+		sig []byte
+		err error
+	)
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		if alg[:2] == "PS" {
+			sig, err = rsa.SignPSS(rand.Reader, key, hash, digest, nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		if err == nil {
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKeys := make(map[string]*ecdsa.PrivateKey)
+	for name, curve := range map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()} {
+		ecKeys[name], err = ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	otherECKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+	// hmac secret that equals to rsa public key, ex. key confusion when public key file used as hmac secret
+	rsaPublicAsSecret := rsaKey.PublicKey.N.Bytes()
+
+	now := time.Now()
+	valid := map[string]interface{}{
+		"exp":    float64(now.Add(time.Hour).Unix()),
+		"tenant": "acme",
+	}
+
+	cases := []struct {
+		name    string
+		token   string
+		key     interface{}
+		wantErr error
+	}{
+		{"HS256", signJWT(t, "HS256", secret, valid), secret, nil},
+		{"HS384", signJWT(t, "HS384", secret, valid), secret, nil},
+		{"HS512", signJWT(t, "HS512", secret, valid), secret, nil},
+		{"HS256 wrong secret", signJWT(t, "HS256", []byte("other"), valid), secret, errJWTSignature},
+		{"RS256", signJWT(t, "RS256", rsaKey, valid), &rsaKey.PublicKey, nil},
+		{"RS384", signJWT(t, "RS384", rsaKey, valid), &rsaKey.PublicKey, nil},
+		{"RS512", signJWT(t, "RS512", rsaKey, valid), &rsaKey.PublicKey, nil},
+		{"RS256 wrong key", signJWT(t, "RS256", otherRSAKey, valid), &rsaKey.PublicKey, errJWTSignature},
+		{"PS256", signJWT(t, "PS256", rsaKey, valid), &rsaKey.PublicKey, nil},
+		{"PS512", signJWT(t, "PS512", rsaKey, valid), &rsaKey.PublicKey, nil},
+		{"PS256 verified as RS256", rewriteJWTAlg(t, signJWT(t, "PS256", rsaKey, valid), "RS256"), &rsaKey.PublicKey, errJWTSignature},
+		{"ES256", signJWT(t, "ES256", ecKeys["P-256"], valid), &ecKeys["P-256"].PublicKey, nil},
+		{"ES384", signJWT(t, "ES384", ecKeys["P-384"], valid), &ecKeys["P-384"].PublicKey, nil},
+		{"ES512", signJWT(t, "ES512", ecKeys["P-521"], valid), &ecKeys["P-521"].PublicKey, nil},
+		{"ES256 wrong curve", signJWT(t, "ES256", ecKeys["P-384"], valid), &ecKeys["P-384"].PublicKey, errJWTAlgorithm},
+		{"ES256 wrong key", signJWT(t, "ES256", otherECKey, valid), &ecKeys["P-256"].PublicKey, errJWTSignature},
+
+		// alg and key type confusion
+		{"HS256 with rsa key", signJWT(t, "HS256", rsaPublicAsSecret, valid), &rsaKey.PublicKey, errJWTAlgorithm},
+		{"HS256 with ec key", signJWT(t, "HS256", secret, valid), &ecKeys["P-256"].PublicKey, errJWTAlgorithm},
+		{"RS256 with hmac secret", signJWT(t, "RS256", rsaKey, valid), secret, errJWTAlgorithm},
+		{"RS256 with ec key", signJWT(t, "RS256", rsaKey, valid), &ecKeys["P-256"].PublicKey, errJWTAlgorithm},
+		{"ES256 with rsa key", signJWT(t, "ES256", ecKeys["P-256"], valid), &rsaKey.PublicKey, errJWTAlgorithm},
+
+		// unsigned
+		{"none", signJWT(t, "none", nil, valid), secret, errJWTAlgorithm},
+		{"none with rsa key", signJWT(t, "none", nil, valid), &rsaKey.PublicKey, errJWTAlgorithm},
+		{"NONE", signJWT(t, "NONE", nil, valid), secret, errJWTAlgorithm},
+		{"HS256 empty signature", rewriteJWTSig(signJWT(t, "HS256", secret, valid), ""), secret, errJWTSignature},
+
+		// malformed
+		{"two parts", "a.b", secret, errJWTMalformed},
+		{"invalid header", "!.e30.", secret, errJWTMalformed},
+		{"invalid signature encoding", rewriteJWTSig(signJWT(t, "HS256", secret, valid), "!"), secret, errJWTMalformed},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &jwtAuth{Key: tc.key, TenantClaim: "tenant"}
+			claims, err := m.Verify(tc.token)
+			if err != tc.wantErr {
+				t.Fatalf("Verify error = %v, want %v", err, tc.wantErr)
+			}
+			if err == nil && jwtClaimString(claims, "tenant") != "acme" {
+				t.Errorf("claims = %v", claims)
+			}
+		})
+	}
+}
+
+func TestJWTValidateClaims(t *testing.T) {
+	now := time.Now()
+	unix := func(d time.Duration) float64 {
+		return float64(now.Add(d).Unix())
+	}
+
+	cases := []struct {
+		name    string
+		m       *jwtAuth
+		claims  map[string]interface{}
+		wantErr error
+	}{
+		{"valid", &jwtAuth{}, map[string]interface{}{"exp": unix(time.Hour)}, nil},
+		{"expired", &jwtAuth{}, map[string]interface{}{"exp": unix(-time.Hour)}, errJWTExpired},
+		{"expired within leeway", &jwtAuth{Leeway: time.Minute}, map[string]interface{}{"exp": unix(-30 * time.Second)}, nil},
+		{"no exp", &jwtAuth{}, map[string]interface{}{}, errJWTNoExpiry},
+		{"no exp allowed", &jwtAuth{AllowNoExp: true}, map[string]interface{}{}, nil},
+		{"null exp", &jwtAuth{AllowNoExp: true}, map[string]interface{}{"exp": nil}, nil},
+		{"string exp", &jwtAuth{AllowNoExp: true}, map[string]interface{}{"exp": "9999999999"}, errJWTMalformed},
+		{"not yet valid", &jwtAuth{}, map[string]interface{}{"exp": unix(time.Hour), "nbf": unix(time.Hour)}, errJWTNotYetValid},
+		{"nbf within leeway", &jwtAuth{Leeway: time.Minute}, map[string]interface{}{"exp": unix(time.Hour), "nbf": unix(30 * time.Second)}, nil},
+		{"string nbf", &jwtAuth{}, map[string]interface{}{"exp": unix(time.Hour), "nbf": "0"}, errJWTMalformed},
+		{"issuer", &jwtAuth{Issuer: "a"}, map[string]interface{}{"exp": unix(time.Hour), "iss": "a"}, nil},
+		{"wrong issuer", &jwtAuth{Issuer: "a"}, map[string]interface{}{"exp": unix(time.Hour), "iss": "b"}, errJWTIssuer},
+		{"audience", &jwtAuth{Audience: "rpc"}, map[string]interface{}{"exp": unix(time.Hour), "aud": "rpc"}, nil},
+		{"audience list", &jwtAuth{Audience: "rpc"}, map[string]interface{}{"exp": unix(time.Hour), "aud": []interface{}{"web", "rpc"}}, nil},
+		{"wrong audience", &jwtAuth{Audience: "rpc"}, map[string]interface{}{"exp": unix(time.Hour), "aud": []interface{}{"web"}}, errJWTAudience},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.m.validateClaims(tc.claims); err != tc.wantErr {
+				t.Errorf("validateClaims error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// rewriteJWTAlg replaces token's alg header, keeps payload and signature
+func rewriteJWTAlg(t *testing.T, token, alg string) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	return base64.RawURLEncoding.EncodeToString(header) + token[strings.Index(token, "."):]
+}
+
+// rewriteJWTSig replaces token's signature
+func rewriteJWTSig(token, sig string) string {
+	return token[:strings.LastIndex(token, ".")+1] + sig
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sDiscovery watches kubernetes service's endpoints using in-cluster config,
+// only ready addresses are added to pool
+type k8sDiscovery struct {
+	Namespace string
+	Service   string
+	HTTPPort  string
+
+	client *http.Client
+	host   string
+	token  string
+}
+
+func newK8sDiscovery(name, httpPort string) *k8sDiscovery {
+	d := &k8sDiscovery{
+		Service:  name,
+		HTTPPort: httpPort,
+	}
+	if i := strings.Index(name, "/"); i >= 0 {
+		d.Namespace = name[:i]
+		d.Service = name[i+1:]
+	}
+	if d.Namespace == "" {
+		// resolve before Host is used, init returns error if namespace is still unknown
+		d.Namespace = k8sNamespace()
+	}
+	return d
+}
+
+// k8sNamespace returns pod's namespace from service account, or empty if not in cluster
+func k8sNamespace() string {
+	ns, err := os.ReadFile(k8sServiceAccountDir + "/namespace")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(ns))
+}
+
+// Source returns discovery source name
+func (d *k8sDiscovery) Source() string {
+	return "k8s+" + d.Namespace + "/" + d.Service
+}
+
+// Host returns service's cluster dns name
+func (d *k8sDiscovery) Host() string {
+	return d.Service + "." + d.Namespace + ".svc"
+}
+
+func (d *k8sDiscovery) init() error {
+	if d.client != nil {
+		return nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("not running in kubernetes cluster")
+	}
+
+	token, err := os.ReadFile(k8sServiceAccountDir + "/token")
+	if err != nil {
+		return err
+	}
+	ca, err := os.ReadFile(k8sServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return err
+	}
+	if d.Namespace == "" {
+		return fmt.Errorf("can not resolve namespace of service %s", d.Service)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+	d.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		},
+	}
+	d.host = "https://" + net.JoinHostPort(host, port)
+	d.token = strings.TrimSpace(string(token))
+	return nil
+}
+
+type k8sEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+	} `json:"subsets"`
+}
+
+type k8sWatchEvent struct {
+	Type   string       `json:"type"`
+	Object k8sEndpoints `json:"object"`
+}
+
+// readyAddresses returns addresses of ready pods,
+// kubernetes puts not ready pods in notReadyAddresses
+func (e *k8sEndpoints) readyAddresses() []string {
+	var rs []string
+	for _, s := range e.Subsets {
+		for _, a := range s.Addresses {
+			rs = append(rs, a.IP)
+		}
+	}
+	return rs
+}
+
+func (d *k8sDiscovery) request(ctx context.Context, watch bool) (*http.Response, error) {
+	u := d.host + "/api/v1/namespaces/" + url.PathEscape(d.Namespace) + "/endpoints"
+	if watch {
+		u += "?watch=1&fieldSelector=" + url.QueryEscape("metadata.name="+d.Service)
+	} else {
+		u += "/" + url.PathEscape(d.Service)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// Sync gets service's endpoints then adds new and removes gone upstreams
+func (d *k8sDiscovery) Sync(ctx context.Context) error {
+	err := d.init()
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.request(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var ep k8sEndpoints
+	err = json.NewDecoder(resp.Body).Decode(&ep)
+	if err != nil {
+		return err
+	}
+	syncUpstreams(d.Source(), d.HTTPPort, ep.readyAddresses())
+	return nil
+}
+
+// Start starts watching endpoints
+func (d *k8sDiscovery) Start() {
+	go func() {
+		for {
+			err := d.watch()
+			if err != nil {
+				log.Printf("discovery: %s watch error; %v", d.Source(), err)
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+func (d *k8sDiscovery) watch() error {
+	resp, err := d.request(context.Background(), true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev k8sWatchEvent
+		err := dec.Decode(&ev)
+		if err != nil {
+			return err
+		}
+
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			syncUpstreams(d.Source(), d.HTTPPort, ev.Object.readyAddresses())
+		case "DELETED":
+			syncUpstreams(d.Source(), d.HTTPPort, nil)
+		}
+	}
+}
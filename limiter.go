@@ -0,0 +1,269 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// concurrencyLimiter limits concurrent requests,
+// excess requests wait in FIFO queue until queue is full then the request will be rejected.
+// With tiers, queued requests from higher tier are scheduled first.
+type concurrencyLimiter struct {
+	Name       string        // name for metrics
+	RetryAfter time.Duration // suggested client retry delay when rejected
+
+	mu       sync.Mutex
+	capacity int
+	inFlight int
+	queue    int
+	queued   int
+	tiers    []string
+	waiters  [][]*limiterWaiter // fifo per tier, highest tier first
+}
+
+type limiterWaiter struct {
+	ready chan struct{}
+}
+
+func newConcurrencyLimiter(name string, capacity, queue int) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		Name:     name,
+		capacity: capacity,
+		queue:    queue,
+		tiers:    []string{""},
+		waiters:  make([][]*limiterWaiter, 1),
+	}
+}
+
+// SetTiers sets priority tiers, highest first,
+// requests with unknown tier are scheduled after all tiers
+func (l *concurrencyLimiter) SetTiers(tiers []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tiers = append(append([]string{}, tiers...), "")
+	l.waiters = make([][]*limiterWaiter, len(l.tiers))
+}
+
+// ServeHandler implements middleware interface
+func (l *concurrencyLimiter) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire(r) {
+			writeRateLimitError(w, r, "server is busy, try again later", rateLimitInfo{
+				Limit:      l.Capacity(),
+				RetryAfter: retryAfterSeconds(l.RetryAfter),
+			})
+			return
+		}
+		defer l.release()
+
+		rateLimitInfo{Limit: l.Capacity(), Remaining: l.Remaining()}.SetHeader(w.Header())
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (l *concurrencyLimiter) tierIndex(tier string) int {
+	for i, t := range l.tiers[:len(l.tiers)-1] {
+		if t == tier {
+			return i
+		}
+	}
+	return len(l.tiers) - 1
+}
+
+func (l *concurrencyLimiter) acquire(r *http.Request) bool {
+	l.mu.Lock()
+	if l.inFlight < l.capacity && l.queued == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		promLimiterInFlight(l.Name, 1)
+		return true
+	}
+	if l.queued >= l.queue {
+		l.mu.Unlock()
+		promLimiterRejected(l.Name)
+		return false
+	}
+
+	ti := l.tierIndex(requestTier(r))
+	tier := l.tiers[ti]
+	wt := &limiterWaiter{ready: make(chan struct{})}
+	l.waiters[ti] = append(l.waiters[ti], wt)
+	l.queued++
+	l.mu.Unlock()
+	promLimiterQueued(l.Name, tier, 1)
+
+	start := time.Now()
+	select {
+	case <-wt.ready:
+		// slot is handed over from release, in-flight count not changed
+		promLimiterQueued(l.Name, tier, -1)
+		promLimiterQueueDuration(l.Name, time.Since(start))
+		return true
+	case <-r.Context().Done():
+	}
+
+	l.mu.Lock()
+	removed := false
+	for i, x := range l.waiters[ti] {
+		if x == wt {
+			l.waiters[ti] = append(l.waiters[ti][:i], l.waiters[ti][i+1:]...)
+			l.queued--
+			removed = true
+			break
+		}
+	}
+	l.mu.Unlock()
+	promLimiterQueued(l.Name, tier, -1)
+	if !removed {
+		// slot was handed over while canceling
+		l.release()
+	}
+	return false
+}
+
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	for i, ws := range l.waiters {
+		if len(ws) == 0 {
+			continue
+		}
+		wt := ws[0]
+		ws[0] = nil
+		l.waiters[i] = ws[1:]
+		l.queued--
+		l.mu.Unlock()
+		close(wt.ready)
+		return
+	}
+	l.inFlight--
+	l.mu.Unlock()
+	promLimiterInFlight(l.Name, -1)
+}
+
+// concurrencyLimiterState is the snapshot of limiter
+type concurrencyLimiterState struct {
+	Name       string         `json:"name"`
+	Capacity   int            `json:"capacity"`
+	InFlight   int            `json:"inFlight"`
+	QueueSize  int            `json:"queueSize"`
+	Queued     int            `json:"queued"`
+	TierQueued map[string]int `json:"tierQueued,omitempty"`
+}
+
+// Capacity returns max concurrent requests
+func (l *concurrencyLimiter) Capacity() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.capacity
+}
+
+// Remaining returns free slots
+func (l *concurrencyLimiter) Remaining() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight >= l.capacity {
+		return 0
+	}
+	return l.capacity - l.inFlight
+}
+
+// State returns current limiter state
+func (l *concurrencyLimiter) State() concurrencyLimiterState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st := concurrencyLimiterState{
+		Name:      l.Name,
+		Capacity:  l.capacity,
+		InFlight:  l.inFlight,
+		QueueSize: l.queue,
+		Queued:    l.queued,
+	}
+	if len(l.tiers) > 1 {
+		st.TierQueued = make(map[string]int)
+		for i, t := range l.tiers {
+			st.TierQueued[limiterTierLabel(t)] = len(l.waiters[i])
+		}
+	}
+	return st
+}
+
+// requestTier returns priority tier of the request,
+// tier claim from authenticated token, or internal for requests from loopback (ex. synthetic probes),
+// both connection and resolved client must be loopback
+func requestTier(r *http.Request) string {
+	if t := getAuthTenant(r.Context()); t != nil {
+		return t.Tier
+	}
+	if isLoopback(remoteIP(r)) && isLoopback(clientIP(r)) {
+		return "internal"
+	}
+	return ""
+}
+
+func limiterTierLabel(tier string) string {
+	if tier == "" {
+		return "default"
+	}
+	return tier
+}
+
+var (
+	limiterInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "limiter_in_flight",
+	}, []string{"name"})
+
+	limiterQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "limiter_queued",
+	}, []string{"name", "tier"})
+
+	limiterQueueDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: promNamespace,
+		Name:      "limiter_queue_duration_seconds",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"name"})
+
+	limiterRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "limiter_rejected",
+	}, []string{"name"})
+)
+
+func promLimiterInFlight(name string, delta float64) {
+	g, err := limiterInFlight.GetMetricWith(prometheus.Labels{"name": name})
+	if err != nil {
+		return
+	}
+	g.Add(delta)
+}
+
+func promLimiterQueued(name, tier string, delta float64) {
+	g, err := limiterQueued.GetMetricWith(prometheus.Labels{"name": name, "tier": limiterTierLabel(tier)})
+	if err != nil {
+		return
+	}
+	g.Add(delta)
+}
+
+func promLimiterQueueDuration(name string, d time.Duration) {
+	o, err := limiterQueueDuration.GetMetricWith(prometheus.Labels{"name": name})
+	if err != nil {
+		return
+	}
+	o.Observe(float64(d) / float64(time.Second))
+}
+
+func promLimiterRejected(name string) {
+	c, err := limiterRejected.GetMetricWith(prometheus.Labels{"name": name})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/moonrhythm/parapet"
+)
+
+// listenFlag is repeatable address flag, the first set replaces default
+type listenFlag struct {
+	values []string
+	set    bool
+}
+
+func newListenFlag(name, value, usage string) *listenFlag {
+	f := &listenFlag{}
+	if value != "" {
+		f.values = []string{value}
+	}
+	flag.Var(f, name, usage)
+	return f
+}
+
+func (f *listenFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.values, " ")
+}
+
+func (f *listenFlag) Set(s string) error {
+	if !f.set {
+		f.values = nil
+		f.set = true
+	}
+	if s != "" {
+		f.values = append(f.values, s)
+	}
+	return nil
+}
+
+// Listeners parses flag values into listeners
+func (f *listenFlag) Listeners() ([]listener, error) {
+	var rs []listener
+	for _, x := range f.values {
+		l, err := parseListener(x)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, l)
+	}
+	return rs, nil
+}
+
+// listener is server address with options that change middleware stack,
+// ex. :8080,noauth for internal listener without auth
+type listener struct {
+	Addr   string
+	NoAuth bool // skip basic auth and jwt
+	NoACL  bool // skip path prefix acl
+}
+
+// UnixPath returns socket path for unix:// address
+func (l listener) UnixPath() (string, bool) {
+	if !strings.HasPrefix(l.Addr, "unix://") {
+		return "", false
+	}
+	return strings.TrimPrefix(l.Addr, "unix://"), true
+}
+
+// parseListener parses addr[,option...]
+func parseListener(s string) (listener, error) {
+	xs := strings.Split(s, ",")
+	l := listener{Addr: strings.TrimSpace(xs[0])}
+	if l.Addr == "" {
+		return l, fmt.Errorf("invalid listener %q", s)
+	}
+	if p, ok := l.UnixPath(); ok && strings.TrimSpace(p) == "" {
+		return l, fmt.Errorf("invalid unix socket path %q", s)
+	}
+	for _, x := range xs[1:] {
+		switch strings.TrimSpace(x) {
+		case "noauth":
+			l.NoAuth = true
+		case "noacl":
+			l.NoACL = true
+		default:
+			return l, fmt.Errorf("invalid listener option %q for %s", x, l.Addr)
+		}
+	}
+	return l, nil
+}
+
+type listenerKey struct{}
+
+// Middleware stores listener into request context
+func (l listener) Middleware() parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), listenerKey{}, l)
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+}
+
+func getListener(ctx context.Context) listener {
+	l, _ := ctx.Value(listenerKey{}).(listener)
+	return l
+}
+
+// skipForListener bypasses middleware when skip returns true for request's listener
+func skipForListener(skip func(l listener) bool, m parapet.Middleware) parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		next := m.ServeHandler(h)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if skip(getListener(r.Context())) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// listenAndServe serves srv on listener address,
+// unix socket is created with mode and removed on shutdown
+func listenAndServe(srv *parapet.Server, l listener, mode os.FileMode) error {
+	path, ok := l.UnixPath()
+	if !ok {
+		return srv.ListenAndServe()
+	}
+
+	ln, err := listenUnix(path, mode)
+	if err != nil {
+		return err
+	}
+	// unix listener removes socket file when closed
+	if srv.GraceTimeout <= 0 {
+		return srv.Serve(ln)
+	}
+
+	// same as parapet's ListenAndServe, which supports only tcp
+	errChan := make(chan error, 1)
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			errChan <- err
+		}
+	}()
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM)
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-shutdown:
+		return srv.Shutdown()
+	}
+}
+
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	// remove stale socket from unclean exit, but not a socket in use
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{Listener: ln}, nil
+}
+
+// unixListener gives each connection unique remote address,
+// unix peers are unnamed, and connection state is keyed by remote address
+type unixListener struct {
+	net.Listener
+	seq uint64
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	id := atomic.AddUint64(&l.seq, 1)
+	return &unixConn{
+		Conn: conn,
+		addr: &net.UnixAddr{Name: fmt.Sprintf("@%d", id), Net: "unix"},
+	}, nil
+}
+
+type unixConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.addr
+}
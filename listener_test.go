@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseListener(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    listener
+		wantErr bool
+	}{
+		{in: ":8080", want: listener{Addr: ":8080"}},
+		{in: ":8080,noauth", want: listener{Addr: ":8080", NoAuth: true}},
+		{in: ":8080, noauth ,noacl", want: listener{Addr: ":8080", NoAuth: true, NoACL: true}},
+		{in: "unix:///var/run/geth-proxy.sock", want: listener{Addr: "unix:///var/run/geth-proxy.sock"}},
+		{in: "unix:///var/run/geth-proxy.sock,noacl", want: listener{Addr: "unix:///var/run/geth-proxy.sock", NoACL: true}},
+		{in: "", wantErr: true},
+		{in: ",noauth", wantErr: true},
+		{in: "unix://", wantErr: true},
+		{in: "unix://,noauth", wantErr: true},
+		{in: "unix://  ", wantErr: true},
+		{in: ":8080,unknown", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := parseListener(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseListener(%q) error = %v, want error %v", tc.in, err, tc.wantErr)
+			}
+			if err == nil && got != tc.want {
+				t.Errorf("parseListener(%q) = %+v, want %+v", tc.in, got, tc.want)
+			}
+		})
+	}
+}
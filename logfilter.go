@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// logFilterBuffer is max logs queued per filter between polls, newer logs are dropped
+const logFilterBuffer = 10000
+
+// logFilters emulates eth_newFilter, eth_getFilterChanges, and eth_getFilterLogs with shared logs subscription,
+// so log filters survive upstream restarts and polls can go to any upstream
+type logFilters struct {
+	Logs    *logsFeed
+	Timeout time.Duration // remove filter not polled within
+
+	mu      sync.Mutex
+	filters map[string]*logFilter
+}
+
+type logFilter struct {
+	sub      *logsSubscriber
+	criteria json.RawMessage // original filter criteria, for eth_getFilterLogs
+	from     *uint64         // min block number, nil = any
+	to       *uint64         // max block number, nil = any
+	lastPoll time.Time
+}
+
+// logFilterCriteria is eth_newFilter params
+type logFilterCriteria struct {
+	FromBlock string            `json:"fromBlock"`
+	ToBlock   string            `json:"toBlock"`
+	Address   json.RawMessage   `json:"address"` // address or list of addresses
+	Topics    []json.RawMessage `json:"topics"`  // per position, null, topic, or list of topics
+	BlockHash *common.Hash      `json:"blockHash"`
+}
+
+func newLogFilters(logs *logsFeed, timeout time.Duration) *logFilters {
+	m := &logFilters{
+		Logs:    logs,
+		Timeout: timeout,
+		filters: make(map[string]*logFilter),
+	}
+	go m.cleanup()
+	return m
+}
+
+// ServeHandler implements middleware interface
+func (m *logFilters) ServeHandler(h http.Handler) http.Handler {
+	return interceptRPC(m.intercept).ServeHandler(h)
+}
+
+func (m *logFilters) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	switch req.Method {
+	case "eth_newFilter":
+		var params []json.RawMessage
+		if json.Unmarshal(req.Params, &params) != nil || len(params) == 0 {
+			return newRPCError(req, rpcCodeInvalidParams, "missing filter criteria")
+		}
+		f, err := parseLogFilter(params[0])
+		if err != nil {
+			return newRPCError(req, rpcCodeInvalidParams, err.Error())
+		}
+		f.lastPoll = time.Now()
+
+		var b [16]byte
+		rand.Read(b[:])
+		id := hexutil.Encode(b[:])
+
+		m.mu.Lock()
+		m.filters[id] = f
+		m.mu.Unlock()
+		m.Logs.Add(f.sub)
+		logFiltersActive.Inc()
+
+		result, _ := json.Marshal(id)
+		return newRPCResult(req, result)
+	case "eth_getFilterChanges":
+		id := filterID(req.Params)
+
+		m.mu.Lock()
+		f := m.filters[id]
+		if f != nil {
+			f.lastPoll = time.Now()
+		}
+		m.mu.Unlock()
+		if f == nil {
+			// not proxy's log filter
+			return nil
+		}
+
+		logs := make([]json.RawMessage, 0)
+	drain:
+		for {
+			select {
+			case raw := <-f.sub.ch:
+				if f.inRange(raw) {
+					logs = append(logs, raw)
+				}
+			default:
+				break drain
+			}
+		}
+		result, _ := json.Marshal(logs)
+		return newRPCResult(req, result)
+	case "eth_getFilterLogs":
+		id := filterID(req.Params)
+
+		m.mu.Lock()
+		f := m.filters[id]
+		if f != nil {
+			f.lastPoll = time.Now()
+		}
+		m.mu.Unlock()
+		if f == nil {
+			return nil
+		}
+
+		// stateless, query logs with filter's criteria
+		params, _ := json.Marshal([]json.RawMessage{f.criteria})
+		result, err := callUpstream(r.Context(), &rpcRequest{
+			JSONRPC: "2.0",
+			ID:      req.ID,
+			Method:  "eth_getLogs",
+			Params:  params,
+		})
+		if err != nil {
+			return newRPCErrorFrom(req, err)
+		}
+		return newRPCResult(req, result)
+	case "eth_uninstallFilter":
+		id := filterID(req.Params)
+		if !m.remove(id) {
+			return nil
+		}
+		return newRPCResult(req, json.RawMessage("true"))
+	}
+	return nil
+}
+
+// parseLogFilter parses eth_newFilter criteria into proxy side filter
+func parseLogFilter(criteria json.RawMessage) (*logFilter, error) {
+	var c logFilterCriteria
+	if err := json.Unmarshal(criteria, &c); err != nil {
+		return nil, fmt.Errorf("invalid filter criteria; %v", err)
+	}
+	if c.BlockHash != nil {
+		return nil, fmt.Errorf("blockHash is not supported by filters, use eth_getLogs")
+	}
+
+	f := &logFilter{
+		criteria: criteria,
+		sub: &logsSubscriber{
+			Addresses: make(map[common.Address]bool),
+			ch:        make(chan json.RawMessage, logFilterBuffer),
+			drop:      func() { logFiltersDropped.Inc() },
+		},
+	}
+
+	var err error
+	f.from, err = parseFilterBlock(c.FromBlock)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fromBlock; %v", err)
+	}
+	f.to, err = parseFilterBlock(c.ToBlock)
+	if err != nil {
+		return nil, fmt.Errorf("invalid toBlock; %v", err)
+	}
+
+	if len(c.Address) > 0 && string(c.Address) != "null" {
+		var xs []common.Address
+		var x common.Address
+		if json.Unmarshal(c.Address, &x) == nil {
+			xs = append(xs, x)
+		} else if err := json.Unmarshal(c.Address, &xs); err != nil {
+			return nil, fmt.Errorf("invalid address")
+		}
+		for _, x := range xs {
+			f.sub.Addresses[x] = true
+		}
+	}
+
+	if len(c.Topics) > 4 {
+		return nil, fmt.Errorf("too many topics")
+	}
+	for i, t := range c.Topics {
+		xs := make(map[common.Hash]bool)
+		if len(t) > 0 && string(t) != "null" {
+			var hs []*common.Hash
+			var h common.Hash
+			if json.Unmarshal(t, &h) == nil {
+				hs = append(hs, &h)
+			} else if err := json.Unmarshal(t, &hs); err != nil {
+				return nil, fmt.Errorf("invalid topic%d", i)
+			}
+			for _, h := range hs {
+				if h == nil {
+					// null in list matches any
+					xs = make(map[common.Hash]bool)
+					break
+				}
+				xs[*h] = true
+			}
+		}
+		f.sub.Topics = append(f.sub.Topics, xs)
+	}
+	return f, nil
+}
+
+// parseFilterBlock returns block number, or nil for tag that does not bound new logs
+func parseFilterBlock(x string) (*uint64, error) {
+	switch x {
+	case "", "latest", "pending", "earliest", "safe", "finalized":
+		return nil, nil
+	}
+	n, err := hexutil.DecodeUint64(x)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// inRange returns true if log is within filter's block range
+func (f *logFilter) inRange(raw json.RawMessage) bool {
+	if f.from == nil && f.to == nil {
+		return true
+	}
+	var l struct {
+		BlockNumber hexutil.Uint64 `json:"blockNumber"`
+	}
+	if json.Unmarshal(raw, &l) != nil {
+		return false
+	}
+	n := uint64(l.BlockNumber)
+	if f.from != nil && n < *f.from {
+		return false
+	}
+	if f.to != nil && n > *f.to {
+		return false
+	}
+	return true
+}
+
+func (m *logFilters) remove(id string) bool {
+	m.mu.Lock()
+	f := m.filters[id]
+	delete(m.filters, id)
+	m.mu.Unlock()
+	if f == nil {
+		return false
+	}
+	m.Logs.Remove(f.sub)
+	logFiltersActive.Dec()
+	return true
+}
+
+func (m *logFilters) cleanup() {
+	for {
+		time.Sleep(m.Timeout / 2)
+
+		var expired []string
+		m.mu.Lock()
+		for id, f := range m.filters {
+			if time.Since(f.lastPoll) > m.Timeout {
+				expired = append(expired, id)
+			}
+		}
+		m.mu.Unlock()
+
+		for _, id := range expired {
+			m.remove(id)
+		}
+	}
+}
+
+var (
+	logFiltersActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "log_filters",
+	})
+
+	logFiltersDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "log_filters_dropped",
+	})
+)
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/logger"
+)
+
+// disableLog drops current request's log record
+var disableLog = logger.Disable().ServeHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+// logSampler logs 1 of N successful requests,
+// errors, json-rpc errors, slow requests, and websocket sessions are always logged.
+// It must be placed after logger.
+type logSampler struct {
+	Rate int           // log 1 of Rate successful requests
+	Slow time.Duration // always log requests slower than, 0 = disable
+
+	n uint64
+}
+
+// ServeHandler implements middleware interface
+func (m *logSampler) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWSUpgrade(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		nw := logSampleResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(&nw, r)
+
+		// no response means client canceled
+		if nw.status == 0 || nw.status >= 400 || nw.rpcError {
+			return
+		}
+		if m.Slow > 0 && time.Since(start) >= m.Slow {
+			return
+		}
+		if atomic.AddUint64(&m.n, 1)%uint64(m.Rate) == 0 {
+			logger.Set(r.Context(), "sampleRate", m.Rate)
+			return
+		}
+		disableLog.ServeHTTP(w, r)
+	})
+}
+
+var rpcErrorToken = []byte(`"error":`)
+
+type logSampleResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	rpcError bool
+	tail     []byte // last bytes of previous write, to find token across writes
+}
+
+func (w *logSampleResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *logSampleResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	// best effort, compressed response can not be inspected
+	if !w.rpcError && w.Header().Get("Content-Encoding") == "" {
+		b := append(w.tail, p...)
+		w.rpcError = bytes.Contains(b, rpcErrorToken)
+		if len(b) >= len(rpcErrorToken) {
+			w.tail = append(w.tail[:0], b[len(b)-len(rpcErrorToken)+1:]...)
+		} else {
+			w.tail = append(w.tail[:0], b...)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements Flusher interface
+func (w *logSampleResponseWriter) Flush() {
+	if w, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.Flush()
+	}
+}
@@ -4,235 +4,1927 @@ import (
 	"context"
 	"crypto/tls"
 	"flag"
+	"io"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/moonrhythm/parapet"
 	"github.com/moonrhythm/parapet/pkg/location"
 	"github.com/moonrhythm/parapet/pkg/logger"
 	"github.com/moonrhythm/parapet/pkg/prom"
 	"github.com/moonrhythm/parapet/pkg/stripprefix"
+	"github.com/moonrhythm/parapet/pkg/timeout"
 	"github.com/moonrhythm/parapet/pkg/upstream"
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/moonrhythm/geth-proxy/pkg/cache"
+	"github.com/moonrhythm/geth-proxy/pkg/health"
 )
 
 var (
-	ethClient       *ethclient.Client
-	blockDuration   time.Duration
-	healthyDuration time.Duration
+	pool             *upstreamPool
+	rpcClient        *rpc.Client
+	ethClient        *ethclient.Client
+	blockDuration    time.Duration
+	healthyDuration  time.Duration
+	checkTimeout     time.Duration // health check rpc timeout
+	poolStrategy     string        // upstream load balancing strategy
+	certExpiryHealth bool
+	validateOnly     bool // validate-config subcommand
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "check":
+			runCheck(os.Args[2:])
+			return
+		case "validate-config":
+			// uses proxy's flags, validated after parsed
+			validateOnly = true
+			os.Args = append(os.Args[:1:1], os.Args[2:]...)
+		}
+	}
+
 	var (
-		addr                = flag.String("addr", ":80", "http address")
-		tlsAddr             = flag.String("tls.addr", ":443", "tls address")
-		tlsKey              = flag.String("tls.key", "", "TLS private key file")
-		tlsCert             = flag.String("tls.cert", "", "TLS certificate file")
-		logEnable           = flag.Bool("log", true, "Enable request log")
-		gethAddr            = flag.String("geth.addr", "127.0.0.1", "geth address")
-		gethHTTP            = flag.String("geth.http", "8545", "geth http port")
-		gethWS              = flag.String("geth.ws", "8546", "geth ws port")
-		gethMetrics         = flag.String("geth.metrics", "6060", "geth metrics port")
-		gethBlockUnit       = flag.Duration("geth.block-unit", time.Second, "block timestamp unit")
-		gethHealthyDuration = flag.Duration("geth.healthy-duration", time.Minute, "duration from last block that mark as healthy")
+		configFile              = flag.String("config", "", "config file, one flag name=value per line (precedence: flag > env > config file)")
+		addr                    = newListenFlag("addr", ":80", "http address, repeatable for multiple listeners (addr[,noauth][,noacl])")
+		unixMode                = flag.String("unix.mode", "0660", "unix socket file mode for unix:// listener")
+		tlsAddr                 = newListenFlag("tls.addr", ":443", "tls address, repeatable for multiple listeners (addr[,noauth][,noacl])")
+		tlsKey                  = flag.String("tls.key", "", "TLS private key file")
+		tlsCert                 = flag.String("tls.cert", "", "TLS certificate file")
+		tlsCerts                = flag.String("tls.certs", "", "additional TLS certificates selected by SNI matching certificate names (certfile|keyfile,...)")
+		tlsReloadInterval       = flag.Duration("tls.reload-interval", time.Minute, "interval to check TLS certificate files and reload when changed (0 = reload only on SIGHUP)")
+		tlsHosts                = flag.String("tls.hosts", "", "per host TLS certificate selected by SNI (host=certfile|keyfile,...)")
+		tlsExpiryWarning        = flag.Duration("tls.expiry-warning", 14*24*time.Hour, "log warning when TLS certificate will expire within")
+		tlsExpiryHealth         = flag.Bool("tls.expiry-health", false, "report not ready when TLS certificate expired")
+		metricsAddr             = flag.String("metrics.addr", "", "internal metrics listening address (empty = disable, use /metrics/proxy instead)")
+		metricsExemplars        = flag.Bool("metrics.exemplars", false, "attach trace id from traceparent or x-cloud-trace-context header to upstream latency as exemplar, serves metrics in openmetrics format")
+		opsAddr                 = flag.String("ops.addr", "", "serve /metrics/*, /healthz, /livez, /readyz, and /version only on this address (empty = serve on rpc listeners)")
+		opsAllow                = flag.String("ops.allow", "", "/metrics/*, /healthz, /livez, /readyz, and /version allowed client cidr list (empty = allow all)")
+		statsdAddr              = flag.String("statsd.addr", "", "push metrics to statsd udp address (empty = disable)")
+		statsdPrefix            = flag.String("statsd.prefix", "", "statsd metric name prefix")
+		statsdDogStatsD         = flag.Bool("statsd.dogstatsd", false, "send labels as dogstatsd tags instead of metric name suffix")
+		statsdTags              = flag.String("statsd.tags", "", "global dogstatsd tags (key:value,...)")
+		statsdInterval          = flag.Duration("statsd.interval", 10*time.Second, "statsd counters and gauges push interval")
+		metricsPushURL          = flag.String("metrics.push.url", "", "push metrics to prometheus pushgateway url (empty = disable)")
+		metricsRemoteWriteURL   = flag.String("metrics.remote-write.url", "", "push metrics to prometheus remote-write url, basic auth from url userinfo (empty = disable)")
+		metricsPushJob          = flag.String("metrics.push.job", "geth-proxy", "job label of pushed metrics")
+		metricsPushInstance     = flag.String("metrics.push.instance", "", "instance label of pushed metrics (empty = hostname)")
+		metricsPushInterval     = flag.Duration("metrics.push.interval", 15*time.Second, "pushgateway and remote-write push interval")
+		logEnable               = flag.Bool("log", true, "Enable request log")
+		logFile                 = flag.String("log.file", "", "write request log to file instead of stdout")
+		logFileMaxSize          = flag.Int64("log.file.max-size", 100, "rotate log file when size exceeds (MB, 0 = unlimited)")
+		logFileMaxAge           = flag.Duration("log.file.max-age", 24*time.Hour, "rotate log file when opened longer than (0 = unlimited)")
+		logFileMaxBackups       = flag.Int("log.file.max-backups", 7, "rotated log files to keep (0 = keep all)")
+		logFileCompress         = flag.Bool("log.file.compress", false, "gzip rotated log files")
+		logSample               = flag.Int("log.sample", 1, "log 1 of N successful requests, errors and slow requests are always logged")
+		logSampleSlow           = flag.Duration("log.sample.slow", time.Second, "always log requests slower than when sampling (0 = disable)")
+		logSyslog               = flag.String("log.syslog", "", "send request log to syslog (local, udp://host:port, or tcp://host:port)")
+		gethAddr                = flag.String("geth.addr", "127.0.0.1", "geth address, comma separated for multiple nodes")
+		gethDiscoveryInterval   = flag.Duration("geth.discovery-interval", 30*time.Second, "re-resolve interval for dns discovered geth address")
+		gethHTTP                = flag.String("geth.http", "8545", "geth http port")
+		gethWS                  = flag.String("geth.ws", "8546", "geth ws port")
+		gethWSTimeout           = flag.Duration("geth.ws-timeout", 10*time.Second, "geth ws upgrade response timeout")
+		gethHeadSubscribe       = flag.Bool("geth.head-subscribe", true, "track head with newHeads subscription on geth ws port, fall back to polling while subscription is down")
+		gethGraphQL             = flag.String("geth.graphql", "", "geth graphql port, serves /graphql when set (geth serves graphql on http port)")
+		graphqlMaxDepth         = flag.Int("graphql.max-depth", 10, "max graphql query depth (0 = unlimited)")
+		graphqlMaxComplexity    = flag.Int("graphql.max-complexity", 500, "max graphql query selected fields (0 = unlimited)")
+		wsMaxConns              = flag.Int("ws.max-conns", 0, "max concurrent websocket connections (0 = unlimited)")
+		wsMaxConnsPerIP         = flag.Int("ws.max-conns-per-ip", 0, "max concurrent websocket connections per client ip (0 = unlimited)")
+		wsMaxSubscriptions      = flag.Int("ws.max-subscriptions", 0, "max subscriptions per websocket connection (0 = unlimited)")
+		wsIdleTimeout           = flag.Duration("ws.idle-timeout", 0, "close websocket connection without message in both directions (0 = disable)")
+		wsPingInterval          = flag.Duration("ws.ping-interval", 30*time.Second, "websocket ping interval to client and geth (0 = disable)")
+		wsPongTimeout           = flag.Duration("ws.pong-timeout", 10*time.Second, "close websocket connection when client or geth not respond to ping within")
+		wsReconnect             = flag.Bool("ws.reconnect", false, "reconnect to geth and replay subscriptions when geth websocket connection lost")
+		wsReconnectTimeout      = flag.Duration("ws.reconnect-timeout", 30*time.Second, "max duration to retry websocket reconnect")
+		wsPendingTxFilter       = flag.Bool("ws.pending-tx-filter", false, "serve filtered newPendingTransactions subscriptions (to address, method selector) from one shared geth subscription")
+		wsLogsRequireFilter     = flag.Bool("ws.logs.require-filter", false, "reject logs subscription without address or topics filter")
+		wsLogsMaxAddresses      = flag.Int("ws.logs.max-addresses", 0, "max addresses in logs subscription filter (0 = unlimited)")
+		wsLogsMaxTopics         = flag.Int("ws.logs.max-topics", 0, "max topic values in logs subscription filter (0 = unlimited)")
+		wsLogsMaxSubscriptions  = flag.Int("ws.logs.max-subscriptions", 0, "max logs subscriptions per websocket connection (0 = unlimited)")
+		wsMaxMessageSize        = flag.Int64("ws.max-message-size", 0, "max websocket message size from client in bytes (0 = unlimited)")
+		wsMetrics               = flag.Bool("ws.metrics", false, "websocket message, bytes, subscription, and per method call metrics, and session summary log")
+		gethWeights             = flag.String("geth.weights", "", "geth address weights (addr=weight,...), ex. canary=1,stable=19 (default 1)")
+		gethStrategy            = flag.String("geth.strategy", "round-robin", "geth load balancing strategy (round-robin, hash, least-loaded, latency), hash maps client ip or tenant to the same geth")
+		gethPrimary             = flag.String("geth.primary", "", "geth address that receives write methods, reads go to other nodes (empty = no read/write split)")
+		gethWriteMethods        = flag.String("geth.write-methods", "eth_sendRawTransaction,eth_sendTransaction,eth_newFilter,eth_newBlockFilter,eth_newPendingTransactionFilter,eth_getFilterChanges,eth_getFilterLogs,eth_uninstallFilter", "methods routed to primary geth")
+		gethTraceAddr           = flag.String("geth.trace-addr", "", "geth addresses that serve debug_* and trace_* calls, ex. archive nodes, calls are rejected when none is healthy (empty = any geth)")
+		fallbackURL             = flag.String("fallback.url", "", "external rpc url used when no geth node is healthy")
+		fallbackHeaders         = flag.String("fallback.headers", "", "headers sent to fallback rpc (Key=Value,...), ex. provider auth")
+		fallbackTimeout         = flag.Duration("fallback.timeout", 30*time.Second, "fallback rpc response header timeout")
+		shadowURL               = flag.String("shadow.url", "", "secondary rpc url that receives mirrored read calls, ex. geth running new version")
+		shadowSample            = flag.Float64("shadow.sample", 1, "sample rate of read calls to mirror (0-1)")
+		shadowDiff              = flag.Bool("shadow.diff", false, "compare shadow responses with live responses")
+		shadowTimeout           = flag.Duration("shadow.timeout", 10*time.Second, "shadow request timeout")
+		shadowConcurrency       = flag.Int("shadow.concurrency", 64, "max in-flight shadow requests, more are dropped")
+		hedgeDelay              = flag.Duration("hedge.delay", 0, "send duplicate read call to another geth node when no response within delay (0 = disable)")
+		hedgeMethods            = flag.String("hedge.methods", "eth_call,eth_estimateGas,eth_getBalance,eth_getCode,eth_getStorageAt,eth_getTransactionCount,eth_getBlockByNumber,eth_getBlockByHash,eth_getTransactionByHash,eth_getTransactionReceipt,eth_getLogs,eth_feeHistory", "idempotent read methods to hedge")
+		retryMax                = flag.Int("retry.max", 0, "max retries of failed read call on other geth nodes (0 = disable)")
+		retryOn                 = flag.String("retry.on", "status:429,status:502,status:503,status:504,code:-32005,message:request timed out,message:header not found", "retried upstream errors (status:n, code:n, message:text), connection errors are always retried")
+		retryNever              = flag.String("retry.never", "message:execution reverted", "never retried upstream errors, precedence over -retry.on")
+		gethH2C                 = flag.Bool("geth.h2c", false, "use HTTP/2 cleartext (h2c) to geth http port")
+		gethMaxIdleConns        = flag.Int("geth.max-idle-conns", 10000, "max idle connections per geth node (100 in sidecar mode)")
+		gethMaxConns            = flag.Int("geth.max-conns", 0, "max connections per geth node (0 = unlimited)")
+		gethIdleConnTimeout     = flag.Duration("geth.idle-conn-timeout", 10*time.Minute, "idle connection timeout to geth")
+		gethTCPKeepAlive        = flag.Duration("geth.tcp-keepalive", time.Minute, "tcp keepalive period to geth")
+		gethDialTimeout         = flag.Duration("geth.dial-timeout", 5*time.Second, "dial timeout to geth")
+		gethTLSEnable           = flag.Bool("geth.tls", false, "connect to geth with https and wss")
+		gethTLSCA               = flag.String("geth.tls.ca", "", "geth ca bundle file, added to system roots")
+		gethTLSServerName       = flag.String("geth.tls.server-name", "", "geth tls server name, overrides sni and verified name")
+		gethTLSCert             = flag.String("geth.tls.cert", "", "client certificate file for geth mutual tls")
+		gethTLSKey              = flag.String("geth.tls.key", "", "client key file for geth mutual tls")
+		gethHeaderTimeout       = flag.Duration("geth.response-header-timeout", time.Minute, "geth response header timeout, raised to longest method timeout")
+		gethMetrics             = flag.String("geth.metrics", "6060", "geth metrics port")
+		chainRoutes             = flag.String("chains", "", "additional chains routed by path prefix /name (name=addr|addr,...)")
+		chainHosts              = flag.String("chains.hosts", "", "route additional chains by host, host can be wildcard subdomain (host=name,...)")
+		gethBlockUnit           = flag.Duration("geth.block-unit", time.Second, "block timestamp unit")
+		gethHealthyDuration     = flag.Duration("geth.healthy-duration", time.Minute, "duration from last block that mark as healthy")
+		gethCheckTimeout        = flag.Duration("geth.check-timeout", 2*time.Second, "health check rpc timeout, also deadline of /healthz, /livez, and /readyz")
+		gethFinality            = flag.Bool("geth.finality", false, "track safe and finalized heads")
+		gethFinalizedWindow     = flag.Duration("geth.finalized-window", 0, "mark as not ready when finalized head not advanced within duration (0 = disable)")
+		gethCompress            = flag.String("geth.compress", "", "request compressed response from geth (comma separated encodings, e.g. zstd,gzip)")
+		getLogsMaxRange         = flag.Uint64("getlogs.max-range", 0, "max eth_getLogs block range (0 = unlimited)")
+		getLogsClamp            = flag.Bool("getlogs.clamp", false, "clamp eth_getLogs range to max range instead of reject")
+		getLogsRequireFilter    = flag.Bool("getlogs.require-filter", false, "reject eth_getLogs without address or topics filter")
+		getLogsSplit            = flag.Uint64("getlogs.split", 0, "split eth_getLogs into sub-ranges of this size (0 = disable)")
+		getLogsSplitConcurrency = flag.Int("getlogs.split-concurrency", 1, "max concurrent sub-range queries of split eth_getLogs")
+		getLogsSplitMax         = flag.Int("getlogs.split-max", 100, "max sub-range queries of split eth_getLogs, larger range is rejected (0 = unlimited)")
+		rpcValidate             = flag.Bool("rpc.validate", false, "reject malformed json-rpc requests without forwarding to geth")
+		rpcMaxBatch             = flag.Int("rpc.max-batch", 0, "max calls per json-rpc batch (0 = unlimited)")
+		rpcMaxPayload           = flag.Int64("rpc.max-payload", 0, "max json-rpc request payload in bytes (0 = unlimited)")
+		rpcMaxConcurrent        = flag.Int("rpc.max-concurrent", 0, "max in-flight json-rpc requests per client ip or tenant, extras are rejected (0 = unlimited)")
+		rpcRewrite              = flag.String("rpc.rewrite", "", "rewrite methods before routing (from=to,...), eth_getBlockReceipts=eth_getTransactionReceipt emulates with fan-out")
+		rpcRewriteConcurrency   = flag.Int("rpc.rewrite-concurrency", 8, "max concurrent fan-out calls of emulated method")
+		anomalyEnable           = flag.Bool("anomaly", false, "enable per client anomaly detection")
+		anomalyWindow           = flag.Duration("anomaly.window", 10*time.Minute, "anomaly detection baseline window")
+		anomalyRecent           = flag.Duration("anomaly.recent", time.Minute, "anomaly detection recent window, compared with baseline")
+		anomalyRateFactor       = flag.Float64("anomaly.rate-factor", 5, "flag client when recent request rate exceeds baseline rate by this factor (0 = disable)")
+		anomalyErrorRate        = flag.Float64("anomaly.error-rate", 0.5, "flag client when recent error rate exceeds this rate (0 = disable)")
+		anomalyMethodShift      = flag.Float64("anomaly.method-shift", 1, "flag client when method mix distance from baseline exceeds this value, 0-2 (0 = disable)")
+		anomalyMinRequests      = flag.Int("anomaly.min-requests", 100, "min recent requests to evaluate client")
+		anomalyWebhook          = flag.String("anomaly.webhook", "", "webhook url to notify anomalies")
+		tunnelTargets           = flag.String("tunnel.targets", "", "allowed http CONNECT tunnel targets (host:port,...), empty = disable tunnel")
+		tunnelAuth              = flag.String("tunnel.auth", "", "tunnel credential (username:password)")
+		syncGuardEnable         = flag.Bool("sync-guard", false, "allow only sync-safe methods while geth is syncing")
+		syncGuardMethods        = flag.String("sync-guard.methods", "eth_blockNumber,eth_syncing,eth_chainId,net_version,net_listening,net_peerCount,web3_clientVersion", "methods allowed while geth is syncing")
+		headCacheEnable         = flag.Bool("head-cache", false, "serve eth_blockNumber, eth_chainId, and net_version from proxy's head tracker")
+		rpcGetEnable            = flag.Bool("rpc-get", false, "allow json-rpc over http GET for read methods")
+		rpcGetMethods           = flag.String("rpc-get.methods", "eth_blockNumber,eth_chainId,net_version,web3_clientVersion,eth_syncing,eth_gasPrice,eth_maxPriorityFeePerGas,eth_feeHistory,eth_getBalance,eth_getCode,eth_getStorageAt,eth_getTransactionCount,eth_call,eth_getBlockByNumber,eth_getBlockByHash,eth_getTransactionByHash,eth_getTransactionReceipt,eth_getLogs", "methods allowed over http GET")
+		rpcGetMaxAge            = flag.Duration("rpc-get.max-age", 0, "Cache-Control max-age for json-rpc over http GET response")
+		defaultBlockTag         = flag.String("default-block", "", "default block tag for requests that omit block parameter (latest, safe, finalized)")
+		defaultBlockPathList    = flag.String("default-block.paths", "", "default block tag per json-rpc path (path=tag,...), ex. /finalized=finalized")
+		pinLatestScope          = flag.String("pin-latest", "", "resolve latest block tag once to block number per batch or connection (batch, connection)")
+		pinLatestTTL            = flag.Duration("pin-latest.ttl", 2*time.Second, "lifetime of pinned block number per connection")
+		pollEnable              = flag.Bool("poll", false, "serve eth_newBlockFilter and eth_newFilter (with -geth.ws) polling, and GET /heads/poll long-poll from proxy's head tracker")
+		pollFilterTimeout       = flag.Duration("poll.filter-timeout", 5*time.Minute, "remove filter not polled within")
+		pollMaxTimeout          = flag.Duration("poll.max-timeout", 30*time.Second, "max /heads/poll wait")
+		sseEnable               = flag.Bool("sse", false, "serve server-sent events of new heads (/sse/heads) and logs (/sse/logs)")
+		sseKeepAlive            = flag.Duration("sse.keepalive", 15*time.Second, "server-sent events keepalive comment interval")
+		blockAPIEnable          = flag.Bool("blocks-api", false, "serve GET /v1/blocks/{n}/full with block, receipts, and traces")
+		blockAPIBatch           = flag.Int("blocks-api.batch", 100, "receipts per upstream batch call for /v1/blocks")
+		blockAPIConcurrency     = flag.Int("blocks-api.concurrency", 8, "max concurrent upstream calls per /v1/blocks request")
+		gasEnable               = flag.Bool("gas", false, "serve GET /gas with base fee and priority fee estimates from eth_feeHistory")
+		gasInterval             = flag.Duration("gas.interval", 5*time.Second, "eth_feeHistory poll interval")
+		gasBlocks               = flag.Int("gas.blocks", 20, "blocks of fee history for priority fee estimates")
+		gasPercentiles          = flag.String("gas.percentiles", "10,50,90", "priority fee reward percentiles")
+		txpoolEnable            = flag.Bool("txpool", false, "poll geth's txpool, export metrics, and serve GET /txpool summary")
+		txpoolInterval          = flag.Duration("txpool.interval", 5*time.Second, "txpool_status poll interval")
+		txpoolInspectInterval   = flag.Duration("txpool.inspect-interval", 30*time.Second, "txpool_inspect poll interval for senders summary (0 = disable)")
+		txpoolTopSenders        = flag.Int("txpool.top-senders", 10, "top senders to list in /txpool summary")
+		cacheGasTTL             = flag.Duration("cache.gas-ttl", 0, "cache ttl for eth_gasPrice, eth_maxPriorityFeePerGas, and eth_feeHistory (0 = disable)")
+		probeInterval           = flag.Duration("probe.interval", 0, "synthetic probe interval (0 = disable)")
+		probeURL                = flag.String("probe.url", "", "synthetic probe target url (default proxy's http address)")
+		probeScript             = flag.String("probe.script", "", "synthetic probe script file (json array of {name, method, params})")
+		probeHeaders            = flag.String("probe.headers", "", "synthetic probe request headers (Key=Value,...)")
+		probeTimeout            = flag.Duration("probe.timeout", 5*time.Second, "synthetic probe call timeout")
+		cacheImmutable          = flag.Bool("cache.immutable", false, "cache immutable json-rpc results (e.g. eth_getBlockByHash, eth_getTransactionReceipt)")
+		cacheImmutableTTL       = flag.Duration("cache.immutable-ttl", time.Hour, "in-memory cache ttl for immutable results")
+		cacheConfirmations      = flag.Uint64("cache.confirmations", 64, "block confirmations before transaction and receipt results are cached")
+		cacheRedis              = flag.String("cache.redis", "", "redis address for shared immutable cache tier (empty = disable)")
+		cacheRedisPassword      = flag.String("cache.redis.password", "", "redis password")
+		cacheRedisDB            = flag.Int("cache.redis.db", 0, "redis database")
+		cacheRedisPrefix        = flag.String("cache.redis.prefix", "geth-proxy:", "redis key prefix")
+		cacheRedisTTL           = flag.Duration("cache.redis.ttl", 24*time.Hour, "redis cache ttl for immutable results")
+		chainID                 = flag.Uint64("chain.id", 0, "expected chain id of upstream (0 = not check)")
+		chainGenesis            = flag.String("chain.genesis", "", "expected genesis block hash of upstream")
+		chainValidateSample     = flag.Float64("chain.validate-sample", 0, "sample rate of block and transaction responses to validate against expected chain (0-1)")
+		chainWebhook            = flag.String("chain.webhook", "", "webhook url to notify chain validation failures")
+		alertWebhook            = flag.String("alert.webhook", "", "webhook url to notify node and upstream health changes (slack compatible)")
+		consistencyInterval     = flag.Duration("consistency.interval", 0, "interval to compare the same read calls across geth nodes (0 = disable)")
+		consistencyURL          = flag.String("consistency.url", "", "reference rpc url to compare geth nodes with, ex. external provider")
+		consistencyDepth        = flag.Uint64("consistency.depth", 16, "compared block depth behind the lowest geth head")
+		stuckCommand            = flag.String("stuck.command", "", "shell command to run when head not advanced, ex. systemctl restart geth (empty = disable)")
+		stuckAfter              = flag.Duration("stuck.after", 5*time.Minute, "head not advanced duration to run stuck command")
+		stuckInterval           = flag.Duration("stuck.interval", 30*time.Minute, "min interval between stuck command runs")
+		stuckTimeout            = flag.Duration("stuck.timeout", time.Minute, "stuck command timeout")
+		stuckDryRun             = flag.Bool("stuck.dry-run", false, "log stuck command without running")
+		alertDebounce           = flag.Duration("alert.debounce", 30*time.Second, "duration health change must persist before notified")
+		broadcastEnable         = flag.Bool("broadcast", false, "broadcast eth_sendRawTransaction to all healthy geth nodes")
+		broadcastTimeout        = flag.Duration("broadcast.timeout", 10*time.Second, "broadcast timeout per geth node")
+		privateRelay            = flag.String("private.relay", "", "external relay json-rpc url for private transactions (ex. https://rpc.flashbots.net)")
+		privateMethods          = flag.String("private.methods", "eth_sendPrivateTransaction", "comma separated methods to route to private relay")
+		privateFallback         = flag.Bool("private.fallback", false, "send transaction to geth when private relay failed")
+		privateTimeout          = flag.Duration("private.timeout", 10*time.Second, "private relay timeout")
+		timeoutDefault          = flag.Duration("timeout", 0, "default upstream timeout for json-rpc call (0 = no timeout)")
+		timeoutMethods          = flag.String("timeout.methods", "", "per method upstream timeout (method=duration,...), method can be prefix pattern (ex. debug_*=2m)")
+		heavyEnable             = flag.Bool("heavy", false, "route debug_* and trace_* calls through separated connection pool, queue, and timeout")
+		heavyMaxConns           = flag.Int("heavy.max-conns", 4, "max upstream connections per geth for heavy calls")
+		heavyConcurrency        = flag.Int("heavy.concurrency", 4, "max concurrent heavy calls")
+		heavyQueue              = flag.Int("heavy.queue", 100, "max queued heavy calls")
+		heavyTimeout            = flag.Duration("heavy.timeout", 2*time.Minute, "heavy call timeout")
+		heavyTraceConcurrency   = flag.Int("heavy.trace-concurrency", 0, "max concurrent debug_trace* calls, separated from other heavy calls (0 = share heavy limit)")
+		heavyTraceQueue         = flag.Int("heavy.trace-queue", 100, "max queued debug_trace* calls")
+		limitConcurrency        = flag.Int("limit.concurrency", 0, "max concurrent calls to geth, proxy-wide (0 = unlimited)")
+		limitTiers              = flag.String("limit.tiers", "", "priority tiers for queued calls, highest first (ex. internal,enterprise,pro)")
+		limitQueue              = flag.Int("limit.queue", 1000, "max queued calls when concurrency limit reached")
+		limitRetryAfter         = flag.Duration("limit.retry-after", time.Second, "Retry-After sent to client when call is rejected by limiter")
+		txValidate              = flag.Bool("txvalidate", false, "decode and validate eth_sendRawTransaction before forwarding")
+		txValidateMaxGas        = flag.Uint64("txvalidate.max-gas", 0, "reject transaction with gas limit above (0 = unlimited)")
+		txValidateNonce         = flag.Bool("txvalidate.nonce", true, "reject transaction with nonce lower than sender's confirmed nonce")
+		drainWait               = flag.Duration("drain.wait", 0, "duration to keep serving after entering maintenance mode or SIGTERM, for load balancer to de-register")
+		drainTimeout            = flag.Duration("drain.timeout", 3*time.Second, "max duration to wait for in-flight requests and websocket sessions on shutdown")
+		upgradeEnable           = flag.Bool("upgrade", false, "re-execute binary on SIGUSR2 then drain old process without dropping connections (listen with SO_REUSEPORT)")
+		upgradeTimeout          = flag.Duration("upgrade.timeout", 30*time.Second, "max duration to wait for new process to be ready on upgrade")
+		upgradeWSDrain          = flag.Duration("upgrade.ws-drain-timeout", time.Hour, "max duration old process keeps websocket sessions after upgrade")
+		trustedProxyList        = flag.String("trusted-proxies", "", "proxy cidr list allowed to set X-Forwarded-For and X-Real-Ip (empty = trust none)")
+		adminAddr               = flag.String("admin.addr", "", "admin api address (empty = disable)")
+		adminAuth               = flag.String("admin.auth", "", "admin api basic auth (username:password)")
+		adminAllow              = flag.String("admin.allow", "", "admin api allowed client cidr list (empty = allow all)")
+		authBasic               = flag.String("auth.basic", "", "rpc and websocket basic auth (username:password)")
+		authKeys                = newStringsFlag("auth.key", "rpc and websocket api key with policy, repeatable (tenant:key;tier=name;methods=method|namespace_*;rate=n;cu=n;batch=n;block=tag)")
+		authHtpasswd            = flag.String("auth.htpasswd", "", "rpc and websocket basic auth htpasswd file (bcrypt, sha1, or plain)")
+		internalAuth            = flag.String("internal.auth", "", "basic auth for /internal/rpc (username:password), enables /internal/rpc")
+		internalHtpasswd        = flag.String("internal.htpasswd", "", "basic auth htpasswd file for /internal/rpc, enables /internal/rpc")
+		internalNamespaces      = flag.String("internal.namespaces", "admin,debug,txpool", "namespaces served only by /internal/rpc, blocked on public route")
+		jwtKey                  = flag.String("jwt.key", "", "validate bearer token with static key file (PEM public key or hmac secret)")
+		jwtJWKS                 = flag.String("jwt.jwks", "", "validate bearer token with keys from jwks url")
+		jwtJWKSRefresh          = flag.Duration("jwt.jwks-refresh", time.Hour, "jwks refresh interval")
+		jwtIssuer               = flag.String("jwt.issuer", "", "required token issuer (iss)")
+		jwtAudience             = flag.String("jwt.audience", "", "required token audience (aud)")
+		jwtTenantClaim          = flag.String("jwt.tenant-claim", "tenant", "claim used as tenant for client identity and metrics")
+		jwtTierClaim            = flag.String("jwt.tier-claim", "tier", "claim used as tier for metrics")
+		jwtLeeway               = flag.Duration("jwt.leeway", time.Minute, "allowed clock skew for token exp and nbf")
+		jwtAllowNoExp           = flag.Bool("jwt.allow-no-exp", false, "accept token without exp claim, the token never expires")
+		usageWeights            = flag.String("usage.weights", "", "compute units per method for usage accounting, api key cu limit, and metrics (method=units,namespace_*=units,*=units), default 1 per call")
+		usageFile               = flag.String("usage.file", "", "append per tenant usage to file every interval (empty = disable)")
+		usageFormat             = flag.String("usage.format", "json", "usage file format (json or csv)")
+		usageInterval           = flag.Duration("usage.interval", time.Hour, "usage export interval")
+		aclAllow                = flag.String("acl.allow", "", "allowed client cidr list per path prefix (prefix=cidr|cidr,...)")
+		aclDeny                 = flag.String("acl.deny", "", "denied client cidr list per path prefix (prefix=cidr|cidr,...)")
+		sidecarEnable           = flag.Bool("sidecar", false, "kubernetes sidecar mode (local geth, no tls, lifecycle endpoints)")
+		sidecarDrain            = flag.Duration("sidecar.drain", 15*time.Second, "duration to drain in preStop hook")
+		slowLogThreshold        = flag.Duration("slowlog", 0, "log json-rpc calls slower than this duration (0 = disable)")
+		slowLogMethods          = flag.String("slowlog.methods", "", "per method slow log threshold (method=duration,...)")
+		slowLogMaxParams        = flag.Int("slowlog.max-params", 256, "max params length in slow log")
+		captureFile             = flag.String("capture.file", "", "record json-rpc calls to file for replay subcommand (empty = disable)")
+		captureSample           = flag.Float64("capture.sample", 1, "sample rate of json-rpc calls to record (0-1)")
+		captureRedact           = flag.String("capture.redact", "eth_sendRawTransaction,eth_sendTransaction,eth_sign,personal_sign,personal_unlockAccount", "methods that params will not be recorded")
+		slowLogRedact           = flag.String("slowlog.redact", "eth_sendRawTransaction,eth_sendTransaction,eth_sign,personal_sign,personal_unlockAccount", "methods that params will be redacted from slow log")
 	)
 
 	flag.Parse()
+	if err := loadConfig(flag.CommandLine, "config"); err != nil {
+		log.Fatalf("invalid config; %v", err)
+	}
+	if *sidecarEnable {
+		// geth runs in the same pod
+		if !isFlagSet("geth.addr") {
+			*gethAddr = "127.0.0.1"
+		}
+		// tls terminates at ingress
+		if !isFlagSet("tls.addr") {
+			*tlsAddr = listenFlag{}
+		}
+		// only local geth, keep footprint small
+		if !isFlagSet("geth.max-idle-conns") {
+			*gethMaxIdleConns = 100
+		}
+	}
+	if validateOnly {
+		runValidateConfig()
+		return
+	}
+	httpListeners, err := addr.Listeners()
+	if err != nil {
+		log.Fatalf("invalid http address; %v", err)
+	}
+	tlsListeners, err := tlsAddr.Listeners()
+	if err != nil {
+		log.Fatalf("invalid tls address; %v", err)
+	}
+	socketMode, err := strconv.ParseUint(*unixMode, 8, 32)
+	if err != nil {
+		log.Fatalf("invalid unix socket mode; %v", err)
+	}
 
-	log.Printf("geth-proxy")
-	log.Printf("HTTP address: %s", *addr)
-	log.Printf("HTTPS address: %s", *tlsAddr)
+	log.Printf("geth-proxy %s", version)
+	log.Printf("Config file: %s", *configFile)
+	log.Printf("HTTP address: %s", addr)
+	log.Printf("HTTPS address: %s", tlsAddr)
+	log.Printf("Unix socket mode: %s", *unixMode)
+	log.Printf("TLS certs: %s", *tlsCerts)
+	log.Printf("TLS hosts: %s", *tlsHosts)
+	log.Printf("TLS reload interval: %s", *tlsReloadInterval)
+	log.Printf("TLS expiry warning: %s", *tlsExpiryWarning)
+	log.Printf("Metrics address: %s", *metricsAddr)
+	log.Printf("Metrics exemplars: %t", *metricsExemplars)
+	log.Printf("Ops address: %s", *opsAddr)
+	log.Printf("Ops allow: %s", *opsAllow)
+	log.Printf("StatsD address: %s", *statsdAddr)
+	log.Printf("StatsD prefix: %s", *statsdPrefix)
+	log.Printf("StatsD dogstatsd: %t", *statsdDogStatsD)
+	log.Printf("StatsD tags: %s", *statsdTags)
+	log.Printf("StatsD interval: %s", *statsdInterval)
+	log.Printf("Metrics push url: %t", *metricsPushURL != "")
+	log.Printf("Metrics remote-write url: %t", *metricsRemoteWriteURL != "")
+	log.Printf("Metrics push job: %s", *metricsPushJob)
+	log.Printf("Metrics push instance: %s", *metricsPushInstance)
+	log.Printf("Metrics push interval: %s", *metricsPushInterval)
+	log.Printf("Log file: %s", *logFile)
+	log.Printf("Log file max size: %dMB", *logFileMaxSize)
+	log.Printf("Log file max age: %s", *logFileMaxAge)
+	log.Printf("Log file max backups: %d", *logFileMaxBackups)
+	log.Printf("Log file compress: %t", *logFileCompress)
+	log.Printf("Log syslog: %s", *logSyslog)
+	log.Printf("Log sample: %d", *logSample)
+	log.Printf("Log sample slow: %s", *logSampleSlow)
 	log.Printf("Geth address: %s", *gethAddr)
+	log.Printf("Geth discovery interval: %s", *gethDiscoveryInterval)
 	log.Printf("Geth http Port: %s", *gethHTTP)
 	log.Printf("Geth ws Port: %s", *gethWS)
+	log.Printf("Geth h2c: %t", *gethH2C)
+	log.Printf("Geth max idle conns: %d", *gethMaxIdleConns)
+	log.Printf("Geth primary: %s", *gethPrimary)
+	log.Printf("Geth trace addr: %s", *gethTraceAddr)
+	log.Printf("Geth weights: %s", *gethWeights)
+	log.Printf("Geth strategy: %s", *gethStrategy)
+	log.Printf("Geth write methods: %s", *gethWriteMethods)
+	log.Printf("Fallback url: %t", *fallbackURL != "")
+	log.Printf("Fallback timeout: %s", *fallbackTimeout)
+	log.Printf("Shadow url: %t", *shadowURL != "")
+	log.Printf("Shadow sample: %g", *shadowSample)
+	log.Printf("Shadow diff: %t", *shadowDiff)
+	log.Printf("Shadow timeout: %s", *shadowTimeout)
+	log.Printf("Shadow concurrency: %d", *shadowConcurrency)
+	log.Printf("Hedge delay: %s", *hedgeDelay)
+	log.Printf("Hedge methods: %s", *hedgeMethods)
+	log.Printf("Retry max: %d", *retryMax)
+	log.Printf("Retry on: %s", *retryOn)
+	log.Printf("Retry never: %s", *retryNever)
+	log.Printf("Geth max conns: %d", *gethMaxConns)
+	log.Printf("Geth idle conn timeout: %s", *gethIdleConnTimeout)
+	log.Printf("Geth tcp keepalive: %s", *gethTCPKeepAlive)
+	log.Printf("Geth dial timeout: %s", *gethDialTimeout)
+	log.Printf("Geth TLS: %t", *gethTLSEnable)
+	log.Printf("Geth TLS server name: %s", *gethTLSServerName)
+	log.Printf("Geth TLS client certificate: %t", *gethTLSCert != "")
+	log.Printf("Geth response header timeout: %s", *gethHeaderTimeout)
+	log.Printf("Geth ws timeout: %s", *gethWSTimeout)
+	log.Printf("Geth head subscribe: %t", *gethHeadSubscribe)
+	log.Printf("Geth graphql Port: %s", *gethGraphQL)
+	log.Printf("GraphQL max depth: %d", *graphqlMaxDepth)
+	log.Printf("GraphQL max complexity: %d", *graphqlMaxComplexity)
+	log.Printf("WS max conns: %d", *wsMaxConns)
+	log.Printf("WS max conns per ip: %d", *wsMaxConnsPerIP)
+	log.Printf("WS max subscriptions: %d", *wsMaxSubscriptions)
+	log.Printf("WS idle timeout: %s", *wsIdleTimeout)
+	log.Printf("WS max message size: %d", *wsMaxMessageSize)
+	log.Printf("WS pending tx filter: %t", *wsPendingTxFilter)
+	log.Printf("WS metrics: %t", *wsMetrics)
+	log.Printf("WS logs require filter: %t", *wsLogsRequireFilter)
+	log.Printf("WS logs max addresses: %d", *wsLogsMaxAddresses)
+	log.Printf("WS logs max topics: %d", *wsLogsMaxTopics)
+	log.Printf("WS logs max subscriptions: %d", *wsLogsMaxSubscriptions)
+	log.Printf("WS ping interval: %s", *wsPingInterval)
+	log.Printf("WS pong timeout: %s", *wsPongTimeout)
+	log.Printf("WS reconnect: %t", *wsReconnect)
+	log.Printf("WS reconnect timeout: %s", *wsReconnectTimeout)
+	log.Printf("Chains: %s", *chainRoutes)
+	log.Printf("Chains hosts: %s", *chainHosts)
 	log.Printf("Geth metrics port: %s", *gethMetrics)
 	log.Printf("Geth block unit: %s", *gethBlockUnit)
 	log.Printf("Geth healthy-duration: %s", *gethHealthyDuration)
+	log.Printf("Geth check timeout: %s", *gethCheckTimeout)
+	log.Printf("Geth finality: %t", *gethFinality)
+	log.Printf("Geth finalized window: %s", *gethFinalizedWindow)
+	log.Printf("Alert webhook: %s", *alertWebhook)
+	log.Printf("Alert debounce: %s", *alertDebounce)
+	log.Printf("Consistency interval: %s", *consistencyInterval)
+	log.Printf("Consistency url: %t", *consistencyURL != "")
+	log.Printf("Consistency depth: %d", *consistencyDepth)
+	log.Printf("Stuck command: %s", *stuckCommand)
+	log.Printf("Stuck after: %s", *stuckAfter)
+	log.Printf("Stuck interval: %s", *stuckInterval)
+	log.Printf("Stuck timeout: %s", *stuckTimeout)
+	log.Printf("Stuck dry run: %t", *stuckDryRun)
+	log.Printf("Geth compress: %s", *gethCompress)
+	log.Printf("eth_getLogs max range: %d", *getLogsMaxRange)
+	log.Printf("eth_getLogs split: %d", *getLogsSplit)
+	log.Printf("eth_getLogs split max: %d", *getLogsSplitMax)
+	log.Printf("RPC validate: %t", *rpcValidate)
+	log.Printf("RPC max batch: %d", *rpcMaxBatch)
+	log.Printf("RPC max payload: %d", *rpcMaxPayload)
+	log.Printf("RPC max concurrent: %d", *rpcMaxConcurrent)
+	log.Printf("RPC rewrite: %s", *rpcRewrite)
+	log.Printf("Anomaly detection: %t", *anomalyEnable)
+	log.Printf("Tunnel targets: %s", *tunnelTargets)
+	log.Printf("Sync guard: %t", *syncGuardEnable)
+	log.Printf("Head cache: %t", *headCacheEnable)
+	log.Printf("Poll emulation: %t", *pollEnable)
+	log.Printf("Poll filter timeout: %s", *pollFilterTimeout)
+	log.Printf("Poll max timeout: %s", *pollMaxTimeout)
+	log.Printf("SSE: %t", *sseEnable)
+	log.Printf("SSE keepalive: %s", *sseKeepAlive)
+	log.Printf("JSON-RPC over GET: %t", *rpcGetEnable)
+	log.Printf("Default block: %s", *defaultBlockTag)
+	log.Printf("Default block paths: %s", *defaultBlockPathList)
+	log.Printf("Pin latest: %s", *pinLatestScope)
+	log.Printf("Pin latest ttl: %s", *pinLatestTTL)
+	log.Printf("Blocks API: %t", *blockAPIEnable)
+	log.Printf("Gas oracle: %t", *gasEnable)
+	log.Printf("Gas oracle interval: %s", *gasInterval)
+	log.Printf("Gas oracle blocks: %d", *gasBlocks)
+	log.Printf("Gas oracle percentiles: %s", *gasPercentiles)
+	log.Printf("Txpool: %t", *txpoolEnable)
+	log.Printf("Txpool interval: %s", *txpoolInterval)
+	log.Printf("Txpool inspect interval: %s", *txpoolInspectInterval)
+	log.Printf("Cache gas ttl: %s", *cacheGasTTL)
+	log.Printf("Probe interval: %s", *probeInterval)
+	log.Printf("Cache immutable: %t", *cacheImmutable)
+	log.Printf("Cache confirmations: %d", *cacheConfirmations)
+	log.Printf("Cache redis: %s", *cacheRedis)
+	log.Printf("Chain id: %d", *chainID)
+	log.Printf("Chain genesis: %s", *chainGenesis)
+	log.Printf("Broadcast: %t", *broadcastEnable)
+	log.Printf("Private relay: %s", *privateRelay)
+	log.Printf("Private methods: %s", *privateMethods)
+	log.Printf("Private fallback: %t", *privateFallback)
+	log.Printf("Timeout: %s", *timeoutDefault)
+	log.Printf("Timeout methods: %s", *timeoutMethods)
+	log.Printf("Limit concurrency: %d", *limitConcurrency)
+	log.Printf("Limit queue: %d", *limitQueue)
+	log.Printf("Limit retry after: %s", *limitRetryAfter)
+	log.Printf("Limit tiers: %s", *limitTiers)
+	log.Printf("Heavy path: %t", *heavyEnable)
+	log.Printf("Heavy trace concurrency: %d", *heavyTraceConcurrency)
+	log.Printf("Tx validate: %t", *txValidate)
+	log.Printf("Tx validate max gas: %d", *txValidateMaxGas)
+	log.Printf("Drain wait: %s", *drainWait)
+	log.Printf("Drain timeout: %s", *drainTimeout)
+	log.Printf("Trusted proxies: %s", *trustedProxyList)
+	log.Printf("Upgrade: %t", *upgradeEnable)
+	log.Printf("Upgrade timeout: %s", *upgradeTimeout)
+	log.Printf("Upgrade ws drain timeout: %s", *upgradeWSDrain)
+	log.Printf("Admin address: %s", *adminAddr)
+	log.Printf("Admin allow: %s", *adminAllow)
+	log.Printf("Auth basic: %t", *authBasic != "")
+	log.Printf("Auth htpasswd: %s", *authHtpasswd)
+	log.Printf("Auth api keys: %d", len(*authKeys))
+	log.Printf("Internal auth: %t", *internalAuth != "")
+	log.Printf("Internal htpasswd: %s", *internalHtpasswd)
+	log.Printf("Internal namespaces: %s", *internalNamespaces)
+	log.Printf("JWT key: %s", *jwtKey)
+	log.Printf("JWT jwks: %s", *jwtJWKS)
+	log.Printf("JWT issuer: %s", *jwtIssuer)
+	log.Printf("JWT audience: %s", *jwtAudience)
+	log.Printf("JWT allow no exp: %v", *jwtAllowNoExp)
+	log.Printf("Usage weights: %s", *usageWeights)
+	log.Printf("Usage file: %s", *usageFile)
+	log.Printf("Usage format: %s", *usageFormat)
+	log.Printf("Usage interval: %s", *usageInterval)
+	log.Printf("ACL allow: %s", *aclAllow)
+	log.Printf("ACL deny: %s", *aclDeny)
+	log.Printf("Sidecar: %t", *sidecarEnable)
+	log.Printf("Slow log: %s", *slowLogThreshold)
+	log.Printf("Slow log methods: %s", *slowLogMethods)
+	log.Printf("Capture file: %s", *captureFile)
+	log.Printf("Capture sample: %g", *captureSample)
+
+	blockDuration = *gethBlockUnit
+	healthyDuration = *gethHealthyDuration
+	exemplarsEnabled = *metricsExemplars
+	checkTimeout = *gethCheckTimeout
+	switch *gethStrategy {
+	case strategyRoundRobin, strategyHash, strategyLeastLoaded, strategyLatency:
+		poolStrategy = *gethStrategy
+	default:
+		log.Fatalf("invalid geth strategy %s, required round-robin, hash, least-loaded, or latency", *gethStrategy)
+	}
+
+	if *gethH2C && *gethTLSEnable {
+		log.Fatalf("geth h2c can not be used with geth tls")
+	}
+	if *gethTLSEnable {
+		gethTLS, err = newGethTLSConfig(*gethTLSCA, *gethTLSServerName, *gethTLSCert, *gethTLSKey)
+		if err != nil {
+			log.Fatalf("invalid geth tls; %v", err)
+		}
+	}
 
 	// TODO: lazy dial ?
-	var err error
-	ethClient, err = ethclient.Dial("http://" + *gethAddr + ":" + *gethHTTP)
+	weights, err := parseWeights(*gethWeights)
 	if err != nil {
-		log.Fatalf("can not dial geth; %v", err)
+		log.Fatalf("invalid geth weights; %v", err)
+	}
+	pool = newUpstreamPool("default")
+	pool.Weights = weights
+	gethAddrs := parseList(*gethAddr)
+	if len(gethAddrs) == 0 {
+		log.Fatalf("geth address required")
+	}
+	for _, x := range gethAddrs {
+		if d, ok := parseDiscovery(x, *gethHTTP, *gethDiscoveryInterval); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := d.Sync(ctx)
+			cancel()
+			if err != nil {
+				log.Fatalf("can not discover geth address %s; %v", d.Source(), err)
+			}
+			d.Start()
+			continue
+		}
+
+		u, err := newGethUpstream(pool.Chain, x, *gethHTTP)
+		if err != nil {
+			log.Fatalf("can not dial geth; %v", err)
+		}
+		pool.Add(u)
+	}
+	if len(pool.List()) == 0 {
+		log.Fatalf("no geth upstream")
+	}
+	if *gethPrimary != "" {
+		if pool.Get(*gethPrimary) == nil {
+			log.Fatalf("geth primary %s is not in geth address", *gethPrimary)
+		}
+		if *broadcastEnable {
+			log.Fatalf("geth primary can not be used with -broadcast")
+		}
+		pool.Primary = *gethPrimary
+		pool.WriteMethods = parseSet(*gethWriteMethods)
+	}
+	if *gethTraceAddr != "" {
+		pool.TraceAddrs = parseSet(*gethTraceAddr)
+		for addr := range pool.TraceAddrs {
+			if pool.Get(addr) == nil {
+				log.Fatalf("geth trace addr %s is not in geth address", addr)
+			}
+		}
+		pool.TraceMethod = isHeavyMethod
+	}
+	pool.Start()
+
+	// primary geth, use for head tracking
+	// discovered upstreams can be removed, dial the dns name instead
+	gethPrimaryAddr := gethAddrs[0]
+	if d, ok := parseDiscovery(gethPrimaryAddr, *gethHTTP, *gethDiscoveryInterval); ok {
+		gethPrimaryAddr = d.Host()
+		c, err := rpc.DialHTTPWithClient(gethURL(gethPrimaryAddr, *gethHTTP), &http.Client{Transport: gethClientTransport()})
+		if err != nil {
+			log.Fatalf("can not dial geth; %v", err)
+		}
+		rpcClient = c
+		ethClient = ethclient.NewClient(c)
+	} else {
+		rpcClient = pool.List()[0].RPC
+		ethClient = pool.List()[0].Eth
+	}
+	headTracker = &health.Tracker{
+		Fetch: func(ctx context.Context) (*types.Header, error) {
+			// only header is used, do not download block body
+			return ethClient.HeaderByNumber(ctx, nil)
+		},
+		Timeout:         checkTimeout,
+		HealthyDuration: healthyDuration,
+		BlockUnit:       blockDuration,
+		OnHead:          heads.Publish,
+	}
+	if *gethHeadSubscribe && *gethWS != "" {
+		startHeadSubscription(&wsProxy{
+			Pool:             pool,
+			Port:             *gethWS,
+			HandshakeTimeout: *gethWSTimeout,
+		}, gethPrimaryAddr)
+	}
+	finalizedWindow = *gethFinalizedWindow
+	maintenance.drainWait = *drainWait
+	certExpiryHealth = *tlsExpiryHealth
+
+	defaultBlockPathTags := parseMap(*defaultBlockPathList)
+	for _, tag := range defaultBlockPathTags {
+		if !isBlockTag(tag) {
+			log.Fatalf("invalid default block tag %s", tag)
+		}
+	}
+	if *defaultBlockTag != "" && !isBlockTag(*defaultBlockTag) {
+		log.Fatalf("invalid default block tag %s", *defaultBlockTag)
+	}
+	var pinLatestBlock *pinLatest
+	switch *pinLatestScope {
+	case "":
+	case "batch":
+		pinLatestBlock = &pinLatest{}
+	case "connection":
+		if *pinLatestTTL <= 0 {
+			log.Fatalf("pin latest ttl must be positive")
+		}
+		pinLatestBlock = &pinLatest{PerConnection: true, TTL: *pinLatestTTL}
+	default:
+		log.Fatalf("invalid pin latest scope %s", *pinLatestScope)
+	}
+
+	methodTimeouts, err := parseDurationMap(*timeoutMethods)
+	if err != nil {
+		log.Fatalf("invalid timeout methods; %v", err)
+	}
+	rpcTimeout := methodTimeout{
+		Default: *timeoutDefault,
+		Methods: methodTimeouts,
+	}
+	// transport's response header timeout must not cut long method timeout
+	responseHeaderTimeout := *gethHeaderTimeout
+	if d := rpcTimeout.Max(); d > responseHeaderTimeout {
+		responseHeaderTimeout = d
+	}
+	transport := transportConfig{
+		MaxIdleConns:          *gethMaxIdleConns,
+		MaxConnsPerHost:       *gethMaxConns,
+		IdleConnTimeout:       *gethIdleConnTimeout,
+		TCPKeepAlive:          *gethTCPKeepAlive,
+		DialTimeout:           *gethDialTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		TLS:                   gethTLS,
+	}
+
+	chains, err := parseChainRoutes(*chainRoutes, *chainHosts, *gethHTTP)
+	if err != nil {
+		log.Fatalf("invalid chains; %v", err)
+	}
+	wsConns := &wsConnLimiter{
+		MaxConns:      *wsMaxConns,
+		MaxConnsPerIP: *wsMaxConnsPerIP,
+	}
+	wsLogs := &wsLogsGuard{
+		RequireFilter:    *wsLogsRequireFilter,
+		MaxAddresses:     *wsLogsMaxAddresses,
+		MaxTopics:        *wsLogsMaxTopics,
+		MaxSubscriptions: *wsLogsMaxSubscriptions,
+	}
+	if !wsLogs.Enabled() {
+		wsLogs = nil
+	}
+	for _, c := range chains {
+		c.WSPort = *gethWS
+		c.WSTimeout = *gethWSTimeout
+		c.GraphQLPort = *gethGraphQL
+		c.GraphQL = graphqlGuard{
+			MaxDepth:      *graphqlMaxDepth,
+			MaxComplexity: *graphqlMaxComplexity,
+		}
+		c.WS = wsProxy{
+			Conns:            wsConns,
+			MaxSubscriptions: *wsMaxSubscriptions,
+			IdleTimeout:      *wsIdleTimeout,
+			MaxMessageSize:   *wsMaxMessageSize,
+			PingInterval:     *wsPingInterval,
+			PongTimeout:      *wsPongTimeout,
+			Reconnect:        *wsReconnect,
+			ReconnectTimeout: *wsReconnectTimeout,
+			PendingTxFilter:  *wsPendingTxFilter,
+			Logs:             wsLogs,
+			Metrics:          *wsMetrics,
+		}
+		c.Transport = transport
+		c.Pool.Start()
+	}
+
+	slowLogMethodThresholds, err := parseDurationMap(*slowLogMethods)
+	if err != nil {
+		log.Fatalf("invalid slow log methods; %v", err)
 	}
-	blockDuration = *gethBlockUnit
-	healthyDuration = *gethHealthyDuration
 
 	prom.Registry().MustRegister(headDuration)
+	prom.Registry().MustRegister(upstreamCompressionSaved)
+	prom.Registry().MustRegister(getLogsGuardCount)
+	prom.Registry().MustRegister(getLogsSplitCount)
+	prom.Registry().MustRegister(rpcRewrites)
+	prom.Registry().MustRegister(batchLimitRejected)
+	prom.Registry().MustRegister(rpcInvalid)
+	prom.Registry().MustRegister(anomalyCount)
+	prom.Registry().MustRegister(anomalyClients)
+	prom.Registry().MustRegister(tunnelActive)
+	prom.Registry().MustRegister(tunnelConnections)
+	prom.Registry().MustRegister(cacheCount)
+	prom.Registry().MustRegister(wsUpgradeFailures)
+	prom.Registry().MustRegister(wsClosed)
+	prom.Registry().MustRegister(wsSubscriptionRejected)
+	prom.Registry().MustRegister(wsReconnects)
+	prom.Registry().MustRegister(wsReplays)
+	if *wsPendingTxFilter {
+		prom.Registry().MustRegister(pendingTxSubscribers, pendingTxDropped)
+	}
+	if wsLogs != nil {
+		prom.Registry().MustRegister(wsLogsRejected)
+	}
+	if *wsMetrics {
+		prom.Registry().MustRegister(wsMessages, wsMessageBytes, wsCalls, wsSubscriptions)
+	}
+	if *gethFinality || finalizedWindow > 0 {
+		prom.Registry().MustRegister(tagHead, tagHeadLag)
+		startFinalityTracker()
+	}
+	prom.Registry().MustRegister(upstreamRequests, upstreamDuration, upstreamInFlight, upstreamHead, upstreamLag, upstreamHealthy, upstreamWeight)
+	prom.Registry().MustRegister(buildInfo, upstreamBuildInfo)
+	promSetBuildInfo()
 	go func() {
 		// update stats
 
 		for {
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
 			promUpdateHeadDuration(ctx)
 			cancel()
+			promUpdateUpstreams(pool)
+			for _, c := range chains {
+				promUpdateUpstreams(c.Pool)
+			}
 
 			time.Sleep(time.Second)
 		}
 	}()
 
+	versions := &versionTracker{
+		Pools:    []*upstreamPool{pool},
+		Interval: time.Minute,
+	}
+	for _, c := range chains {
+		versions.Pools = append(versions.Pools, c.Pool)
+	}
+	versions.Start()
+
+	if *alertWebhook != "" {
+		m := &healthAlerter{
+			Webhook:  *alertWebhook,
+			Debounce: *alertDebounce,
+			Pools:    []*upstreamPool{pool},
+		}
+		for _, c := range chains {
+			m.Pools = append(m.Pools, c.Pool)
+		}
+		m.Start()
+	}
+
+	if *consistencyInterval > 0 {
+		prom.Registry().MustRegister(consistencyChecks)
+		m := &consistencyChecker{
+			Pool:     pool,
+			Depth:    *consistencyDepth,
+			Interval: *consistencyInterval,
+			Timeout:  5 * time.Second,
+		}
+		if *consistencyURL != "" {
+			if _, err := parseRPCURL(*consistencyURL); err != nil {
+				log.Fatalf("invalid consistency url; %v", err)
+			}
+			m.Reference, err = rpc.DialHTTP(*consistencyURL)
+			if err != nil {
+				log.Fatalf("can not dial consistency url; %v", err)
+			}
+		}
+		m.Start()
+	}
+
+	if *stuckCommand != "" {
+		prom.Registry().MustRegister(stuckHookRuns)
+		m := &stuckHook{
+			Command:  *stuckCommand,
+			After:    *stuckAfter,
+			Interval: *stuckInterval,
+			Timeout:  *stuckTimeout,
+			DryRun:   *stuckDryRun,
+		}
+		m.Start()
+	}
+
+	var statsd *statsdClient
+	if *statsdAddr != "" {
+		statsd, err = newStatsdClient(*statsdAddr)
+		if err != nil {
+			log.Fatalf("can not dial statsd; %v", err)
+		}
+		statsd.Prefix = *statsdPrefix
+		statsd.DogStatsD = *statsdDogStatsD
+		statsd.Tags = parseList(*statsdTags)
+		statsd.Start()
+
+		e := &statsdExporter{
+			Client:   statsd,
+			Gatherer: prom.Registry(),
+			Interval: *statsdInterval,
+		}
+		e.Start()
+	}
+
+	if *metricsPushURL != "" || *metricsRemoteWriteURL != "" {
+		instance := *metricsPushInstance
+		if instance == "" {
+			instance, _ = os.Hostname()
+		}
+		e := &metricsPusher{
+			Gatherer:       prom.Registry(),
+			PushURL:        *metricsPushURL,
+			RemoteWriteURL: *metricsRemoteWriteURL,
+			Job:            *metricsPushJob,
+			Instance:       instance,
+			Interval:       *metricsPushInterval,
+			Timeout:        10 * time.Second,
+		}
+		if err := e.Validate(); err != nil {
+			log.Fatalf("invalid metrics push; %v", err)
+		}
+		e.Start()
+	}
+
 	var s parapet.Middlewares
+	var adminAPI admin
+
+	// forwarded client ip headers from untrusted remote are replaced with remote ip
+	var trustProxies trustedProxies
+	trustProxies, err = parseCIDRs(parseList(*trustedProxyList))
+	if err != nil {
+		log.Fatalf("invalid trusted proxies; %v", err)
+	}
+	s.Use(trustProxies)
 
 	if *logEnable {
-		s.Use(logger.Stdout())
+		var ws []io.Writer
+		if *logFile != "" {
+			w := &rotateWriter{
+				Path:       *logFile,
+				MaxSize:    *logFileMaxSize << 20,
+				MaxAge:     *logFileMaxAge,
+				MaxBackups: *logFileMaxBackups,
+				Compress:   *logFileCompress,
+			}
+			if err := w.Open(); err != nil {
+				log.Fatalf("can not open log file; %v", err)
+			}
+			ws = append(ws, w)
+		}
+		if *logSyslog != "" {
+			w, err := dialSyslog(*logSyslog)
+			if err != nil {
+				log.Fatalf("can not connect to syslog; %v", err)
+			}
+			ws = append(ws, w)
+		}
+
+		m := logger.Stdout()
+		if len(ws) == 1 {
+			m.Writer = ws[0]
+		} else if len(ws) > 1 {
+			m.Writer = io.MultiWriter(ws...)
+		}
+		s.Use(m)
+
+		if *logSample > 1 {
+			s.Use(&logSampler{
+				Rate: *logSample,
+				Slow: *logSampleSlow,
+			})
+		}
 	}
 	s.Use(prom.Requests())
 
+	// acl
+	if *aclAllow != "" || *aclDeny != "" || *adminAllow != "" || *opsAllow != "" {
+		prom.Registry().MustRegister(aclDenied)
+	}
+	if *aclAllow != "" || *aclDeny != "" {
+		acl, err := parseLocationACL(*aclAllow, *aclDeny)
+		if err != nil {
+			log.Fatalf("invalid acl; %v", err)
+		}
+		s.Use(skipForListener(func(l listener) bool { return l.NoACL }, acl))
+	}
+
+	// tunnel
+	if *tunnelTargets != "" {
+		username, password := parseCredential(*tunnelAuth)
+		if username == "" || password == "" {
+			log.Fatalf("tunnel requires -tunnel.auth")
+		}
+		s.Use(tunnel{
+			Targets:  parseSet(*tunnelTargets),
+			Username: username,
+			Password: password,
+		})
+	}
+	// operational endpoints, served on rpc listeners or ops listener
+	var ops, opsGuard parapet.Middlewares
+	if *opsAllow != "" {
+		ns, err := parseCIDRs(parseList(*opsAllow))
+		if err != nil {
+			log.Fatalf("invalid ops allow list; %v", err)
+		}
+		acl := &ipACL{Allow: ns}
+		opsGuard.Use(acl.Middleware("ops"))
+	}
+
 	// healthz
 	{
 		l := location.Exact("/healthz")
+		l.Use(opsGuard)
 		l.Use(parapet.Handler(healthz))
-		s.Use(l)
+		ops.Use(l)
 	}
+	{
+		livez := &health.Checks{Name: "livez", Timeout: checkTimeout}
+		livez.Add("ping", func(ctx context.Context) error { return nil })
 
-	// websocket
-	if *gethWS != "" {
-		l := location.Exact("/ws")
-		l.Use(stripprefix.New("/ws"))
-		l.Use(upstream.SingleHost(*gethAddr+":"+*gethWS, &upstream.HTTPTransport{}))
-		s.Use(l)
+		l := location.Exact("/livez")
+		l.Use(opsGuard)
+		l.Use(parapet.Handler(livez.ServeHTTP))
+		ops.Use(l)
+	}
+	{
+		readyz := &health.Checks{Name: "readyz", Timeout: checkTimeout}
+		readyz.Add("maintenance", checkMaintenance)
+		readyz.Add("geth-head", checkGethHead)
+		readyz.Add("upstreams", checkUpstreams)
+		if finalizedWindow > 0 {
+			readyz.Add("geth-finalized", checkGethFinalized)
+		}
+		if certExpiryHealth {
+			readyz.Add("cert-expiry", checkCertExpiry)
+		}
+
+		l := location.Exact("/readyz")
+		l.Use(opsGuard)
+		l.Use(parapet.Handler(readyz.ServeHTTP))
+		ops.Use(l)
+	}
+	{
+		l := location.Exact("/version")
+		l.Use(opsGuard)
+		l.Use(parapet.Handler(versions.ServeHTTP))
+		ops.Use(l)
 	}
 
 	// metrics
 	if *gethMetrics != "" {
 		l := location.Prefix("/metrics/")
+		l.Use(opsGuard)
 
 		// /geth
 		{
+			var single parapet.Middlewares
+			single.Use(rewritePath("/debug/metrics/prometheus"))
+			single.Use(upstream.SingleHost(net.JoinHostPort(gethPrimaryAddr, *gethMetrics), transportConfig{TLS: gethTLS}.New()))
+
 			p := location.Exact("/metrics/geth")
-			p.Use(rewritePath("/debug/metrics/prometheus"))
-			p.Use(upstream.SingleHost(*gethAddr+":"+*gethMetrics, &upstream.HTTPTransport{}))
+			p.Use(wrapHandler(&gethMetricsAggregator{
+				Port:    *gethMetrics,
+				Path:    "/debug/metrics/prometheus",
+				Timeout: 10 * time.Second,
+				Single:  single.ServeHandler(http.NotFoundHandler()),
+				client:  http.Client{Transport: gethClientTransport()},
+			}))
 			l.Use(p)
 		}
 
 		// /proxy
 		{
 			p := location.Exact("/metrics/proxy")
-			p.Use(wrapHandler(prom.Handler()))
+			p.Use(wrapHandler(metricsHandler()))
 			l.Use(p)
 		}
 
 		l.Use(wrapHandler(http.NotFoundHandler()))
 
+		ops.Use(l)
+	}
+
+	// sidecar lifecycle, served only on ops listener or from loopback
+	if *sidecarEnable {
+		sc := &sidecar{Drain: *sidecarDrain}
+
+		l := location.Prefix("/lifecycle/")
+		l.Use(opsGuard)
+		if *opsAddr == "" {
+			l.Use(loopbackOnly())
+		}
+		{
+			p := location.Exact("/lifecycle/prestop")
+			p.Use(parapet.Handler(sc.preStop))
+			l.Use(p)
+		}
+		{
+			p := location.Exact("/lifecycle/ready")
+			p.Use(parapet.Handler(sc.ready))
+			l.Use(p)
+		}
+		l.Use(parapet.Handler(http.NotFound))
+		ops.Use(l)
+	}
+
+	// maintenance mode, served only on ops listener or from loopback
+	{
+		l := location.Exact("/maintenance")
+		l.Use(opsGuard)
+		if *opsAddr == "" {
+			l.Use(loopbackOnly())
+		}
+		l.Use(parapet.Handler(serveMaintenance))
+		ops.Use(l)
+	}
+
+	if *opsAddr == "" {
+		s.Use(ops)
+	}
+
+	// internal rpc, allows namespaces that are blocked on public route
+	var publicGuard *namespaceGuard
+	if *internalAuth != "" || *internalHtpasswd != "" {
+		auth, err := newBasicAuth(*internalAuth, *internalHtpasswd)
+		if err != nil {
+			log.Fatalf("can not load internal auth; %v", err)
+		}
+		if auth.Len() == 0 {
+			log.Fatalf("internal auth requires at least one user")
+		}
+		publicGuard = &namespaceGuard{Namespaces: parseSet(*internalNamespaces)}
+		prom.Registry().MustRegister(namespaceDenied)
+
+		l := location.Exact("/internal/rpc")
+		l.Use(auth.Middleware())
+		l.Use(parseRPC())
+		l.Use(normalizeRPCError())
+		l.Use(maintenanceGuard())
+		l.Use(rewritePath("/"))
+		l.Use(upstream.New(pool.Transport(*gethHTTP, upstreamTimer{
+			transport.WithResponseHeaderTimeout(maxDuration(responseHeaderTimeout, *heavyTimeout)).New(),
+		})))
+		s.Use(l)
+	}
+
+	// basic auth, for rpc and websocket paths
+	if *authBasic != "" || *authHtpasswd != "" {
+		auth, err := newBasicAuth(*authBasic, *authHtpasswd)
+		if err != nil {
+			log.Fatalf("can not load basic auth; %v", err)
+		}
+		if auth.Len() == 0 {
+			log.Fatalf("basic auth requires at least one user")
+		}
+		s.Use(skipForListener(func(l listener) bool { return l.NoAuth }, auth.Middleware()))
+	}
+
+	// api key auth, for rpc and websocket paths
+	if len(*authKeys) > 0 {
+		if *authBasic != "" || *authHtpasswd != "" || *jwtKey != "" || *jwtJWKS != "" {
+			log.Fatalf("api key can not be used with basic auth or jwt")
+		}
+		m, err := newAPIKeyAuth(*authKeys)
+		if err != nil {
+			log.Fatalf("invalid api key; %v", err)
+		}
+		prom.Registry().MustRegister(apiKeyRequests, apiKeyRejected, tenantRequests)
+		s.Use(skipForListener(func(l listener) bool { return l.NoAuth }, m))
+	}
+
+	// bearer token auth, for rpc and websocket paths
+	if *jwtKey != "" || *jwtJWKS != "" {
+		if *authBasic != "" || *authHtpasswd != "" {
+			log.Fatalf("basic auth and jwt can not be used together")
+		}
+		if *jwtKey != "" && *jwtJWKS != "" {
+			log.Fatalf("jwt requires only one of -jwt.key or -jwt.jwks")
+		}
+
+		m := &jwtAuth{
+			JWKSURL:     *jwtJWKS,
+			JWKSRefresh: *jwtJWKSRefresh,
+			Issuer:      *jwtIssuer,
+			Audience:    *jwtAudience,
+			TenantClaim: *jwtTenantClaim,
+			TierClaim:   *jwtTierClaim,
+			Leeway:      *jwtLeeway,
+			AllowNoExp:  *jwtAllowNoExp,
+		}
+		if *jwtKey != "" {
+			key, err := loadJWTKey(*jwtKey)
+			if err != nil {
+				log.Fatalf("can not load jwt key; %v", err)
+			}
+			m.Key = key
+		}
+		err := m.Start()
+		if err != nil {
+			log.Fatalf("can not load jwks; %v", err)
+		}
+		prom.Registry().MustRegister(jwtRequests, tenantRequests)
+		s.Use(skipForListener(func(l listener) bool { return l.NoAuth }, m))
+	}
+
+	cuWeights, err := parseWeights(*usageWeights)
+	if err != nil {
+		log.Fatalf("invalid usage weights; %v", err)
+	}
+
+	// rpc policies, accounting, and limits are shared by default route and chains,
+	// so chain routes can not bypass default route's limits
+	if *usageWeights != "" {
+		prom.Registry().MustRegister(computeUnitsTotal)
+	}
+	var usage *usageTracker
+	var usageExport *usageExporter
+	if len(*authKeys) > 0 || *jwtKey != "" || *jwtJWKS != "" {
+		prom.Registry().MustRegister(usageRequests, usageCalls, usageComputeUnits, usageBytes)
+		usage = newUsageTracker(cuWeights)
+		adminAPI.Usage = usage
+
+		if *usageFile != "" {
+			usageExport = &usageExporter{
+				Tracker:  usage,
+				File:     *usageFile,
+				Format:   *usageFormat,
+				Interval: *usageInterval,
+			}
+			if err := usageExport.Validate(); err != nil {
+				log.Fatalf("invalid usage export; %v", err)
+			}
+			usageExport.Start()
+		}
+	}
+	var clientConcurrency *clientConcurrencyLimit
+	if *rpcMaxConcurrent > 0 {
+		prom.Registry().MustRegister(clientConcurrencyRejected)
+		clientConcurrency = &clientConcurrencyLimit{Max: *rpcMaxConcurrent}
+	}
+	rewriter := methodRewriter{Methods: parseMap(*rpcRewrite)}
+	if err := rewriter.Validate(); err != nil {
+		log.Fatalf("invalid rpc rewrite; %v", err)
+	}
+
+	// rpcPolicy returns rpc parsing, validation, auth policy, and accounting middlewares,
+	// methods are rewritten before policy so allowlist checks the forwarded method,
+	// emulated fan-out calls go to pool after policy
+	rpcPolicy := func(p *upstreamPool) parapet.Middlewares {
+		var m parapet.Middlewares
+		if *rpcMaxPayload > 0 {
+			m.Use(payloadLimit{Max: *rpcMaxPayload})
+		}
+		m.Use(parseRPC())
+		m.Use(normalizeRPCError())
+		if len(rewriter.Methods) > 0 {
+			m.Use(rewriter)
+		}
+		if *rpcValidate {
+			m.Use(rpcValidator{})
+		}
+		if *rpcMaxBatch > 0 {
+			m.Use(batchLimit{Max: *rpcMaxBatch})
+		}
+		if len(*authKeys) > 0 {
+			m.Use(apiKeyPolicyGuard{Units: cuWeights})
+		}
+		if *usageWeights != "" {
+			m.Use(computeUnitMeter{Units: cuWeights})
+		}
+		if usage != nil {
+			m.Use(usage)
+		}
+		if clientConcurrency != nil {
+			m.Use(clientConcurrency)
+		}
+		if statsd != nil {
+			m.Use(statsdTiming{Client: statsd})
+		}
+		if publicGuard != nil {
+			m.Use(publicGuard)
+		}
+		m.Use(maintenanceGuard())
+		if rpcTimeout.Max() > 0 {
+			m.Use(rpcTimeout)
+		}
+		if len(rewriter.Methods) > 0 {
+			m.Use(methodFanout{
+				Methods:     rewriter.Methods,
+				Concurrency: *rpcRewriteConcurrency,
+				Pool:        p,
+			})
+		}
+		return m
+	}
+
+	if *heavyEnable || *limitConcurrency > 0 {
+		prom.Registry().MustRegister(limiterInFlight, limiterQueued, limiterQueueDuration, limiterRejected)
+	}
+	var heavy heavyLimiter
+	if *heavyEnable {
+		heavy.Heavy = newConcurrencyLimiter("heavy", *heavyConcurrency, *heavyQueue)
+		heavy.Heavy.RetryAfter = *limitRetryAfter
+		heavy.Heavy.SetTiers(parseList(*limitTiers))
+		adminAPI.Limiters = append(adminAPI.Limiters, heavy.Heavy)
+		if *heavyTraceConcurrency > 0 {
+			heavy.Trace = newConcurrencyLimiter("trace", *heavyTraceConcurrency, *heavyTraceQueue)
+			heavy.Trace.RetryAfter = *limitRetryAfter
+			heavy.Trace.SetTiers(parseList(*limitTiers))
+			adminAPI.Limiters = append(adminAPI.Limiters, heavy.Trace)
+		}
+	}
+	var globalLimiter *concurrencyLimiter
+	if *limitConcurrency > 0 {
+		// heavy calls already routed to heavy path, limit only calls to main upstream
+		globalLimiter = newConcurrencyLimiter("global", *limitConcurrency, *limitQueue)
+		globalLimiter.RetryAfter = *limitRetryAfter
+		globalLimiter.SetTiers(parseList(*limitTiers))
+		adminAPI.Limiters = append(adminAPI.Limiters, globalLimiter)
+	}
+
+	// rpcLimits returns heavy path, eth_getLogs guard and splitter, and global limiter middlewares,
+	// limiters are shared by all chains, heavy calls go to pool and block tags resolve by head
+	rpcLimits := func(p *upstreamPool, head blockHead) parapet.Middlewares {
+		var m parapet.Middlewares
+		if *heavyEnable {
+			b := heavyPath()
+			b.Use(heavy)
+			b.Use(&timeout.Timout{
+				Timeout: *heavyTimeout,
+				TimeoutHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					writeRPCError(w, r, http.StatusGatewayTimeout, rpcCodeServerError, "request timed out")
+				}),
+			})
+			heavyTransport := transport.WithResponseHeaderTimeout(maxDuration(responseHeaderTimeout, *heavyTimeout))
+			heavyTransport.MaxConnsPerHost = *heavyMaxConns
+			b.Use(upstream.New(p.Transport(*gethHTTP, upstreamTimer{heavyTransport.New()})))
+			m.Use(b)
+		}
+		if *getLogsMaxRange > 0 || *getLogsRequireFilter {
+			m.Use(getLogsGuard{
+				MaxRange:      *getLogsMaxRange,
+				Clamp:         *getLogsClamp,
+				RequireFilter: *getLogsRequireFilter,
+				Head:          head,
+			})
+		}
+		// split before limiter, so each sub-range query takes a limiter slot
+		if *getLogsSplit > 0 {
+			m.Use(getLogsSplitter{
+				Size:        *getLogsSplit,
+				Concurrency: *getLogsSplitConcurrency,
+				MaxQueries:  *getLogsSplitMax,
+				Head:        head,
+			})
+		}
+		if globalLimiter != nil {
+			m.Use(globalLimiter)
+		}
+		return m
+	}
+
+	// additional chains
+	for _, c := range chains {
+		c.Guard = publicGuard
+		if len(*authKeys) > 0 {
+			c.APIKeys = &apiKeyPolicyGuard{Units: cuWeights}
+		}
+		c.RPC.Use(rpcPolicy(c.Pool))
+		c.RPC.Use(rpcLimits(c.Pool, poolHead(c.Pool)))
+		s.Use(c.Middleware())
+	}
+
+	// websocket
+	if *gethWS != "" {
+		var wsAPIKeys *apiKeyPolicyGuard
+		if len(*authKeys) > 0 {
+			wsAPIKeys = &apiKeyPolicyGuard{Units: cuWeights}
+		}
+
+		l := location.Exact("/ws")
+		l.Use(maintenanceGuard())
+		l.Use(trackWSSession())
+		l.Use(stripprefix.New("/ws"))
+		l.Use(&wsProxy{
+			Pool:             pool,
+			Port:             *gethWS,
+			HandshakeTimeout: *gethWSTimeout,
+			Conns:            wsConns,
+			MaxSubscriptions: *wsMaxSubscriptions,
+			IdleTimeout:      *wsIdleTimeout,
+			MaxMessageSize:   *wsMaxMessageSize,
+			PingInterval:     *wsPingInterval,
+			PongTimeout:      *wsPongTimeout,
+			Reconnect:        *wsReconnect,
+			ReconnectTimeout: *wsReconnectTimeout,
+			PendingTxFilter:  *wsPendingTxFilter,
+			Logs:             wsLogs,
+			Metrics:          *wsMetrics,
+			Guard:            publicGuard,
+			APIKeys:          wsAPIKeys,
+		})
+		l.Use(upstream.New(pool.Transport(*gethWS, transport.WithResponseHeaderTimeout(*gethWSTimeout).New())))
+		s.Use(l)
+	}
+
+	// graphql
+	if *gethGraphQL != "" {
+		prom.Registry().MustRegister(graphqlRequests)
+		l := location.Exact("/graphql")
+		l.Use(maintenanceGuard())
+		l.Use(graphqlGuard{
+			MaxDepth:      *graphqlMaxDepth,
+			MaxComplexity: *graphqlMaxComplexity,
+		})
+		l.Use(upstream.New(pool.Transport(*gethGraphQL, upstreamTimer{transport.New()})))
+		s.Use(l)
+	}
+
+	// blocks api
+	if *blockAPIEnable {
+		if *blockAPIBatch <= 0 || *blockAPIConcurrency <= 0 {
+			log.Fatalf("blocks api batch and concurrency must be positive")
+		}
+		l := location.Prefix("/v1/blocks/")
+		l.Use(maintenanceGuard())
+		l.Use(parapet.Handler((&blockAPI{
+			BatchSize:   *blockAPIBatch,
+			Concurrency: *blockAPIConcurrency,
+		}).ServeHTTP))
+		s.Use(l)
+	}
+
+	// gas oracle
+	if *gasEnable {
+		percentiles, err := parseFloatList(*gasPercentiles)
+		if err != nil {
+			log.Fatalf("invalid gas percentiles; %v", err)
+		}
+		if !sort.Float64sAreSorted(percentiles) || len(percentiles) == 0 || percentiles[0] < 0 || percentiles[len(percentiles)-1] > 100 {
+			log.Fatalf("gas percentiles must be ascending between 0 and 100")
+		}
+		if *gasBlocks < 1 || *gasBlocks > 1024 {
+			log.Fatalf("gas blocks must be between 1 and 1024")
+		}
+		prom.Registry().MustRegister(gasBaseFee, gasPriorityFee)
+		m := &gasOracle{
+			Interval:    *gasInterval,
+			Blocks:      *gasBlocks,
+			Percentiles: percentiles,
+		}
+		m.Start()
+
+		l := location.Exact("/gas")
+		l.Use(parapet.Handler(m.ServeHTTP))
+		s.Use(l)
+	}
+
+	// head long-poll
+	if *pollEnable {
+		l := location.Exact("/heads/poll")
+		l.Use(parapet.Handler(headPoll{MaxTimeout: *pollMaxTimeout}.ServeHTTP))
+		s.Use(l)
+	}
+
+	// server-sent events
+	// one upstream logs subscription shared by sse and log filters
+	var logs *logsFeed
+	if *gethWS != "" && (*sseEnable || *pollEnable) {
+		logs = newLogsFeed(&wsProxy{
+			Pool:             pool,
+			Port:             *gethWS,
+			HandshakeTimeout: *gethWSTimeout,
+		})
+	}
+	if *sseEnable {
+		prom.Registry().MustRegister(sseClients, sseDropped)
+		m := &sseStream{KeepAlive: *sseKeepAlive, Logs: logs}
+
+		l := location.Exact("/sse/heads")
+		l.Use(maintenanceGuard())
+		l.Use(parapet.Handler(m.ServeHeads))
+		s.Use(l)
+
+		l = location.Exact("/sse/logs")
+		l.Use(maintenanceGuard())
+		l.Use(parapet.Handler(m.ServeLogs))
+		s.Use(l)
+	}
+
+	// txpool
+	if *txpoolEnable {
+		prom.Registry().MustRegister(txpoolPending, txpoolQueued, txpoolSenders)
+		m := &txpoolPoller{
+			Interval:        *txpoolInterval,
+			InspectInterval: *txpoolInspectInterval,
+			TopSenders:      *txpoolTopSenders,
+		}
+		m.Start()
+
+		l := location.Exact("/txpool")
+		l.Use(parapet.Handler(m.ServeHTTP))
 		s.Use(l)
 	}
 
 	// http
-	s.Use(upstream.SingleHost(*gethAddr+":"+*gethHTTP, &upstream.HTTPTransport{
-		MaxIdleConns: 10000,
-	}))
+	if len(defaultBlockPathTags) > 0 {
+		s.Use(defaultBlockPaths(defaultBlockPathTags))
+	}
+	if *rpcGetEnable {
+		s.Use(rpcOverGet{
+			Methods: parseSet(*rpcGetMethods),
+			MaxAge:  *rpcGetMaxAge,
+		})
+	}
+	s.Use(rpcPolicy(pool))
+	if *anomalyEnable {
+		if *anomalyWindow < time.Minute || *anomalyRecent >= *anomalyWindow {
+			log.Fatalf("invalid anomaly window; window must be at least 1m and longer than recent window")
+		}
+		m := &anomalyDetector{
+			Window:      *anomalyWindow,
+			Recent:      *anomalyRecent,
+			RateFactor:  *anomalyRateFactor,
+			ErrorRate:   *anomalyErrorRate,
+			MethodShift: *anomalyMethodShift,
+			MinRequests: *anomalyMinRequests,
+			Webhook:     *anomalyWebhook,
+		}
+		m.Start()
+		s.Use(m)
+	}
+	if *slowLogThreshold > 0 || len(slowLogMethodThresholds) > 0 {
+		s.Use(slowLog{
+			Threshold: *slowLogThreshold,
+			Methods:   slowLogMethodThresholds,
+			MaxParams: *slowLogMaxParams,
+			Redact:    parseSet(*slowLogRedact),
+		})
+	}
+	if *captureFile != "" {
+		w := &rotateWriter{Path: *captureFile}
+		if err := w.Open(); err != nil {
+			log.Fatalf("can not open capture file; %v", err)
+		}
+		s.Use(&capture{
+			Writer: w,
+			Sample: *captureSample,
+			Redact: parseSet(*captureRedact),
+		})
+	}
+	if *chainID != 0 || *chainGenesis != "" {
+		m := &chainValidator{
+			Sample:  *chainValidateSample,
+			Webhook: *chainWebhook,
+		}
+		if *chainID != 0 {
+			m.ChainID = new(big.Int).SetUint64(*chainID)
+		}
+		if *chainGenesis != "" {
+			m.Genesis = common.HexToHash(*chainGenesis)
+		}
+		prom.Registry().MustRegister(chainValidationFailures)
+		m.Start()
+		if m.Sample > 0 {
+			s.Use(m)
+		}
+	}
+	if *defaultBlockTag != "" || len(defaultBlockPathTags) > 0 || len(*authKeys) > 0 {
+		s.Use(defaultBlock{Tag: *defaultBlockTag})
+	}
+	if pinLatestBlock != nil {
+		s.Use(pinLatestBlock)
+	}
+	if *syncGuardEnable {
+		prom.Registry().MustRegister(syncing)
+		startSyncTracker()
+		s.Use(syncGuard{
+			Methods: parseSet(*syncGuardMethods),
+		})
+	}
+	if *headCacheEnable {
+		s.Use(headCache())
+	}
+	if *pollEnable {
+		s.Use(newBlockFilters(*pollFilterTimeout))
+		if logs != nil {
+			prom.Registry().MustRegister(logFiltersActive, logFiltersDropped)
+			s.Use(newLogFilters(logs, *pollFilterTimeout))
+		}
+	}
+	if *cacheImmutable {
+		store := &cache.Tiered{
+			Tiers:   []cache.Store{cache.NewMemory()},
+			FillTTL: *cacheImmutableTTL,
+		}
+		if *cacheRedis != "" {
+			prom.Registry().MustRegister(redisErrors)
+			rc := newRedisCache(*cacheRedis, 64)
+			rc.Password = *cacheRedisPassword
+			rc.DB = *cacheRedisDB
+			rc.Prefix = *cacheRedisPrefix
+			rc.TTL = *cacheRedisTTL
+			store.Tiers = append(store.Tiers, rc)
+		}
+		ttl := make(map[string]time.Duration)
+		for _, method := range cache.ImmutableMethods {
+			ttl[method] = *cacheImmutableTTL
+		}
+		for _, method := range cache.ConfirmedMethods {
+			ttl[method] = *cacheImmutableTTL
+		}
+		s.Use(&cache.RPC{
+			TTL:     ttl,
+			Store:   store,
+			Call:    callUpstream,
+			Observe: promCache,
+			Head: func(ctx context.Context) (uint64, error) {
+				block, err := getLastBlock(ctx)
+				if err != nil {
+					return 0, err
+				}
+				return block.NumberU64(), nil
+			},
+			Confirmations: *cacheConfirmations,
+		})
+		adminAPI.Caches = append(adminAPI.Caches, store)
+	}
+	if *cacheGasTTL > 0 {
+		store := cache.NewMemory()
+		s.Use(&cache.RPC{
+			TTL: map[string]time.Duration{
+				"eth_gasPrice":             *cacheGasTTL,
+				"eth_maxPriorityFeePerGas": *cacheGasTTL,
+				"eth_feeHistory":           *cacheGasTTL,
+			},
+			Store:   store,
+			Call:    callUpstream,
+			Observe: promCache,
+		})
+		adminAPI.Caches = append(adminAPI.Caches, store)
+	}
+	if *txValidate {
+		prom.Registry().MustRegister(txRejected)
+		m := txValidator{
+			MaxGas: *txValidateMaxGas,
+			Nonce:  *txValidateNonce,
+		}
+		if *chainID != 0 {
+			m.ChainID = new(big.Int).SetUint64(*chainID)
+		}
+		s.Use(m)
+	}
+	if *privateRelay != "" {
+		relay, err := rpc.DialHTTP(*privateRelay)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prom.Registry().MustRegister(privateTxCount)
+		s.Use(&privateTx{
+			Relay:    relay,
+			Methods:  parseSet(*privateMethods),
+			Fallback: *privateFallback,
+			Timeout:  *privateTimeout,
+		})
+	}
+	if *broadcastEnable {
+		prom.Registry().MustRegister(broadcastFailures)
+		s.Use(broadcastTx(*broadcastTimeout))
+	}
+	if len(pool.TraceAddrs) > 0 {
+		s.Use(traceNodes{Pool: pool})
+	}
+	s.Use(rpcLimits(pool, nil))
+	var gethTransport http.RoundTripper = transport.New()
+	if *gethH2C {
+		// multiplex requests over few connections
+		gethTransport = transport.NewH2C()
+	}
+	if encodings := parseList(*gethCompress); len(encodings) > 0 {
+		gethTransport = compressTransport{
+			RoundTripper: gethTransport,
+			Encodings:    encodings,
+		}
+	}
+	rpcTransport := pool.Transport(*gethHTTP, upstreamTimer{gethTransport})
+	if *hedgeDelay > 0 {
+		prom.Registry().MustRegister(hedgeRequests)
+		rpcTransport = &hedgeTransport{
+			Pool:      pool,
+			Port:      *gethHTTP,
+			Transport: upstreamTimer{gethTransport},
+			Delay:     *hedgeDelay,
+			Methods:   parseSet(*hedgeMethods),
+		}
+	}
+	if *retryMax > 0 {
+		if *hedgeDelay > 0 {
+			log.Fatalf("retry can not be used with hedge")
+		}
+		on, err := parseRetryRules(*retryOn)
+		if err != nil {
+			log.Fatalf("invalid retry on; %v", err)
+		}
+		never, err := parseRetryRules(*retryNever)
+		if err != nil {
+			log.Fatalf("invalid retry never; %v", err)
+		}
+		prom.Registry().MustRegister(retries)
+		rpcTransport = &retryTransport{
+			Pool:      pool,
+			Port:      *gethHTTP,
+			Transport: upstreamTimer{gethTransport},
+			Max:       *retryMax,
+			On:        on,
+			Never:     never,
+			Exclude:   parseSet(*gethWriteMethods),
+		}
+	}
+	if *fallbackURL != "" {
+		t, err := newFallbackTransport(rpcTransport, pool, *fallbackURL, parseHeader(*fallbackHeaders), *fallbackTimeout)
+		if err != nil {
+			log.Fatalf("invalid fallback url; %v", err)
+		}
+		prom.Registry().MustRegister(fallbackRequests)
+		rpcTransport = t
+	}
+	if *shadowURL != "" {
+		t, err := newShadowTransport(rpcTransport, *shadowURL, *shadowConcurrency)
+		if err != nil {
+			log.Fatalf("invalid shadow url; %v", err)
+		}
+		t.Sample = *shadowSample
+		t.Exclude = parseSet(*gethWriteMethods)
+		t.Diff = *shadowDiff
+		t.Timeout = *shadowTimeout
+		prom.Registry().MustRegister(shadowRequests)
+		rpcTransport = t
+	}
+	s.Use(upstream.New(rpcTransport))
+
+	if *probeInterval > 0 {
+		script, err := loadProbeScript(*probeScript)
+		if err != nil {
+			log.Fatalf("can not load probe script; %v", err)
+		}
+		target := *probeURL
+		for _, l := range httpListeners {
+			if _, ok := l.UnixPath(); target == "" && !ok {
+				_, port, _ := net.SplitHostPort(l.Addr)
+				target = "http://127.0.0.1:" + port + "/"
+			}
+		}
+		prom.Registry().MustRegister(probeSuccess, probeDuration, probeFailures)
+		p := &prober{
+			URL:      target,
+			Header:   parseHeader(*probeHeaders),
+			Script:   script,
+			Interval: *probeInterval,
+			Timeout:  *probeTimeout,
+		}
+		p.Start()
+	}
+	var up *upgrader
+	if *upgradeEnable {
+		if *drainTimeout <= 0 {
+			log.Fatalf("upgrade requires -drain.timeout")
+		}
+		for _, l := range append(httpListeners, tlsListeners...) {
+			// unix socket can not be shared between old and new process
+			if _, ok := l.UnixPath(); ok {
+				log.Fatalf("upgrade does not support unix socket listener")
+			}
+		}
+		up = &upgrader{Timeout: *upgradeTimeout}
+	}
+
+	if *metricsAddr != "" {
+		go func() {
+			var err error
+			if up != nil {
+				// old process exits after drained, no graceful shutdown for metrics
+				srv := parapet.New()
+				srv.Addr = *metricsAddr
+				srv.GraceTimeout = 0
+				srv.ReusePort = true
+				srv.Handler = metricsHandler()
+				err = srv.ListenAndServe()
+			} else if exemplarsEnabled {
+				err = (&http.Server{
+					Addr:         *metricsAddr,
+					ReadTimeout:  30 * time.Second,
+					IdleTimeout:  120 * time.Second,
+					WriteTimeout: 30 * time.Second,
+					Handler:      metricsHandler(),
+				}).ListenAndServe()
+			} else {
+				err = prom.Start(*metricsAddr)
+			}
+			if err != nil {
+				log.Fatalf("can not start metrics server; %v", err)
+			}
+		}()
+	}
 
 	var wg sync.WaitGroup
 
-	if *addr != "" {
+	if *adminAddr != "" {
+		adminAPI.Username, adminAPI.Password = parseCredential(*adminAuth)
+		if adminAPI.Username == "" || adminAPI.Password == "" {
+			log.Fatalf("admin api requires -admin.auth")
+		}
+
 		wg.Add(1)
-		srv := parapet.NewBackend()
-		srv.Addr = *addr
+		srv := parapet.New()
+		srv.Addr = *adminAddr
 		srv.GraceTimeout = 3 * time.Second
 		srv.WaitBeforeShutdown = 0
-		srv.Use(s)
-		prom.Connections(srv)
-		prom.Networks(srv)
+		srv.TrustProxy = trustProxies.Conditional()
+		srv.Use(trustProxies)
+		if *adminAllow != "" {
+			ns, err := parseCIDRs(parseList(*adminAllow))
+			if err != nil {
+				log.Fatalf("invalid admin allow list; %v", err)
+			}
+			acl := &ipACL{Allow: ns}
+			srv.Use(acl.Middleware("admin"))
+		}
+		srv.Use(adminAPI.Middleware())
+		if up != nil {
+			up.Add(srv)
+		}
 		go func() {
 			defer wg.Done()
 
-			err = srv.ListenAndServe()
+			err := srv.ListenAndServe()
 			if err != nil {
-				log.Fatalf("can not start server; %v", err)
+				log.Fatalf("can not start admin server; %v", err)
 			}
 		}()
 	}
 
-	if *tlsAddr != "" {
+	if *opsAddr != "" {
 		wg.Add(1)
 		srv := parapet.NewBackend()
-		srv.Addr = *tlsAddr
-		srv.GraceTimeout = 3 * time.Second
+		srv.Addr = *opsAddr
+		srv.GraceTimeout = *drainTimeout
 		srv.WaitBeforeShutdown = 0
-		srv.TLSConfig = &tls.Config{}
-
-		if *tlsKey == "" || *tlsCert == "" {
-			cert, err := parapet.GenerateSelfSignCertificate(parapet.SelfSign{
-				CommonName: "geth-proxy",
-				Hosts:      []string{"geth-proxy"},
-				NotBefore:  time.Now().Add(-5 * time.Minute),
-				NotAfter:   time.Now().AddDate(10, 0, 0),
-			})
-			if err != nil {
-				log.Fatalf("can not generate self signed cert; %v", err)
-			}
-			srv.TLSConfig.Certificates = append(srv.TLSConfig.Certificates, cert)
-		} else {
-			cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		srv.TrustProxy = trustProxies.Conditional()
+		srv.Use(trustProxies)
+		srv.Use(ops)
+		srv.Use(parapet.Handler(http.NotFound))
+		if up != nil {
+			up.Add(srv)
+		}
+		go func() {
+			defer wg.Done()
+
+			err := srv.ListenAndServe()
 			if err != nil {
-				log.Fatalf("can not load x509 key pair; %v", err)
+				log.Fatalf("can not start ops server; %v", err)
 			}
-			srv.TLSConfig.Certificates = append(srv.TLSConfig.Certificates, cert)
-		}
+		}()
+	}
 
+	for _, l := range httpListeners {
+		wg.Add(1)
+		srv := parapet.NewBackend()
+		srv.Addr = l.Addr
+		srv.GraceTimeout = *drainTimeout
+		srv.WaitBeforeShutdown = *drainWait
+		srv.RegisterOnShutdown(func() { setMaintenance(true) })
+		srv.TrustProxy = trustProxies.Conditional()
+		srv.Use(l.Middleware())
 		srv.Use(s)
 		prom.Connections(srv)
 		prom.Networks(srv)
-		go func() {
+		if pinLatestBlock != nil && pinLatestBlock.PerConnection {
+			pinLatestBlock.TrackConnections(srv)
+		}
+		if up != nil {
+			up.Add(srv)
+		}
+		go func(l listener) {
 			defer wg.Done()
 
-			err = srv.ListenAndServe()
+			err := listenAndServe(srv, l, os.FileMode(socketMode))
 			if err != nil {
 				log.Fatalf("can not start server; %v", err)
 			}
-		}()
+		}(l)
 	}
 
-	wg.Wait()
-}
+	if len(tlsListeners) > 0 {
+		certLoader := &tlsCertLoader{
+			Cert:  *tlsCert,
+			Key:   *tlsKey,
+			Certs: *tlsCerts,
+			Hosts: *tlsHosts,
+		}
+		if err := certLoader.Load(); err != nil {
+			log.Fatalf("can not load tls certificates; %v", err)
+		}
+		certLoader.WatchSignal()
+		if *tlsReloadInterval > 0 {
+			certLoader.Watch(*tlsReloadInterval)
+		}
 
-var lastBlock struct {
-	mu        sync.Mutex
-	Block     *types.Block
-	UpdatedAt time.Time
-}
+		tlsConfig := &tls.Config{
+			NextProtos:     []string{"h2", "http/1.1"},
+			GetCertificate: certLoader.GetCertificate,
+		}
 
-func getLastBlock(ctx context.Context) (*types.Block, error) {
-	lastBlock.mu.Lock()
-	defer lastBlock.mu.Unlock()
+		if certs.Len() > 0 {
+			prom.Registry().MustRegister(certExpiry)
+			certs.Warning = *tlsExpiryWarning
+			certs.Start()
+		}
 
-	if time.Since(lastBlock.UpdatedAt) < time.Second {
-		return lastBlock.Block, nil
+		for _, l := range tlsListeners {
+			wg.Add(1)
+			srv := parapet.NewBackend()
+			srv.Addr = l.Addr
+			srv.GraceTimeout = *drainTimeout
+			srv.WaitBeforeShutdown = *drainWait
+			srv.RegisterOnShutdown(func() { setMaintenance(true) })
+			srv.TrustProxy = trustProxies.Conditional()
+			srv.TLSConfig = tlsConfig
+			srv.Use(l.Middleware())
+			srv.Use(s)
+			prom.Connections(srv)
+			prom.Networks(srv)
+			if pinLatestBlock != nil && pinLatestBlock.PerConnection {
+				pinLatestBlock.TrackConnections(srv)
+			}
+			if up != nil {
+				up.Add(srv)
+			}
+			go func(l listener) {
+				defer wg.Done()
+
+				err := listenAndServe(srv, l, os.FileMode(socketMode))
+				if err != nil {
+					log.Fatalf("can not start server; %v", err)
+				}
+			}(l)
+		}
 	}
 
-	block, err := ethClient.BlockByNumber(ctx, nil)
-	if err != nil {
-		return lastBlock.Block, err
+	if up != nil {
+		up.Watch()
+		notifyUpgradeReady()
 	}
-	lastBlock.Block = block
-	lastBlock.UpdatedAt = time.Now()
-	return lastBlock.Block, nil
-}
 
-func isReady(ctx context.Context) (bool, error) {
-	block, err := getLastBlock(ctx)
-	if err != nil {
-		return false, err
+	wg.Wait()
+	wsDrain := *drainTimeout
+	if up != nil && up.Upgraded() {
+		// new process serves new sessions, keep existing sessions until clients leave
+		wsDrain = *upgradeWSDrain
+	}
+	waitWSSessions(wsDrain)
+	if usageExport != nil {
+		usageExport.Export()
 	}
-	ts := block.Time()
-	ts = ts * uint64(blockDuration) // convert to ns
-	t := time.Unix(0, int64(ts))
-	return time.Since(t) < healthyDuration, nil
 }
 
-func isLive(ctx context.Context) bool {
-	_, err := getLastBlock(ctx)
-	return err == nil
+// headTracker tracks primary geth's head
+var headTracker *health.Tracker
+
+// getLastBlock returns primary geth's cached head
+func getLastBlock(ctx context.Context) (*types.Block, error) {
+	return headTracker.Block(ctx)
 }
 
 func healthz(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	// fail fast before probe's timeout
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
 	if r.FormValue("ready") == "1" {
-		ready, err := isReady(ctx)
+		if inMaintenance() {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		if certExpiryHealth && certs.Expired() {
+			http.Error(w, "certificate expired", http.StatusServiceUnavailable)
+			return
+		}
+		ready, err := headTracker.Ready(ctx)
 		if err != nil {
 			http.Error(w, "can not get block", http.StatusInternalServerError)
 			return
@@ -246,7 +1938,7 @@ func healthz(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	live := isLive(ctx)
+	live := headTracker.Live(ctx)
 	if !live {
 		http.Error(w, "not ok", http.StatusInternalServerError)
 		return
@@ -283,14 +1975,9 @@ func promUpdateHeadDuration(ctx context.Context) {
 		return
 	}
 
-	block, _ := getLastBlock(ctx)
-	if block == nil {
+	age, err := headTracker.Age(ctx)
+	if err != nil {
 		return
 	}
-	ts := block.Time()
-	ts = ts * uint64(blockDuration) // convert to ns
-	t := time.Unix(0, int64(ts))
-	diff := time.Since(t)
-
-	g.Set(float64(diff) / float64(time.Second))
+	g.Set(float64(age) / float64(time.Second))
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moonrhythm/parapet"
+)
+
+// maintenance mode reports not ready immediately,
+// then rejects new requests after drain wait to let load balancer de-register the proxy
+var maintenance struct {
+	mu        sync.RWMutex
+	enabled   bool
+	since     time.Time
+	drainWait time.Duration
+}
+
+func inMaintenance() bool {
+	maintenance.mu.RLock()
+	defer maintenance.mu.RUnlock()
+	return maintenance.enabled
+}
+
+// maintenanceRejecting returns true when drain wait elapsed,
+// new requests must be rejected but existing requests and websocket sessions continue
+func maintenanceRejecting() bool {
+	maintenance.mu.RLock()
+	defer maintenance.mu.RUnlock()
+	return maintenance.enabled && time.Since(maintenance.since) >= maintenance.drainWait
+}
+
+func setMaintenance(enable bool) {
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+
+	if maintenance.enabled == enable {
+		return
+	}
+	maintenance.enabled = enable
+	maintenance.since = time.Now()
+	log.Printf("maintenance: %t", enable)
+}
+
+// serveMaintenance gets or sets (enable=1 or enable=0) maintenance mode
+func serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		setMaintenance(r.FormValue("enable") == "1")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, struct {
+		Maintenance bool `json:"maintenance"`
+	}{inMaintenance()})
+}
+
+// maintenanceGuard rejects new requests while in maintenance mode
+func maintenanceGuard() parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if maintenanceRejecting() {
+				writeRPCError(w, r, http.StatusServiceUnavailable, rpcCodeServerError, "service under maintenance")
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+}
+
+// wsSessions is the number of active websocket sessions
+var wsSessions int64
+
+// trackWSSession tracks active websocket sessions for draining,
+// http server shutdown does not wait for hijacked connections
+func trackWSSession() parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&wsSessions, 1)
+			defer atomic.AddInt64(&wsSessions, -1)
+
+			h.ServeHTTP(w, r)
+		})
+	})
+}
+
+// waitWSSessions waits for active websocket sessions to be closed, or timeout
+func waitWSSessions(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	var last int64
+	for time.Now().Before(deadline) {
+		n := atomic.LoadInt64(&wsSessions)
+		if n <= 0 {
+			return
+		}
+		if n != last {
+			log.Printf("maintenance: waiting for %d websocket sessions", n)
+			last = n
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/timeout"
+)
+
+// methodTimeout sets upstream timeout by json-rpc method,
+// request context is canceled when timeout so upstream request is aborted
+type methodTimeout struct {
+	Default time.Duration            // 0 = no timeout
+	Methods map[string]time.Duration // method or prefix pattern (ex. debug_*) to timeout
+}
+
+// Timeout returns timeout for the method
+func (m methodTimeout) Timeout(method string) time.Duration {
+	if d, ok := m.Methods[method]; ok {
+		return d
+	}
+
+	// longest prefix pattern wins
+	var (
+		d      = m.Default
+		prefix string
+	)
+	for p, x := range m.Methods {
+		if !strings.HasSuffix(p, "*") {
+			continue
+		}
+		p = strings.TrimSuffix(p, "*")
+		if strings.HasPrefix(method, p) && len(p) >= len(prefix) {
+			d, prefix = x, p
+		}
+	}
+	return d
+}
+
+// Max returns max configured timeout
+func (m methodTimeout) Max() time.Duration {
+	d := m.Default
+	for _, x := range m.Methods {
+		if x > d {
+			d = x
+		}
+	}
+	return d
+}
+
+// ServeHandler implements middleware interface
+func (m methodTimeout) ServeHandler(h http.Handler) http.Handler {
+	timeoutHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeRPCError(w, r, http.StatusGatewayTimeout, rpcCodeServerError, "request timed out")
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := getRPCCall(r.Context())
+		if c == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// batch uses the most lenient timeout
+		var d time.Duration
+		for _, req := range c.Requests {
+			if req == nil {
+				continue
+			}
+			x := m.Timeout(req.Method)
+			if x <= 0 {
+				// no timeout
+				h.ServeHTTP(w, r)
+				return
+			}
+			if x > d {
+				d = x
+			}
+		}
+
+		timeout.Timout{
+			Timeout:        d,
+			TimeoutHandler: timeoutHandler,
+		}.ServeHandler(h).ServeHTTP(w, r)
+	})
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pendingTxFeed shares one upstream full transaction newPendingTransactions subscription
+// with all filtered client subscriptions
+type pendingTxFeed struct {
+	feed wsFeed
+
+	mu   sync.Mutex
+	subs map[*pendingTxSubscription]struct{}
+}
+
+func newPendingTxFeed(p *wsProxy) *pendingTxFeed {
+	f := &pendingTxFeed{
+		subs: make(map[*pendingTxSubscription]struct{}),
+	}
+	f.feed = wsFeed{
+		Proxy:    p,
+		Name:     "pending tx",
+		Params:   json.RawMessage(`["newPendingTransactions",true]`),
+		OnResult: f.dispatch,
+	}
+	return f
+}
+
+// pendingTxSubscription is client's filtered newPendingTransactions subscription
+type pendingTxSubscription struct {
+	ID        string
+	To        map[string]bool // lower case addresses, empty = any
+	Selectors map[string]bool // lower case 4 bytes method selectors, empty = any
+	FullTx    bool
+
+	ch chan pendingTx
+}
+
+type pendingTx struct {
+	Hash string
+	Raw  json.RawMessage
+}
+
+// pendingTxFilter is eth_subscribe("newPendingTransactions", filter) filter
+type pendingTxFilter struct {
+	To        []string `json:"to"`
+	Selectors []string `json:"selectors"`
+	FullTx    bool     `json:"fullTx"`
+}
+
+// pendingTxBuffer is max notifications queued per slow client, newer notifications are dropped
+const pendingTxBuffer = 256
+
+// newPendingTxSubscription parses filter, returns nil if params is not filtered newPendingTransactions subscription
+func newPendingTxSubscription(params json.RawMessage) (*pendingTxSubscription, error) {
+	var xs []json.RawMessage
+	if json.Unmarshal(params, &xs) != nil || len(xs) != 2 {
+		return nil, nil
+	}
+	var kind string
+	if json.Unmarshal(xs[0], &kind) != nil || kind != "newPendingTransactions" {
+		return nil, nil
+	}
+	if b := strings.TrimSpace(string(xs[1])); !strings.HasPrefix(b, "{") {
+		// geth's fullTx bool
+		return nil, nil
+	}
+
+	var f pendingTxFilter
+	if err := json.Unmarshal(xs[1], &f); err != nil {
+		return nil, fmt.Errorf("invalid filter; %v", err)
+	}
+	sub := &pendingTxSubscription{
+		To:        make(map[string]bool),
+		Selectors: make(map[string]bool),
+		FullTx:    f.FullTx,
+		ch:        make(chan pendingTx, pendingTxBuffer),
+	}
+	for _, x := range f.To {
+		if !common.IsHexAddress(x) {
+			return nil, fmt.Errorf("invalid to address %s", x)
+		}
+		sub.To[strings.ToLower(x)] = true
+	}
+	for _, x := range f.Selectors {
+		if b, err := hexutil.Decode(x); err != nil || len(b) != 4 {
+			return nil, fmt.Errorf("invalid selector %s", x)
+		}
+		sub.Selectors[strings.ToLower(x)] = true
+	}
+
+	var id [16]byte
+	rand.Read(id[:])
+	sub.ID = hexutil.Encode(id[:])
+	return sub, nil
+}
+
+// match returns true if transaction matches all filters
+func (sub *pendingTxSubscription) match(to, input string) bool {
+	if len(sub.To) > 0 && !sub.To[to] {
+		return false
+	}
+	if len(sub.Selectors) > 0 && (len(input) < 10 || !sub.Selectors[input[:10]]) {
+		return false
+	}
+	return true
+}
+
+// Add adds subscription, opens upstream subscription if not opened
+func (f *pendingTxFeed) Add(sub *pendingTxSubscription) {
+	f.mu.Lock()
+	f.subs[sub] = struct{}{}
+	f.mu.Unlock()
+
+	pendingTxSubscribers.Inc()
+	f.feed.Acquire()
+}
+
+// Remove removes subscription, closes upstream subscription after last subscriber left
+func (f *pendingTxFeed) Remove(sub *pendingTxSubscription) {
+	f.mu.Lock()
+	_, ok := f.subs[sub]
+	delete(f.subs, sub)
+	f.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	pendingTxSubscribers.Dec()
+	f.feed.Release()
+}
+
+func (f *pendingTxFeed) dispatch(raw json.RawMessage) {
+	var tx struct {
+		Hash  string  `json:"hash"`
+		To    *string `json:"to"`
+		Input string  `json:"input"`
+	}
+	if json.Unmarshal(raw, &tx) != nil {
+		return
+	}
+	var to string
+	if tx.To != nil {
+		to = strings.ToLower(*tx.To)
+	}
+	input := strings.ToLower(tx.Input)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subs {
+		if !sub.match(to, input) {
+			continue
+		}
+		select {
+		case sub.ch <- pendingTx{Hash: tx.Hash, Raw: raw}:
+		default:
+			pendingTxDropped.Inc()
+		}
+	}
+}
+
+// serveLocal serves filtered newPendingTransactions subscribe and its unsubscribe in proxy,
+// returns response, or nil if message must be forwarded to upstream
+func (s *wsSession) serveLocal(p []byte) []byte {
+	c, err := parseRPCCall(p)
+	if err != nil || c.Batch || c.Requests[0] == nil {
+		return nil
+	}
+	req := c.Requests[0]
+
+	var resp *rpcResponse
+	switch req.Method {
+	case "eth_subscribe":
+		sub, err := newPendingTxSubscription(req.Params)
+		if err != nil {
+			resp = newRPCError(req, rpcCodeInvalidParams, err.Error())
+			break
+		}
+		if sub == nil {
+			return nil
+		}
+		if !s.addLocal(sub) {
+			promWSSubscriptionRejected()
+			resp = newRPCError(req, rpcCodeLimitExceeded, "subscription limit exceeded")
+			break
+		}
+		id, _ := json.Marshal(sub.ID)
+		resp = newRPCResult(req, id)
+	case "eth_unsubscribe":
+		var params []string
+		if json.Unmarshal(req.Params, &params) != nil || len(params) == 0 || !s.removeLocal(params[0]) {
+			return nil
+		}
+		resp = newRPCResult(req, json.RawMessage("true"))
+	default:
+		return nil
+	}
+	b, _ := json.Marshal(resp)
+	return b
+}
+
+// addLocal adds proxy served subscription, returns false if subscription limit exceeded
+func (s *wsSession) addLocal(sub *pendingTxSubscription) bool {
+	s.mu.Lock()
+	if s.p.MaxSubscriptions > 0 && s.subscriptions() >= s.p.MaxSubscriptions {
+		s.mu.Unlock()
+		return false
+	}
+	if s.local == nil {
+		s.local = make(map[string]*pendingTxSubscription)
+	}
+	s.local[sub.ID] = sub
+	s.promSubscriptions(1)
+	s.mu.Unlock()
+
+	s.p.pendingTx.Add(sub)
+	go s.pumpLocal(sub)
+	return true
+}
+
+func (s *wsSession) removeLocal(id string) bool {
+	s.mu.Lock()
+	sub := s.local[id]
+	delete(s.local, id)
+	if sub != nil {
+		s.promSubscriptions(-1)
+	}
+	s.mu.Unlock()
+	if sub == nil {
+		return false
+	}
+	s.p.pendingTx.Remove(sub)
+	return true
+}
+
+// closeLocal removes all proxy served subscriptions when session closed
+func (s *wsSession) closeLocal() {
+	s.mu.Lock()
+	local := s.local
+	s.local = nil
+	s.promSubscriptions(-len(local))
+	s.mu.Unlock()
+	for _, sub := range local {
+		s.p.pendingTx.Remove(sub)
+	}
+}
+
+// pumpLocal writes subscription's notifications to client until unsubscribed or session closed
+func (s *wsSession) pumpLocal(sub *pendingTxSubscription) {
+	for {
+		var tx pendingTx
+		select {
+		case tx = <-sub.ch:
+		case <-s.done:
+			return
+		}
+
+		s.mu.Lock()
+		active := s.local[sub.ID] == sub
+		s.mu.Unlock()
+		if !active {
+			return
+		}
+
+		var n wsNotification
+		n.JSONRPC = "2.0"
+		n.Method = "eth_subscription"
+		n.Params.Subscription = sub.ID
+		n.Params.Result = tx.Raw
+		if !sub.FullTx {
+			n.Params.Result, _ = json.Marshal(tx.Hash)
+		}
+		b, _ := json.Marshal(n)
+		s.touch()
+		if err := s.writeClient(websocket.TextMessage, b); err != nil {
+			s.close("client", 0, "")
+			return
+		}
+	}
+}
+
+var (
+	pendingTxSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "ws_pending_tx_subscribers",
+	})
+
+	pendingTxDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "ws_pending_tx_dropped",
+	})
+)
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/moonrhythm/parapet"
+)
+
+// blockNumberParamMethods are methods that take block number as first parameter
+var blockNumberParamMethods = map[string]bool{
+	"eth_getBlockByNumber":                    true,
+	"eth_getBlockTransactionCountByNumber":    true,
+	"eth_getUncleCountByBlockNumber":          true,
+	"eth_getTransactionByBlockNumberAndIndex": true,
+	"eth_getUncleByBlockNumberAndIndex":       true,
+}
+
+// pinLatest resolves latest block tag once to a concrete block number,
+// so every request in a batch (or a connection) reads from the same block
+// even when routed to upstreams at slightly different heads
+type pinLatest struct {
+	PerConnection bool          // pin for connection, instead of per batch
+	TTL           time.Duration // lifetime of connection's pinned block, so keep-alive connection still follows head
+
+	mu    sync.Mutex
+	conns map[string]pinnedBlock // remote addr => pinned block
+}
+
+type pinnedBlock struct {
+	Number    uint64
+	ExpiresAt time.Time
+}
+
+// ServeHandler implements middleware interface
+func (m *pinLatest) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := getRPCCall(r.Context())
+		if c == nil || (!c.Batch && !m.PerConnection) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// resolve latest at most once per call
+		var (
+			resolved bool
+			number   uint64
+			ok       bool
+		)
+		resolve := func() (uint64, bool) {
+			if !resolved {
+				number, ok = m.resolve(r)
+				resolved = true
+			}
+			return number, ok
+		}
+
+		interceptRPC(func(r *http.Request, req *rpcRequest) *rpcResponse {
+			if req.Method == "eth_blockNumber" {
+				if n, ok := resolve(); ok {
+					result, _ := json.Marshal(hexutil.Uint64(n))
+					return newRPCResult(req, result)
+				}
+				return nil
+			}
+			if pinLatestRequest(req, resolve) {
+				c.Dirty = true
+			}
+			return nil
+		}).ServeHandler(h).ServeHTTP(w, r)
+	})
+}
+
+func (m *pinLatest) resolve(r *http.Request) (uint64, bool) {
+	if m.PerConnection {
+		m.mu.Lock()
+		x, ok := m.conns[r.RemoteAddr]
+		m.mu.Unlock()
+		if ok && time.Now().Before(x.ExpiresAt) {
+			return x.Number, true
+		}
+	}
+
+	block, err := getLastBlock(r.Context())
+	if err != nil || block == nil {
+		return 0, false
+	}
+	n := block.NumberU64()
+
+	if m.PerConnection {
+		m.mu.Lock()
+		if m.conns == nil {
+			m.conns = make(map[string]pinnedBlock)
+		}
+		m.conns[r.RemoteAddr] = pinnedBlock{
+			Number:    n,
+			ExpiresAt: time.Now().Add(m.TTL),
+		}
+		m.mu.Unlock()
+	}
+	return n, true
+}
+
+// TrackConnections removes pinned block number when server's connection closed,
+// it must be called after other ConnState hooks are set
+func (m *pinLatest) TrackConnections(srv *parapet.Server) {
+	next := srv.ConnState
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		if next != nil {
+			next(conn, state)
+		}
+		if state != http.StateClosed && state != http.StateHijacked {
+			return
+		}
+		m.mu.Lock()
+		delete(m.conns, conn.RemoteAddr().String())
+		m.mu.Unlock()
+	}
+}
+
+// pinLatestRequest replaces latest block tag in request params with resolved block number,
+// omitted block parameter also means latest
+func pinLatestRequest(req *rpcRequest, resolve func() (uint64, bool)) bool {
+	pin := func() (json.RawMessage, bool) {
+		n, ok := resolve()
+		if !ok {
+			return nil, false
+		}
+		b, _ := json.Marshal(hexutil.Uint64(n))
+		return b, true
+	}
+
+	if req.Method == "eth_getLogs" {
+		var params []map[string]json.RawMessage
+		if json.Unmarshal(req.Params, &params) != nil || len(params) == 0 || params[0] == nil {
+			return false
+		}
+		filter := params[0]
+		if _, ok := filter["blockHash"]; ok {
+			return false
+		}
+		dirty := false
+		for _, k := range []string{"fromBlock", "toBlock"} {
+			if v, ok := filter[k]; ok && !isLatestTag(v) {
+				continue
+			}
+			b, ok := pin()
+			if !ok {
+				return dirty
+			}
+			filter[k] = b
+			dirty = true
+		}
+		if dirty {
+			req.Params, _ = json.Marshal(params)
+		}
+		return dirty
+	}
+
+	i, ok := blockParamIndex[req.Method]
+	if !ok {
+		if !blockNumberParamMethods[req.Method] {
+			return false
+		}
+		i = 0
+	}
+
+	var params []json.RawMessage
+	if json.Unmarshal(req.Params, &params) != nil {
+		return false
+	}
+	switch {
+	case len(params) == i && !blockNumberParamMethods[req.Method]:
+		b, ok := pin()
+		if !ok {
+			return false
+		}
+		params = append(params, b)
+	case len(params) > i && isLatestTag(params[i]):
+		b, ok := pin()
+		if !ok {
+			return false
+		}
+		params[i] = b
+	default:
+		return false
+	}
+	req.Params, _ = json.Marshal(params)
+	return true
+}
+
+func isLatestTag(v json.RawMessage) bool {
+	var tag string
+	return json.Unmarshal(v, &tag) == nil && tag == "latest"
+}
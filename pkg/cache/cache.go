@@ -0,0 +1,292 @@
+// Package cache provides json-rpc result cache middleware and cache stores
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/moonrhythm/geth-proxy/pkg/rpcproxy"
+)
+
+// Store stores cached json-rpc results
+type Store interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+// Flusher is the Store that can be flushed
+type Flusher interface {
+	Flush()
+}
+
+// Memory is in-memory Store
+type Memory struct {
+	mu    sync.RWMutex
+	items map[string]memoryItem
+}
+
+type memoryItem struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// NewMemory creates in-memory store, expired items are removed every minute
+func NewMemory() *Memory {
+	c := &Memory{
+		items: make(map[string]memoryItem),
+	}
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			c.cleanup()
+		}
+	}()
+	return c
+}
+
+func (c *Memory) Get(key string) ([]byte, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	x, ok := c.items[key]
+	if !ok || time.Now().After(x.expiresAt) {
+		return nil, false
+	}
+	return x.value, true
+}
+
+func (c *Memory) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items[key] = memoryItem{
+		value:     value,
+		expiresAt: time.Now().Add(ttl),
+	}
+}
+
+// Flush removes all items
+func (c *Memory) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[string]memoryItem)
+}
+
+func (c *Memory) cleanup() {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, x := range c.items {
+		if now.After(x.expiresAt) {
+			delete(c.items, k)
+		}
+	}
+}
+
+// Tiered looks up caches in order, then fills the upper tiers on lower tier hit
+type Tiered struct {
+	Tiers   []Store
+	FillTTL time.Duration // ttl for filling upper tiers
+}
+
+func (c *Tiered) Get(key string) ([]byte, bool) {
+	for i, t := range c.Tiers {
+		value, ok := t.Get(key)
+		if !ok {
+			continue
+		}
+		for _, upper := range c.Tiers[:i] {
+			upper.Set(key, value, c.FillTTL)
+		}
+		return value, true
+	}
+	return nil, false
+}
+
+func (c *Tiered) Set(key string, value []byte, ttl time.Duration) {
+	for _, t := range c.Tiers {
+		t.Set(key, value, ttl)
+	}
+}
+
+// Flush flushes all flushable tiers, shared tiers (e.g. redis) are not flushable
+func (c *Tiered) Flush() {
+	for _, t := range c.Tiers {
+		if f, ok := t.(Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// ImmutableMethods are methods that result never change once available
+var ImmutableMethods = []string{
+	"eth_chainId",
+	"net_version",
+	"eth_getBlockByHash",
+	"eth_getBlockTransactionCountByHash",
+	"eth_getUncleCountByBlockHash",
+	"eth_getTransactionByBlockHashAndIndex",
+	"eth_getUncleByBlockHashAndIndex",
+}
+
+// ConfirmedMethods are methods that result can be changed by reorg (block hash, block number, or dropped),
+// they must be cached only when the containing block is confirmed
+var ConfirmedMethods = []string{
+	"eth_getTransactionByHash",
+	"eth_getTransactionReceipt",
+}
+
+// RPC caches json-rpc results by method and params,
+// must be used after rpcproxy.Parse
+type RPC struct {
+	TTL   map[string]time.Duration // cache ttl per method
+	Store Store
+
+	// Call calls json-rpc request on cache miss
+	Call func(ctx context.Context, req *rpcproxy.Request) (json.RawMessage, error)
+
+	// Observe is called with hit or miss result, ex. metrics
+	Observe func(method, result string)
+
+	// Head returns current head block number, results of ConfirmedMethods are cached
+	// only when their block is at least Confirmations deep, nil = never cache them
+	Head          func(ctx context.Context) (uint64, error)
+	Confirmations uint64
+}
+
+// ServeHandler implements middleware interface
+func (m *RPC) ServeHandler(h http.Handler) http.Handler {
+	var group flightGroup
+
+	return rpcproxy.Intercept(func(r *http.Request, req *rpcproxy.Request) *rpcproxy.Response {
+		ttl, ok := m.TTL[req.Method]
+		if !ok {
+			return nil
+		}
+
+		key := Key(req)
+		if result, ok := m.Store.Get(key); ok {
+			m.observe(req.Method, "hit")
+			return rpcproxy.NewResult(req, result)
+		}
+		m.observe(req.Method, "miss")
+
+		result, err := group.Do(key, func() ([]byte, error) {
+			result, err := m.Call(r.Context(), req)
+			if err != nil {
+				return nil, err
+			}
+			if !isEmptyResult(result) && m.confirmed(r.Context(), req.Method, result) {
+				m.Store.Set(key, result, ttl)
+			}
+			return result, nil
+		})
+		if err != nil {
+			return rpcproxy.NewErrorFrom(req, err)
+		}
+		return rpcproxy.NewResult(req, result)
+	}).ServeHandler(h)
+}
+
+// confirmed returns true if result's block is deep enough to be cached,
+// results of methods that are not in ConfirmedMethods are always confirmed
+func (m *RPC) confirmed(ctx context.Context, method string, result []byte) bool {
+	if !isConfirmedMethod(method) {
+		return true
+	}
+	if m.Head == nil {
+		return false
+	}
+
+	var x struct {
+		BlockNumber *hexutil.Uint64 `json:"blockNumber"`
+	}
+	if json.Unmarshal(result, &x) != nil || x.BlockNumber == nil {
+		return false
+	}
+	head, err := m.Head(ctx)
+	if err != nil {
+		return false
+	}
+	return head >= uint64(*x.BlockNumber)+m.Confirmations
+}
+
+func isConfirmedMethod(method string) bool {
+	for _, x := range ConfirmedMethods {
+		if x == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *RPC) observe(method, result string) {
+	if m.Observe != nil {
+		m.Observe(method, result)
+	}
+}
+
+// isEmptyResult returns true when result is not available yet (e.g. pending transaction),
+// so it must not be cached
+func isEmptyResult(result []byte) bool {
+	if len(result) == 0 || string(result) == "null" {
+		return true
+	}
+	// pending transaction
+	return bytes.Contains(result, []byte(`"blockHash":null`))
+}
+
+// Key returns cache key of request
+func Key(req *rpcproxy.Request) string {
+	var params bytes.Buffer
+	if json.Compact(&params, req.Params) != nil {
+		params.Reset()
+		params.Write(req.Params)
+	}
+	return req.Method + ":" + params.String()
+}
+
+// flightGroup coalesces concurrent calls with the same key
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg     sync.WaitGroup
+	result []byte
+	err    error
+}
+
+func (g *flightGroup) Do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.result, c.err
+	}
+	c := new(flightCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.result, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return c.result, c.err
+}
@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moonrhythm/geth-proxy/pkg/rpcproxy"
+)
+
+func TestKey(t *testing.T) {
+	cases := []struct {
+		name   string
+		a, b   *rpcproxy.Request
+		sameAs bool
+	}{
+		{
+			name:   "ignores id",
+			a:      &rpcproxy.Request{ID: json.RawMessage(`1`), Method: "eth_chainId"},
+			b:      &rpcproxy.Request{ID: json.RawMessage(`"x"`), Method: "eth_chainId"},
+			sameAs: true,
+		},
+		{
+			name:   "ignores whitespace",
+			a:      &rpcproxy.Request{Method: "eth_getBlockByHash", Params: json.RawMessage(`["0x01",true]`)},
+			b:      &rpcproxy.Request{Method: "eth_getBlockByHash", Params: json.RawMessage(" [ \"0x01\",\n true ] ")},
+			sameAs: true,
+		},
+		{
+			name:   "empty params",
+			a:      &rpcproxy.Request{Method: "eth_chainId"},
+			b:      &rpcproxy.Request{Method: "eth_chainId", Params: json.RawMessage(``)},
+			sameAs: true,
+		},
+		{
+			name: "different params",
+			a:    &rpcproxy.Request{Method: "eth_getBlockByHash", Params: json.RawMessage(`["0x01",true]`)},
+			b:    &rpcproxy.Request{Method: "eth_getBlockByHash", Params: json.RawMessage(`["0x01",false]`)},
+		},
+		{
+			name: "different method",
+			a:    &rpcproxy.Request{Method: "eth_getBlockByHash", Params: json.RawMessage(`["0x01"]`)},
+			b:    &rpcproxy.Request{Method: "eth_getUncleCountByBlockHash", Params: json.RawMessage(`["0x01"]`)},
+		},
+		{
+			name: "method and params boundary",
+			a:    &rpcproxy.Request{Method: "a", Params: json.RawMessage(`["b:c"]`)},
+			b:    &rpcproxy.Request{Method: "a:b", Params: json.RawMessage(`["c"]`)},
+		},
+		{
+			name: "invalid params kept as is",
+			a:    &rpcproxy.Request{Method: "eth_chainId", Params: json.RawMessage(`[1,`)},
+			b:    &rpcproxy.Request{Method: "eth_chainId", Params: json.RawMessage(`[1, `)},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := Key(tc.a), Key(tc.b)
+			if (a == b) != tc.sameAs {
+				t.Errorf("Key(a) = %q, Key(b) = %q, want same = %v", a, b, tc.sameAs)
+			}
+		})
+	}
+}
+
+func TestRPC(t *testing.T) {
+	var calls int
+	m := &RPC{
+		TTL:   map[string]time.Duration{"eth_chainId": time.Minute, "eth_getTransactionByHash": time.Minute},
+		Store: NewMemory(),
+		Call: func(ctx context.Context, req *rpcproxy.Request) (json.RawMessage, error) {
+			calls++
+			switch req.Method {
+			case "eth_chainId":
+				return json.RawMessage(`"0x1"`), nil
+			case "eth_getTransactionByHash":
+				return json.RawMessage(`null`), nil
+			}
+			return nil, errors.New("unexpected method")
+		},
+	}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("upstream called")
+	})
+	h := rpcproxy.Parse().ServeHandler(m.ServeHandler(upstream))
+
+	cases := []struct {
+		name  string
+		body  string
+		resp  string
+		calls int
+	}{
+		{
+			name:  "miss",
+			body:  `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			resp:  `{"jsonrpc":"2.0","id":1,"result":"0x1"}`,
+			calls: 1,
+		},
+		{
+			name:  "hit with request id",
+			body:  `[{"jsonrpc":"2.0","id":"a","method":"eth_chainId"},{"jsonrpc":"2.0","id":"b","method":"eth_chainId"}]`,
+			resp:  `[{"jsonrpc":"2.0","id":"a","result":"0x1"},{"jsonrpc":"2.0","id":"b","result":"0x1"}]`,
+			calls: 1,
+		},
+		{
+			name:  "empty result not cached",
+			body:  `{"jsonrpc":"2.0","id":2,"method":"eth_getTransactionByHash","params":["0x01"]}`,
+			resp:  `{"jsonrpc":"2.0","id":2,"result":null}`,
+			calls: 2,
+		},
+		{
+			name:  "empty result called again",
+			body:  `{"jsonrpc":"2.0","id":3,"method":"eth_getTransactionByHash","params":["0x01"]}`,
+			resp:  `{"jsonrpc":"2.0","id":3,"result":null}`,
+			calls: 3,
+		},
+	}
+
+	// cases share the cache, so they run in order
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+		h.ServeHTTP(w, r)
+
+		if got := strings.TrimSpace(w.Body.String()); got != tc.resp {
+			t.Errorf("%s: response = %s, want %s", tc.name, got, tc.resp)
+		}
+		if calls != tc.calls {
+			t.Errorf("%s: calls = %d, want %d", tc.name, calls, tc.calls)
+		}
+	}
+}
+
+func TestConfirmed(t *testing.T) {
+	head := func(ctx context.Context) (uint64, error) {
+		return 100, nil
+	}
+
+	cases := []struct {
+		name   string
+		head   func(ctx context.Context) (uint64, error)
+		method string
+		result string
+		want   bool
+	}{
+		{"not confirmed method", nil, "eth_chainId", `"0x1"`, true},
+		{"no head", nil, "eth_getTransactionReceipt", `{"blockNumber":"0x1"}`, false},
+		{"deep", head, "eth_getTransactionReceipt", `{"blockNumber":"0x5a"}`, true},     // 90 + 10 <= 100
+		{"shallow", head, "eth_getTransactionReceipt", `{"blockNumber":"0x5b"}`, false}, // 91 + 10 > 100
+		{"pending", head, "eth_getTransactionByHash", `{"blockNumber":null}`, false},
+		{"head error", func(ctx context.Context) (uint64, error) {
+			return 0, errors.New("no head")
+		}, "eth_getTransactionByHash", `{"blockNumber":"0x1"}`, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &RPC{Head: tc.head, Confirmations: 10}
+			if got := m.confirmed(context.Background(), tc.method, []byte(tc.result)); got != tc.want {
+				t.Errorf("confirmed = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
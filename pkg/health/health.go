@@ -0,0 +1,73 @@
+// Package health provides kubernetes style liveness and readiness endpoint
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Check is a named liveness or readiness check
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Checks serves checks in kubernetes style,
+// ?verbose lists each check, ?exclude=name skips the check
+type Checks struct {
+	Name    string        // livez or readyz
+	Timeout time.Duration // deadline for all checks, 0 = request's context
+	Checks  []Check
+}
+
+// Add adds check
+func (m *Checks) Add(name string, check func(ctx context.Context) error) {
+	m.Checks = append(m.Checks, Check{Name: name, Check: check})
+}
+
+// ServeHTTP implements http.Handler
+func (m *Checks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if m.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+	}
+	_, verbose := r.URL.Query()["verbose"]
+	exclude := make(map[string]bool)
+	for _, x := range r.URL.Query()["exclude"] {
+		exclude[x] = true
+	}
+
+	var b strings.Builder
+	failed := false
+	for _, c := range m.Checks {
+		if exclude[c.Name] {
+			fmt.Fprintf(&b, "[+]%s excluded: ok\n", c.Name)
+			continue
+		}
+		if err := c.Check(ctx); err != nil {
+			failed = true
+			fmt.Fprintf(&b, "[-]%s failed: %v\n", c.Name, err)
+			continue
+		}
+		fmt.Fprintf(&b, "[+]%s ok\n", c.Name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if failed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		// failed checks are always listed
+		fmt.Fprintf(w, "%s%s check failed\n", b.String(), m.Name)
+		return
+	}
+	if verbose {
+		fmt.Fprintf(w, "%s%s check passed\n", b.String(), m.Name)
+		return
+	}
+	w.Write([]byte("ok"))
+}
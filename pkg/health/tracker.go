@@ -0,0 +1,173 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ErrNoHead is returned when head is not known yet
+var ErrNoHead = errors.New("no head")
+
+// Tracker tracks chain's head for liveness and readiness,
+// cached head is returned immediately and refreshed in background when stale,
+// only one refresh is in-flight, so callers never stall on slow upstream except before first head
+type Tracker struct {
+	Fetch           func(ctx context.Context) (*types.Header, error) // fetches head from upstream
+	Timeout         time.Duration                                    // fetch timeout, 0 = no timeout
+	HealthyDuration time.Duration                                    // head older than is not ready
+	BlockUnit       time.Duration                                    // unit of block timestamp
+	TTL             time.Duration                                    // duration that fetched head is fresh, default 1s
+	SubscribedTTL   time.Duration                                    // duration that subscribed head is fresh, default 1m
+	OnHead          func(h *types.Header)                            // called with every new head, nil = disable
+
+	mu         sync.Mutex
+	block      *types.Block // header only, without body
+	err        error        // last refresh error
+	updatedAt  time.Time
+	refresh    chan struct{} // closed when in-flight refresh done, nil = no refresh
+	subscribed bool          // head subscription is open
+	headAt     time.Time     // last head from subscription
+}
+
+func (t *Tracker) ttl() time.Duration {
+	if t.TTL <= 0 {
+		return time.Second
+	}
+	return t.TTL
+}
+
+// subscribedTTL is duration that head from subscription is fresh,
+// after that tracker falls back to fetching, in case subscription is silently stuck
+func (t *Tracker) subscribedTTL() time.Duration {
+	if t.SubscribedTTL <= 0 {
+		return time.Minute
+	}
+	return t.SubscribedTTL
+}
+
+// Block returns cached head, and refreshes it in background when stale,
+// error is the last refresh error, returned with the cached head
+func (t *Tracker) Block(ctx context.Context) (*types.Block, error) {
+	t.mu.Lock()
+	block, err := t.block, t.err
+	fresh := time.Since(t.updatedAt) < t.ttl()
+	if t.subscribed && time.Since(t.headAt) < t.subscribedTTL() {
+		fresh = true
+	}
+	if fresh {
+		t.mu.Unlock()
+		return block, err
+	}
+	refresh := t.refresh
+	if refresh == nil {
+		refresh = make(chan struct{})
+		t.refresh = refresh
+		go t.fetch(refresh)
+	}
+	t.mu.Unlock()
+
+	if block != nil {
+		return block, err
+	}
+
+	// no head yet, wait for refresh
+	select {
+	case <-refresh:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.block, t.err
+}
+
+func (t *Tracker) fetch(done chan struct{}) {
+	// not bound to any caller
+	ctx := context.Background()
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	header, err := t.Fetch(ctx)
+	if err == nil && header == nil {
+		err = ErrNoHead
+	}
+
+	t.mu.Lock()
+	t.err = err
+	if err == nil {
+		t.block = types.NewBlockWithHeader(header)
+	}
+	// failed refresh is retried after ttl, not by every caller
+	t.updatedAt = time.Now()
+	t.refresh = nil
+	t.mu.Unlock()
+	close(done)
+
+	if err == nil && t.OnHead != nil {
+		t.OnHead(header)
+	}
+}
+
+// SetHead sets head from subscription
+func (t *Tracker) SetHead(h *types.Header) {
+	now := time.Now()
+	t.mu.Lock()
+	t.block = types.NewBlockWithHeader(h)
+	t.err = nil
+	t.updatedAt = now
+	t.headAt = now
+	t.mu.Unlock()
+
+	if t.OnHead != nil {
+		t.OnHead(h)
+	}
+}
+
+// SetSubscribed sets whether head subscription is open
+func (t *Tracker) SetSubscribed(subscribed bool) {
+	t.mu.Lock()
+	t.subscribed = subscribed
+	t.mu.Unlock()
+}
+
+// Age returns duration since cached head's block time
+func (t *Tracker) Age(ctx context.Context) (time.Duration, error) {
+	block, err := t.Block(ctx)
+	if block == nil {
+		if err == nil {
+			err = ErrNoHead
+		}
+		return 0, err
+	}
+	return t.age(block), nil
+}
+
+func (t *Tracker) age(block *types.Block) time.Duration {
+	ts := block.Time() * uint64(t.BlockUnit) // convert to ns
+	return time.Since(time.Unix(0, int64(ts)))
+}
+
+// Ready returns true when head is younger than healthy duration
+func (t *Tracker) Ready(ctx context.Context) (bool, error) {
+	block, err := t.Block(ctx)
+	if err != nil {
+		return false, err
+	}
+	if block == nil {
+		return false, ErrNoHead
+	}
+	return t.age(block) < t.HealthyDuration, nil
+}
+
+// Live returns true when the last refresh succeeded
+func (t *Tracker) Live(ctx context.Context) bool {
+	_, err := t.Block(ctx)
+	return err == nil
+}
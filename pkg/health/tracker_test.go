@@ -0,0 +1,92 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestTracker(t *testing.T) {
+	now := uint64(time.Now().Unix())
+
+	cases := []struct {
+		name   string
+		header *types.Header
+		err    error
+		ready  bool
+		live   bool
+		fail   bool // Ready returns error
+	}{
+		{"fresh", &types.Header{Number: big.NewInt(1), Time: now}, nil, true, true, false},
+		{"stale", &types.Header{Number: big.NewInt(1), Time: now - 60}, nil, false, true, false},
+		{"fetch error", nil, errors.New("upstream down"), false, false, true},
+		{"no head", nil, nil, false, false, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &Tracker{
+				Fetch: func(ctx context.Context) (*types.Header, error) {
+					return tc.header, tc.err
+				},
+				HealthyDuration: 10 * time.Second,
+				BlockUnit:       time.Second,
+			}
+			ctx := context.Background()
+
+			ready, err := tr.Ready(ctx)
+			if ready != tc.ready || (err != nil) != tc.fail {
+				t.Errorf("Ready = %v, %v; want %v, error %v", ready, err, tc.ready, tc.fail)
+			}
+			if live := tr.Live(ctx); live != tc.live {
+				t.Errorf("Live = %v, want %v", live, tc.live)
+			}
+		})
+	}
+}
+
+func TestTrackerCachesHead(t *testing.T) {
+	var fetches int
+	heads := make(chan uint64, 2)
+	tr := &Tracker{
+		Fetch: func(ctx context.Context) (*types.Header, error) {
+			fetches++
+			return &types.Header{Number: big.NewInt(int64(fetches)), Time: uint64(time.Now().Unix())}, nil
+		},
+		HealthyDuration: 10 * time.Second,
+		BlockUnit:       time.Second,
+		TTL:             time.Hour,
+		OnHead: func(h *types.Header) {
+			heads <- h.Number.Uint64()
+		},
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		b, err := tr.Block(ctx)
+		if err != nil {
+			t.Fatalf("Block error: %v", err)
+		}
+		if b.NumberU64() != 1 {
+			t.Errorf("Block = %d, want cached 1", b.NumberU64())
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("fetches = %d, want 1", fetches)
+	}
+
+	tr.SetHead(&types.Header{Number: big.NewInt(5), Time: uint64(time.Now().Unix())})
+	if b, _ := tr.Block(ctx); b.NumberU64() != 5 {
+		t.Errorf("Block after SetHead = %d, want 5", b.NumberU64())
+	}
+
+	// fetched head is published from background refresh
+	published := map[uint64]bool{<-heads: true, <-heads: true}
+	if !published[1] || !published[5] {
+		t.Errorf("OnHead = %v, want 1 and 5", published)
+	}
+}
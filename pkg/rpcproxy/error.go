@@ -0,0 +1,88 @@
+package rpcproxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/moonrhythm/parapet"
+)
+
+// NormalizeError converts non json error responses (ex. parapet's upstream error page)
+// into json-rpc error responses, must be used after Parse to preserve request id
+func NormalizeError() parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			nw := errorResponseWriter{
+				ResponseWriter: w,
+				r:              r,
+			}
+			h.ServeHTTP(&nw, r)
+		})
+	})
+}
+
+type errorResponseWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+	discard     bool
+}
+
+func (w *errorResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	ct := w.Header().Get("Content-Type")
+	if statusCode < 400 || strings.HasPrefix(ct, "application/json") {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	w.discard = true
+	w.Header().Del("Content-Length")
+	w.Header().Del("X-Content-Type-Options")
+	WriteError(w.ResponseWriter, w.r, statusCode, CodeServerError, errorMessage(statusCode))
+}
+
+func (w *errorResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements Flusher interface
+func (w *errorResponseWriter) Flush() {
+	if w.discard {
+		return
+	}
+	if w, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.Flush()
+	}
+}
+
+// errorMessage returns json-rpc error message for proxy's http status
+func errorMessage(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadGateway:
+		return "upstream unavailable"
+	case http.StatusServiceUnavailable:
+		return "no healthy upstream"
+	case http.StatusGatewayTimeout:
+		return "upstream timeout"
+	}
+	if s := http.StatusText(statusCode); s != "" {
+		return strings.ToLower(s)
+	}
+	return "upstream error"
+}
@@ -0,0 +1,378 @@
+// Package rpcproxy provides json-rpc aware http middlewares,
+// the call is parsed once by Parse, then middlewares can inspect, intercept, or rewrite requests in the call
+package rpcproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/moonrhythm/parapet"
+	"github.com/moonrhythm/parapet/pkg/logger"
+)
+
+// Request is a json-rpc request
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Call is the parsed json-rpc http request body
+type Call struct {
+	Batch    bool
+	Requests []*Request
+	Dirty    bool // requests modified, body must be re-encoded
+}
+
+// Methods returns all methods in the call
+func (c *Call) Methods() []string {
+	xs := make([]string, len(c.Requests))
+	for i, req := range c.Requests {
+		if req != nil { // null in batch
+			xs[i] = req.Method
+		}
+	}
+	return xs
+}
+
+type callKey struct{}
+
+// GetCall returns parsed call from context, or nil if request is not json-rpc
+func GetCall(ctx context.Context) *Call {
+	c, _ := ctx.Value(callKey{}).(*Call)
+	return c
+}
+
+// ParseCall parses json-rpc request body
+func ParseCall(body []byte) (*Call, error) {
+	body = bytes.TrimSpace(body)
+
+	var c Call
+	if len(body) > 0 && body[0] == '[' {
+		c.Batch = true
+		err := json.Unmarshal(body, &c.Requests)
+		if err != nil {
+			return nil, err
+		}
+		return &c, nil
+	}
+
+	var req Request
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		return nil, err
+	}
+	c.Requests = []*Request{&req}
+	return &c, nil
+}
+
+// Parse parses json-rpc request body and stores it into request context,
+// the body is restored so upstream still receives the original request
+func Parse() parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.Body == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				WriteError(w, r, http.StatusBadRequest, CodeParseError, "can not read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+
+			c, err := ParseCall(body)
+			if err != nil {
+				// let upstream returns parse error
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			logger.Set(ctx, "rpcMethod", strings.Join(c.Methods(), ","))
+			ctx = context.WithValue(ctx, callKey{}, c)
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+}
+
+// Response is a json-rpc response
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error is a json-rpc error
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// json-rpc error codes
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	CodeServerError    = -32000
+	CodeLimitExceeded  = -32005
+)
+
+// NewError creates error response for request
+func NewError(req *Request, code int, message string) *Response {
+	return &Response{
+		JSONRPC: "2.0",
+		ID:      id(req),
+		Error: &Error{
+			Code:    code,
+			Message: message,
+		},
+	}
+}
+
+// NewResult creates result response for request
+func NewResult(req *Request, result json.RawMessage) *Response {
+	return &Response{
+		JSONRPC: "2.0",
+		ID:      id(req),
+		Result:  result,
+	}
+}
+
+// NewErrorFrom converts error from rpc client into json-rpc error response
+func NewErrorFrom(req *Request, err error) *Response {
+	resp := NewError(req, CodeInternalError, err.Error())
+	if e, ok := err.(rpc.Error); ok {
+		resp.Error.Code = e.ErrorCode()
+	}
+	if e, ok := err.(rpc.DataError); ok {
+		resp.Error.Data = e.ErrorData()
+	}
+	return resp
+}
+
+func id(req *Request) json.RawMessage {
+	if req == nil || len(req.ID) == 0 {
+		return json.RawMessage("null")
+	}
+	return req.ID
+}
+
+// WriteResponses writes responses as batch or single response
+func WriteResponses(w http.ResponseWriter, batch bool, resps []*Response) {
+	w.Header().Set("Content-Type", "application/json")
+	if batch {
+		json.NewEncoder(w).Encode(resps)
+		return
+	}
+	if len(resps) > 0 {
+		json.NewEncoder(w).Encode(resps[0])
+	}
+}
+
+// WriteError writes json-rpc error for all requests in the call
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code int, message string) {
+	WriteErrorData(w, r, status, code, message, nil)
+}
+
+// WriteErrorData writes json-rpc error with data to all requests in the call
+func WriteErrorData(w http.ResponseWriter, r *http.Request, status int, code int, message string, data interface{}) {
+	c := GetCall(r.Context())
+	if c == nil {
+		c = &Call{Requests: []*Request{nil}}
+	}
+
+	resps := make([]*Response, len(c.Requests))
+	for i, req := range c.Requests {
+		resps[i] = NewError(req, code, message)
+		resps[i].Error.Data = data
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if c.Batch {
+		json.NewEncoder(w).Encode(resps)
+		return
+	}
+	json.NewEncoder(w).Encode(resps[0])
+}
+
+// Interceptor returns response for the request that should not forward to upstream,
+// or nil to forward the request to upstream.
+// Interceptor never receives nil request.
+//
+// Interceptor may modify the request, then it must mark the call as dirty.
+type Interceptor func(r *http.Request, req *Request) *Response
+
+// Intercept serves intercepted requests from interceptor,
+// and forwards the remaining requests in the call to the next handler
+func Intercept(f Interceptor) parapet.Middleware {
+	return parapet.MiddlewareFunc(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := GetCall(r.Context())
+			if c == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			var (
+				resps     []*Response
+				remaining []*Request
+			)
+			for _, req := range c.Requests {
+				// null in batch, let upstream returns invalid request error
+				if req == nil {
+					remaining = append(remaining, req)
+					continue
+				}
+				if resp := f(r, req); resp != nil {
+					resps = append(resps, resp)
+					continue
+				}
+				remaining = append(remaining, req)
+			}
+
+			// nothing intercepted
+			if len(resps) == 0 {
+				if c.Dirty {
+					r = withCall(r, c)
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			// all intercepted
+			if len(remaining) == 0 {
+				WriteResponses(w, c.Batch, resps)
+				return
+			}
+
+			// forward remaining requests as a batch, then merge responses
+			r = withCall(r, &Call{
+				Batch:    true,
+				Requests: remaining,
+			})
+			r.Header.Del("Accept-Encoding")
+
+			nw := newBufferResponseWriter()
+			h.ServeHTTP(nw, r)
+
+			var upstreamResps []*Response
+			if nw.status != http.StatusOK || json.Unmarshal(nw.buf.Bytes(), &upstreamResps) != nil {
+				nw.writeTo(w)
+				return
+			}
+			WriteResponses(w, true, append(resps, upstreamResps...))
+		})
+	})
+}
+
+// Forward sends request as a single call to the next handler, and returns its response,
+// used by interceptors that split a request into sub-requests
+func Forward(h http.Handler, r *http.Request, req *Request) *Response {
+	// clone headers, sub-requests may be forwarded concurrently
+	r = withCall(r.Clone(r.Context()), &Call{Requests: []*Request{req}})
+	r.Header.Del("Accept-Encoding")
+
+	nw := newBufferResponseWriter()
+	h.ServeHTTP(nw, r)
+
+	var resp Response
+	if json.Unmarshal(nw.buf.Bytes(), &resp) == nil && (resp.Error != nil || resp.Result != nil) {
+		resp.ID = id(req)
+		return &resp
+	}
+	return NewError(req, CodeServerError, errorMessage(nw.status))
+}
+
+// withCall re-encodes the call into request body
+func withCall(r *http.Request, c *Call) *http.Request {
+	var body []byte
+	if c.Batch {
+		body, _ = json.Marshal(c.Requests)
+	} else {
+		body, _ = json.Marshal(c.Requests[0])
+	}
+	c.Dirty = false
+
+	r = r.WithContext(context.WithValue(r.Context(), callKey{}, c))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Del("Content-Length")
+	return r
+}
+
+type bufferResponseWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func newBufferResponseWriter() *bufferResponseWriter {
+	return &bufferResponseWriter{
+		header: make(http.Header),
+	}
+}
+
+func (w *bufferResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferResponseWriter) WriteHeader(statusCode int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = statusCode
+}
+
+func (w *bufferResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *bufferResponseWriter) writeTo(rw http.ResponseWriter) {
+	for k, v := range w.header {
+		rw.Header()[k] = v
+	}
+	if w.status != 0 {
+		rw.WriteHeader(w.status)
+	}
+	rw.Write(w.buf.Bytes())
+}
+
+// CallClient calls json-rpc request using rpc client
+func CallClient(ctx context.Context, c *rpc.Client, req *Request) (json.RawMessage, error) {
+	var params []json.RawMessage
+	if len(req.Params) > 0 {
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	args := make([]interface{}, len(params))
+	for i := range params {
+		args[i] = params[i]
+	}
+
+	var result json.RawMessage
+	err := c.CallContext(ctx, &result, req.Method, args...)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,234 @@
+package rpcproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoUpstream responds to every request with its method as result,
+// and records the body it received
+type echoUpstream struct {
+	body string
+}
+
+func (u *echoUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	u.body = string(body)
+
+	c, err := ParseCall(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	resps := make([]*Response, len(c.Requests))
+	for i, req := range c.Requests {
+		if req == nil {
+			resps[i] = NewError(nil, CodeInvalidRequest, "invalid request")
+			continue
+		}
+		result, _ := json.Marshal(req.Method)
+		resps[i] = NewResult(req, result)
+	}
+	WriteResponses(w, c.Batch, resps)
+}
+
+func compact(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(s)); err != nil {
+		t.Fatalf("invalid json %q: %v", s, err)
+	}
+	return buf.String()
+}
+
+func TestIntercept(t *testing.T) {
+	// intercepts methods start with "local_", and rewrites "old_" params
+	f := func(r *http.Request, req *Request) *Response {
+		if strings.HasPrefix(req.Method, "local_") {
+			return NewResult(req, json.RawMessage(`"intercepted"`))
+		}
+		if req.Method == "old_method" {
+			req.Method = "new_method"
+			GetCall(r.Context()).Dirty = true
+		}
+		return nil
+	}
+
+	cases := []struct {
+		name     string
+		body     string
+		upstream string // body upstream received, empty = not called
+		resp     string
+	}{
+		{
+			name:     "single forwarded",
+			body:     `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			upstream: `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			resp:     `{"jsonrpc":"2.0","id":1,"result":"eth_chainId"}`,
+		},
+		{
+			name: "single intercepted",
+			body: `{"jsonrpc":"2.0","id":"a","method":"local_x"}`,
+			resp: `{"jsonrpc":"2.0","id":"a","result":"intercepted"}`,
+		},
+		{
+			name: "batch all intercepted",
+			body: `[{"jsonrpc":"2.0","id":1,"method":"local_x"},{"jsonrpc":"2.0","id":2,"method":"local_y"}]`,
+			resp: `[{"jsonrpc":"2.0","id":1,"result":"intercepted"},{"jsonrpc":"2.0","id":2,"result":"intercepted"}]`,
+		},
+		{
+			name:     "batch merged",
+			body:     `[{"jsonrpc":"2.0","id":1,"method":"eth_a"},{"jsonrpc":"2.0","id":2,"method":"local_x"},{"jsonrpc":"2.0","id":3,"method":"eth_b"}]`,
+			upstream: `[{"jsonrpc":"2.0","id":1,"method":"eth_a"},{"jsonrpc":"2.0","id":3,"method":"eth_b"}]`,
+			resp:     `[{"jsonrpc":"2.0","id":2,"result":"intercepted"},{"jsonrpc":"2.0","id":1,"result":"eth_a"},{"jsonrpc":"2.0","id":3,"result":"eth_b"}]`,
+		},
+		{
+			name:     "batch null forwarded",
+			body:     `[null,{"jsonrpc":"2.0","id":1,"method":"local_x"}]`,
+			upstream: `[null]`,
+			resp:     `[{"jsonrpc":"2.0","id":1,"result":"intercepted"},{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request"}}]`,
+		},
+		{
+			name:     "single dirty",
+			body:     `{"jsonrpc":"2.0","id":1,"method":"old_method"}`,
+			upstream: `{"jsonrpc":"2.0","id":1,"method":"new_method"}`,
+			resp:     `{"jsonrpc":"2.0","id":1,"result":"new_method"}`,
+		},
+		{
+			name:     "batch dirty merged",
+			body:     `[{"jsonrpc":"2.0","id":1,"method":"old_method"},{"jsonrpc":"2.0","id":2,"method":"local_x"}]`,
+			upstream: `[{"jsonrpc":"2.0","id":1,"method":"new_method"}]`,
+			resp:     `[{"jsonrpc":"2.0","id":2,"result":"intercepted"},{"jsonrpc":"2.0","id":1,"result":"new_method"}]`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &echoUpstream{}
+			h := Parse().ServeHandler(Intercept(f).ServeHandler(u))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			h.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got, want := compact(t, w.Body.String()), compact(t, tc.resp); got != want {
+				t.Errorf("response = %s, want %s", got, want)
+			}
+			if tc.upstream == "" {
+				if u.body != "" {
+					t.Errorf("upstream called with %s", u.body)
+				}
+				return
+			}
+			if got, want := compact(t, u.body), compact(t, tc.upstream); got != want {
+				t.Errorf("upstream body = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestInterceptUpstreamError(t *testing.T) {
+	f := func(r *http.Request, req *Request) *Response {
+		if req.Method == "local_x" {
+			return NewResult(req, json.RawMessage(`"intercepted"`))
+		}
+		return nil
+	}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	})
+	h := Parse().ServeHandler(Intercept(f).ServeHandler(upstream))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[{"jsonrpc":"2.0","id":1,"method":"eth_a"},{"jsonrpc":"2.0","id":2,"method":"local_x"}]`))
+	h.ServeHTTP(w, r)
+
+	// upstream error is passed through, not merged
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestForward(t *testing.T) {
+	cases := []struct {
+		name   string
+		req    *Request
+		status int
+		body   string
+		resp   string
+	}{
+		{
+			name:   "result",
+			req:    &Request{JSONRPC: "2.0", ID: json.RawMessage(`7`), Method: "eth_a"},
+			status: http.StatusOK,
+			body:   `{"jsonrpc":"2.0","id":99,"result":"0x1"}`,
+			resp:   `{"jsonrpc":"2.0","id":7,"result":"0x1"}`,
+		},
+		{
+			name:   "error",
+			req:    &Request{JSONRPC: "2.0", ID: json.RawMessage(`"x"`), Method: "eth_a"},
+			status: http.StatusOK,
+			body:   `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"method not found"}}`,
+			resp:   `{"jsonrpc":"2.0","id":"x","error":{"code":-32601,"message":"method not found"}}`,
+		},
+		{
+			name:   "no id",
+			req:    &Request{JSONRPC: "2.0", Method: "eth_a"},
+			status: http.StatusOK,
+			body:   `{"jsonrpc":"2.0","id":1,"result":"0x1"}`,
+			resp:   `{"jsonrpc":"2.0","id":null,"result":"0x1"}`,
+		},
+		{
+			name:   "upstream unavailable",
+			req:    &Request{JSONRPC: "2.0", ID: json.RawMessage(`1`), Method: "eth_a"},
+			status: http.StatusBadGateway,
+			body:   `bad gateway`,
+			resp:   `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"upstream unavailable"}}`,
+		},
+		{
+			name:   "invalid response",
+			req:    &Request{JSONRPC: "2.0", ID: json.RawMessage(`1`), Method: "eth_a"},
+			status: http.StatusOK,
+			body:   `{}`,
+			resp:   `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"ok"}}`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got string
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				got = string(body)
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			resp := Forward(upstream, r, tc.req)
+
+			// sub-request is sent as single call
+			want, _ := json.Marshal(tc.req)
+			if got != string(want) {
+				t.Errorf("upstream body = %s, want %s", got, want)
+			}
+			if r.Header.Get("Accept-Encoding") == "" {
+				t.Errorf("original request header modified")
+			}
+
+			b, _ := json.Marshal(resp)
+			if string(b) != compact(t, tc.resp) {
+				t.Errorf("response = %s, want %s", b, tc.resp)
+			}
+		})
+	}
+}
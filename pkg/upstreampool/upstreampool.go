@@ -0,0 +1,605 @@
+// Package upstreampool provides health checked pool of geth nodes,
+// with weighted round-robin, consistent hashing, or load aware balancing, and read/write split
+package upstreampool
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/moonrhythm/parapet/pkg/upstream"
+
+	"github.com/moonrhythm/geth-proxy/pkg/rpcproxy"
+)
+
+// Upstream is a geth node in upstream pool
+type Upstream struct {
+	Addr   string // host address, without port
+	Source string // discovery source, empty for static upstream
+	RPC    *rpc.Client
+	Eth    *ethclient.Client
+
+	stop chan struct{}
+
+	mu       sync.RWMutex
+	head     *types.Header
+	healthy  bool
+	disabled bool
+	weight   int
+	latency  time.Duration // ewma of response latency, 0 = no sample
+
+	inFlight int64
+}
+
+// latencyDecay is weight of new latency sample in ewma
+const latencyDecay = 0.2
+
+// Dial creates upstream for geth at addr, rpc calls use client
+func Dial(addr, httpPort string, client *http.Client) (*Upstream, error) {
+	return DialURL(addr, "http://"+net.JoinHostPort(addr, httpPort), client)
+}
+
+// DialURL creates upstream for geth at addr with rpc url, ex. https url for geth behind tls
+func DialURL(addr, rawURL string, client *http.Client) (*Upstream, error) {
+	c, err := rpc.DialHTTPWithClient(rawURL, client)
+	if err != nil {
+		return nil, err
+	}
+	return &Upstream{
+		Addr:   addr,
+		RPC:    c,
+		Eth:    ethclient.NewClient(c),
+		stop:   make(chan struct{}),
+		weight: 1,
+	}, nil
+}
+
+// Healthy returns true if upstream's last block is not older than healthy duration
+func (u *Upstream) Healthy() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.healthy
+}
+
+// Disabled returns true if upstream was drained from pool
+func (u *Upstream) Disabled() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.disabled
+}
+
+// SetDisabled drains or re-enables upstream
+func (u *Upstream) SetDisabled(disabled bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.disabled = disabled
+}
+
+// Weight returns upstream's share of traffic relative to other upstreams
+func (u *Upstream) Weight() int {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.weight
+}
+
+// SetWeight sets upstream's weight, 0 receives no traffic unless all upstreams are 0
+func (u *Upstream) SetWeight(weight int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.weight = weight
+}
+
+// InFlight returns number of in-flight requests to upstream
+func (u *Upstream) InFlight() int64 {
+	return atomic.LoadInt64(&u.inFlight)
+}
+
+// Latency returns ewma of upstream's response latency, 0 if no sample yet
+func (u *Upstream) Latency() time.Duration {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.latency
+}
+
+func (u *Upstream) observeLatency(d time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.latency == 0 {
+		u.latency = d
+		return
+	}
+	u.latency = time.Duration(latencyDecay*float64(d) + (1-latencyDecay)*float64(u.latency))
+}
+
+// Track wraps rt to count upstream's in-flight requests and response latency for load aware strategies,
+// request is in-flight until response body is closed
+func (u *Upstream) Track(rt http.RoundTripper) http.RoundTripper {
+	return &trackTransport{Upstream: u, Transport: rt}
+}
+
+type trackTransport struct {
+	Upstream  *Upstream
+	Transport http.RoundTripper
+}
+
+func (t *trackTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	u := t.Upstream
+	atomic.AddInt64(&u.inFlight, 1)
+	start := time.Now()
+	resp, err := t.Transport.RoundTrip(r)
+	if err != nil {
+		atomic.AddInt64(&u.inFlight, -1)
+		return nil, err
+	}
+	u.observeLatency(time.Since(start))
+	resp.Body = &trackBody{ReadCloser: resp.Body, u: u}
+	return resp, nil
+}
+
+type trackBody struct {
+	io.ReadCloser
+	u    *Upstream
+	once sync.Once
+}
+
+func (b *trackBody) Close() error {
+	b.once.Do(func() {
+		atomic.AddInt64(&b.u.inFlight, -1)
+	})
+	return b.ReadCloser.Close()
+}
+
+// Head returns last known header
+func (u *Upstream) Head() *types.Header {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.head
+}
+
+func (u *Upstream) check(ctx context.Context, healthyDuration, blockUnit time.Duration) {
+	start := time.Now()
+	header, err := u.Eth.HeaderByNumber(ctx, nil)
+	if err == nil {
+		// keep latency fresh for upstream that gets no traffic
+		u.observeLatency(time.Since(start))
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err != nil {
+		u.healthy = false
+		return
+	}
+	u.head = header
+	u.healthy = time.Since(BlockTime(header.Time, blockUnit)) < healthyDuration
+}
+
+// startCheck starts health checking loop until upstream removed from pool
+func (u *Upstream) startCheck(p *Pool) {
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), p.checkTimeout())
+			u.check(ctx, p.HealthyDuration, p.BlockUnit)
+			cancel()
+
+			select {
+			case <-u.stop:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+// Pool is the pool of geth upstreams
+type Pool struct {
+	Chain           string          // chain name for metrics
+	Primary         string          // primary upstream address for write methods, empty = no read/write split
+	WriteMethods    map[string]bool // methods routed to primary
+	Weights         map[string]int  // initial upstream weights by address, default 1
+	HealthyDuration time.Duration   // duration from last block that mark as healthy
+	BlockUnit       time.Duration   // block timestamp unit, ex. time.Second
+	CheckTimeout    time.Duration   // health check rpc timeout, default 2s
+
+	// TraceAddrs is upstream addresses that serve TraceMethod calls, ex. archive nodes, empty = any upstream
+	TraceAddrs map[string]bool
+	// TraceMethod returns true if method is served only by TraceAddrs
+	TraceMethod func(method string) bool
+
+	// Strategy is load balancing strategy, StrategyRoundRobin (default), StrategyHash,
+	// StrategyLeastLoaded, or StrategyLatency
+	Strategy string
+	// ClientKey returns client identity of request for StrategyHash, empty = round-robin
+	ClientKey func(r *http.Request) string
+
+	// Instrument wraps transport to upstream, ex. per upstream metrics
+	Instrument func(u *Upstream, rt http.RoundTripper) http.RoundTripper
+
+	// OnRemove is called after upstream removed from pool
+	OnRemove func(u *Upstream)
+
+	mu        sync.RWMutex
+	upstreams []*Upstream
+	started   bool
+
+	i uint32
+}
+
+func (p *Pool) checkTimeout() time.Duration {
+	if p.CheckTimeout <= 0 {
+		return 2 * time.Second
+	}
+	return p.CheckTimeout
+}
+
+// Start starts health checking loop
+func (p *Pool) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.started = true
+	for _, u := range p.upstreams {
+		u.startCheck(p)
+	}
+}
+
+// List returns all upstreams
+func (p *Pool) List() []*Upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.upstreams
+}
+
+// Add adds upstream to pool
+func (p *Pool) Add(u *Upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if w, ok := p.Weights[u.Addr]; ok {
+		u.SetWeight(w)
+	}
+	xs := make([]*Upstream, 0, len(p.upstreams)+1)
+	xs = append(xs, p.upstreams...)
+	p.upstreams = append(xs, u)
+	if p.started {
+		u.startCheck(p)
+	}
+}
+
+// Remove removes upstream from pool
+func (p *Pool) Remove(u *Upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	xs := make([]*Upstream, 0, len(p.upstreams))
+	for _, x := range p.upstreams {
+		if x != u {
+			xs = append(xs, x)
+		}
+	}
+	if len(xs) == len(p.upstreams) {
+		return
+	}
+	p.upstreams = xs
+	close(u.stop)
+	u.RPC.Close()
+	if p.OnRemove != nil {
+		p.OnRemove(u)
+	}
+}
+
+// Healthy returns all healthy enabled upstreams,
+// or all enabled upstreams if none is healthy to let the request fail on upstream instead of the proxy
+func (p *Pool) Healthy() []*Upstream {
+	enabled := p.Enabled()
+	if len(enabled) == 1 {
+		return enabled
+	}
+
+	var xs []*Upstream
+	for _, u := range enabled {
+		if u.Healthy() {
+			xs = append(xs, u)
+		}
+	}
+	if len(xs) == 0 {
+		return enabled
+	}
+	return xs
+}
+
+// Head returns the highest last known header of healthy upstreams, or nil if none is known
+func (p *Pool) Head() *types.Header {
+	var head *types.Header
+	for _, u := range p.Healthy() {
+		h := u.Head()
+		if h != nil && (head == nil || h.Number.Cmp(head.Number) > 0) {
+			head = h
+		}
+	}
+	return head
+}
+
+// Enabled returns all enabled upstreams,
+// or all upstreams if all were drained
+func (p *Pool) Enabled() []*Upstream {
+	all := p.List()
+
+	var xs []*Upstream
+	for _, u := range all {
+		if !u.Disabled() {
+			xs = append(xs, u)
+		}
+	}
+	if len(xs) == 0 {
+		return all
+	}
+	return xs
+}
+
+// TraceHealthy returns healthy enabled upstreams in TraceAddrs,
+// unlike Healthy there is no fallback to unhealthy upstreams, since other nodes can not serve trace calls
+func (p *Pool) TraceHealthy() []*Upstream {
+	var xs []*Upstream
+	for _, u := range p.List() {
+		if p.TraceAddrs[u.Addr] && !u.Disabled() && u.Healthy() {
+			xs = append(xs, u)
+		}
+	}
+	return xs
+}
+
+// IsTrace returns true if call contains method served only by trace upstreams
+func (p *Pool) IsTrace(c *rpcproxy.Call) bool {
+	if len(p.TraceAddrs) == 0 || p.TraceMethod == nil || c == nil {
+		return false
+	}
+	for _, req := range c.Requests {
+		if req != nil && p.TraceMethod(req.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns upstream by address
+func (p *Pool) Get(addr string) *Upstream {
+	for _, u := range p.List() {
+		if u.Addr == addr {
+			return u
+		}
+	}
+	return nil
+}
+
+// Load balancing strategies
+const (
+	StrategyRoundRobin  = "round-robin"
+	StrategyHash        = "hash"         // client affinity with weighted rendezvous hashing
+	StrategyLeastLoaded = "least-loaded" // fewest in-flight requests per weight
+	StrategyLatency     = "latency"      // lowest ewma latency, scaled by in-flight requests
+)
+
+// Next returns next healthy upstream using pool's strategy, hash falls back to round-robin,
+// or nil if pool is empty
+func (p *Pool) Next() *Upstream {
+	return p.pickFor(p.Healthy(), "")
+}
+
+// pickFor returns upstream from xs using pool's strategy,
+// StrategyHash without client key is round-robin
+func (p *Pool) pickFor(xs []*Upstream, key string) *Upstream {
+	switch p.Strategy {
+	case StrategyHash:
+		if key != "" {
+			return pickHash(xs, key)
+		}
+	case StrategyLeastLoaded:
+		return p.pickLoad(xs, func(u *Upstream) float64 {
+			return float64(u.InFlight() + 1)
+		})
+	case StrategyLatency:
+		// peak ewma, fast upstream is not picked for every request while it is busy
+		return p.pickLoad(xs, func(u *Upstream) float64 {
+			return float64(u.Latency()) * float64(u.InFlight()+1)
+		})
+	}
+	return p.pick(xs)
+}
+
+// pickLoad returns upstream with lowest cost per weight,
+// ties are broken by round-robin so idle upstreams share traffic
+func (p *Pool) pickLoad(xs []*Upstream, cost func(u *Upstream) float64) *Upstream {
+	if len(xs) == 0 {
+		return nil
+	}
+
+	i := atomic.AddUint32(&p.i, 1) - 1
+	var (
+		best      *Upstream
+		bestScore = math.Inf(1)
+	)
+	for j := range xs {
+		u := xs[(int(i%uint32(len(xs)))+j)%len(xs)]
+		w := u.Weight()
+		if w <= 0 {
+			continue
+		}
+		score := cost(u) / float64(w)
+		if score < bestScore {
+			best, bestScore = u, score
+		}
+	}
+	if best == nil {
+		// all weights are zero
+		return xs[i%uint32(len(xs))]
+	}
+	return best
+}
+
+// pickHash returns upstream with highest weighted rendezvous score for key,
+// when upstream added or removed, only clients of that upstream are moved
+func pickHash(xs []*Upstream, key string) *Upstream {
+	var (
+		best      *Upstream
+		bestScore = math.Inf(-1)
+	)
+	for _, u := range xs {
+		w := u.Weight()
+		if w <= 0 {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(u.Addr))
+		// uniform in (0, 1)
+		x := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		score := -float64(w) / math.Log(x)
+		if score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+	if best == nil && len(xs) > 0 {
+		// all weights are zero
+		return xs[0]
+	}
+	return best
+}
+
+// mix64 spreads every input bit to the high bits,
+// fnv alone barely changes high bits for addresses that differ only in the last byte
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// pick returns next upstream from xs using weighted round-robin,
+// ex. weights 19 and 1 send 5% of requests to the second upstream
+func (p *Pool) pick(xs []*Upstream) *Upstream {
+	if len(xs) == 0 {
+		return nil
+	}
+	if len(xs) == 1 {
+		// do not advance counter, ex. trace calls to single trace node would skew other calls
+		return xs[0]
+	}
+
+	var total uint32
+	weights := make([]uint32, len(xs))
+	for i, u := range xs {
+		if w := u.Weight(); w > 0 {
+			weights[i] = uint32(w)
+			total += weights[i]
+		}
+	}
+	i := atomic.AddUint32(&p.i, 1) - 1
+	if total == 0 {
+		return xs[i%uint32(len(xs))]
+	}
+
+	n := i % total
+	for j, w := range weights {
+		if n < w {
+			return xs[j]
+		}
+		n -= w
+	}
+	return xs[len(xs)-1]
+}
+
+// NextFor returns upstream for json-rpc call, with read/write split
+// calls with write method go to primary, trace calls go to trace upstreams, other calls go to the rest of the pool,
+// returns nil if no trace upstream is healthy for trace call
+func (p *Pool) NextFor(c *rpcproxy.Call) *Upstream {
+	return p.nextFor(c, "")
+}
+
+// NextForRequest returns upstream for http request's json-rpc call,
+// with read/write split, and client affinity when using StrategyHash
+func (p *Pool) NextForRequest(r *http.Request) *Upstream {
+	var key string
+	if p.Strategy == StrategyHash && p.ClientKey != nil {
+		key = p.ClientKey(r)
+	}
+	return p.nextFor(rpcproxy.GetCall(r.Context()), key)
+}
+
+func (p *Pool) nextFor(c *rpcproxy.Call, key string) *Upstream {
+	if p.IsTrace(c) {
+		return p.pickFor(p.TraceHealthy(), key)
+	}
+	if p.Primary == "" || c == nil {
+		return p.pickFor(p.Healthy(), key)
+	}
+	primary := p.Get(p.Primary)
+	if primary == nil {
+		return p.pickFor(p.Healthy(), key)
+	}
+	for _, req := range c.Requests {
+		if req != nil && p.WriteMethods[req.Method] {
+			return primary
+		}
+	}
+
+	var xs []*Upstream
+	for _, u := range p.Healthy() {
+		if u != primary {
+			xs = append(xs, u)
+		}
+	}
+	if len(xs) == 0 {
+		// primary is the only healthy upstream
+		return p.pickFor(p.Healthy(), key)
+	}
+	return p.pickFor(xs, key)
+}
+
+// Transport returns round tripper that forwards request to the given port of next healthy upstream
+func (p *Pool) Transport(port string, transport http.RoundTripper) http.RoundTripper {
+	return &poolTransport{
+		Pool:      p,
+		Port:      port,
+		Transport: transport,
+	}
+}
+
+type poolTransport struct {
+	Pool      *Pool
+	Port      string
+	Transport http.RoundTripper
+}
+
+func (t *poolTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	u := t.Pool.NextForRequest(r)
+	if u == nil {
+		return nil, upstream.ErrUnavailable
+	}
+	r.URL.Host = net.JoinHostPort(u.Addr, t.Port)
+
+	rt := u.Track(t.Transport)
+	if t.Pool.Instrument != nil {
+		rt = t.Pool.Instrument(u, rt)
+	}
+	return rt.RoundTrip(r)
+}
+
+// BlockTime converts block timestamp in unit into time
+func BlockTime(ts uint64, unit time.Duration) time.Time {
+	ts = ts * uint64(unit) // convert to ns
+	return time.Unix(0, int64(ts))
+}
@@ -0,0 +1,279 @@
+package upstreampool
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/moonrhythm/geth-proxy/pkg/rpcproxy"
+)
+
+func newTestUpstream(addr string, weight int) *Upstream {
+	return &Upstream{
+		Addr:    addr,
+		stop:    make(chan struct{}),
+		healthy: true,
+		weight:  weight,
+	}
+}
+
+func newTestPool(strategy string, weights ...int) *Pool {
+	p := &Pool{Strategy: strategy}
+	for i, w := range weights {
+		p.Add(newTestUpstream(fmt.Sprintf("10.0.0.%d", i+1), w))
+	}
+	return p
+}
+
+// countPicks returns number of picks by upstream address
+func countPicks(n int, pick func() *Upstream) map[string]int {
+	m := make(map[string]int)
+	for i := 0; i < n; i++ {
+		if u := pick(); u != nil {
+			m[u.Addr]++
+		}
+	}
+	return m
+}
+
+func TestPickRoundRobin(t *testing.T) {
+	cases := []struct {
+		name    string
+		weights []int
+		n       int
+		want    map[string]int
+	}{
+		{"equal", []int{1, 1, 1}, 6, map[string]int{"10.0.0.1": 2, "10.0.0.2": 2, "10.0.0.3": 2}},
+		{"weighted", []int{3, 1}, 8, map[string]int{"10.0.0.1": 6, "10.0.0.2": 2}},
+		{"zero weight", []int{1, 0, 1}, 4, map[string]int{"10.0.0.1": 2, "10.0.0.3": 2}},
+		{"all zero", []int{0, 0}, 4, map[string]int{"10.0.0.1": 2, "10.0.0.2": 2}},
+		{"single", []int{0}, 3, map[string]int{"10.0.0.1": 3}},
+		{"empty", nil, 3, map[string]int{}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPool(StrategyRoundRobin, tc.weights...)
+			got := countPicks(tc.n, p.Next)
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("picks = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPickRoundRobinSingleDoesNotAdvance(t *testing.T) {
+	p := newTestPool(StrategyRoundRobin, 1, 1)
+	single := []*Upstream{p.List()[0]}
+
+	first := p.Next()
+	p.pick(single)
+	// the counter advanced only once, so the next pick is the other upstream
+	if second := p.Next(); second == first {
+		t.Errorf("pick from single upstream advanced counter")
+	}
+}
+
+func TestPickHash(t *testing.T) {
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("client-%d", i)
+	}
+
+	cases := []struct {
+		name    string
+		weights []int
+	}{
+		{"equal", []int{1, 1, 1}},
+		{"weighted", []int{5, 1, 1}},
+		{"zero weight", []int{1, 0, 1}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPool(StrategyHash, tc.weights...)
+			xs := p.List()
+
+			for _, key := range keys {
+				u := p.pickFor(xs, key)
+				if u == nil {
+					t.Fatalf("pick %s returned nil", key)
+				}
+				if u.Weight() == 0 {
+					t.Errorf("pick %s returned zero weight upstream %s", key, u.Addr)
+				}
+				// stable for the same key
+				if again := p.pickFor(xs, key); again != u {
+					t.Errorf("pick %s = %s, then %s", key, u.Addr, again.Addr)
+				}
+
+				// removing other upstream does not move the key
+				var (
+					rest    []*Upstream
+					removed bool
+				)
+				for _, x := range xs {
+					if x != u && !removed {
+						removed = true
+						continue
+					}
+					rest = append(rest, x)
+				}
+				if got := pickHash(rest, key); got != u {
+					t.Errorf("pick %s moved from %s to %s after removing other upstream", key, u.Addr, got.Addr)
+				}
+			}
+		})
+	}
+}
+
+func TestPickHashWeights(t *testing.T) {
+	const n = 3000
+
+	cases := []struct {
+		name    string
+		weights []int
+	}{
+		{"equal", []int{1, 1, 1}},
+		{"weighted", []int{9, 1}},
+		{"three weighted", []int{2, 1, 1}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPool(StrategyHash, tc.weights...)
+			xs := p.List()
+
+			got := make(map[string]int)
+			for i := 0; i < n; i++ {
+				got[pickHash(xs, fmt.Sprintf("client-%d", i)).Addr]++
+			}
+
+			var total int
+			for _, w := range tc.weights {
+				total += w
+			}
+			for _, u := range xs {
+				// allows some skew from hashing
+				want := n * u.Weight() / total
+				if d := got[u.Addr] - want; d < -n/20 || d > n/20 {
+					t.Errorf("picks = %v, want about %d for %s", got, want, u.Addr)
+				}
+			}
+		})
+	}
+}
+
+func TestPickHashWithoutKey(t *testing.T) {
+	p := newTestPool(StrategyHash, 1, 1)
+	got := countPicks(4, func() *Upstream {
+		return p.pickFor(p.List(), "")
+	})
+	if got["10.0.0.1"] != 2 || got["10.0.0.2"] != 2 {
+		t.Errorf("picks without key = %v, want round-robin", got)
+	}
+}
+
+func TestPickLeastLoaded(t *testing.T) {
+	cases := []struct {
+		name     string
+		weights  []int
+		inFlight []int64
+		want     string
+	}{
+		{"idle", []int{1, 1, 1}, []int64{2, 0, 1}, "10.0.0.2"},
+		{"weighted", []int{4, 1}, []int64{4, 0}, "10.0.0.2"},      // 5/4 vs 1/1
+		{"weighted busy", []int{4, 1}, []int64{2, 1}, "10.0.0.1"}, // 3/4 vs 2/1
+		{"zero weight", []int{0, 1}, []int64{0, 10}, "10.0.0.2"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPool(StrategyLeastLoaded, tc.weights...)
+			for i, u := range p.List() {
+				u.inFlight = tc.inFlight[i]
+			}
+			if got := p.Next(); got.Addr != tc.want {
+				t.Errorf("pick = %s, want %s", got.Addr, tc.want)
+			}
+		})
+	}
+}
+
+func TestPickLeastLoadedSharesIdle(t *testing.T) {
+	p := newTestPool(StrategyLeastLoaded, 1, 1, 1)
+	got := countPicks(6, p.Next)
+	for _, u := range p.List() {
+		if got[u.Addr] != 2 {
+			t.Errorf("idle picks = %v, want 2 each", got)
+			break
+		}
+	}
+}
+
+func TestNextFor(t *testing.T) {
+	p := newTestPool(StrategyRoundRobin, 1, 1, 1)
+	p.Primary = "10.0.0.1"
+	p.WriteMethods = map[string]bool{"eth_sendRawTransaction": true}
+	p.TraceAddrs = map[string]bool{"10.0.0.3": true}
+	p.TraceMethod = func(method string) bool {
+		return method == "trace_block"
+	}
+
+	call := func(methods ...string) *rpcproxy.Call {
+		c := &rpcproxy.Call{Batch: len(methods) > 1}
+		for _, m := range methods {
+			c.Requests = append(c.Requests, &rpcproxy.Request{Method: m})
+		}
+		return c
+	}
+
+	cases := []struct {
+		name string
+		call *rpcproxy.Call
+		want []string // allowed upstreams
+	}{
+		{"write", call("eth_sendRawTransaction"), []string{"10.0.0.1"}},
+		{"write in batch", call("eth_chainId", "eth_sendRawTransaction"), []string{"10.0.0.1"}},
+		{"read", call("eth_chainId"), []string{"10.0.0.2", "10.0.0.3"}},
+		{"trace", call("trace_block"), []string{"10.0.0.3"}},
+		{"no call", nil, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 6; i++ {
+				u := p.NextFor(tc.call)
+				if u == nil {
+					t.Fatalf("next returned nil")
+				}
+				ok := false
+				for _, addr := range tc.want {
+					ok = ok || u.Addr == addr
+				}
+				if !ok {
+					t.Fatalf("next = %s, want one of %v", u.Addr, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHead(t *testing.T) {
+	p := newTestPool(StrategyRoundRobin, 1, 1, 1)
+	if h := p.Head(); h != nil {
+		t.Fatalf("head = %v, want nil", h.Number)
+	}
+
+	xs := p.List()
+	xs[0].head = &types.Header{Number: big.NewInt(10)}
+	xs[1].head = &types.Header{Number: big.NewInt(12)}
+	xs[2].head = &types.Header{Number: big.NewInt(20)}
+	xs[2].healthy = false
+
+	if h := p.Head(); h == nil || h.Number.Uint64() != 12 {
+		t.Errorf("head = %v, want 12", h)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/moonrhythm/geth-proxy/pkg/upstreampool"
+)
+
+// upstream pool is in upstreampool package
+type (
+	gethUpstream = upstreampool.Upstream
+	upstreamPool = upstreampool.Pool
+)
+
+// upstream load balancing strategies
+const (
+	strategyRoundRobin  = upstreampool.StrategyRoundRobin
+	strategyHash        = upstreampool.StrategyHash
+	strategyLeastLoaded = upstreampool.StrategyLeastLoaded
+	strategyLatency     = upstreampool.StrategyLatency
+)
+
+// newUpstreamPool creates pool for chain with health check config and per upstream metrics
+func newUpstreamPool(chain string) *upstreamPool {
+	return &upstreamPool{
+		Chain:           chain,
+		HealthyDuration: healthyDuration,
+		BlockUnit:       blockDuration,
+		CheckTimeout:    checkTimeout,
+		Strategy:        poolStrategy,
+		ClientKey:       clientKey,
+		Instrument: func(u *gethUpstream, rt http.RoundTripper) http.RoundTripper {
+			return upstreamMetricsTransport{
+				RoundTripper: rt,
+				Chain:        chain,
+				Upstream:     u.Addr,
+			}
+		},
+		OnRemove: func(u *gethUpstream) {
+			promDeleteUpstream(chain, u.Addr)
+		},
+	}
+}
+
+func newGethUpstream(chain, addr, httpPort string) (*gethUpstream, error) {
+	return upstreampool.DialURL(addr, gethURL(addr, httpPort), &http.Client{
+		Transport: upstreamMetricsTransport{
+			RoundTripper: gethClientTransport(),
+			Chain:        chain,
+			Upstream:     addr,
+		},
+	})
+}
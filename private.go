@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// privateTx routes transactions to external private relay instead of local geth
+type privateTx struct {
+	Relay    *rpc.Client
+	Methods  map[string]bool // eth_sendRawTransaction and/or eth_sendPrivateTransaction
+	Fallback bool            // send to local geth when relay failed
+	Timeout  time.Duration
+}
+
+// ServeHandler implements middleware interface
+func (m *privateTx) ServeHandler(h http.Handler) http.Handler {
+	return interceptRPC(m.intercept).ServeHandler(h)
+}
+
+func (m *privateTx) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	if !m.Methods[req.Method] {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), m.Timeout)
+	res, err := callRPC(ctx, m.Relay, req)
+	cancel()
+	if err == nil {
+		promPrivateTx("relay")
+		return newRPCResult(req, res)
+	}
+	log.Printf("private tx: relay failed; %v", err)
+
+	if !m.Fallback || isAlreadyKnown(err) {
+		promPrivateTx("failed")
+		return newRPCErrorFrom(req, err)
+	}
+
+	local := req
+	if req.Method == "eth_sendPrivateTransaction" {
+		local = privateToRawTx(req)
+		if local == nil {
+			promPrivateTx("failed")
+			return newRPCErrorFrom(req, err)
+		}
+	}
+	res, err = callUpstream(r.Context(), local)
+	if err != nil {
+		promPrivateTx("failed")
+		return newRPCErrorFrom(req, err)
+	}
+	promPrivateTx("fallback")
+	return newRPCResult(req, res)
+}
+
+// privateToRawTx converts eth_sendPrivateTransaction into eth_sendRawTransaction
+func privateToRawTx(req *rpcRequest) *rpcRequest {
+	var params []struct {
+		Tx json.RawMessage `json:"tx"`
+	}
+	if json.Unmarshal(req.Params, &params) != nil || len(params) == 0 || len(params[0].Tx) == 0 {
+		return nil
+	}
+	p, _ := json.Marshal([]json.RawMessage{params[0].Tx})
+	return &rpcRequest{
+		JSONRPC: req.JSONRPC,
+		ID:      req.ID,
+		Method:  "eth_sendRawTransaction",
+		Params:  p,
+	}
+}
+
+var privateTxCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "private_tx",
+}, []string{"result"})
+
+func promPrivateTx(result string) {
+	c, err := privateTxCount.GetMetricWith(prometheus.Labels{
+		"result": result,
+	})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// probeStep is a json-rpc call in probe script
+type probeStep struct {
+	Name   string          `json:"name"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+var defaultProbeScript = []probeStep{
+	{Name: "block_number", Method: "eth_blockNumber"},
+	{Name: "chain_id", Method: "eth_chainId"},
+}
+
+func loadProbeScript(filename string) ([]probeStep, error) {
+	if filename == "" {
+		return defaultProbeScript, nil
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var script []probeStep
+	err = json.Unmarshal(b, &script)
+	if err != nil {
+		return nil, err
+	}
+	for i, x := range script {
+		if x.Method == "" {
+			return nil, fmt.Errorf("step %d: method required", i)
+		}
+		if x.Name == "" {
+			script[i].Name = x.Method
+		}
+	}
+	return script, nil
+}
+
+// prober periodically runs json-rpc script through the proxy
+type prober struct {
+	URL      string
+	Header   http.Header
+	Script   []probeStep
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Start starts probing loop
+func (p *prober) Start() {
+	go func() {
+		for {
+			time.Sleep(p.Interval)
+			p.run()
+		}
+	}()
+}
+
+func (p *prober) run() {
+	for _, step := range p.Script {
+		ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+		start := time.Now()
+		err := p.call(ctx, step)
+		duration := time.Since(start)
+		cancel()
+
+		promProbe(step.Name, duration, err == nil)
+		if err != nil {
+			log.Printf("probe: %s failed; %v", step.Name, err)
+		}
+	}
+}
+
+func (p *prober) call(ctx context.Context, step probeStep) error {
+	body, err := json.Marshal(rpcRequest{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage("1"),
+		Method:  step.Method,
+		Params:  step.Params,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range p.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var rpcResp rpcResponse
+	err = json.NewDecoder(io.LimitReader(resp.Body, 10<<20)).Decode(&rpcResp)
+	if err != nil {
+		return err
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("json-rpc error %d: %s", rpcResp.Error.Code, rpcResp.Error.Message)
+	}
+	return nil
+}
+
+var (
+	probeSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "probe_success",
+	}, []string{"name"})
+
+	probeDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "probe_duration_seconds",
+	}, []string{"name"})
+
+	probeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "probe_failures",
+	}, []string{"name"})
+)
+
+func promProbe(name string, duration time.Duration, success bool) {
+	l := prometheus.Labels{"name": name}
+
+	if g, err := probeDuration.GetMetricWith(l); err == nil {
+		g.Set(float64(duration) / float64(time.Second))
+	}
+	if g, err := probeSuccess.GetMetricWith(l); err == nil {
+		if success {
+			g.Set(1)
+		} else {
+			g.Set(0)
+		}
+	}
+	if !success {
+		if c, err := probeFailures.GetMetricWith(l); err == nil {
+			c.Inc()
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// metricsPusher pushes proxy's metrics to prometheus pushgateway and/or remote-write endpoint,
+// for deployments that can not be scraped
+type metricsPusher struct {
+	Gatherer       prometheus.Gatherer
+	PushURL        string // pushgateway url, empty = disable
+	RemoteWriteURL string // remote-write url, basic auth from userinfo, empty = disable
+	Job            string
+	Instance       string
+	Interval       time.Duration
+	Timeout        time.Duration
+
+	client http.Client
+}
+
+// Validate validates pusher config
+func (e *metricsPusher) Validate() error {
+	for _, x := range []string{e.PushURL, e.RemoteWriteURL} {
+		if x == "" {
+			continue
+		}
+		u, err := url.Parse(x)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid url %s, required http or https", u.Redacted())
+		}
+	}
+	if e.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	return nil
+}
+
+// Start pushes metrics periodically
+func (e *metricsPusher) Start() {
+	e.client.Timeout = e.Timeout
+	go func() {
+		for {
+			time.Sleep(e.Interval)
+			e.push()
+		}
+	}()
+}
+
+func (e *metricsPusher) push() {
+	if e.PushURL != "" {
+		err := push.New(e.PushURL, e.Job).
+			Gatherer(e.Gatherer).
+			Grouping("instance", e.Instance).
+			Client(&e.client).
+			Push()
+		if err != nil {
+			log.Printf("metrics: pushgateway error; %v", err)
+		}
+	}
+	if e.RemoteWriteURL != "" {
+		if err := e.remoteWrite(); err != nil {
+			log.Printf("metrics: remote-write error; %v", err)
+		}
+	}
+}
+
+func (e *metricsPusher) remoteWrite() error {
+	mfs, err := e.Gatherer.Gather()
+	if err != nil {
+		// partial result is still sent
+		log.Printf("metrics: gather metrics error; %v", err)
+	}
+
+	u, err := url.Parse(e.RemoteWriteURL)
+	if err != nil {
+		return err
+	}
+	user := u.User
+	u.User = nil
+
+	body := snappyEncode(remoteWriteRequest(mfs, e.Job, e.Instance, time.Now()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d; %s", resp.StatusCode, bytes.TrimSpace(b))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// remoteWriteRequest encodes metric families to prometheus remote-write WriteRequest protobuf,
+// histograms and summaries are flattened to _bucket, _sum, _count, and quantile series
+func remoteWriteRequest(mfs []*dto.MetricFamily, job, instance string, now time.Time) []byte {
+	ts := now.UnixNano() / int64(time.Millisecond)
+
+	var b []byte
+	add := func(name string, m *dto.Metric, extra [2]string, v float64) {
+		labels := map[string]string{
+			"__name__": name,
+			"job":      job,
+			"instance": instance,
+		}
+		for _, l := range m.GetLabel() {
+			// empty label is same as no label
+			if l.GetValue() != "" {
+				labels[l.GetName()] = l.GetValue()
+			}
+		}
+		if extra[0] != "" {
+			labels[extra[0]] = extra[1]
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType) // timeseries
+		b = protowire.AppendBytes(b, remoteWriteSeries(labels, v, ts))
+	}
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, [2]string{}, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, [2]string{}, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, [2]string{}, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, x := range h.GetBucket() {
+					add(name+"_bucket", m, [2]string{"le", strconv.FormatFloat(x.GetUpperBound(), 'g', -1, 64)}, float64(x.GetCumulativeCount()))
+				}
+				add(name+"_bucket", m, [2]string{"le", "+Inf"}, float64(h.GetSampleCount()))
+				add(name+"_sum", m, [2]string{}, h.GetSampleSum())
+				add(name+"_count", m, [2]string{}, float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, x := range s.GetQuantile() {
+					add(name, m, [2]string{"quantile", strconv.FormatFloat(x.GetQuantile(), 'g', -1, 64)}, x.GetValue())
+				}
+				add(name+"_sum", m, [2]string{}, s.GetSampleSum())
+				add(name+"_count", m, [2]string{}, float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return b
+}
+
+// remoteWriteSeries encodes TimeSeries with one sample, labels are sorted by name
+func remoteWriteSeries(labels map[string]string, v float64, ts int64) []byte {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b []byte
+	for _, k := range keys {
+		var l []byte
+		l = protowire.AppendTag(l, 1, protowire.BytesType)
+		l = protowire.AppendString(l, k)
+		l = protowire.AppendTag(l, 2, protowire.BytesType)
+		l = protowire.AppendString(l, labels[k])
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType) // labels
+		b = protowire.AppendBytes(b, l)
+	}
+
+	var s []byte
+	s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+	s = protowire.AppendFixed64(s, math.Float64bits(v))
+	s = protowire.AppendTag(s, 2, protowire.VarintType)
+	s = protowire.AppendVarint(s, uint64(ts))
+
+	b = protowire.AppendTag(b, 2, protowire.BytesType) // samples
+	b = protowire.AppendBytes(b, s)
+	return b
+}
+
+// snappyEncode encodes snappy block format with literals only,
+// metrics are small and pushed on interval, so compression is not worth a dependency
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+3*(len(src)/65536+1))
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+	for len(src) > 0 {
+		n := len(src)
+		if n > 65536 {
+			n = 65536
+		}
+		// literal tag with 2 bytes length
+		dst = append(dst, 61<<2, byte(n-1), byte((n-1)>>8))
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rateLimitInfo is limiter state for client to back off,
+// sent in X-RateLimit-* and Retry-After headers, and json-rpc error data when rejected
+type rateLimitInfo struct {
+	Limit      int `json:"limit"`
+	Remaining  int `json:"remaining"`
+	RetryAfter int `json:"retryAfter,omitempty"` // seconds
+}
+
+// SetHeader sets rate limit headers
+func (x rateLimitInfo) SetHeader(h http.Header) {
+	h.Set("X-RateLimit-Limit", strconv.Itoa(x.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(x.Remaining))
+	if x.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(x.RetryAfter))
+	}
+}
+
+// writeRateLimitError writes 429 json-rpc error with rate limit headers and data
+func writeRateLimitError(w http.ResponseWriter, r *http.Request, message string, x rateLimitInfo) {
+	x.SetHeader(w.Header())
+	writeRPCErrorData(w, r, http.StatusTooManyRequests, rpcCodeLimitExceeded, message, x)
+}
+
+// retryAfterSeconds converts duration into Retry-After seconds, rounded up
+func retryAfterSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// redisCache is the cache.Store backed by redis
+type redisCache struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string        // key prefix
+	TTL      time.Duration // override ttl, 0 = use caller's ttl
+	Timeout  time.Duration
+
+	pool chan *redisConn
+
+	mu        sync.Mutex
+	backoff   time.Duration
+	downUntil time.Time // skip redis until, after connection error
+}
+
+const (
+	redisMinBackoff = time.Second
+	redisMaxBackoff = 30 * time.Second
+)
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+var (
+	errRedisNil  = errors.New("redis: nil")
+	errRedisDown = errors.New("redis: unavailable")
+)
+
+func newRedisCache(addr string, maxIdle int) *redisCache {
+	return &redisCache{
+		Addr:    addr,
+		Timeout: time.Second,
+		pool:    make(chan *redisConn, maxIdle),
+	}
+}
+
+func (c *redisCache) Get(key string) ([]byte, bool) {
+	reply, err := c.do("GET", c.Prefix+key)
+	if err == errRedisNil || err == errRedisDown {
+		return nil, false
+	}
+	if err != nil {
+		promRedisError()
+		return nil, false
+	}
+	return reply, true
+}
+
+func (c *redisCache) Set(key string, value []byte, ttl time.Duration) {
+	if c.TTL > 0 {
+		ttl = c.TTL
+	}
+	_, err := c.do("SET", c.Prefix+key, string(value), "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if err != nil && err != errRedisDown {
+		promRedisError()
+	}
+}
+
+func (c *redisCache) do(args ...string) ([]byte, error) {
+	if c.down() {
+		return nil, errRedisDown
+	}
+
+	conn, err := c.getConn()
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	reply, err := conn.do(c.Timeout, args...)
+	if err != nil && err != errRedisNil {
+		conn.Close()
+		c.fail(err)
+		return nil, err
+	}
+	c.putConn(conn)
+	c.succeed()
+	return reply, err
+}
+
+// down returns true if redis failed recently, so lookups do not wait for dial timeout
+func (c *redisCache) down() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Before(c.downUntil)
+}
+
+// fail backs off redis exponentially, logs once per backoff
+func (c *redisCache) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(c.downUntil) {
+		// concurrent call already backed off
+		return
+	}
+	if c.backoff == 0 {
+		c.backoff = redisMinBackoff
+	} else if c.backoff *= 2; c.backoff > redisMaxBackoff {
+		c.backoff = redisMaxBackoff
+	}
+	c.downUntil = now.Add(c.backoff)
+	log.Printf("redis: error, retry in %s; %v", c.backoff, err)
+}
+
+func (c *redisCache) succeed() {
+	c.mu.Lock()
+	c.backoff = 0
+	c.mu.Unlock()
+}
+
+func (c *redisCache) getConn() (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{
+		Conn: nc,
+		r:    bufio.NewReader(nc),
+	}
+	if c.Password != "" {
+		_, err = conn.do(c.Timeout, "AUTH", c.Password)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.DB != 0 {
+		_, err = conn.do(c.Timeout, "SELECT", strconv.Itoa(c.DB))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisCache) putConn(conn *redisConn) {
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) ([]byte, error) {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+
+	w := bufio.NewWriter(c.Conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	err := w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() ([]byte, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: invalid reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(c.r, b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unsupported reply %q", line[0])
+}
+
+var redisErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "cache_redis_errors",
+})
+
+func promRedisError() {
+	redisErrors.Inc()
+}
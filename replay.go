@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// runReplay runs replay subcommand, replays captured json-rpc calls against target endpoint
+//
+//	geth-proxy replay -target=http://127.0.0.1:8545 capture.jsonl
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		target      = fs.String("target", "http://127.0.0.1:8545", "target json-rpc endpoint")
+		speed       = fs.Float64("speed", 1, "replay speed factor, ex. 2 for twice original speed (0 = as fast as possible)")
+		concurrency = fs.Int("concurrency", 64, "max in-flight requests")
+		timeout     = fs.Duration("timeout", 30*time.Second, "request timeout")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: geth-proxy replay [flags] capture-file\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, err := parseRPCURL(*target); err != nil {
+		log.Fatalf("invalid target; %v", err)
+	}
+	if *concurrency <= 0 {
+		*concurrency = 1
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("can not open capture file; %v", err)
+	}
+	defer f.Close()
+
+	r := &replayer{
+		Target: *target,
+		Speed:  *speed,
+		Client: &http.Client{Timeout: *timeout},
+		sem:    make(chan struct{}, *concurrency),
+		stats:  make(map[string]*replayStats),
+	}
+	err = r.Run(f)
+	if err != nil {
+		log.Fatalf("replay failed; %v", err)
+	}
+	r.Report(os.Stdout)
+}
+
+type replayer struct {
+	Target string
+	Speed  float64
+	Client *http.Client
+
+	sem      chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	stats    map[string]*replayStats // by method
+	skipped  int
+	duration time.Duration
+}
+
+type replayStats struct {
+	Count     int
+	Errors    int
+	Durations []time.Duration
+}
+
+// Run replays records from capture file, keeping original time between calls divided by speed
+func (r *replayer) Run(rd io.Reader) error {
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+
+	start := time.Now()
+	var first time.Time
+	var id int
+	for sc.Scan() {
+		var rec captureRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return fmt.Errorf("invalid capture record; %w", err)
+		}
+		body, ids, ok := replayBody(&rec, &id)
+		if !ok {
+			r.skipped++
+			continue
+		}
+
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if r.Speed > 0 {
+			at := time.Duration(float64(rec.Time.Sub(first)) / r.Speed)
+			if d := at - time.Since(start); d > 0 {
+				time.Sleep(d)
+			}
+		}
+
+		r.sem <- struct{}{}
+		r.wg.Add(1)
+		go func(rec captureRecord) {
+			defer func() {
+				<-r.sem
+				r.wg.Done()
+			}()
+			r.send(&rec, body, ids)
+		}(rec)
+	}
+	r.wg.Wait()
+	r.duration = time.Since(start)
+	return sc.Err()
+}
+
+// replayBody encodes record into json-rpc body, redacted records can not be replayed
+func replayBody(rec *captureRecord, id *int) ([]byte, []string, bool) {
+	if len(rec.Requests) == 0 {
+		return nil, nil, false
+	}
+	reqs := make([]rpcRequest, len(rec.Requests))
+	ids := make([]string, len(rec.Requests))
+	for i, x := range rec.Requests {
+		if x.Redacted {
+			return nil, nil, false
+		}
+		*id++
+		ids[i] = fmt.Sprint(*id)
+		reqs[i] = rpcRequest{
+			JSONRPC: "2.0",
+			ID:      json.RawMessage(ids[i]),
+			Method:  x.Method,
+			Params:  x.Params,
+		}
+	}
+
+	var v interface{} = reqs[0]
+	if rec.Batch {
+		v = reqs
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, nil, false
+	}
+	return b, ids, true
+}
+
+func (r *replayer) send(rec *captureRecord, body []byte, ids []string) {
+	start := time.Now()
+	errs, err := r.do(body, ids)
+	duration := time.Since(start)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, x := range rec.Requests {
+		st := r.stats[x.Method]
+		if st == nil {
+			st = &replayStats{}
+			r.stats[x.Method] = st
+		}
+		st.Count++
+		if err != nil || errs[i] {
+			st.Errors++
+		}
+		st.Durations = append(st.Durations, duration)
+	}
+}
+
+// do sends body to target, returns rpc error flag by request index
+func (r *replayer) do(body []byte, ids []string) ([]bool, error) {
+	resp, err := r.Client.Post(r.Target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status %d", resp.StatusCode)
+	}
+
+	rs, err := decodeRPCResponses(b)
+	if err != nil {
+		return nil, err
+	}
+	ok := make(map[string]bool, len(rs))
+	for _, x := range rs {
+		ok[string(x.ID)] = x.Error == nil
+	}
+	errs := make([]bool, len(ids))
+	for i, id := range ids {
+		errs[i] = !ok[id]
+	}
+	return errs, nil
+}
+
+// Report writes per method summary
+func (r *replayer) Report(w io.Writer) {
+	methods := make([]string, 0, len(r.stats))
+	var total, errors int
+	for m, st := range r.stats {
+		methods = append(methods, m)
+		total += st.Count
+		errors += st.Errors
+	}
+	sort.Strings(methods)
+
+	fmt.Fprintf(w, "replayed %d requests in %s, %d errors, %d records skipped\n", total, r.duration.Truncate(time.Millisecond), errors, r.skipped)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tCOUNT\tERRORS\tP50\tP99")
+	for _, m := range methods {
+		st := r.stats[m]
+		sort.Slice(st.Durations, func(i, j int) bool { return st.Durations[i] < st.Durations[j] })
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", m, st.Count, st.Errors,
+			percentileDuration(st.Durations, 0.5).Truncate(time.Microsecond),
+			percentileDuration(st.Durations, 0.99).Truncate(time.Microsecond),
+		)
+	}
+	tw.Flush()
+}
+
+// percentileDuration returns p percentile of sorted durations
+func percentileDuration(xs []time.Duration, p float64) time.Duration {
+	if len(xs) == 0 {
+		return 0
+	}
+	return xs[int(float64(len(xs)-1)*p)]
+}
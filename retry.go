@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/moonrhythm/parapet/pkg/upstream"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// retryPeekSize is max response body read to find json-rpc errors,
+// larger response is a result and never retried
+const retryPeekSize = 64 << 10
+
+// retryRule matches failed upstream response, only one field is set
+type retryRule struct {
+	Status  int    // http status
+	Code    int    // json-rpc error code
+	Message string // substring of json-rpc error message, case-insensitive
+}
+
+// parseRetryRules parses comma separated status:n, code:n, and message:text list
+func parseRetryRules(s string) ([]retryRule, error) {
+	var rs []retryRule
+	for _, x := range parseList(s) {
+		i := strings.Index(x, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid retry rule %s, required status:n, code:n, or message:text", x)
+		}
+		k, v := strings.TrimSpace(x[:i]), strings.TrimSpace(x[i+1:])
+
+		var (
+			r   retryRule
+			err error
+		)
+		switch k {
+		case "status":
+			r.Status, err = strconv.Atoi(v)
+		case "code":
+			r.Code, err = strconv.Atoi(v)
+		case "message":
+			r.Message = strings.ToLower(v)
+			if v == "" {
+				err = fmt.Errorf("empty message")
+			}
+		default:
+			err = fmt.Errorf("unknown kind %s", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry rule %s; %v", x, err)
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// matchError returns true if rule matches json-rpc error
+func (r retryRule) matchError(e *rpcError) bool {
+	switch {
+	case r.Code != 0:
+		return e.Code == r.Code
+	case r.Message != "":
+		return strings.Contains(strings.ToLower(e.Message), r.Message)
+	}
+	return false
+}
+
+// retryTransport retries failed call on other healthy upstreams,
+// infra errors (connection error, overloaded or timed out node) are retried,
+// errors matched Never (ex. execution reverted) and calls with Exclude methods (ex. tx submission) are never retried
+type retryTransport struct {
+	Pool      *upstreamPool
+	Port      string
+	Transport http.RoundTripper
+	Max       int             // max retries
+	On        []retryRule     // retried errors, transport errors are always retried
+	Never     []retryRule     // never retried errors, precedence over On
+	Exclude   map[string]bool // never retried methods
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c := getRPCCall(r.Context())
+	if !t.retryable(c) {
+		return t.Pool.Transport(t.Port, t.Transport).RoundTrip(r)
+	}
+
+	u := t.Pool.NextForRequest(r)
+	if u == nil {
+		return nil, upstream.ErrUnavailable
+	}
+
+	// body was buffered by parseRPC
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	tried := []*gethUpstream{u}
+	for i := 0; ; i++ {
+		req := r.Clone(r.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.URL.Host = net.JoinHostPort(u.Addr, t.Port)
+		r.URL.Host = req.URL.Host
+
+		resp, err := upstreamMetricsTransport{
+			RoundTripper: u.Track(t.Transport),
+			Chain:        t.Pool.Chain,
+			Upstream:     u.Addr,
+		}.RoundTrip(req)
+
+		var reason string
+		if err != nil {
+			if r.Context().Err() != nil {
+				return nil, err
+			}
+			reason = "transport"
+		} else {
+			reason = t.classify(resp)
+		}
+		if reason == "" || i >= t.Max {
+			return resp, err
+		}
+
+		next := t.nextExcept(c, tried)
+		if next == nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		promRetry(t.Pool.Chain, reason)
+		tried = append(tried, next)
+		u = next
+	}
+}
+
+// retryable returns true if call can be sent again
+func (t *retryTransport) retryable(c *rpcCall) bool {
+	if c == nil || len(c.Requests) == 0 {
+		return false
+	}
+	for _, req := range c.Requests {
+		if req == nil || t.Exclude[req.Method] {
+			return false
+		}
+		// tx submission may be accepted by failed upstream
+		if strings.HasPrefix(req.Method, "eth_send") {
+			return false
+		}
+	}
+	return true
+}
+
+// classify returns retry reason for response, or empty if response should be returned to client,
+// response body is restored after read
+func (t *retryTransport) classify(resp *http.Response) string {
+	for _, x := range t.On {
+		if x.Status != 0 && x.Status == resp.StatusCode {
+			return "status"
+		}
+	}
+	if resp.Header.Get("Content-Encoding") != "" {
+		return ""
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, retryPeekSize+1))
+	if err != nil || len(b) > retryPeekSize {
+		resp.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(b), resp.Body), Closer: resp.Body}
+		return ""
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+
+	errs := rpcResponseErrors(b)
+	var reason string
+	for _, e := range errs {
+		for _, x := range t.Never {
+			if x.matchError(e) {
+				return ""
+			}
+		}
+		for _, x := range t.On {
+			if x.matchError(e) {
+				reason = "rpc"
+			}
+		}
+	}
+	return reason
+}
+
+// rpcResponseErrors returns json-rpc errors in single or batch response
+func rpcResponseErrors(b []byte) []*rpcError {
+	b = bytes.TrimSpace(b)
+	var xs []rpcResponse
+	if len(b) > 0 && b[0] == '[' {
+		json.Unmarshal(b, &xs)
+	} else {
+		var x rpcResponse
+		if json.Unmarshal(b, &x) == nil {
+			xs = append(xs, x)
+		}
+	}
+
+	var rs []*rpcError
+	for _, x := range xs {
+		if x.Error != nil {
+			rs = append(rs, x.Error)
+		}
+	}
+	return rs
+}
+
+// nextExcept returns next upstream for call that was not tried
+func (t *retryTransport) nextExcept(c *rpcCall, tried []*gethUpstream) *gethUpstream {
+	for range t.Pool.Healthy() {
+		x := t.Pool.NextFor(c)
+		if x != nil && !containsUpstream(tried, x) {
+			return x
+		}
+	}
+	return nil
+}
+
+func containsUpstream(xs []*gethUpstream, u *gethUpstream) bool {
+	for _, x := range xs {
+		if x == u {
+			return true
+		}
+	}
+	return false
+}
+
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+var retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "retries",
+}, []string{"chain", "reason"})
+
+func promRetry(chain, reason string) {
+	c, err := retries.GetMetricWith(prometheus.Labels{"chain": chain, "reason": reason})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
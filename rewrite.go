@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rpcFanout emulates method with multiple calls of another method to upstream
+type rpcFanout func(ctx context.Context, p *upstreamPool, req *rpcRequest, concurrency int) *rpcResponse
+
+// rpcFanouts are emulations by from and to method,
+// used instead of renaming when upstream does not support the method
+var rpcFanouts = map[[2]string]rpcFanout{
+	{"eth_getBlockReceipts", "eth_getTransactionReceipt"}: blockReceiptsFanout,
+}
+
+// methodRewriter renames methods before validation, auth policy, and routing,
+// so clients built for other providers work unchanged,
+// methods emulated by fan-out are kept for methodFanout
+type methodRewriter struct {
+	Methods map[string]string // from => to
+}
+
+// Validate returns error if rewrite table is invalid
+func (m methodRewriter) Validate() error {
+	for from, to := range m.Methods {
+		if from == "" || to == "" {
+			return fmt.Errorf("empty method in %s=%s", from, to)
+		}
+		if from == to {
+			return fmt.Errorf("%s rewrites to itself", from)
+		}
+	}
+	return nil
+}
+
+// ServeHandler implements middleware interface
+func (m methodRewriter) ServeHandler(h http.Handler) http.Handler {
+	return interceptRPC(m.intercept).ServeHandler(h)
+}
+
+func (m methodRewriter) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	to, ok := m.Methods[req.Method]
+	if !ok || rpcFanouts[[2]string{req.Method, to}] != nil {
+		return nil
+	}
+	promRPCRewrite(req.Method, to)
+
+	req.Method = to
+	getRPCCall(r.Context()).Dirty = true
+	return nil
+}
+
+// methodFanout emulates methods with fan-out of another method from rewrite table,
+// must be used after auth policy and limits, since fan-out calls do not pass through them
+type methodFanout struct {
+	Methods     map[string]string // from => to
+	Concurrency int               // max concurrent fan-out calls per request
+	Pool        *upstreamPool     // pool for fan-out calls, nil = default pool
+}
+
+// ServeHandler implements middleware interface
+func (m methodFanout) ServeHandler(h http.Handler) http.Handler {
+	if m.Concurrency <= 0 {
+		m.Concurrency = 1
+	}
+	if m.Pool == nil {
+		m.Pool = pool
+	}
+	return interceptRPC(m.intercept).ServeHandler(h)
+}
+
+func (m methodFanout) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	to, ok := m.Methods[req.Method]
+	if !ok {
+		return nil
+	}
+	f := rpcFanouts[[2]string{req.Method, to}]
+	if f == nil {
+		return nil
+	}
+	promRPCRewrite(req.Method, to)
+	return f(r.Context(), m.Pool, req, m.Concurrency)
+}
+
+// blockReceiptsFanout emulates eth_getBlockReceipts on geth without the method,
+// gets block's transaction hashes then their receipts from the same upstream
+func blockReceiptsFanout(ctx context.Context, p *upstreamPool, req *rpcRequest, concurrency int) *rpcResponse {
+	var params []json.RawMessage
+	if json.Unmarshal(req.Params, &params) != nil || len(params) == 0 {
+		return newRPCError(req, rpcCodeInvalidParams, "missing value for required argument 0")
+	}
+	var block string
+	if json.Unmarshal(params[0], &block) != nil {
+		return newRPCError(req, rpcCodeInvalidParams, "invalid argument 0: block number or hash required")
+	}
+
+	u := p.Next()
+	if u == nil {
+		return newRPCError(req, rpcCodeInternalError, "no upstream available")
+	}
+
+	method := "eth_getBlockByNumber"
+	if len(block) == 66 { // 0x + 32 bytes hash
+		method = "eth_getBlockByHash"
+	}
+	var b *struct {
+		Transactions []string `json:"transactions"`
+	}
+	if err := u.RPC.CallContext(ctx, &b, method, block, false); err != nil {
+		return newRPCErrorFrom(req, err)
+	}
+	if b == nil {
+		return newRPCResult(req, json.RawMessage("null"))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	receipts := make([]json.RawMessage, len(b.Transactions))
+	errs := make([]error, len(b.Transactions))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i, hash := range b.Transactions {
+		i, hash := i, hash
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			errs[i] = u.RPC.CallContext(ctx, &receipts[i], "eth_getTransactionReceipt", hash)
+			if errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return newRPCErrorFrom(req, err)
+		}
+	}
+	result, _ := json.Marshal(receipts)
+	return newRPCResult(req, result)
+}
+
+var rpcRewrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "rpc_rewrites",
+}, []string{"method", "to"})
+
+func promRPCRewrite(method, to string) {
+	c, err := rpcRewrites.GetMetricWith(prometheus.Labels{
+		"method": method,
+		"to":     to,
+	})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/moonrhythm/parapet/pkg/upstream"
+
+	"github.com/moonrhythm/geth-proxy/pkg/rpcproxy"
+)
+
+// json-rpc types and middlewares are in rpcproxy package
+type (
+	rpcRequest     = rpcproxy.Request
+	rpcCall        = rpcproxy.Call
+	rpcResponse    = rpcproxy.Response
+	rpcError       = rpcproxy.Error
+	rpcInterceptor = rpcproxy.Interceptor
+)
+
+// json-rpc error codes
+const (
+	rpcCodeParseError     = rpcproxy.CodeParseError
+	rpcCodeInvalidRequest = rpcproxy.CodeInvalidRequest
+	rpcCodeMethodNotFound = rpcproxy.CodeMethodNotFound
+	rpcCodeInvalidParams  = rpcproxy.CodeInvalidParams
+	rpcCodeInternalError  = rpcproxy.CodeInternalError
+	rpcCodeServerError    = rpcproxy.CodeServerError
+	rpcCodeLimitExceeded  = rpcproxy.CodeLimitExceeded
+)
+
+var (
+	getRPCCall        = rpcproxy.GetCall
+	parseRPCCall      = rpcproxy.ParseCall
+	parseRPC          = rpcproxy.Parse
+	normalizeRPCError = rpcproxy.NormalizeError
+	interceptRPC      = rpcproxy.Intercept
+	forwardRPC        = rpcproxy.Forward
+	newRPCError       = rpcproxy.NewError
+	newRPCResult      = rpcproxy.NewResult
+	newRPCErrorFrom   = rpcproxy.NewErrorFrom
+	writeRPCResponses = rpcproxy.WriteResponses
+	writeRPCError     = rpcproxy.WriteError
+	writeRPCErrorData = rpcproxy.WriteErrorData
+	callRPC           = rpcproxy.CallClient
+)
+
+// callUpstream calls json-rpc request to next healthy upstream
+func callUpstream(ctx context.Context, req *rpcRequest) (json.RawMessage, error) {
+	u := pool.NextFor(&rpcCall{Requests: []*rpcRequest{req}})
+	if u == nil {
+		return nil, upstream.ErrUnavailable
+	}
+	return callRPC(ctx, u.RPC, req)
+}
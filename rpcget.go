@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rpcOverGet translates json-rpc over http GET into POST request.
+//
+// Supported formats:
+//
+//	GET /?method=eth_getBalance&params=["0x...","latest"]&id=1
+//	GET /?payload=<base64url encoded json-rpc request>
+type rpcOverGet struct {
+	Methods map[string]bool // allowed methods
+	MaxAge  time.Duration   // Cache-Control max-age for response
+}
+
+// ServeHandler implements middleware interface
+func (m rpcOverGet) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := m.body(r)
+		if err != nil {
+			writeRPCResponses(w, false, []*rpcResponse{newRPCError(nil, rpcCodeParseError, err.Error())})
+			return
+		}
+		if body == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		c, err := parseRPCCall(body)
+		if err != nil {
+			writeRPCResponses(w, false, []*rpcResponse{newRPCError(nil, rpcCodeParseError, "invalid json-rpc request")})
+			return
+		}
+		for _, req := range c.Requests {
+			if req == nil {
+				writeRPCResponses(w, false, []*rpcResponse{newRPCError(nil, rpcCodeInvalidRequest, "invalid json-rpc request")})
+				return
+			}
+			if !m.Methods[req.Method] {
+				writeRPCResponses(w, false, []*rpcResponse{newRPCError(req, rpcCodeInvalidRequest, fmt.Sprintf("method %s is not allowed over GET", req.Method))})
+				return
+			}
+		}
+
+		r.Method = http.MethodPost
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.URL.RawQuery = ""
+
+		if m.MaxAge > 0 {
+			w.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(int64(m.MaxAge/time.Second), 10))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// body builds json-rpc request body from query string, returns nil if request is not json-rpc
+func (m rpcOverGet) body(r *http.Request) ([]byte, error) {
+	q := r.URL.Query()
+
+	if payload := q.Get("payload"); payload != "" {
+		payload = strings.TrimRight(payload, "=")
+		payload = strings.ReplaceAll(payload, " ", "+") // unescaped '+' in query string
+		b, err := base64.RawURLEncoding.DecodeString(payload)
+		if err != nil {
+			b, err = base64.RawStdEncoding.DecodeString(payload)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 payload")
+		}
+		return b, nil
+	}
+
+	method := q.Get("method")
+	if method == "" {
+		return nil, nil
+	}
+
+	req := rpcRequest{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage("1"),
+		Method:  method,
+	}
+	if id := q.Get("id"); id != "" {
+		if json.Valid([]byte(id)) {
+			req.ID = json.RawMessage(id)
+		} else {
+			req.ID, _ = json.Marshal(id)
+		}
+	}
+	if params := q.Get("params"); params != "" {
+		if !json.Valid([]byte(params)) {
+			return nil, fmt.Errorf("invalid params")
+		}
+		req.Params = json.RawMessage(params)
+	}
+	return json.Marshal(req)
+}
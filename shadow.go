@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/upstream"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// shadowTransport asynchronously mirrors sampled read calls to secondary rpc,
+// ex. geth running new version, shadow responses are discarded or diffed with live responses
+type shadowTransport struct {
+	http.RoundTripper // live transport
+	URL               *url.URL
+	Sample            float64         // 0-1
+	Exclude           map[string]bool // write methods, never mirrored
+	Diff              bool
+	Timeout           time.Duration
+
+	transport http.RoundTripper
+	inflight  chan struct{}
+}
+
+func newShadowTransport(next http.RoundTripper, rawURL string, concurrency int) (*shadowTransport, error) {
+	u, err := parseRPCURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	t := &shadowTransport{
+		RoundTripper: next,
+		URL:          u,
+		inflight:     make(chan struct{}, concurrency),
+	}
+	if u.Scheme == "https" {
+		t.transport = &upstream.HTTPSTransport{}
+	} else {
+		t.transport = &upstream.HTTPTransport{}
+	}
+	return t, nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *shadowTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c := getRPCCall(r.Context())
+	if !t.mirrorable(c, r) {
+		return t.RoundTripper.RoundTrip(r)
+	}
+
+	// body was buffered by parseRPC
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	req := t.newRequest(r, body)
+
+	if !t.Diff {
+		t.mirror(c, req, nil)
+		return t.RoundTripper.RoundTrip(r)
+	}
+
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		// nothing to compare with
+		t.mirror(c, req, nil)
+		return resp, err
+	}
+	live, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(live))
+	t.mirror(c, req, live)
+	return resp, nil
+}
+
+func (t *shadowTransport) mirrorable(c *rpcCall, r *http.Request) bool {
+	if c == nil || r.Body == nil || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	for _, req := range c.Requests {
+		if req == nil || t.Exclude[req.Method] {
+			return false
+		}
+	}
+	return t.Sample >= 1 || rand.Float64() < t.Sample
+}
+
+// newRequest creates shadow request, detached from client's context
+func (t *shadowTransport) newRequest(r *http.Request, body []byte) *http.Request {
+	req := r.Clone(context.Background())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.URL.Scheme = t.URL.Scheme
+	req.URL.Host = t.URL.Host
+	req.URL.Path = t.URL.Path
+	req.URL.RawPath = t.URL.RawPath
+	req.URL.RawQuery = t.URL.RawQuery
+	req.Host = t.URL.Host
+	req.Header.Del("Authorization")
+	req.Header.Del("Cookie")
+	// let transport decode response
+	req.Header.Del("Accept-Encoding")
+	return req
+}
+
+// mirror sends request to shadow rpc in background,
+// request is dropped when too many shadow requests are in flight
+func (t *shadowTransport) mirror(c *rpcCall, req *http.Request, live []byte) {
+	select {
+	case t.inflight <- struct{}{}:
+	default:
+		promShadow("dropped")
+		return
+	}
+
+	go func() {
+		defer func() { <-t.inflight }()
+
+		ctx := context.Background()
+		if t.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+			defer cancel()
+		}
+
+		resp, err := t.transport.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			promShadow("error")
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			io.Copy(io.Discard, resp.Body)
+			promShadow("error")
+			return
+		}
+		if live == nil {
+			io.Copy(io.Discard, resp.Body)
+			promShadow("success")
+			return
+		}
+
+		shadow, err := io.ReadAll(resp.Body)
+		if err != nil {
+			promShadow("error")
+			return
+		}
+		if ids := diffRPCResponses(live, shadow); len(ids) > 0 {
+			promShadow("mismatch")
+			log.Printf("shadow: response mismatch; methods=%s ids=%s", strings.Join(c.Methods(), ","), strings.Join(ids, ","))
+			return
+		}
+		promShadow("match")
+	}()
+}
+
+// diffRPCResponses returns ids of responses that results or error codes are different
+func diffRPCResponses(a, b []byte) []string {
+	xs, err := decodeRPCResponses(a)
+	if err != nil {
+		return []string{"-"}
+	}
+	ys, err := decodeRPCResponses(b)
+	if err != nil {
+		return []string{"-"}
+	}
+
+	m := make(map[string]*rpcResponse, len(ys))
+	for _, y := range ys {
+		m[string(y.ID)] = y
+	}
+
+	var ids []string
+	for _, x := range xs {
+		y := m[string(x.ID)]
+		if y == nil || !equalRPCResponse(x, y) {
+			ids = append(ids, string(x.ID))
+		}
+	}
+	return ids
+}
+
+func decodeRPCResponses(b []byte) ([]*rpcResponse, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '[' {
+		var xs []*rpcResponse
+		err := json.Unmarshal(b, &xs)
+		return xs, err
+	}
+	var x rpcResponse
+	err := json.Unmarshal(b, &x)
+	if err != nil {
+		return nil, err
+	}
+	return []*rpcResponse{&x}, nil
+}
+
+func equalRPCResponse(x, y *rpcResponse) bool {
+	if (x.Error == nil) != (y.Error == nil) {
+		return false
+	}
+	if x.Error != nil {
+		// error messages are different between versions
+		return x.Error.Code == y.Error.Code
+	}
+
+	var bx, by bytes.Buffer
+	if json.Compact(&bx, x.Result) != nil || json.Compact(&by, y.Result) != nil {
+		return bytes.Equal(x.Result, y.Result)
+	}
+	return bytes.Equal(bx.Bytes(), by.Bytes())
+}
+
+var shadowRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "shadow_requests",
+}, []string{"result"})
+
+func promShadow(result string) {
+	c, err := shadowRequests.GetMetricWith(prometheus.Labels{"result": result})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+)
+
+// sidecar integrates proxy with kubernetes pod lifecycle when running next to geth container
+type sidecar struct {
+	Drain time.Duration // duration to wait in preStop hook before container receive SIGTERM
+}
+
+// preStop enters maintenance mode then blocks until drain duration elapsed,
+// kubernetes sends SIGTERM after preStop hook returned
+func (m *sidecar) preStop(w http.ResponseWriter, r *http.Request) {
+	if !inMaintenance() {
+		log.Printf("sidecar: preStop, draining for %s", m.Drain)
+	}
+	setMaintenance(true)
+
+	select {
+	case <-time.After(m.Drain):
+	case <-r.Context().Done():
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// ready returns ready when local geth is ready and proxy is not draining
+func (m *sidecar) ready(w http.ResponseWriter, r *http.Request) {
+	if inMaintenance() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if certExpiryHealth && certs.Expired() {
+		http.Error(w, "certificate expired", http.StatusServiceUnavailable)
+		return
+	}
+
+	ready, err := headTracker.Ready(r.Context())
+	if err != nil {
+		http.Error(w, "can not get block", http.StatusInternalServerError)
+		return
+	}
+	if !ready {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ready"))
+}
+
+// isFlagSet returns true if flag was set from command line
+func isFlagSet(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
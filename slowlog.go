@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// slowLog logs json-rpc calls that take longer than threshold
+type slowLog struct {
+	Threshold time.Duration            // default threshold, 0 = only methods in Methods
+	Methods   map[string]time.Duration // per method threshold
+	MaxParams int                      // max params length to log
+	Redact    map[string]bool          // methods that params must not be logged
+}
+
+type upstreamDurationKey struct{}
+
+// ServeHandler implements middleware interface
+func (m slowLog) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := getRPCCall(r.Context())
+		if c == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		threshold := m.threshold(c)
+		if threshold <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var upstreamDuration int64
+		ctx := context.WithValue(r.Context(), upstreamDurationKey{}, &upstreamDuration)
+
+		start := time.Now()
+		h.ServeHTTP(w, r.WithContext(ctx))
+		duration := time.Since(start)
+		if duration < threshold {
+			return
+		}
+
+		for _, req := range c.Requests {
+			if req == nil {
+				continue
+			}
+			log.Printf("slowlog: method=%s duration=%s upstream=%s batch=%d params=%s",
+				req.Method,
+				duration,
+				time.Duration(atomic.LoadInt64(&upstreamDuration)),
+				len(c.Requests),
+				m.params(req),
+			)
+		}
+	})
+}
+
+// threshold returns the most lenient threshold of all methods in the call,
+// so a batch will not be logged because of its fastest method
+func (m slowLog) threshold(c *rpcCall) time.Duration {
+	var t time.Duration
+	for _, req := range c.Requests {
+		if req == nil {
+			continue
+		}
+		x, ok := m.Methods[req.Method]
+		if !ok {
+			x = m.Threshold
+		}
+		if x <= 0 {
+			// method is not tracked
+			continue
+		}
+		if x > t {
+			t = x
+		}
+	}
+	return t
+}
+
+func (m slowLog) params(req *rpcRequest) string {
+	if m.Redact[req.Method] {
+		return "[redacted]"
+	}
+	p := string(req.Params)
+	if m.MaxParams > 0 && len(p) > m.MaxParams {
+		p = p[:m.MaxParams] + "...(truncated)"
+	}
+	return p
+}
+
+// upstreamTimer records upstream round-trip duration into request context
+type upstreamTimer struct {
+	http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t upstreamTimer) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if p, _ := r.Context().Value(upstreamDurationKey{}).(*int64); p != nil {
+		atomic.AddInt64(p, int64(time.Since(start)))
+	}
+	return resp, err
+}
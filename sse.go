@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sseBuffer is max events queued per slow client, newer events are dropped
+const sseBuffer = 256
+
+// sseStream serves server-sent events of new heads and logs,
+// heads are from proxy's head tracker, logs are from one shared upstream logs subscription
+type sseStream struct {
+	KeepAlive time.Duration // comment interval to keep idle connection open
+	Logs      *logsFeed     // nil = /sse/logs disabled
+}
+
+// ServeHeads serves GET /sse/heads
+func (m *sseStream) ServeHeads(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := m.start(w, r, "heads")
+	if !ok {
+		return
+	}
+	defer promSSEClient("heads", -1)
+
+	keepAlive := time.NewTicker(m.KeepAlive)
+	defer keepAlive.Stop()
+
+	var last common.Hash
+	for {
+		h, changed := heads.Latest()
+		if h != nil && h.Hash() != last {
+			last = h.Hash()
+			b, _ := json.Marshal(h)
+			if writeSSE(w, flusher, "head", h.Number.String(), b) != nil {
+				return
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			if writeSSEComment(w, flusher) != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ServeLogs serves GET /sse/logs?address=0x..,0x..&topic0=0x..,0x..
+func (m *sseStream) ServeLogs(w http.ResponseWriter, r *http.Request) {
+	if m.Logs == nil {
+		http.NotFound(w, r)
+		return
+	}
+	sub, err := parseLogsSubscriber(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := m.start(w, r, "logs")
+	if !ok {
+		return
+	}
+	defer promSSEClient("logs", -1)
+
+	m.Logs.Add(sub)
+	defer m.Logs.Remove(sub)
+
+	keepAlive := time.NewTicker(m.KeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case b := <-sub.ch:
+			if writeSSE(w, flusher, "log", "", b) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if writeSSEComment(w, flusher) != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// start writes event stream headers
+func (m *sseStream) start(w http.ResponseWriter, r *http.Request, stream string) (http.Flusher, bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	promSSEClient(stream, 1)
+	return flusher, true
+}
+
+func writeSSE(w http.ResponseWriter, flusher http.Flusher, event, id string, data []byte) error {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return nil
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+func writeSSEComment(w http.ResponseWriter, flusher http.Flusher) error {
+	_, err := w.Write([]byte(": keepalive\n\n"))
+	if err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+// logsFeed shares one upstream logs subscription with all logs subscribers (sse clients and log filters),
+// logs are filtered in proxy
+type logsFeed struct {
+	feed wsFeed
+
+	mu   sync.Mutex
+	subs map[*logsSubscriber]struct{}
+}
+
+// logsSubscriber is proxy side logs filter
+type logsSubscriber struct {
+	Addresses map[common.Address]bool // empty = any
+	Topics    []map[common.Hash]bool  // per position, empty = any
+
+	ch   chan json.RawMessage
+	drop func() // called when log dropped from full channel
+}
+
+func newLogsFeed(p *wsProxy) *logsFeed {
+	f := &logsFeed{
+		subs: make(map[*logsSubscriber]struct{}),
+	}
+	f.feed = wsFeed{
+		Proxy:    p,
+		Name:     "logs",
+		Params:   json.RawMessage(`["logs",{}]`),
+		OnResult: f.dispatch,
+	}
+	return f
+}
+
+// parseLogsSubscriber parses address and topic0-3 query, each is comma separated list that any matches
+func parseLogsSubscriber(r *http.Request) (*logsSubscriber, error) {
+	sub := &logsSubscriber{
+		Addresses: make(map[common.Address]bool),
+		ch:        make(chan json.RawMessage, sseBuffer),
+		drop:      func() { promSSEDropped("logs") },
+	}
+	for _, v := range r.URL.Query()["address"] {
+		for _, x := range parseList(v) {
+			if !common.IsHexAddress(x) {
+				return nil, fmt.Errorf("invalid address %s", x)
+			}
+			sub.Addresses[common.HexToAddress(x)] = true
+		}
+	}
+	for i := 0; i < 4; i++ {
+		v := r.URL.Query().Get(fmt.Sprintf("topic%d", i))
+		xs := make(map[common.Hash]bool)
+		for _, x := range parseList(v) {
+			if len(strings.TrimPrefix(x, "0x")) != 64 {
+				return nil, fmt.Errorf("invalid topic%d %s", i, x)
+			}
+			xs[common.HexToHash(x)] = true
+		}
+		sub.Topics = append(sub.Topics, xs)
+	}
+	return sub, nil
+}
+
+func (sub *logsSubscriber) match(address common.Address, topics []common.Hash) bool {
+	if len(sub.Addresses) > 0 && !sub.Addresses[address] {
+		return false
+	}
+	for i, xs := range sub.Topics {
+		if len(xs) == 0 {
+			continue
+		}
+		if i >= len(topics) || !xs[topics[i]] {
+			return false
+		}
+	}
+	return true
+}
+
+// Add adds subscriber, opens upstream subscription if not opened
+func (f *logsFeed) Add(sub *logsSubscriber) {
+	f.mu.Lock()
+	f.subs[sub] = struct{}{}
+	f.mu.Unlock()
+	f.feed.Acquire()
+}
+
+// Remove removes subscriber, closes upstream subscription after last subscriber left
+func (f *logsFeed) Remove(sub *logsSubscriber) {
+	f.mu.Lock()
+	_, ok := f.subs[sub]
+	delete(f.subs, sub)
+	f.mu.Unlock()
+	if ok {
+		f.feed.Release()
+	}
+}
+
+func (f *logsFeed) dispatch(raw json.RawMessage) {
+	var l struct {
+		Address common.Address `json:"address"`
+		Topics  []common.Hash  `json:"topics"`
+	}
+	if json.Unmarshal(raw, &l) != nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subs {
+		if !sub.match(l.Address, l.Topics) {
+			continue
+		}
+		select {
+		case sub.ch <- raw:
+		default:
+			sub.drop()
+		}
+	}
+}
+
+var (
+	sseClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "sse_clients",
+	}, []string{"stream"})
+
+	sseDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "sse_dropped",
+	}, []string{"stream"})
+)
+
+func promSSEClient(stream string, delta float64) {
+	g, err := sseClients.GetMetricWith(prometheus.Labels{"stream": stream})
+	if err != nil {
+		return
+	}
+	g.Add(delta)
+}
+
+func promSSEDropped(stream string) {
+	c, err := sseDropped.GetMetricWith(prometheus.Labels{"stream": stream})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdMaxPacket is the max udp payload to not fragment on common networks
+const statsdMaxPacket = 1432
+
+// statsdClient buffers metrics and sends to statsd over udp
+type statsdClient struct {
+	Prefix    string
+	DogStatsD bool     // send labels as dogstatsd tags, otherwise labels are appended to metric name
+	Tags      []string // global dogstatsd tags
+
+	mu   sync.Mutex
+	conn net.Conn
+	buf  []byte
+}
+
+func newStatsdClient(addr string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdClient{conn: conn}, nil
+}
+
+// Start flushes buffered metrics periodically
+func (c *statsdClient) Start() {
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			c.Flush()
+		}
+	}()
+}
+
+// Count sends counter
+func (c *statsdClient) Count(name string, value float64, labels map[string]string) {
+	c.send(name, value, "c", labels)
+}
+
+// Gauge sends gauge
+func (c *statsdClient) Gauge(name string, value float64, labels map[string]string) {
+	c.send(name, value, "g", labels)
+}
+
+// Timing sends timing in milliseconds
+func (c *statsdClient) Timing(name string, d time.Duration, labels map[string]string) {
+	c.send(name, float64(d)/float64(time.Millisecond), "ms", labels)
+}
+
+func (c *statsdClient) send(name string, value float64, typ string, labels map[string]string) {
+	var b strings.Builder
+	b.WriteString(c.Prefix)
+	b.WriteString(statsdSanitize(name))
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if !c.DogStatsD {
+		for _, k := range keys {
+			if labels[k] == "" {
+				continue
+			}
+			// dot separates name segments
+			b.WriteString(".")
+			b.WriteString(strings.ReplaceAll(statsdSanitize(labels[k]), ".", "_"))
+		}
+	}
+	b.WriteString(":")
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteString("|")
+	b.WriteString(typ)
+
+	if c.DogStatsD && (len(keys) > 0 || len(c.Tags) > 0) {
+		tags := append([]string{}, c.Tags...)
+		for _, k := range keys {
+			tags = append(tags, statsdSanitize(k)+":"+statsdSanitize(labels[k]))
+		}
+		b.WriteString("|#")
+		b.WriteString(strings.Join(tags, ","))
+	}
+	line := b.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.buf) > 0 && len(c.buf)+1+len(line) > statsdMaxPacket {
+		c.flush()
+	}
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, line...)
+}
+
+// Flush sends buffered metrics
+func (c *statsdClient) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush()
+}
+
+func (c *statsdClient) flush() {
+	if len(c.buf) == 0 {
+		return
+	}
+	// statsd is best effort, udp write error can not be handled
+	c.conn.Write(c.buf)
+	c.buf = c.buf[:0]
+}
+
+func statsdSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// statsdExporter pushes prometheus counters and gauges to statsd,
+// counters are sent as delta since last push
+type statsdExporter struct {
+	Client   *statsdClient
+	Gatherer prometheus.Gatherer
+	Interval time.Duration
+
+	last map[string]float64 // series => last counter value
+}
+
+// Start pushes metrics periodically
+func (e *statsdExporter) Start() {
+	e.last = make(map[string]float64)
+	go func() {
+		for {
+			time.Sleep(e.Interval)
+			e.push()
+		}
+	}()
+}
+
+func (e *statsdExporter) push() {
+	mfs, err := e.Gatherer.Gather()
+	if err != nil {
+		log.Printf("statsd: gather metrics error; %v", err)
+	}
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				v := m.GetCounter().GetValue()
+				key := statsdSeriesKey(name, m)
+				delta := v - e.last[key]
+				if delta < 0 {
+					// counter reset
+					delta = v
+				}
+				e.last[key] = v
+				if delta > 0 {
+					e.Client.Count(name, delta, labels)
+				}
+			case dto.MetricType_GAUGE:
+				e.Client.Gauge(name, m.GetGauge().GetValue(), labels)
+			case dto.MetricType_UNTYPED:
+				e.Client.Gauge(name, m.GetUntyped().GetValue(), labels)
+			}
+			// histograms and summaries are not exported, latency is sent as timing from request
+		}
+	}
+	e.Client.Flush()
+}
+
+func statsdSeriesKey(name string, m *dto.Metric) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range m.GetLabel() {
+		b.WriteString("\xff")
+		b.WriteString(l.GetName())
+		b.WriteString("=")
+		b.WriteString(l.GetValue())
+	}
+	return b.String()
+}
+
+// statsdTiming sends json-rpc call duration as timing
+type statsdTiming struct {
+	Client *statsdClient
+}
+
+// ServeHandler implements middleware interface
+func (m statsdTiming) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := getRPCCall(r.Context())
+		if c == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		h.ServeHTTP(w, r)
+
+		method := "batch"
+		if !c.Batch && len(c.Requests) == 1 {
+			method = c.Requests[0].Method
+		}
+		m.Client.Timing("rpc_duration", time.Since(start), map[string]string{"method": method})
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stuckHook runs command when head not advanced for a duration,
+// ex. restart geth to recover stuck node
+type stuckHook struct {
+	Command  string        // shell command
+	After    time.Duration // head not advanced duration to run command
+	Interval time.Duration // min interval between runs
+	Timeout  time.Duration // command timeout
+	DryRun   bool          // log command without running
+
+	head      uint64
+	advanced  time.Time
+	lastRunAt time.Time
+}
+
+// Start starts watching head
+func (m *stuckHook) Start() {
+	m.advanced = time.Now()
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			m.check()
+		}
+	}()
+}
+
+func (m *stuckHook) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	block, _ := getLastBlock(ctx)
+	cancel()
+
+	now := time.Now()
+	if block != nil && block.NumberU64() > m.head {
+		m.head = block.NumberU64()
+		m.advanced = now
+		return
+	}
+
+	stuckFor := now.Sub(m.advanced)
+	if stuckFor < m.After {
+		return
+	}
+	if !m.lastRunAt.IsZero() && now.Sub(m.lastRunAt) < m.Interval {
+		return
+	}
+	m.lastRunAt = now
+
+	if m.DryRun {
+		log.Printf("stuck: head %d not advanced for %s, dry run: %s", m.head, stuckFor.Truncate(time.Second), m.Command)
+		promStuckHookRun("dry_run")
+		return
+	}
+	log.Printf("stuck: head %d not advanced for %s, running: %s", m.head, stuckFor.Truncate(time.Second), m.Command)
+	m.run(stuckFor)
+}
+
+func (m *stuckHook) run(stuckFor time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", m.Command)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("GETH_PROXY_HEAD=%d", m.head),
+		fmt.Sprintf("GETH_PROXY_STUCK_SECONDS=%d", int64(stuckFor/time.Second)),
+	)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("stuck: command output: %s", out)
+	}
+	if err != nil {
+		log.Printf("stuck: command failed; %v", err)
+		promStuckHookRun("error")
+		return
+	}
+	promStuckHookRun("success")
+}
+
+var stuckHookRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "stuck_hook_runs",
+}, []string{"result"})
+
+func promStuckHookRun(result string) {
+	c, err := stuckHookRuns.GetMetricWith(prometheus.Labels{"result": result})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var syncState struct {
+	mu       sync.RWMutex
+	Progress *ethereum.SyncProgress // nil when not syncing
+}
+
+func getSyncProgress() *ethereum.SyncProgress {
+	syncState.mu.RLock()
+	defer syncState.mu.RUnlock()
+	return syncState.Progress
+}
+
+func updateSyncProgress(ctx context.Context) {
+	p, err := ethClient.SyncProgress(ctx)
+	if err != nil {
+		return
+	}
+
+	syncState.mu.Lock()
+	syncState.Progress = p
+	syncState.mu.Unlock()
+
+	if p != nil {
+		syncing.Set(1)
+	} else {
+		syncing.Set(0)
+	}
+}
+
+func startSyncTracker() {
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			updateSyncProgress(ctx)
+			cancel()
+
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+// syncGuard allows only sync-safe methods while upstream is syncing
+type syncGuard struct {
+	Methods map[string]bool // allowed methods while syncing
+}
+
+// ServeHandler implements middleware interface
+func (m syncGuard) ServeHandler(h http.Handler) http.Handler {
+	return interceptRPC(m.intercept).ServeHandler(h)
+}
+
+func (m syncGuard) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	if m.Methods[req.Method] {
+		return nil
+	}
+
+	p := getSyncProgress()
+	if p == nil {
+		return nil
+	}
+
+	resp := newRPCError(req, rpcCodeServerError, fmt.Sprintf("node is syncing, %s is unavailable", req.Method))
+	resp.Error.Data = map[string]interface{}{
+		"startingBlock": p.StartingBlock,
+		"currentBlock":  p.CurrentBlock,
+		"highestBlock":  p.HighestBlock,
+	}
+	return resp
+}
+
+var syncing = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: promNamespace,
+	Name:      "syncing",
+})
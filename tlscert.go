@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/moonrhythm/parapet"
+)
+
+// tlsCertLoader loads listener's tls certificates from files,
+// and reloads them without restart when files changed or on SIGHUP,
+// established connections (ex. websocket) keep running
+type tlsCertLoader struct {
+	Cert  string // default certificate file, empty = self signed
+	Key   string // default key file
+	Certs string // additional certificates selected by SNI (certfile|keyfile,...)
+	Hosts string // per host certificates (host=certfile|keyfile,...)
+
+	mu         sync.RWMutex
+	selfSigned *tls.Certificate
+	certs      []tls.Certificate // default first
+	hosts      vhostCerts
+	modTime    time.Time
+}
+
+// Load loads all certificates, current certificates are kept on error
+func (m *tlsCertLoader) Load() error {
+	// stat before load, file changed while loading is reloaded next check
+	modTime := m.lastModified()
+
+	var xs []tls.Certificate
+	if m.Cert == "" || m.Key == "" {
+		if m.selfSigned == nil {
+			cert, err := parapet.GenerateSelfSignCertificate(parapet.SelfSign{
+				CommonName: "geth-proxy",
+				Hosts:      []string{"geth-proxy"},
+				NotBefore:  time.Now().Add(-5 * time.Minute),
+				NotAfter:   time.Now().AddDate(10, 0, 0),
+			})
+			if err != nil {
+				return err
+			}
+			m.selfSigned = &cert
+		}
+		xs = append(xs, *m.selfSigned)
+	} else {
+		cert, err := tls.LoadX509KeyPair(m.Cert, m.Key)
+		if err != nil {
+			return err
+		}
+		xs = append(xs, cert)
+	}
+
+	more, err := parseCerts(m.Certs)
+	if err != nil {
+		return err
+	}
+	xs = append(xs, more...)
+
+	hosts, err := parseVhostCerts(m.Hosts)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.certs = xs
+	m.hosts = hosts
+	m.modTime = modTime
+	m.mu.Unlock()
+
+	// self signed certificate is valid for 10 years, monitor only loaded certificate
+	certs.Reset()
+	for i, cert := range xs {
+		if i == 0 && m.selfSigned != nil {
+			continue
+		}
+		certs.Add(cert)
+	}
+	for _, cert := range hosts {
+		certs.Add(*cert)
+	}
+	return nil
+}
+
+// files returns all certificate and key files
+func (m *tlsCertLoader) files() []string {
+	var rs []string
+	if m.Cert != "" && m.Key != "" {
+		rs = append(rs, m.Cert, m.Key)
+	}
+	for _, x := range parseList(m.Certs) {
+		rs = append(rs, strings.Split(x, "|")...)
+	}
+	for _, x := range parseMap(m.Hosts) {
+		rs = append(rs, strings.Split(x, "|")...)
+	}
+	return rs
+}
+
+// lastModified returns latest modification time of all files,
+// stat follows symlink, so secret volume's symlink swap is detected
+func (m *tlsCertLoader) lastModified() time.Time {
+	var t time.Time
+	for _, fn := range m.files() {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+func (m *tlsCertLoader) reload(reason string) {
+	err := m.Load()
+	if err != nil {
+		log.Printf("tls: reload on %s failed, keep current certificates; %v", reason, err)
+		return
+	}
+	log.Printf("tls: certificates reloaded on %s", reason)
+}
+
+// WatchSignal reloads certificates on SIGHUP
+func (m *tlsCertLoader) WatchSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			m.reload("SIGHUP")
+		}
+	}()
+}
+
+// Watch reloads certificates when files modified, checks every interval
+func (m *tlsCertLoader) Watch(interval time.Duration) {
+	go func() {
+		var attempted time.Time // do not retry failed reload until files change again
+		for {
+			time.Sleep(interval)
+
+			m.mu.RLock()
+			modTime := m.modTime
+			m.mu.RUnlock()
+
+			t := m.lastModified()
+			if t.After(modTime) && !t.Equal(attempted) {
+				attempted = t
+				m.reload("file change")
+			}
+		}
+	}()
+}
+
+var errNoCertificate = errors.New("tls: no certificate")
+
+// GetCertificate implements tls.Config's GetCertificate,
+// selects per host certificate, then certificate that supports SNI, then default certificate
+func (m *tlsCertLoader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if cert, _ := m.hosts.GetCertificate(hello); cert != nil {
+		return cert, nil
+	}
+	if len(m.certs) == 0 {
+		return nil, errNoCertificate
+	}
+	for i := 1; i < len(m.certs); i++ {
+		if hello.SupportsCertificate(&m.certs[i]) == nil {
+			return &m.certs[i], nil
+		}
+	}
+	return &m.certs[0], nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/moonrhythm/parapet/pkg/upstream"
+	"golang.org/x/net/http2"
+)
+
+// transportConfig is geth http transport tuning, zero uses parapet's default
+type transportConfig struct {
+	MaxIdleConns          int // per host
+	MaxConnsPerHost       int // 0 = unlimited
+	IdleConnTimeout       time.Duration
+	TCPKeepAlive          time.Duration
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	TLS                   *tls.Config // nil = plaintext
+}
+
+// New creates http or https transport from config
+func (c transportConfig) New() http.RoundTripper {
+	if c.TLS != nil {
+		return &upstream.HTTPSTransport{
+			MaxIdleConns:          c.MaxIdleConns,
+			MaxConn:               c.MaxConnsPerHost,
+			IdleConnTimeout:       c.IdleConnTimeout,
+			TCPKeepAlive:          c.TCPKeepAlive,
+			DialTimeout:           c.DialTimeout,
+			ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+			TLSClientConfig:       c.TLS,
+		}
+	}
+	return &upstream.HTTPTransport{
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxConn:               c.MaxConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		TCPKeepAlive:          c.TCPKeepAlive,
+		DialTimeout:           c.DialTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+	}
+}
+
+// NewH2C creates http/2 cleartext transport from config, upgrade requests (websocket) use http/1.1,
+// config must not have TLS
+func (c transportConfig) NewH2C() http.RoundTripper {
+	h1 := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DisableCompression:    true,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConns,
+		MaxConnsPerHost:       c.MaxConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+	}
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: c.TCPKeepAlive,
+	}
+	h1.DialContext = dialer.DialContext
+
+	// http/2 transport reads idle and response header timeouts from h1
+	h2, _ := http2.ConfigureTransports(h1)
+	h2.AllowHTTP = true
+	h2.DisableCompression = true
+	limit := connLimiter{Max: c.MaxConnsPerHost}
+	h2.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+		return limit.Dial(dialer, network, addr)
+	}
+	return &h2cTransport{h1: h1, h2: h2}
+}
+
+type h2cTransport struct {
+	h1 *http.Transport
+	h2 *http2.Transport
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *h2cTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.URL.Scheme = "http"
+	if r.Header.Get("Upgrade") != "" {
+		return t.h1.RoundTrip(r)
+	}
+	return t.h2.RoundTrip(r)
+}
+
+var errConnLimit = errors.New("upstream connection limit reached")
+
+// connLimiter limits open connections per address, 0 = unlimited
+type connLimiter struct {
+	Max int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+// Dial dials address, returns error when address has max connections
+func (l *connLimiter) Dial(d *net.Dialer, network, addr string) (net.Conn, error) {
+	if l.Max <= 0 {
+		return d.Dial(network, addr)
+	}
+
+	l.mu.Lock()
+	if l.conns == nil {
+		l.conns = make(map[string]int)
+	}
+	if l.conns[addr] >= l.Max {
+		l.mu.Unlock()
+		return nil, errConnLimit
+	}
+	l.conns[addr]++
+	l.mu.Unlock()
+
+	conn, err := d.Dial(network, addr)
+	if err != nil {
+		l.release(addr)
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, release: func() { l.release(addr) }}, nil
+}
+
+func (l *connLimiter) release(addr string) {
+	l.mu.Lock()
+	l.conns[addr]--
+	l.mu.Unlock()
+}
+
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// WithResponseHeaderTimeout returns config with response header timeout
+func (c transportConfig) WithResponseHeaderTimeout(d time.Duration) transportConfig {
+	c.ResponseHeaderTimeout = d
+	return c
+}
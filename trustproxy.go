@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/moonrhythm/parapet"
+)
+
+// trustedProxies are proxies allowed to set client ip headers
+type trustedProxies []*net.IPNet
+
+func (ps trustedProxies) Contains(ip net.IP) bool {
+	for _, p := range ps {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conditional returns server's trust proxy condition,
+// forwarded headers from untrusted remote are overwritten with remote ip
+func (ps trustedProxies) Conditional() parapet.Conditional {
+	return func(r *http.Request) bool {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		return ip != nil && ps.Contains(ip)
+	}
+}
+
+type clientIPKey struct{}
+
+// ServeHandler implements middleware interface,
+// it resolves client ip then sets to X-Real-Ip and request context for clientIP
+func (ps trustedProxies) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ps.resolve(r)
+		if ip != nil {
+			r.Header.Set("X-Real-Ip", ip.String())
+		}
+		ctx := context.WithValue(r.Context(), clientIPKey{}, ip)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// resolve returns remote ip, or forwarded client ip when remote is trusted proxy,
+// client ip is the right-most untrusted address in X-Forwarded-For,
+// so client can not spoof its ip by sending X-Forwarded-For through trusted proxy
+func (ps trustedProxies) resolve(r *http.Request) net.IP {
+	remote := remoteIP(r)
+	if remote == nil || !ps.Contains(remote) {
+		return remote
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		var client net.IP
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			client = ip
+			if !ps.Contains(ip) {
+				break
+			}
+		}
+		if client != nil {
+			return client
+		}
+	}
+	if ip := net.ParseIP(r.Header.Get("X-Real-Ip")); ip != nil {
+		return ip
+	}
+	return remote
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tunnel serves authenticated http CONNECT tunnel to whitelisted targets
+type tunnel struct {
+	Targets  map[string]bool // allowed host:port
+	Username string
+	Password string
+}
+
+// ServeHandler implements middleware interface
+func (m tunnel) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if !m.authenticate(r) {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="geth-proxy"`)
+			http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+			return
+		}
+
+		target := r.Host
+		if !m.Targets[target] {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		upstreamConn, err := net.DialTimeout("tcp", target, 5*time.Second)
+		if err != nil {
+			log.Printf("tunnel: can not dial %s; %v", target, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		defer upstreamConn.Close()
+
+		tunnelActive.Inc()
+		defer tunnelActive.Dec()
+		promTunnelConnection(target)
+
+		if r.ProtoMajor == 1 {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				http.Error(w, "Tunnel not supported", http.StatusInternalServerError)
+				return
+			}
+			conn, rw, err := hj.Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+			pipe(conn, rw.Reader, upstreamConn, func() { conn.Close() })
+			return
+		}
+
+		// http/2 stream
+		w.WriteHeader(http.StatusOK)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		pipe(flushWriter{w}, r.Body, upstreamConn, func() { r.Body.Close() })
+	})
+}
+
+func (m tunnel) authenticate(r *http.Request) bool {
+	auth := r.Header.Get("Proxy-Authorization")
+	r.Header.Del("Proxy-Authorization")
+
+	const prefix = "Basic "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	username, password := parseCredential(string(b))
+	return username == m.Username &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(m.Password)) == 1
+}
+
+// pipe copies data between client and upstream until one side closed
+func pipe(clientWriter io.Writer, clientReader io.Reader, upstreamConn net.Conn, closeClient func()) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstreamConn, clientReader)
+		if c, ok := upstreamConn.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+	}()
+	io.Copy(clientWriter, upstreamConn)
+	upstreamConn.Close()
+	closeClient()
+	wg.Wait()
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+var tunnelActive = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: promNamespace,
+	Name:      "tunnel_active_connections",
+})
+
+var tunnelConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "tunnel_connections",
+}, []string{"target"})
+
+func promTunnelConnection(target string) {
+	c, err := tunnelConnections.GetMetricWith(prometheus.Labels{
+		"target": target,
+	})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
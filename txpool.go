@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// txpoolSummary is the polled txpool state
+type txpoolSummary struct {
+	Pending    uint64         `json:"pending"`
+	Queued     uint64         `json:"queued"`
+	Senders    int            `json:"senders,omitempty"` // senders with pending or queued transactions
+	TopSenders []txpoolSender `json:"topSenders,omitempty"`
+	UpdatedAt  time.Time      `json:"updatedAt"`
+}
+
+type txpoolSender struct {
+	Address string `json:"address"`
+	Pending int    `json:"pending"`
+	Queued  int    `json:"queued"`
+}
+
+// txpoolPoller polls geth's txpool, and serves summary
+//
+//	GET /txpool
+type txpoolPoller struct {
+	Interval        time.Duration // txpool_status poll interval
+	InspectInterval time.Duration // txpool_inspect poll interval for senders, 0 = disable
+	TopSenders      int           // senders to list in summary
+
+	mu      sync.RWMutex
+	summary *txpoolSummary
+}
+
+// Start starts polling
+func (m *txpoolPoller) Start() {
+	go func() {
+		var inspectedAt time.Time
+		for {
+			inspect := m.InspectInterval > 0 && time.Since(inspectedAt) >= m.InspectInterval
+			if inspect {
+				inspectedAt = time.Now()
+			}
+			m.poll(inspect)
+			time.Sleep(m.Interval)
+		}
+	}()
+}
+
+func (m *txpoolPoller) poll(inspect bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var status struct {
+		Pending hexutil.Uint64 `json:"pending"`
+		Queued  hexutil.Uint64 `json:"queued"`
+	}
+	err := rpcClient.CallContext(ctx, &status, "txpool_status")
+	if err != nil {
+		return
+	}
+
+	m.mu.RLock()
+	var prev txpoolSummary
+	if m.summary != nil {
+		prev = *m.summary
+	}
+	m.mu.RUnlock()
+
+	summary := &txpoolSummary{
+		Pending:    uint64(status.Pending),
+		Queued:     uint64(status.Queued),
+		Senders:    prev.Senders,
+		TopSenders: prev.TopSenders,
+		UpdatedAt:  time.Now(),
+	}
+	if inspect {
+		summary.Senders, summary.TopSenders = m.inspect(ctx)
+	}
+
+	m.mu.Lock()
+	m.summary = summary
+	m.mu.Unlock()
+
+	txpoolPending.Set(float64(summary.Pending))
+	txpoolQueued.Set(float64(summary.Queued))
+	txpoolSenders.Set(float64(summary.Senders))
+}
+
+// inspect counts transactions per sender from txpool_inspect,
+// which is lighter than txpool_content
+func (m *txpoolPoller) inspect(ctx context.Context) (int, []txpoolSender) {
+	// pending|queued => sender => nonce => summary
+	var content map[string]map[string]map[string]json.RawMessage
+	err := rpcClient.CallContext(ctx, &content, "txpool_inspect")
+	if err != nil {
+		return 0, nil
+	}
+
+	senders := make(map[string]*txpoolSender)
+	get := func(addr string) *txpoolSender {
+		s := senders[addr]
+		if s == nil {
+			s = &txpoolSender{Address: addr}
+			senders[addr] = s
+		}
+		return s
+	}
+	for addr, txs := range content["pending"] {
+		get(addr).Pending = len(txs)
+	}
+	for addr, txs := range content["queued"] {
+		get(addr).Queued = len(txs)
+	}
+
+	xs := make([]txpoolSender, 0, len(senders))
+	for _, s := range senders {
+		xs = append(xs, *s)
+	}
+	sort.Slice(xs, func(i, j int) bool {
+		ni, nj := xs[i].Pending+xs[i].Queued, xs[j].Pending+xs[j].Queued
+		if ni != nj {
+			return ni > nj
+		}
+		return xs[i].Address < xs[j].Address
+	})
+	if len(xs) > m.TopSenders {
+		xs = xs[:m.TopSenders]
+	}
+	return len(senders), xs
+}
+
+func (m *txpoolPoller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m.mu.RLock()
+	summary := m.summary
+	m.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if summary == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(blockAPIError{"txpool not available"})
+		return
+	}
+	json.NewEncoder(w).Encode(summary)
+}
+
+var (
+	txpoolPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "txpool_pending",
+	})
+
+	txpoolQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "txpool_queued",
+	})
+
+	txpoolSenders = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "txpool_senders",
+	})
+)
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// txValidator decodes raw transaction and rejects invalid one before forwarding to upstream
+type txValidator struct {
+	ChainID *big.Int // expected chain id, nil = use upstream's chain id
+	MaxGas  uint64   // max gas limit, 0 = unlimited
+	Nonce   bool     // reject nonce lower than sender's confirmed nonce
+}
+
+// ServeHandler implements middleware interface
+func (m txValidator) ServeHandler(h http.Handler) http.Handler {
+	return interceptRPC(m.intercept).ServeHandler(h)
+}
+
+func (m txValidator) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	if req.Method != "eth_sendRawTransaction" {
+		return nil
+	}
+
+	var params []hexutil.Bytes
+	if json.Unmarshal(req.Params, &params) != nil || len(params) != 1 {
+		promTxRejected("decode")
+		return newRPCError(req, rpcCodeInvalidParams, "invalid params")
+	}
+
+	var tx types.Transaction
+	err := tx.UnmarshalBinary(params[0])
+	if err != nil {
+		promTxRejected("decode")
+		return newRPCError(req, rpcCodeInvalidParams, fmt.Sprintf("can not decode transaction; %v", err))
+	}
+
+	if m.MaxGas > 0 && tx.Gas() > m.MaxGas {
+		promTxRejected("gas")
+		return newRPCError(req, rpcCodeServerError, fmt.Sprintf("gas limit %d exceeds cap %d", tx.Gas(), m.MaxGas))
+	}
+
+	ctx := r.Context()
+
+	// unprotected (pre EIP-155) transaction does not have chain id
+	if tx.Protected() {
+		chainID := m.ChainID
+		if chainID == nil {
+			chainID, err = getChainID(ctx)
+			if err != nil {
+				// let upstream validate
+				return nil
+			}
+		}
+		if tx.ChainId().Cmp(chainID) != 0 {
+			promTxRejected("chain_id")
+			return newRPCError(req, rpcCodeServerError, fmt.Sprintf("invalid chain id %s, expected %s", tx.ChainId(), chainID))
+		}
+	}
+
+	if m.Nonce {
+		from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), &tx)
+		if err != nil {
+			promTxRejected("sender")
+			return newRPCError(req, rpcCodeInvalidParams, fmt.Sprintf("invalid sender; %v", err))
+		}
+		nonce, err := pool.Next().Eth.NonceAt(ctx, from, nil)
+		if err == nil && tx.Nonce() < nonce {
+			promTxRejected("nonce")
+			return newRPCError(req, rpcCodeServerError, fmt.Sprintf("nonce too low: address %s, tx: %d state: %d", from.Hex(), tx.Nonce(), nonce))
+		}
+	}
+
+	return nil
+}
+
+var txRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "tx_rejected",
+}, []string{"reason"})
+
+func promTxRejected(reason string) {
+	c, err := txRejected.GetMetricWith(prometheus.Labels{
+		"reason": reason,
+	})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
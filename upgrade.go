@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/moonrhythm/parapet"
+)
+
+// upgradeFDEnv is the environment variable that tells new process
+// the file descriptor to report readiness to old process
+const upgradeFDEnv = "GETH_PROXY_UPGRADE_FD"
+
+// upgradeReadyDelay is the duration new process must keep running
+// before reporting ready, server start failure exits the process within this duration
+const upgradeReadyDelay = time.Second
+
+// upgrader re-executes the binary on SIGUSR2,
+// both processes listen with SO_REUSEPORT, then old process drains after new process is ready
+type upgrader struct {
+	Timeout time.Duration // max duration to wait for new process to be ready
+
+	mu       sync.Mutex
+	servers  []*parapet.Server
+	running  bool
+	upgraded bool
+}
+
+// Add adds server to shutdown without waiting when upgraded
+func (u *upgrader) Add(srv *parapet.Server) {
+	srv.ReusePort = true
+
+	u.mu.Lock()
+	u.servers = append(u.servers, srv)
+	u.mu.Unlock()
+}
+
+// Upgraded returns true if new process took over
+func (u *upgrader) Upgraded() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.upgraded
+}
+
+// Watch starts upgrade on SIGUSR2
+func (u *upgrader) Watch() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	go func() {
+		for range ch {
+			u.mu.Lock()
+			if u.running {
+				u.mu.Unlock()
+				continue
+			}
+			u.running = true
+			u.mu.Unlock()
+
+			err := u.upgrade()
+			if err != nil {
+				log.Printf("upgrade: failed; %v", err)
+				u.mu.Lock()
+				u.running = false
+				u.mu.Unlock()
+			}
+		}
+	}()
+}
+
+func (u *upgrader) upgrade() error {
+	// binary may be replaced, resolve path again instead of os.Executable
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), upgradeFDEnv+"=3")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("upgrade: started new process %d", cmd.Process.Pid)
+
+	// new process writes a byte when ready, or closes the pipe when exited
+	ready := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := r.Read(b)
+		ready <- n == 1
+	}()
+	go cmd.Wait()
+
+	select {
+	case ok := <-ready:
+		if !ok {
+			return errors.New("new process exited")
+		}
+	case <-time.After(u.Timeout):
+		cmd.Process.Kill()
+		return errors.New("new process not ready within timeout")
+	}
+
+	log.Printf("upgrade: new process %d ready, draining", cmd.Process.Pid)
+
+	// new process already serving, stop accepting immediately
+	u.mu.Lock()
+	for _, srv := range u.servers {
+		srv.WaitBeforeShutdown = 0
+	}
+	u.upgraded = true
+	u.mu.Unlock()
+	return syscall.Kill(os.Getpid(), syscall.SIGTERM)
+}
+
+// notifyUpgradeReady reports readiness to old process when started by upgrade
+func notifyUpgradeReady() {
+	s := os.Getenv(upgradeFDEnv)
+	if s == "" {
+		return
+	}
+	os.Unsetenv(upgradeFDEnv)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+	go func() {
+		defer f.Close()
+
+		time.Sleep(upgradeReadyDelay)
+		f.Write([]byte{1})
+	}()
+}
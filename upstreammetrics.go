@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// upstreamMetricsTransport records per upstream request metrics
+type upstreamMetricsTransport struct {
+	http.RoundTripper
+	Chain    string
+	Upstream string
+}
+
+// RoundTrip implements http.RoundTripper
+func (t upstreamMetricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	l := prometheus.Labels{"chain": t.Chain, "upstream": t.Upstream}
+
+	inFlight, _ := upstreamInFlight.GetMetricWith(l)
+	if inFlight != nil {
+		inFlight.Inc()
+		defer inFlight.Dec()
+	}
+
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if o, e := upstreamDuration.GetMetricWith(l); e == nil {
+		observeDuration(o, time.Since(start), r.Header)
+	}
+
+	result := "success"
+	if err != nil || resp.StatusCode >= 500 {
+		result = "error"
+	}
+	if c, e := upstreamRequests.GetMetricWith(prometheus.Labels{"chain": t.Chain, "upstream": t.Upstream, "result": result}); e == nil {
+		c.Inc()
+	}
+	return resp, err
+}
+
+var (
+	upstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "upstream_requests",
+	}, []string{"chain", "upstream", "result"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: promNamespace,
+		Name:      "upstream_duration_seconds",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"chain", "upstream"})
+
+	upstreamInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "upstream_in_flight",
+	}, []string{"chain", "upstream"})
+
+	upstreamHead = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "upstream_head",
+	}, []string{"chain", "upstream"})
+
+	upstreamLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "upstream_head_lag",
+	}, []string{"chain", "upstream"})
+
+	upstreamHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "upstream_healthy",
+	}, []string{"chain", "upstream"})
+
+	upstreamWeight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "upstream_weight",
+	}, []string{"chain", "upstream"})
+)
+
+// promUpdateUpstreams updates pool's upstreams head, lag, and health
+func promUpdateUpstreams(p *upstreamPool) {
+	upstreams := p.List()
+
+	var maxHead uint64
+	heads := make([]uint64, len(upstreams))
+	for i, u := range upstreams {
+		if h := u.Head(); h != nil {
+			heads[i] = h.Number.Uint64()
+		}
+		if heads[i] > maxHead {
+			maxHead = heads[i]
+		}
+	}
+
+	for i, u := range upstreams {
+		l := prometheus.Labels{"chain": p.Chain, "upstream": u.Addr}
+		if g, err := upstreamHead.GetMetricWith(l); err == nil {
+			g.Set(float64(heads[i]))
+		}
+		if g, err := upstreamLag.GetMetricWith(l); err == nil {
+			g.Set(float64(maxHead - heads[i]))
+		}
+		if g, err := upstreamHealthy.GetMetricWith(l); err == nil {
+			if u.Healthy() {
+				g.Set(1)
+			} else {
+				g.Set(0)
+			}
+		}
+		if g, err := upstreamWeight.GetMetricWith(l); err == nil {
+			g.Set(float64(u.Weight()))
+		}
+	}
+}
+
+// promDeleteUpstream deletes removed upstream's metrics
+func promDeleteUpstream(chain, addr string) {
+	l := prometheus.Labels{"chain": chain, "upstream": addr}
+	upstreamInFlight.Delete(l)
+	upstreamDuration.Delete(l)
+	upstreamHead.Delete(l)
+	upstreamLag.Delete(l)
+	upstreamHealthy.Delete(l)
+	upstreamWeight.Delete(l)
+	upstreamRequests.Delete(prometheus.Labels{"chain": chain, "upstream": addr, "result": "success"})
+	upstreamRequests.Delete(prometheus.Labels{"chain": chain, "upstream": addr, "result": "error"})
+	for _, result := range []string{"match", "mismatch", "error"} {
+		consistencyChecks.Delete(prometheus.Labels{"chain": chain, "upstream": addr, "result": result})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// gethTLS is tls config for connections to geth nodes, nil = plaintext
+var gethTLS *tls.Config
+
+// newGethTLSConfig creates tls config for geth nodes behind tls,
+// caFile adds ca bundle to system roots, serverName overrides sni and verified name,
+// certFile and keyFile are client certificate for mutual tls
+func newGethTLSConfig(caFile, serverName, certFile, keyFile string) (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+		c.RootCAs = roots
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// gethScheme returns http scheme to geth nodes
+func gethScheme() string {
+	if gethTLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// gethWSScheme returns websocket scheme to geth nodes
+func gethWSScheme() string {
+	if gethTLS != nil {
+		return "wss"
+	}
+	return "ws"
+}
+
+// gethURL returns url to geth node's port
+func gethURL(addr, port string) string {
+	return gethScheme() + "://" + net.JoinHostPort(addr, port)
+}
+
+var (
+	gethClientTransportOnce sync.Once
+	gethClientTransportTLS  *http.Transport
+)
+
+// gethClientTransport returns transport for rpc clients to geth nodes
+func gethClientTransport() http.RoundTripper {
+	if gethTLS == nil {
+		return http.DefaultTransport
+	}
+	gethClientTransportOnce.Do(func() {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = gethTLS.Clone()
+		gethClientTransportTLS = t
+	})
+	return gethClientTransportTLS
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// computeUnits is compute units per method, namespace_*, or * (default 1),
+// cost of calls on geth, like hosted providers' compute units
+type computeUnits map[string]int
+
+// lookup returns method's compute units and the matched weight, method, namespace_*, or *
+func (m computeUnits) lookup(method string) (int, string) {
+	if w, ok := m[method]; ok {
+		return w, method
+	}
+	ns := rpcNamespace(method) + "_*"
+	if w, ok := m[ns]; ok {
+		return w, ns
+	}
+	if w, ok := m["*"]; ok {
+		return w, "*"
+	}
+	return 1, "*"
+}
+
+// Of returns method's compute units
+func (m computeUnits) Of(method string) int {
+	w, _ := m.lookup(method)
+	return w
+}
+
+// Call returns total compute units of all requests in call
+func (m computeUnits) Call(c *rpcCall) int {
+	var n int
+	for _, req := range c.Requests {
+		if req != nil {
+			n += m.Of(req.Method)
+		}
+	}
+	return n
+}
+
+// usageTracker accounts requests, compute units, and bandwidth per tenant (api key or jwt tenant),
+// must be used after parseRPC and auth
+type usageTracker struct {
+	Weights computeUnits
+
+	mu      sync.Mutex
+	total   map[string]*tenantUsage // since start
+	period  map[string]*tenantUsage // since last export
+	started time.Time
+}
+
+// tenantUsage is tenant's usage counters
+type tenantUsage struct {
+	Tenant       string `json:"tenant"`
+	Tier         string `json:"tier,omitempty"`
+	Requests     int64  `json:"requests"`
+	Calls        int64  `json:"calls"`
+	ComputeUnits int64  `json:"computeUnits"`
+	BytesIn      int64  `json:"bytesIn"`
+	BytesOut     int64  `json:"bytesOut"`
+}
+
+func (x *tenantUsage) add(y *tenantUsage) {
+	x.Tier = y.Tier
+	x.Requests += y.Requests
+	x.Calls += y.Calls
+	x.ComputeUnits += y.ComputeUnits
+	x.BytesIn += y.BytesIn
+	x.BytesOut += y.BytesOut
+}
+
+func newUsageTracker(weights computeUnits) *usageTracker {
+	return &usageTracker{
+		Weights: weights,
+		total:   make(map[string]*tenantUsage),
+		period:  make(map[string]*tenantUsage),
+		started: time.Now(),
+	}
+}
+
+// ServeHandler implements middleware interface
+func (m *usageTracker) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := getAuthTenant(r.Context())
+		if t == nil || t.Tenant == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		x := tenantUsage{
+			Tenant:   t.Tenant,
+			Tier:     t.Tier,
+			Requests: 1,
+		}
+		if r.ContentLength > 0 {
+			x.BytesIn = r.ContentLength
+		}
+		if c := getRPCCall(r.Context()); c != nil {
+			for _, req := range c.Requests {
+				if req == nil {
+					continue
+				}
+				x.Calls++
+				x.ComputeUnits += int64(m.Weights.Of(req.Method))
+			}
+		}
+
+		nw := usageResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(&nw, r)
+		x.BytesOut = nw.n
+
+		m.add(&x)
+	})
+}
+
+// computeUnitMeter counts compute units of calls by matched weight, for cost throughput,
+// must be used after parseRPC
+type computeUnitMeter struct {
+	Units computeUnits
+}
+
+// ServeHandler implements middleware interface
+func (m computeUnitMeter) ServeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c := getRPCCall(r.Context()); c != nil {
+			for _, req := range c.Requests {
+				if req == nil {
+					continue
+				}
+				promComputeUnits(m.Units.lookup(req.Method))
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (m *usageTracker) add(x *tenantUsage) {
+	m.mu.Lock()
+	addUsage(m.total, x)
+	addUsage(m.period, x)
+	m.mu.Unlock()
+
+	promUsage(x)
+}
+
+func addUsage(xs map[string]*tenantUsage, x *tenantUsage) {
+	p := xs[x.Tenant]
+	if p == nil {
+		p = &tenantUsage{Tenant: x.Tenant}
+		xs[x.Tenant] = p
+	}
+	p.add(x)
+}
+
+// Usage returns tenants' usage since start, sorted by tenant
+func (m *usageTracker) Usage() []tenantUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return sortUsage(m.total)
+}
+
+// takePeriod returns tenants' usage since last call, then resets period counters
+func (m *usageTracker) takePeriod() []tenantUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rs := sortUsage(m.period)
+	m.period = make(map[string]*tenantUsage)
+	return rs
+}
+
+// restorePeriod adds back usage that can not be exported
+func (m *usageTracker) restorePeriod(xs []tenantUsage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range xs {
+		addUsage(m.period, &xs[i])
+	}
+}
+
+func sortUsage(xs map[string]*tenantUsage) []tenantUsage {
+	rs := make([]tenantUsage, 0, len(xs))
+	for _, x := range xs {
+		rs = append(rs, *x)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Tenant < rs[j].Tenant })
+	return rs
+}
+
+// ServeHTTP serves usage since start
+func (m *usageTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Since   time.Time     `json:"since"`
+		Tenants []tenantUsage `json:"tenants"`
+	}{m.started, m.Usage()})
+}
+
+// usageExporter appends usage of each period to file, as json lines or csv, for billing
+type usageExporter struct {
+	Tracker  *usageTracker
+	File     string
+	Format   string // json or csv
+	Interval time.Duration
+
+	mu    sync.Mutex
+	since time.Time
+}
+
+// Validate validates exporter config
+func (m *usageExporter) Validate() error {
+	if m.Format != "json" && m.Format != "csv" {
+		return fmt.Errorf("invalid format %s, required json or csv", m.Format)
+	}
+	return nil
+}
+
+// Start starts exporting every interval
+func (m *usageExporter) Start() {
+	m.since = time.Now()
+	go func() {
+		for {
+			time.Sleep(m.Interval)
+			m.Export()
+		}
+	}()
+}
+
+// Export appends usage since last export, period without usage is not written
+func (m *usageExporter) Export() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	since := m.since
+	m.since = now
+	xs := m.Tracker.takePeriod()
+	if len(xs) == 0 {
+		return
+	}
+
+	err := m.write(since, now, xs)
+	if err != nil {
+		// retry with next period
+		m.Tracker.restorePeriod(xs)
+		m.since = since
+		log.Printf("usage: can not export; %v", err)
+	}
+}
+
+func (m *usageExporter) write(from, to time.Time, xs []tenantUsage) error {
+	fi, statErr := os.Stat(m.File)
+	f, err := os.OpenFile(m.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if m.Format == "csv" {
+		w := csv.NewWriter(f)
+		if statErr != nil || fi.Size() == 0 {
+			w.Write([]string{"from", "to", "tenant", "tier", "requests", "calls", "compute_units", "bytes_in", "bytes_out"})
+		}
+		for _, x := range xs {
+			w.Write([]string{
+				from.UTC().Format(time.RFC3339),
+				to.UTC().Format(time.RFC3339),
+				x.Tenant,
+				x.Tier,
+				strconv.FormatInt(x.Requests, 10),
+				strconv.FormatInt(x.Calls, 10),
+				strconv.FormatInt(x.ComputeUnits, 10),
+				strconv.FormatInt(x.BytesIn, 10),
+				strconv.FormatInt(x.BytesOut, 10),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	enc := json.NewEncoder(f)
+	for _, x := range xs {
+		err := enc.Encode(struct {
+			From time.Time `json:"from"`
+			To   time.Time `json:"to"`
+			tenantUsage
+		}{from.UTC(), to.UTC(), x})
+		if err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// usageResponseWriter counts response body bytes
+type usageResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *usageResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Flush implements Flusher interface
+func (w *usageResponseWriter) Flush() {
+	if w, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.Flush()
+	}
+}
+
+var (
+	usageRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "usage_requests",
+	}, []string{"tenant"})
+
+	usageCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "usage_calls",
+	}, []string{"tenant"})
+
+	usageComputeUnits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "usage_compute_units",
+	}, []string{"tenant"})
+
+	usageBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "usage_bytes",
+	}, []string{"tenant", "direction"})
+
+	computeUnitsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "compute_units",
+	}, []string{"method"}) // matched weight, bounded by -usage.weights
+)
+
+func promComputeUnits(units int, method string) {
+	c, err := computeUnitsTotal.GetMetricWith(prometheus.Labels{"method": method})
+	if err != nil {
+		return
+	}
+	c.Add(float64(units))
+}
+
+func promUsage(x *tenantUsage) {
+	l := prometheus.Labels{"tenant": x.Tenant}
+	if c, err := usageRequests.GetMetricWith(l); err == nil {
+		c.Add(float64(x.Requests))
+	}
+	if c, err := usageCalls.GetMetricWith(l); err == nil {
+		c.Add(float64(x.Calls))
+	}
+	if c, err := usageComputeUnits.GetMetricWith(l); err == nil {
+		c.Add(float64(x.ComputeUnits))
+	}
+	for dir, n := range map[string]int64{"in": x.BytesIn, "out": x.BytesOut} {
+		c, err := usageBytes.GetMetricWith(prometheus.Labels{"tenant": x.Tenant, "direction": dir})
+		if err != nil {
+			continue
+		}
+		c.Add(float64(n))
+	}
+}
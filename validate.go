@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rpcValidator rejects malformed json-rpc requests without forwarding to upstream,
+// invalid requests in a batch get error while the rest are forwarded,
+// must be used after parseRPC
+type rpcValidator struct{}
+
+// ServeHandler implements middleware interface
+func (m rpcValidator) ServeHandler(h http.Handler) http.Handler {
+	next := interceptRPC(m.intercept).ServeHandler(h)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Body == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		c := getRPCCall(r.Context())
+		if c == nil {
+			// parseRPC could not parse the body
+			body, _ := io.ReadAll(r.Body)
+			if json.Valid(body) {
+				promRPCInvalid("request")
+				writeRPCError(w, r, http.StatusOK, rpcCodeInvalidRequest, "invalid request")
+				return
+			}
+			promRPCInvalid("parse")
+			writeRPCError(w, r, http.StatusOK, rpcCodeParseError, "parse error")
+			return
+		}
+		if len(c.Requests) == 0 {
+			promRPCInvalid("empty_batch")
+			writeRPCResponses(w, false, []*rpcResponse{
+				newRPCError(nil, rpcCodeInvalidRequest, "empty batch"),
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m rpcValidator) intercept(r *http.Request, req *rpcRequest) *rpcResponse {
+	reason, message := validateRPCRequest(req)
+	if reason == "" {
+		return nil
+	}
+	promRPCInvalid(reason)
+
+	resp := newRPCError(req, rpcCodeInvalidRequest, message)
+	if reason == "id" {
+		resp.ID = json.RawMessage("null")
+	}
+	return resp
+}
+
+// validateRPCRequest returns reason and message if request envelope is invalid
+func validateRPCRequest(req *rpcRequest) (reason, message string) {
+	if req == nil {
+		return "request", "invalid request"
+	}
+	if req.JSONRPC != "2.0" {
+		return "jsonrpc", `invalid jsonrpc version, must be "2.0"`
+	}
+	if len(req.ID) > 0 && !isJSONKind(req.ID, '"', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'n') {
+		return "id", "invalid id, must be string, number, or null"
+	}
+	if req.Method == "" {
+		return "method", "missing method"
+	}
+	if len(req.Params) > 0 && !isJSONKind(req.Params, '[', '{', 'n') {
+		return "params", "invalid params, must be array or object"
+	}
+	return "", ""
+}
+
+// isJSONKind returns true if raw json value starts with one of the given bytes
+func isJSONKind(raw json.RawMessage, kinds ...byte) bool {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return false
+	}
+	for _, k := range kinds {
+		if raw[0] == k {
+			return true
+		}
+	}
+	return false
+}
+
+var rpcInvalid = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "rpc_invalid",
+}, []string{"reason"})
+
+func promRPCInvalid(reason string) {
+	c, err := rpcInvalid.GetMetricWith(prometheus.Labels{"reason": reason})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// configValidator collects config problems
+type configValidator struct {
+	errs []string
+}
+
+func (v *configValidator) add(name string, err error) {
+	if err != nil {
+		v.errs = append(v.errs, fmt.Sprintf("%s: %v", name, err))
+	}
+}
+
+// flagValue returns flag value as string
+func flagValue(name string) string {
+	f := flag.Lookup(name)
+	if f == nil {
+		return ""
+	}
+	return f.Value.String()
+}
+
+// runValidateConfig runs validate-config subcommand, checks flags, env, and config file
+// without binding ports or starting the proxy, prints each problem then exits 1 when any found
+//
+//	geth-proxy validate-config -config=/etc/geth-proxy.conf
+func runValidateConfig() {
+	var v configValidator
+	v.listeners()
+	v.tls()
+	v.upstreams()
+	v.auth()
+	v.acl()
+	v.rpc()
+
+	if len(v.errs) > 0 {
+		for _, e := range v.errs {
+			fmt.Println(e)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("config ok")
+}
+
+func (v *configValidator) listeners() {
+	for _, name := range []string{"addr", "tls.addr"} {
+		_, err := flag.Lookup(name).Value.(*listenFlag).Listeners()
+		v.add(name, err)
+	}
+}
+
+func (v *configValidator) tls() {
+	if flagValue("tls.addr") != "" {
+		m := &tlsCertLoader{
+			Cert:  flagValue("tls.cert"),
+			Key:   flagValue("tls.key"),
+			Certs: flagValue("tls.certs"),
+			Hosts: flagValue("tls.hosts"),
+		}
+		if (m.Cert == "") != (m.Key == "") {
+			v.add("tls", errors.New("requires both -tls.cert and -tls.key"))
+		} else if err := m.Load(); err != nil {
+			v.add("tls", err)
+		} else if certs.Expired() {
+			v.add("tls", errors.New("certificate expired"))
+		}
+	}
+
+	if flagValue("geth.tls") == "true" {
+		_, err := newGethTLSConfig(flagValue("geth.tls.ca"), flagValue("geth.tls.server-name"), flagValue("geth.tls.cert"), flagValue("geth.tls.key"))
+		v.add("geth.tls", err)
+	}
+}
+
+func (v *configValidator) upstreams() {
+	addrs := parseList(flagValue("geth.addr"))
+	if len(addrs) == 0 {
+		v.add("geth.addr", errors.New("geth address required"))
+	}
+	for _, addr := range addrs {
+		v.add("geth.addr", resolveUpstream(addr))
+	}
+
+	weights, err := parseWeights(flagValue("geth.weights"))
+	v.add("geth.weights", err)
+	for addr := range weights {
+		if !containsString(addrs, addr) {
+			v.add("geth.weights", fmt.Errorf("%s is not in -geth.addr", addr))
+		}
+	}
+	if p := flagValue("geth.primary"); p != "" && !containsString(addrs, p) {
+		v.add("geth.primary", fmt.Errorf("%s is not in -geth.addr", p))
+	}
+
+	for _, x := range parseList(flagValue("chains")) {
+		name, chainAddrs := splitKeyValue(x)
+		for _, addr := range strings.Split(chainAddrs, "|") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				v.add("chains."+name, resolveUpstream(addr))
+			}
+		}
+	}
+	_, err = parseChainRoutes(flagValue("chains"), flagValue("chains.hosts"), flagValue("geth.http"))
+	v.add("chains", err)
+
+	for _, name := range []string{"fallback.url", "shadow.url", "consistency.url", "private.relay"} {
+		if x := flagValue(name); x != "" {
+			_, err := parseRPCURL(x)
+			v.add(name, err)
+		}
+	}
+}
+
+// resolveUpstream resolves geth address or discovery entry
+func resolveUpstream(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var r net.Resolver
+	switch {
+	case strings.HasPrefix(addr, "k8s+"):
+		// resolved by kubernetes api at runtime
+		if strings.TrimPrefix(addr, "k8s+") == "" {
+			return fmt.Errorf("invalid %s, required k8s+[namespace/]service", addr)
+		}
+		return nil
+	case strings.HasPrefix(addr, "dnssrv+"):
+		_, _, err := r.LookupSRV(ctx, "", "", strings.TrimPrefix(addr, "dnssrv+"))
+		return err
+	case strings.HasPrefix(addr, "dns+"):
+		_, err := r.LookupHost(ctx, strings.TrimPrefix(addr, "dns+"))
+		return err
+	}
+	if net.ParseIP(addr) != nil {
+		return nil
+	}
+	_, err := r.LookupHost(ctx, addr)
+	return err
+}
+
+func containsString(xs []string, s string) bool {
+	for _, x := range xs {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *configValidator) auth() {
+	basic, htpasswd := flagValue("auth.basic"), flagValue("auth.htpasswd")
+	if basic != "" || htpasswd != "" {
+		auth, err := newBasicAuth(basic, htpasswd)
+		if err != nil {
+			v.add("auth", err)
+		} else if auth.Len() == 0 {
+			v.add("auth", errors.New("basic auth requires at least one user"))
+		}
+	}
+
+	key, jwks := flagValue("jwt.key"), flagValue("jwt.jwks")
+	if keys := *flag.Lookup("auth.key").Value.(*stringsFlag); len(keys) > 0 {
+		if basic != "" || htpasswd != "" || key != "" || jwks != "" {
+			v.add("auth.key", errors.New("api key can not be used with basic auth or jwt"))
+		}
+		_, err := newAPIKeyAuth(keys)
+		v.add("auth.key", err)
+	}
+	if key == "" && jwks == "" {
+		return
+	}
+	if basic != "" || htpasswd != "" {
+		v.add("jwt", errors.New("basic auth and jwt can not be used together"))
+	}
+	if key != "" && jwks != "" {
+		v.add("jwt", errors.New("requires only one of -jwt.key or -jwt.jwks"))
+	}
+	if key != "" {
+		k, err := loadJWTKey(key)
+		if err != nil {
+			v.add("jwt.key", err)
+		} else if secret, ok := k.([]byte); ok && len(secret) == 0 {
+			v.add("jwt.key", errors.New("empty hmac secret"))
+		}
+	}
+	if jwks != "" {
+		m := &jwtAuth{JWKSURL: jwks}
+		v.add("jwt.jwks", m.loadJWKS())
+	}
+}
+
+func (v *configValidator) acl() {
+	_, err := parseLocationACL(flagValue("acl.allow"), flagValue("acl.deny"))
+	v.add("acl", err)
+	for _, name := range []string{"ops.allow", "admin.allow"} {
+		_, err := parseCIDRs(parseList(flagValue(name)))
+		v.add(name, err)
+	}
+}
+
+func (v *configValidator) rpc() {
+	for _, name := range []string{"timeout.methods", "slowlog.methods"} {
+		_, err := parseDurationMap(flagValue(name))
+		v.add(name, err)
+	}
+	_, err := parseWeights(flagValue("usage.weights"))
+	v.add("usage.weights", err)
+	if flagValue("usage.file") != "" {
+		v.add("usage.format", (&usageExporter{Format: flagValue("usage.format")}).Validate())
+	}
+	interval, _ := time.ParseDuration(flagValue("metrics.push.interval"))
+	v.add("metrics.push", (&metricsPusher{
+		PushURL:        flagValue("metrics.push.url"),
+		RemoteWriteURL: flagValue("metrics.remote-write.url"),
+		Interval:       interval,
+	}).Validate())
+	for _, name := range []string{"retry.on", "retry.never"} {
+		_, err := parseRetryRules(flagValue(name))
+		v.add(name, err)
+	}
+	if flagValue("retry.max") != "0" && flagValue("hedge.delay") != "0s" {
+		v.add("retry.max", errors.New("retry can not be used with hedge"))
+	}
+	if x := flagValue("rpc.rewrite"); x != "" {
+		v.add("rpc.rewrite", methodRewriter{Methods: parseMap(x)}.Validate())
+	}
+}
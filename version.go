@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// build info, set by -ldflags "-X main.version=v1.2.3 -X main.commit=abcdef"
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// upstreamVersion is geth's client version and chain id
+type upstreamVersion struct {
+	Chain         string `json:"chain"`
+	Addr          string `json:"addr"`
+	ClientVersion string `json:"clientVersion"`
+	ChainID       string `json:"chainId"`
+}
+
+// versionTracker polls geth's web3_clientVersion and chain id,
+// geth can be upgraded without proxy restart
+type versionTracker struct {
+	Pools    []*upstreamPool
+	Interval time.Duration
+
+	mu        sync.RWMutex
+	upstreams map[string]upstreamVersion // by chain and addr
+}
+
+// Start starts polling loop
+func (m *versionTracker) Start() {
+	go func() {
+		for {
+			m.update()
+			time.Sleep(m.Interval)
+		}
+	}()
+}
+
+func (m *versionTracker) update() {
+	rs := make(map[string]upstreamVersion)
+	for _, p := range m.Pools {
+		for _, u := range p.List() {
+			key := p.Chain + "/" + u.Addr
+
+			// keep last known version when geth is unreachable
+			m.mu.RLock()
+			x, ok := m.upstreams[key]
+			m.mu.RUnlock()
+			if !ok {
+				x = upstreamVersion{Chain: p.Chain, Addr: u.Addr}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			var v string
+			if err := u.RPC.CallContext(ctx, &v, "web3_clientVersion"); err == nil {
+				x.ClientVersion = v
+			}
+			if id, err := u.Eth.ChainID(ctx); err == nil {
+				x.ChainID = id.String()
+			}
+			cancel()
+			rs[key] = x
+		}
+	}
+
+	m.mu.Lock()
+	old := m.upstreams
+	m.upstreams = rs
+	m.mu.Unlock()
+
+	for key, x := range old {
+		if y, ok := rs[key]; !ok || y != x {
+			upstreamBuildInfo.Delete(x.labels())
+		}
+	}
+	for _, x := range rs {
+		if g, err := upstreamBuildInfo.GetMetricWith(x.labels()); err == nil {
+			g.Set(1)
+		}
+	}
+}
+
+func (x upstreamVersion) labels() prometheus.Labels {
+	return prometheus.Labels{
+		"chain":          x.Chain,
+		"upstream":       x.Addr,
+		"client_version": x.ClientVersion,
+		"chain_id":       x.ChainID,
+	}
+}
+
+// Upstreams returns last known upstream versions
+func (m *versionTracker) Upstreams() []upstreamVersion {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rs := make([]upstreamVersion, 0, len(m.upstreams))
+	for _, x := range m.upstreams {
+		rs = append(rs, x)
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Chain != rs[j].Chain {
+			return rs[i].Chain < rs[j].Chain
+		}
+		return rs[i].Addr < rs[j].Addr
+	})
+	return rs
+}
+
+// ServeHTTP serves proxy and geth versions
+func (m *versionTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Version   string            `json:"version"`
+		Commit    string            `json:"commit,omitempty"`
+		GoVersion string            `json:"goVersion"`
+		Upstreams []upstreamVersion `json:"upstreams"`
+	}{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+		Upstreams: m.Upstreams(),
+	})
+}
+
+var (
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "build_info",
+	}, []string{"version", "commit", "goversion"})
+
+	upstreamBuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "upstream_build_info",
+	}, []string{"chain", "upstream", "client_version", "chain_id"})
+)
+
+func promSetBuildInfo() {
+	g, err := buildInfo.GetMetricWith(prometheus.Labels{
+		"version":   version,
+		"commit":    commit,
+		"goversion": runtime.Version(),
+	})
+	if err != nil {
+		return
+	}
+	g.Set(1)
+}
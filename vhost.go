@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// matchHost returns true if host matches any of hosts,
+// hosts can be wildcard subdomain (ex. *.rpc.example.com)
+func matchHost(hosts map[string]bool, host string) bool {
+	if len(hosts) == 0 {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	if hosts[host] {
+		return true
+	}
+	for host != "" {
+		i := strings.Index(host, ".")
+		if i <= 0 {
+			break
+		}
+		if hosts["*"+host[i:]] {
+			return true
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+// vhostCerts selects tls certificate by SNI,
+// fallback to listener's default certificate when no host matched
+type vhostCerts map[string]*tls.Certificate
+
+// parseVhostCerts parses host=certfile|keyfile,...
+func parseVhostCerts(s string) (vhostCerts, error) {
+	rs := make(vhostCerts)
+	for host, files := range parseMap(s) {
+		i := strings.Index(files, "|")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid cert for host %s, required certfile|keyfile", host)
+		}
+		cert, err := tls.LoadX509KeyPair(files[:i], files[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("can not load x509 key pair for host %s; %w", host, err)
+		}
+		rs[strings.ToLower(host)] = &cert
+	}
+	return rs, nil
+}
+
+// parseCerts parses certfile|keyfile,... into certificates,
+// the certificate is selected when SNI matches its names
+func parseCerts(s string) ([]tls.Certificate, error) {
+	var rs []tls.Certificate
+	for _, files := range parseList(s) {
+		i := strings.Index(files, "|")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid cert %s, required certfile|keyfile", files)
+		}
+		cert, err := tls.LoadX509KeyPair(files[:i], files[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("can not load x509 key pair %s; %w", files[:i], err)
+		}
+		rs = append(rs, cert)
+	}
+	return rs, nil
+}
+
+// GetCertificate implements tls.Config's GetCertificate
+func (m vhostCerts) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(hello.ServerName)
+	if cert := m[host]; cert != nil {
+		return cert, nil
+	}
+	for host != "" {
+		i := strings.Index(host, ".")
+		if i <= 0 {
+			break
+		}
+		if cert := m["*"+host[i:]]; cert != nil {
+			return cert, nil
+		}
+		host = host[i+1:]
+	}
+	return nil, nil
+}
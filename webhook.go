@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// postWebhook posts v as json to url
+func postWebhook(url string, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("webhook: can not encode payload; %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookClient.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("webhook: can not create request; %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		log.Printf("webhook: can not send; %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("webhook: unexpected status %d", resp.StatusCode)
+	}
+}
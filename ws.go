@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type wsUpgradeFailure struct {
+	Error          string `json:"error"`
+	Reason         string `json:"reason"`
+	UpstreamStatus int    `json:"upstreamStatus,omitempty"`
+	Message        string `json:"message,omitempty"`
+}
+
+// writeWSUpgradeFailure writes structured json response for websocket upgrade failure,
+// instead of plain text bad gateway or connection reset.
+// Upstream address and dial errors are logged but not exposed to client.
+func writeWSUpgradeFailure(w http.ResponseWriter, upstreamAddr string, status int, f wsUpgradeFailure) {
+	f.Error = "websocket upgrade failed"
+	log.Printf("ws: upgrade failed; reason=%s upstream=%s status=%d message=%s", f.Reason, upstreamAddr, f.UpstreamStatus, f.Message)
+	promWSUpgradeFailure(f.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(f)
+}
+
+func isWSUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+var wsUpgradeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "ws_upgrade_failures",
+}, []string{"reason"})
+
+func promWSUpgradeFailure(reason string) {
+	c, err := wsUpgradeFailures.GetMetricWith(prometheus.Labels{
+		"reason": reason,
+	})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsFeed is one upstream websocket subscription shared by proxy's subscribers,
+// it is opened on first Acquire and closed after last Release,
+// lost connection is re-dialed while there are subscribers
+type wsFeed struct {
+	Proxy    *wsProxy
+	Addr     string                // upstream host, empty = next healthy upstream from proxy's pool
+	Name     string                // for log
+	Params   json.RawMessage       // eth_subscribe params
+	OnResult func(json.RawMessage) // called for each notification's result, must not block
+	OnState  func(subscribed bool) // called when subscription opened and lost, optional
+
+	mu      sync.Mutex
+	refs    int
+	conn    *websocket.Conn
+	running bool
+}
+
+// Acquire adds a subscriber, opens upstream subscription if not opened
+func (f *wsFeed) Acquire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.refs++
+	if !f.running {
+		f.running = true
+		go f.run()
+	}
+}
+
+// Release removes a subscriber, closes upstream subscription after last subscriber left
+func (f *wsFeed) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.refs--
+	if f.refs == 0 && f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+func (f *wsFeed) idle() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.refs == 0 {
+		f.running = false
+		return true
+	}
+	return false
+}
+
+func (f *wsFeed) run() {
+	backoff := 500 * time.Millisecond
+	for !f.idle() {
+		err := f.subscribe()
+		if err == nil {
+			backoff = 500 * time.Millisecond
+			continue
+		}
+		log.Printf("ws: %s feed failed; %v", f.Name, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+// subscribe opens upstream subscription and dispatches notifications until connection closed,
+// returns nil when closed by last subscriber
+func (f *wsFeed) subscribe() error {
+	r := &http.Request{URL: &url.URL{Path: "/"}, Header: make(http.Header)}
+	var (
+		conn *websocket.Conn
+		addr string
+		err  error
+	)
+	if f.Addr != "" {
+		conn, addr, _, err = f.Proxy.dialAddr(context.Background(), r, f.Addr)
+	} else {
+		conn, addr, _, err = f.Proxy.dial(context.Background(), r)
+	}
+	if err != nil {
+		return fmt.Errorf("upstream=%s %v", addr, err)
+	}
+	defer conn.Close()
+
+	f.mu.Lock()
+	if f.refs == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	f.conn = conn
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.conn = nil
+		f.mu.Unlock()
+	}()
+
+	err = conn.WriteJSON(rpcRequest{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage("1"),
+		Method:  "eth_subscribe",
+		Params:  f.Params,
+	})
+	if err != nil {
+		return fmt.Errorf("upstream=%s %v", addr, err)
+	}
+
+	var subscribed bool
+	defer func() {
+		if subscribed && f.OnState != nil {
+			f.OnState(false)
+		}
+	}()
+
+	for {
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			f.mu.Lock()
+			closed := f.refs == 0
+			f.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return fmt.Errorf("upstream=%s %v", addr, err)
+		}
+
+		var n wsNotification
+		if json.Unmarshal(p, &n) != nil {
+			continue
+		}
+		if n.Method != "eth_subscription" {
+			var msg wsMessage
+			if json.Unmarshal(p, &msg) != nil {
+				continue
+			}
+			if len(msg.Error) > 0 {
+				return fmt.Errorf("upstream=%s subscribe failed; %s", addr, msg.Error)
+			}
+			if len(msg.Result) > 0 && !subscribed {
+				subscribed = true
+				if f.OnState != nil {
+					f.OnState(true)
+				}
+			}
+			continue
+		}
+		f.OnResult(n.Params.Result)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// wsLogsGuard validates eth_subscribe("logs") filters before subscriptions are opened on geth
+type wsLogsGuard struct {
+	RequireFilter    bool // require address or topics filter
+	MaxAddresses     int  // max addresses, 0 = unlimited
+	MaxTopics        int  // max topic values in all positions, 0 = unlimited
+	MaxSubscriptions int  // max logs subscriptions per connection, 0 = unlimited
+}
+
+// Enabled returns true if any limit is set
+func (m *wsLogsGuard) Enabled() bool {
+	return m.RequireFilter || m.MaxAddresses > 0 || m.MaxTopics > 0 || m.MaxSubscriptions > 0
+}
+
+// logsFilter returns filter of logs subscription, ok is false if params is not logs subscription
+func logsFilter(params json.RawMessage) (filter map[string]json.RawMessage, ok bool) {
+	var xs []json.RawMessage
+	if json.Unmarshal(params, &xs) != nil || len(xs) == 0 {
+		return nil, false
+	}
+	var kind string
+	if json.Unmarshal(xs[0], &kind) != nil || kind != "logs" {
+		return nil, false
+	}
+	if len(xs) > 1 {
+		json.Unmarshal(xs[1], &filter)
+	}
+	return filter, true
+}
+
+func (m *wsLogsGuard) intercept(req *rpcRequest) *rpcResponse {
+	if req.Method != "eth_subscribe" {
+		return nil
+	}
+	filter, ok := logsFilter(req.Params)
+	if !ok {
+		return nil
+	}
+
+	if m.RequireFilter && !hasLogFilter(filter) {
+		promWSLogsRejected("filter")
+		return newRPCError(req, rpcCodeInvalidParams, "logs subscription requires address or topics filter")
+	}
+
+	if m.MaxAddresses > 0 {
+		var address interface{}
+		json.Unmarshal(filter["address"], &address)
+		n := 0
+		switch x := address.(type) {
+		case string:
+			n = 1
+		case []interface{}:
+			n = len(x)
+		}
+		if n > m.MaxAddresses {
+			promWSLogsRejected("addresses")
+			return newRPCError(req, rpcCodeLimitExceeded, fmt.Sprintf("logs subscription addresses %d exceeds limit %d", n, m.MaxAddresses))
+		}
+	}
+
+	if m.MaxTopics > 0 {
+		var topics []interface{}
+		json.Unmarshal(filter["topics"], &topics)
+		n := 0
+		for _, t := range topics {
+			switch x := t.(type) {
+			case string:
+				n++
+			case []interface{}:
+				n += len(x)
+			}
+		}
+		if n > m.MaxTopics {
+			promWSLogsRejected("topics")
+			return newRPCError(req, rpcCodeLimitExceeded, fmt.Sprintf("logs subscription topics %d exceeds limit %d", n, m.MaxTopics))
+		}
+	}
+	return nil
+}
+
+// logsSubscriptions returns number of logs subscriptions including in-flight subscribe requests,
+// must be called with s.mu held
+func (s *wsSession) logsSubscriptions() int {
+	var n int
+	for _, sub := range s.subs {
+		if _, ok := logsFilter(sub.Params); ok {
+			n++
+		}
+	}
+	for _, req := range s.pending {
+		if req.Method != "eth_subscribe" {
+			continue
+		}
+		if _, ok := logsFilter(req.Params); ok {
+			n++
+		}
+	}
+	return n
+}
+
+var wsLogsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "ws_logs_rejected",
+}, []string{"reason"})
+
+func promWSLogsRejected(reason string) {
+	c, err := wsLogsRejected.GetMetricWith(prometheus.Labels{"reason": reason})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// wsMaxMethodLabels is max distinct method labels of ws_calls, other methods are counted as "other",
+// method names come from clients, so labels must be bounded
+const wsMaxMethodLabels = 256
+
+// wsSessionStats is session's message counters, for metrics and summary log
+type wsSessionStats struct {
+	start    time.Time
+	reason   string // close reason
+	msgsIn   int64  // from client
+	bytesIn  int64
+	msgsOut  int64 // to client
+	bytesOut int64
+	calls    int64
+}
+
+// observeClient counts message from client, and calls in the message
+func (s *wsSession) observeClient(messageType int, p []byte) {
+	atomic.AddInt64(&s.stats.msgsIn, 1)
+	atomic.AddInt64(&s.stats.bytesIn, int64(len(p)))
+	promWSMessage("in", len(p))
+
+	if messageType != websocket.TextMessage {
+		return
+	}
+	c, err := parseRPCCall(p)
+	if err != nil {
+		return
+	}
+	for _, req := range c.Requests {
+		if req == nil {
+			continue
+		}
+		atomic.AddInt64(&s.stats.calls, 1)
+		promWSCall(req.Method)
+	}
+}
+
+// observeOut counts message to client
+func (s *wsSession) observeOut(p []byte) {
+	atomic.AddInt64(&s.stats.msgsOut, 1)
+	atomic.AddInt64(&s.stats.bytesOut, int64(len(p)))
+	promWSMessage("out", len(p))
+}
+
+// logSummary logs session's summary when closed
+func (s *wsSession) logSummary() {
+	var ip string
+	if x := clientIP(s.r); x != nil {
+		ip = x.String()
+	}
+	log.Printf("ws: session closed; ip=%s reason=%s duration=%s in=%d/%dB out=%d/%dB calls=%d",
+		ip,
+		s.stats.reason,
+		time.Since(s.stats.start).Round(time.Millisecond),
+		atomic.LoadInt64(&s.stats.msgsIn), atomic.LoadInt64(&s.stats.bytesIn),
+		atomic.LoadInt64(&s.stats.msgsOut), atomic.LoadInt64(&s.stats.bytesOut),
+		atomic.LoadInt64(&s.stats.calls),
+	)
+}
+
+// promSubscriptions adds delta to subscriptions gauge when metrics enabled
+func (s *wsSession) promSubscriptions(delta int) {
+	if !s.p.Metrics || delta == 0 {
+		return
+	}
+	wsSubscriptions.Add(float64(delta))
+}
+
+var wsMethodLabels = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// wsMethodLabel returns method as label, or "other" when too many distinct methods
+func wsMethodLabel(method string) string {
+	wsMethodLabels.Lock()
+	defer wsMethodLabels.Unlock()
+
+	if wsMethodLabels.m[method] {
+		return method
+	}
+	if len(wsMethodLabels.m) >= wsMaxMethodLabels {
+		return "other"
+	}
+	wsMethodLabels.m[method] = true
+	return method
+}
+
+var (
+	wsMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "ws_messages",
+	}, []string{"direction"})
+
+	wsMessageBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "ws_message_bytes",
+	}, []string{"direction"})
+
+	wsCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "ws_calls",
+	}, []string{"method"})
+
+	wsSubscriptions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "ws_subscriptions",
+	})
+)
+
+func promWSMessage(direction string, size int) {
+	l := prometheus.Labels{"direction": direction}
+	if c, err := wsMessages.GetMetricWith(l); err == nil {
+		c.Inc()
+	}
+	if c, err := wsMessageBytes.GetMetricWith(l); err == nil {
+		c.Add(float64(size))
+	}
+}
+
+func promWSCall(method string) {
+	c, err := wsCalls.GetMetricWith(prometheus.Labels{"method": wsMethodLabel(method)})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
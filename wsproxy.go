@@ -0,0 +1,1018 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// wsProxy proxies websocket messages between client and geth,
+// non websocket requests are passed to next handler
+type wsProxy struct {
+	Pool             *upstreamPool
+	Port             string
+	HandshakeTimeout time.Duration
+	Conns            *wsConnLimiter
+	MaxSubscriptions int           // max subscriptions per connection (0 = unlimited)
+	IdleTimeout      time.Duration // close connection when no message in both directions (0 = disable)
+	MaxMessageSize   int64         // max client message size (0 = unlimited)
+	PingInterval     time.Duration // ping interval to client and upstream (0 = disable)
+	PongTimeout      time.Duration // close connection when no pong or message within ping interval + pong timeout
+	Reconnect        bool          // reconnect to upstream and replay subscriptions when upstream connection lost
+	ReconnectTimeout time.Duration // max duration to retry reconnect
+	PendingTxFilter  bool          // serve filtered newPendingTransactions subscriptions from shared upstream subscription
+	Logs             *wsLogsGuard  // logs subscription limits, nil = disable
+	Metrics          bool          // message, bytes, subscription, and per method metrics, and session summary log
+
+	Guard   *namespaceGuard    // blocked namespaces, nil = allow all
+	APIKeys *apiKeyPolicyGuard // api key's batch, rate, and compute unit limits per message, nil = disable
+
+	pendingTx *pendingTxFeed
+}
+
+// wsConnLimiter limits concurrent websocket connections, shared by all chains
+type wsConnLimiter struct {
+	MaxConns      int // 0 = unlimited
+	MaxConnsPerIP int // 0 = unlimited
+
+	mu    sync.Mutex
+	conns int
+	perIP map[string]int
+}
+
+// acquire returns reject reason, or empty if allowed
+func (l *wsConnLimiter) acquire(ip string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.MaxConns > 0 && l.conns >= l.MaxConns {
+		return "limit"
+	}
+	if l.MaxConnsPerIP > 0 && l.perIP[ip] >= l.MaxConnsPerIP {
+		return "ip_limit"
+	}
+	if l.perIP == nil {
+		l.perIP = make(map[string]int)
+	}
+	l.conns++
+	l.perIP[ip]++
+	return ""
+}
+
+func (l *wsConnLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.conns--
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+var wsUpgrader = websocket.Upgrader{
+	// origin is checked by geth
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsForwardHeaders are client headers forwarded to geth
+var wsForwardHeaders = []string{
+	"Origin",
+	"User-Agent",
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+func (p *wsProxy) ServeHandler(h http.Handler) http.Handler {
+	if p.PendingTxFilter {
+		p.pendingTx = newPendingTxFeed(p)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWSUpgrade(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		p.serveWS(w, r)
+	})
+}
+
+func (p *wsProxy) serveWS(w http.ResponseWriter, r *http.Request) {
+	var ip string
+	if x := clientIP(r); x != nil {
+		ip = x.String()
+	}
+	if p.Conns != nil {
+		if reason := p.Conns.acquire(ip); reason != "" {
+			writeWSUpgradeFailure(w, "", http.StatusTooManyRequests, wsUpgradeFailure{
+				Reason:  reason,
+				Message: "too many websocket connections",
+			})
+			return
+		}
+		defer p.Conns.release(ip)
+	}
+
+	upstreamConn, upstreamAddr, resp, err := p.dial(r.Context(), r)
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil {
+		if resp != nil {
+			// upstream refused upgrade
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+			status := resp.StatusCode
+			if status >= 500 || status < 400 {
+				status = http.StatusServiceUnavailable
+			}
+			writeWSUpgradeFailure(w, upstreamAddr, status, wsUpgradeFailure{
+				Reason:         "rejected",
+				UpstreamStatus: resp.StatusCode,
+				Message:        strings.TrimSpace(string(msg)),
+			})
+			return
+		}
+
+		reason := "unavailable"
+		var nErr net.Error
+		if errors.As(err, &nErr) && nErr.Timeout() {
+			reason = "timeout"
+		}
+		if upstreamAddr != "" {
+			log.Printf("ws: upgrade failed; upstream=%s %v", upstreamAddr, err)
+		}
+		writeWSUpgradeFailure(w, upstreamAddr, http.StatusServiceUnavailable, wsUpgradeFailure{
+			Reason:  reason,
+			Message: "upstream " + reason,
+		})
+		return
+	}
+
+	var respHeader http.Header
+	if proto := upstreamConn.Subprotocol(); proto != "" {
+		respHeader = http.Header{"Sec-Websocket-Protocol": []string{proto}}
+	}
+	clientConn, err := wsUpgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		// upgrader already responded error to client
+		upstreamConn.Close()
+		return
+	}
+	defer clientConn.Close()
+
+	if p.MaxMessageSize > 0 {
+		clientConn.SetReadLimit(p.MaxMessageSize)
+	}
+
+	s := &wsSession{
+		p:        p,
+		r:        r,
+		client:   clientConn,
+		upstream: upstreamConn,
+		track:    p.MaxSubscriptions > 0 || p.Reconnect || p.Metrics || (p.Logs != nil && p.Logs.MaxSubscriptions > 0),
+		pending:  make(map[string]*rpcRequest),
+		subs:     make(map[string]*wsSubscription),
+		upSubs:   make(map[string]string),
+		replays:  make(map[string]string),
+	}
+	s.run()
+}
+
+var errWSNoUpstream = errors.New("no healthy upstream")
+
+// dial dials websocket to next healthy upstream
+func (p *wsProxy) dial(ctx context.Context, r *http.Request) (*websocket.Conn, string, *http.Response, error) {
+	u := p.Pool.NextForRequest(r)
+	if u == nil {
+		return nil, "", nil, errWSNoUpstream
+	}
+	return p.dialAddr(ctx, r, u.Addr)
+}
+
+// dialAddr dials websocket to given upstream host
+func (p *wsProxy) dialAddr(ctx context.Context, r *http.Request, addr string) (*websocket.Conn, string, *http.Response, error) {
+	upstreamAddr := net.JoinHostPort(addr, p.Port)
+
+	reqHeader := make(http.Header)
+	for _, k := range wsForwardHeaders {
+		if v := r.Header.Values(k); len(v) > 0 {
+			reqHeader[k] = v
+		}
+	}
+	dialer := websocket.Dialer{
+		HandshakeTimeout: p.HandshakeTimeout,
+		Subprotocols:     websocket.Subprotocols(r),
+		TLSClientConfig:  gethTLS,
+	}
+	conn, resp, err := dialer.DialContext(ctx, gethWSScheme()+"://"+upstreamAddr+r.URL.RequestURI(), reqHeader)
+	return conn, upstreamAddr, resp, err
+}
+
+// wsSession is a proxied websocket connection
+type wsSession struct {
+	p      *wsProxy
+	r      *http.Request // upgrade request, to re-dial upstream
+	client *websocket.Conn
+
+	clientMu         sync.Mutex // serializes writes to client
+	lastActive       int64      // unix nano, last data message in both directions
+	lastClientSeen   int64      // unix nano, last message or pong from client
+	lastUpstreamSeen int64      // unix nano, last message or pong from upstream
+
+	upMu     sync.Mutex
+	upstream *websocket.Conn
+	upReady  chan struct{} // closed when upstream is connected
+
+	mu       sync.Mutex
+	track    bool                       // track requests and subscriptions
+	pending  map[string]*rpcRequest     // in-flight request id => request
+	subs     map[string]*wsSubscription // client subscription id => subscription
+	upSubs   map[string]string          // upstream subscription id => client subscription id
+	replays  map[string]string          // replay request id => client subscription id
+	replayN  int
+	remapped int                               // number of subscriptions that upstream id is not client id
+	local    map[string]*pendingTxSubscription // subscriptions served by proxy
+
+	stats wsSessionStats
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// wsSubscription is the client's subscription,
+// client id is kept when subscription is replayed to new upstream connection
+type wsSubscription struct {
+	ClientID   string
+	UpstreamID string
+	Params     json.RawMessage
+}
+
+func (s *wsSession) run() {
+	s.done = make(chan struct{})
+	s.upReady = make(chan struct{})
+	close(s.upReady)
+	now := time.Now().UnixNano()
+	s.lastActive = now
+	s.lastClientSeen = now
+	s.lastUpstreamSeen = now
+	s.stats.start = time.Now()
+
+	if s.p.PingInterval > 0 {
+		s.client.SetPongHandler(s.clientPong)
+		s.upstream.SetPongHandler(s.upstreamPong)
+	}
+
+	go s.pumpUpstream()
+	if s.p.IdleTimeout > 0 {
+		go s.watchIdle()
+	}
+	if s.p.PingInterval > 0 {
+		go s.keepAlive()
+	}
+	s.pumpClient()
+	<-s.done
+	s.closeLocal()
+
+	if s.p.Metrics {
+		s.mu.Lock()
+		s.promSubscriptions(-len(s.subs))
+		s.mu.Unlock()
+		s.logSummary()
+	}
+}
+
+func (s *wsSession) clientPong(string) error {
+	atomic.StoreInt64(&s.lastClientSeen, time.Now().UnixNano())
+	return nil
+}
+
+func (s *wsSession) upstreamPong(string) error {
+	atomic.StoreInt64(&s.lastUpstreamSeen, time.Now().UnixNano())
+	return nil
+}
+
+func (s *wsSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *wsSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// currentUpstream returns current upstream connection, can be disconnected
+func (s *wsSession) currentUpstream() *websocket.Conn {
+	s.upMu.Lock()
+	defer s.upMu.Unlock()
+	return s.upstream
+}
+
+// waitUpstream waits until upstream is connected, returns nil if session closed
+func (s *wsSession) waitUpstream() *websocket.Conn {
+	s.upMu.Lock()
+	ready := s.upReady
+	s.upMu.Unlock()
+
+	select {
+	case <-ready:
+	case <-s.done:
+		return nil
+	}
+	return s.currentUpstream()
+}
+
+// close closes both connections, only the first reason is recorded
+func (s *wsSession) close(reason string, code int, text string) {
+	s.closeOnce.Do(func() {
+		promWSClosed(reason)
+		s.stats.reason = reason
+
+		deadline := time.Now().Add(time.Second)
+		if code != 0 {
+			s.client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+		}
+		upstream := s.currentUpstream()
+		upstream.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+		s.client.Close()
+		upstream.Close()
+		close(s.done)
+	})
+}
+
+func (s *wsSession) writeClient(messageType int, p []byte) error {
+	if s.p.Metrics {
+		s.observeOut(p)
+	}
+
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	return s.client.WriteMessage(messageType, p)
+}
+
+func (s *wsSession) pumpClient() {
+	for {
+		messageType, p, err := s.client.ReadMessage()
+		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				// gorilla already sent close message too big to client
+				s.close("message_too_large", 0, "")
+				return
+			}
+			s.close("client", 0, "")
+			return
+		}
+		s.touch()
+		atomic.StoreInt64(&s.lastClientSeen, time.Now().UnixNano())
+		if s.p.Metrics {
+			s.observeClient(messageType, p)
+		}
+
+		upstream := s.waitUpstream()
+		if upstream == nil {
+			return
+		}
+
+		if messageType == websocket.TextMessage && s.guarded() {
+			if reject := s.guardRequest(p); reject != nil {
+				err = s.writeClient(websocket.TextMessage, reject)
+				if err != nil {
+					s.close("client", 0, "")
+					return
+				}
+				continue
+			}
+		}
+		if messageType == websocket.TextMessage && s.p.pendingTx != nil {
+			if resp := s.serveLocal(p); resp != nil {
+				err = s.writeClient(websocket.TextMessage, resp)
+				if err != nil {
+					s.close("client", 0, "")
+					return
+				}
+				continue
+			}
+		}
+		if messageType == websocket.TextMessage && s.track {
+			var reject []byte
+			p, reject = s.trackRequest(p)
+			if reject != nil {
+				promWSSubscriptionRejected()
+				err = s.writeClient(websocket.TextMessage, reject)
+				if err != nil {
+					s.close("client", 0, "")
+					return
+				}
+				continue
+			}
+		}
+
+		err = upstream.WriteMessage(messageType, p)
+		if err != nil {
+			if s.p.Reconnect {
+				// pending requests will be failed by reconnect
+				continue
+			}
+			s.close("upstream", websocket.CloseGoingAway, "upstream closed")
+			return
+		}
+	}
+}
+
+func (s *wsSession) pumpUpstream() {
+	for {
+		upstream := s.currentUpstream()
+		messageType, p, err := upstream.ReadMessage()
+		if err != nil {
+			if s.closed() {
+				return
+			}
+			if s.p.Reconnect && s.reconnect(upstream) {
+				continue
+			}
+
+			code, text := websocket.CloseGoingAway, "upstream closed"
+			var cErr *websocket.CloseError
+			if errors.As(err, &cErr) && cErr.Code != websocket.CloseNoStatusReceived && cErr.Code != websocket.CloseAbnormalClosure {
+				code, text = cErr.Code, cErr.Text
+			}
+			s.close("upstream", code, text)
+			return
+		}
+		s.touch()
+		atomic.StoreInt64(&s.lastUpstreamSeen, time.Now().UnixNano())
+
+		if messageType == websocket.TextMessage && s.track {
+			p = s.trackResponse(p)
+			if p == nil {
+				continue
+			}
+		}
+
+		err = s.writeClient(messageType, p)
+		if err != nil {
+			s.close("client", 0, "")
+			return
+		}
+	}
+}
+
+// reconnect dials new upstream connection and replays client's subscriptions
+func (s *wsSession) reconnect(old *websocket.Conn) bool {
+	s.upMu.Lock()
+	s.upReady = make(chan struct{})
+	s.upMu.Unlock()
+	old.Close()
+
+	s.failPending()
+
+	deadline := time.Now().Add(s.p.ReconnectTimeout)
+	backoff := 500 * time.Millisecond
+	var conn *websocket.Conn
+	for {
+		var (
+			addr string
+			err  error
+		)
+		conn, addr, _, err = s.p.dial(context.Background(), s.r)
+		if err == nil {
+			break
+		}
+		log.Printf("ws: reconnect failed; upstream=%s %v", addr, err)
+		if time.Now().Add(backoff).After(deadline) {
+			promWSReconnect("failed")
+			return false
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			return false
+		}
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+
+	if s.p.PingInterval > 0 {
+		conn.SetPongHandler(s.upstreamPong)
+	}
+
+	s.mu.Lock()
+	for _, sub := range s.subs {
+		if sub.UpstreamID != "" {
+			delete(s.upSubs, sub.UpstreamID)
+			if sub.UpstreamID != sub.ClientID {
+				s.remapped--
+			}
+			sub.UpstreamID = ""
+		}
+
+		s.replayN++
+		id := json.RawMessage(strconv.Quote("geth-proxy-replay-" + strconv.Itoa(s.replayN)))
+		s.replays[string(id)] = sub.ClientID
+		msg, _ := json.Marshal(rpcRequest{
+			JSONRPC: "2.0",
+			ID:      id,
+			Method:  "eth_subscribe",
+			Params:  sub.Params,
+		})
+		// write error will be handled by next read
+		conn.WriteMessage(websocket.TextMessage, msg)
+	}
+	s.mu.Unlock()
+
+	atomic.StoreInt64(&s.lastUpstreamSeen, time.Now().UnixNano())
+	s.upMu.Lock()
+	s.upstream = conn
+	close(s.upReady)
+	s.upMu.Unlock()
+	if s.closed() {
+		// session closed while reconnecting, close() may see the old connection
+		conn.Close()
+		return false
+	}
+
+	promWSReconnect("success")
+	return true
+}
+
+// failPending responds error to in-flight requests that lost with upstream connection
+func (s *wsSession) failPending() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]*rpcRequest)
+	for id := range s.replays {
+		delete(s.replays, id)
+	}
+	s.mu.Unlock()
+
+	for _, req := range pending {
+		b, _ := json.Marshal(newRPCError(req, rpcCodeServerError, "upstream connection lost"))
+		s.writeClient(websocket.TextMessage, b)
+	}
+}
+
+func (s *wsSession) watchIdle() {
+	t := time.NewTicker(s.p.IdleTimeout / 4)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+
+		last := time.Unix(0, atomic.LoadInt64(&s.lastActive))
+		if time.Since(last) >= s.p.IdleTimeout {
+			s.close("idle", websocket.CloseGoingAway, "idle timeout")
+			return
+		}
+	}
+}
+
+// keepAlive pings client and upstream, and closes connection when either side is dead,
+// keeps nat and load balancer from dropping idle tcp connection
+func (s *wsSession) keepAlive() {
+	t := time.NewTicker(s.p.PingInterval)
+	defer t.Stop()
+
+	deadAfter := s.p.PingInterval + s.p.PongTimeout
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+
+		if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastClientSeen))) > deadAfter {
+			s.close("client_dead", 0, "")
+			return
+		}
+		deadline := time.Now().Add(s.p.PongTimeout)
+		if err := s.client.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+			s.close("client", 0, "")
+			return
+		}
+
+		s.upMu.Lock()
+		upstream, ready := s.upstream, s.upReady
+		s.upMu.Unlock()
+		select {
+		case <-ready:
+		default:
+			// reconnecting
+			continue
+		}
+
+		if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastUpstreamSeen))) > deadAfter {
+			if s.p.Reconnect {
+				// unblock upstream reader to reconnect
+				upstream.Close()
+				continue
+			}
+			s.close("upstream_dead", websocket.CloseGoingAway, "upstream not responding")
+			return
+		}
+		upstream.WriteControl(websocket.PingMessage, nil, deadline)
+	}
+}
+
+// guardRequest returns error response when message calls blocked namespace or method not allowed for api key,
+// or exceeds api key's limits, batch is rejected as a whole, so session does not track partially forwarded batch
+func (s *wsSession) guardRequest(p []byte) []byte {
+	c, err := parseRPCCall(p)
+	if err != nil {
+		return nil
+	}
+
+	var denied bool
+	resps := make([]*rpcResponse, len(c.Requests))
+	for i, req := range c.Requests {
+		if req != nil {
+			resps[i] = s.deny(req)
+		}
+		if resps[i] != nil {
+			denied = true
+		}
+	}
+	if !denied {
+		return s.limitRequest(c)
+	}
+
+	for i, req := range c.Requests {
+		if resps[i] == nil {
+			resps[i] = newRPCError(req, rpcCodeInvalidRequest, "batch contains method that is not available")
+		}
+	}
+	return marshalRPCResponses(c.Batch, resps)
+}
+
+// limitRequest returns error response when message exceeds api key's batch size, rate, or compute unit rate,
+// tokens are taken only from allowed messages
+func (s *wsSession) limitRequest(c *rpcCall) []byte {
+	t := getAuthTenant(s.r.Context())
+	if s.p.APIKeys == nil || t == nil || t.Policy == nil {
+		return nil
+	}
+	l, _ := s.p.APIKeys.take(t.Policy, c)
+	if l == nil {
+		return nil
+	}
+
+	resps := make([]*rpcResponse, len(c.Requests))
+	for i, req := range c.Requests {
+		resps[i] = newRPCError(req, rpcCodeLimitExceeded, l.Message)
+		resps[i].Error.Data = l.Data
+	}
+	return marshalRPCResponses(c.Batch, resps)
+}
+
+func marshalRPCResponses(batch bool, resps []*rpcResponse) []byte {
+	if batch {
+		b, _ := json.Marshal(resps)
+		return b
+	}
+	b, _ := json.Marshal(resps[0])
+	return b
+}
+
+// guarded returns true if messages must be checked by guardRequest
+func (s *wsSession) guarded() bool {
+	if s.p.Guard != nil || s.p.Logs != nil {
+		return true
+	}
+	t := getAuthTenant(s.r.Context())
+	return t != nil && t.Policy != nil
+}
+
+// deny returns error response if request is not allowed, or nil
+func (s *wsSession) deny(req *rpcRequest) *rpcResponse {
+	if g := s.p.Guard; g != nil && g.Denied(req.Method) {
+		return g.intercept(nil, req)
+	}
+	if m := s.p.Logs; m != nil {
+		if resp := m.intercept(req); resp != nil {
+			return resp
+		}
+	}
+	if t := getAuthTenant(s.r.Context()); t != nil && t.Policy != nil {
+		return apiKeyPolicyGuard{}.intercept(s.r, req)
+	}
+	return nil
+}
+
+// trackRequest tracks requests and subscriptions,
+// returns message to forward, or error response when subscription limit exceeded
+func (s *wsSession) trackRequest(p []byte) (forward []byte, reject []byte) {
+	c, err := parseRPCCall(p)
+	if err != nil {
+		return p, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.p.MaxSubscriptions > 0 {
+		n := s.subscriptions()
+		var subscribes int
+		for _, req := range c.Requests {
+			if req != nil && req.Method == "eth_subscribe" {
+				subscribes++
+			}
+		}
+		if subscribes > 0 && n+subscribes > s.p.MaxSubscriptions {
+			return nil, rejectCall(c, "subscription limit exceeded")
+		}
+	}
+	if m := s.p.Logs; m != nil && m.MaxSubscriptions > 0 {
+		var subscribes int
+		for _, req := range c.Requests {
+			if req == nil || req.Method != "eth_subscribe" {
+				continue
+			}
+			if _, ok := logsFilter(req.Params); ok {
+				subscribes++
+			}
+		}
+		if subscribes > 0 && s.logsSubscriptions()+subscribes > m.MaxSubscriptions {
+			promWSLogsRejected("subscriptions")
+			return nil, rejectCall(c, "logs subscription limit exceeded")
+		}
+	}
+
+	for _, req := range c.Requests {
+		if req == nil || len(req.ID) == 0 {
+			continue
+		}
+		s.pending[string(req.ID)] = req
+
+		// rewrite client subscription id to current upstream id
+		if req.Method == "eth_unsubscribe" && s.remapped > 0 {
+			var params []string
+			if json.Unmarshal(req.Params, &params) == nil && len(params) > 0 {
+				if sub := s.subs[params[0]]; sub != nil && sub.UpstreamID != "" && sub.UpstreamID != sub.ClientID {
+					req.Params, _ = json.Marshal([]string{sub.UpstreamID})
+					c.Dirty = true
+				}
+			}
+		}
+	}
+
+	if !c.Dirty {
+		return p, nil
+	}
+	if c.Batch {
+		p, _ = json.Marshal(c.Requests)
+		return p, nil
+	}
+	p, _ = json.Marshal(c.Requests[0])
+	return p, nil
+}
+
+// rejectCall returns limit exceeded error response for all requests in call
+func rejectCall(c *rpcCall, message string) []byte {
+	resps := make([]*rpcResponse, len(c.Requests))
+	for i, req := range c.Requests {
+		resps[i] = newRPCError(req, rpcCodeLimitExceeded, message)
+	}
+	if c.Batch {
+		b, _ := json.Marshal(resps)
+		return b
+	}
+	b, _ := json.Marshal(resps[0])
+	return b
+}
+
+// subscriptions returns number of subscriptions including in-flight subscribe requests,
+// must be called with s.mu held
+func (s *wsSession) subscriptions() int {
+	n := len(s.subs) + len(s.local)
+	for _, req := range s.pending {
+		if req.Method == "eth_subscribe" {
+			n++
+		}
+	}
+	return n
+}
+
+// wsMessage is json-rpc response or subscription notification from upstream
+type wsMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params struct {
+		Subscription string `json:"subscription"`
+	} `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+type wsNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  struct {
+		Subscription string          `json:"subscription"`
+		Result       json.RawMessage `json:"result"`
+	} `json:"params"`
+}
+
+// trackResponse tracks subscription ids from upstream responses,
+// returns message to forward to client, or nil if message is for proxy (replayed subscription)
+func (s *wsSession) trackResponse(p []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) == 0 && len(s.replays) == 0 && s.remapped == 0 {
+		return p
+	}
+
+	var msgs []wsMessage
+	p = bytes.TrimSpace(p)
+	if len(p) > 0 && p[0] == '[' {
+		if json.Unmarshal(p, &msgs) != nil {
+			return p
+		}
+	} else {
+		var msg wsMessage
+		if json.Unmarshal(p, &msg) != nil {
+			return p
+		}
+		if msg.Method == "eth_subscription" {
+			return s.remapNotification(p, msg.Params.Subscription)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	for _, msg := range msgs {
+		id := string(msg.ID)
+		if clientID, ok := s.replays[id]; ok {
+			delete(s.replays, id)
+			s.replayed(clientID, msg)
+			return nil
+		}
+
+		req := s.pending[id]
+		if req == nil {
+			continue
+		}
+		delete(s.pending, id)
+		if len(msg.Error) > 0 {
+			continue
+		}
+
+		switch req.Method {
+		case "eth_subscribe":
+			var subID string
+			if json.Unmarshal(msg.Result, &subID) == nil {
+				if s.subs[subID] == nil {
+					s.promSubscriptions(1)
+				}
+				s.subs[subID] = &wsSubscription{
+					ClientID:   subID,
+					UpstreamID: subID,
+					Params:     req.Params,
+				}
+				s.upSubs[subID] = subID
+			}
+		case "eth_unsubscribe":
+			var params []string
+			if json.Unmarshal(req.Params, &params) == nil && len(params) > 0 {
+				s.removeSubscription(params[0])
+			}
+		}
+	}
+	return p
+}
+
+// remapNotification rewrites upstream subscription id in notification to client subscription id
+func (s *wsSession) remapNotification(p []byte, upstreamID string) []byte {
+	clientID, ok := s.upSubs[upstreamID]
+	if !ok || clientID == upstreamID {
+		return p
+	}
+
+	var n wsNotification
+	if json.Unmarshal(p, &n) != nil {
+		return p
+	}
+	n.Params.Subscription = clientID
+	b, err := json.Marshal(n)
+	if err != nil {
+		return p
+	}
+	return b
+}
+
+// replayed maps new upstream subscription id to client subscription id
+func (s *wsSession) replayed(clientID string, resp wsMessage) {
+	sub := s.subs[clientID]
+	if sub == nil {
+		return
+	}
+
+	var subID string
+	if len(resp.Error) > 0 || json.Unmarshal(resp.Result, &subID) != nil {
+		log.Printf("ws: can not replay subscription %s; %s", clientID, resp.Error)
+		promWSReplay("failed")
+		s.removeSubscription(clientID)
+		return
+	}
+	promWSReplay("success")
+
+	sub.UpstreamID = subID
+	s.upSubs[subID] = clientID
+	if subID != clientID {
+		s.remapped++
+	}
+}
+
+// removeSubscription removes subscription by client id, or upstream id
+func (s *wsSession) removeSubscription(id string) {
+	sub := s.subs[id]
+	if sub == nil {
+		clientID, ok := s.upSubs[id]
+		if !ok {
+			return
+		}
+		sub = s.subs[clientID]
+		if sub == nil {
+			return
+		}
+	}
+	if sub.UpstreamID != "" {
+		delete(s.upSubs, sub.UpstreamID)
+		if sub.UpstreamID != sub.ClientID {
+			s.remapped--
+		}
+	}
+	delete(s.subs, sub.ClientID)
+	s.promSubscriptions(-1)
+}
+
+var (
+	wsClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "ws_closed",
+	}, []string{"reason"})
+
+	wsSubscriptionRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "ws_subscription_rejected",
+	})
+
+	wsReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "ws_reconnects",
+	}, []string{"result"})
+
+	wsReplays = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "ws_subscription_replays",
+	}, []string{"result"})
+)
+
+func promWSClosed(reason string) {
+	c, err := wsClosed.GetMetricWith(prometheus.Labels{"reason": reason})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
+
+func promWSSubscriptionRejected() {
+	wsSubscriptionRejected.Inc()
+}
+
+func promWSReconnect(result string) {
+	c, err := wsReconnects.GetMetricWith(prometheus.Labels{"result": result})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}
+
+func promWSReplay(result string) {
+	c, err := wsReplays.GetMetricWith(prometheus.Labels{"result": result})
+	if err != nil {
+		return
+	}
+	c.Inc()
+}